@@ -0,0 +1,212 @@
+package aac
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+func TestAudioSpecificConfig(t *testing.T) {
+	var tests = []struct {
+		config string
+		want   AudioSpecificConfig
+	}{
+		{"1190", AudioSpecificConfig{ObjectType: ObjectTypeAACLC, SampleRate: 48000, ChannelCount: 2, FrameLength: 1024}},
+		{"1210", AudioSpecificConfig{ObjectType: ObjectTypeAACLC, SampleRate: 44100, ChannelCount: 2, FrameLength: 1024}},
+		{"158c", AudioSpecificConfig{ObjectType: ObjectTypeAACLC, SampleRate: 8000, ChannelCount: 1, FrameLength: 960}},
+		// HE-AAC: 24 kHz core, 48 kHz after SBR
+		{"2b098800", AudioSpecificConfig{ObjectType: ObjectTypeAACLC, SampleRate: 24000, ChannelCount: 1,
+			FrameLength: 1024, SBR: true, ExtensionSampleRate: 48000}},
+		// a sample rate without an index
+		{"178061a810", AudioSpecificConfig{ObjectType: ObjectTypeAACLC, SampleRate: 50000, ChannelCount: 2, FrameLength: 1024}},
+	}
+	for _, test := range tests {
+		got, err := ParseConfig(test.config)
+		if err != nil {
+			t.Errorf("ParseConfig(%q): %v", test.config, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("ParseConfig(%q) = %+v, want %+v", test.config, *got, test.want)
+		}
+		if s := got.String(); s != test.config {
+			t.Errorf("String() = %q, want %q", s, test.config)
+		}
+	}
+
+	for _, config := range []string{"", "11", "1180", "zz", "3990"} {
+		if _, err := ParseConfig(config); err == nil {
+			t.Errorf("ParseConfig(%q) succeeded", config)
+		}
+	}
+}
+
+func TestParseFmtp(t *testing.T) {
+	params, err := ParseFmtp("97 profile-level-id=15;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=1190")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Params{
+		ProfileLevelID:   15,
+		Mode:             "AAC-hbr",
+		SizeLength:       13,
+		IndexLength:      3,
+		IndexDeltaLength: 3,
+		Config:           &AudioSpecificConfig{ObjectType: ObjectTypeAACLC, SampleRate: 48000, ChannelCount: 2, FrameLength: 1024},
+	}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("ParseFmtp() = %+v, want %+v", params, want)
+	}
+	if got := params.String(); got != "profile-level-id=15;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=1190" {
+		t.Errorf("String() = %q", got)
+	}
+
+	for _, fmtp := range []string{"sizelength=x", "sizelength=33", "config=1180"} {
+		if _, err := ParseFmtp(fmtp); err == nil {
+			t.Errorf("ParseFmtp(%q) succeeded", fmtp)
+		}
+	}
+}
+
+func testAccessUnits(sizes ...int) [][]byte {
+	var aus [][]byte
+	for i, size := range sizes {
+		au := bytes.Repeat([]byte{byte(i + 1)}, size)
+		aus = append(aus, au)
+	}
+	return aus
+}
+
+func TestGenericRoundTrip(t *testing.T) {
+	params, _ := ParseFmtp("mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=1190")
+	p := &Packetizer{Params: params, PayloadType: 97, MTU: 500}
+	aus := testAccessUnits(100, 200, 150, 1200, 50)
+	packets, err := p.Packetize(aus, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// three in the first packet, the fourth in three fragments, the last alone
+	var timestamps []uint32
+	var markers []bool
+	for _, packet := range packets {
+		if size := packet.MarshalSize(); size > 500 {
+			t.Errorf("packet of %d bytes", size)
+		}
+		timestamps = append(timestamps, packet.Timestamp)
+		markers = append(markers, packet.Marker)
+	}
+	if want := []uint32{0, 3072, 3072, 3072, 4096}; !reflect.DeepEqual(timestamps, want) {
+		t.Errorf("timestamps = %v, want %v", timestamps, want)
+	}
+	if want := []bool{true, false, false, true, true}; !reflect.DeepEqual(markers, want) {
+		t.Errorf("markers = %v, want %v", markers, want)
+	}
+
+	d := &Depacketizer{Params: params}
+	var got [][]byte
+	for _, packet := range packets {
+		decoded, err := d.Decode(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, decoded...)
+	}
+	if !reflect.DeepEqual(got, aus) {
+		t.Errorf("decoded %d access units, want %d", len(got), len(aus))
+	}
+
+	// a lost fragment drops the access unit, and only that one
+	d = &Depacketizer{Params: params}
+	var errs []error
+	got = nil
+	for i, packet := range packets {
+		if i == 2 {
+			continue
+		}
+		decoded, err := d.Decode(packet)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		got = append(got, decoded...)
+	}
+	if len(errs) != 1 || errs[0] != ErrFragmentLost || len(got) != 4 {
+		t.Errorf("after a lost fragment: errors %v, %d access units", errs, len(got))
+	}
+}
+
+func TestGenericHeaders(t *testing.T) {
+	// an AU header section with CTS deltas and an auxiliary section
+	params := &Params{SizeLength: 13, IndexLength: 3, IndexDeltaLength: 3, CTSDeltaLength: 8, AuxiliaryDataSizeLength: 8}
+	w := &bitWriter{}
+	w.writeBits(13+3+1+13+3+1+8, 16)
+	w.writeBits(2, 13)
+	w.writeBits(0, 3)
+	w.writeBits(0, 1)
+	w.writeBits(1, 13)
+	w.writeBits(0, 3)
+	w.writeBits(1, 1)
+	w.writeBits(0xAB, 8)
+	payload := append(w.buf, 8, 0xEE, 'a', 'b', 'c')
+
+	d := &Depacketizer{Params: params}
+	got, err := d.Decode(&rtp.Packet{Header: rtp.Header{Marker: true}, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]byte{[]byte("ab"), []byte("c")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode() = %q, want %q", got, want)
+	}
+}
+
+func TestLATM(t *testing.T) {
+	params, err := ParseLATMFmtp("96 profile-level-id=30;object=2;cpresent=0;config=400024203fc0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &LATMParams{
+		ProfileLevelID: 30,
+		Object:         2,
+		Config: &StreamMuxConfig{
+			SubFrames:      1,
+			Config:         AudioSpecificConfig{ObjectType: ObjectTypeAACLC, SampleRate: 44100, ChannelCount: 2, FrameLength: 1024},
+			BufferFullness: 0xFF,
+		},
+	}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("ParseLATMFmtp() = %+v, want %+v", params, want)
+	}
+	if got := params.String(); got != "profile-level-id=30;object=2;cpresent=0;config=400024203fc0" {
+		t.Errorf("String() = %q", got)
+	}
+
+	p := &LATMPacketizer{Params: params, PayloadType: 96, MTU: 300}
+	aus := testAccessUnits(10, 255, 600)
+	packets, err := p.Packetize(aus, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 5 || packets[1].Payload[0] != 0xFF || packets[1].Payload[1] != 0 {
+		t.Errorf("packets = %d, second starting %x", len(packets), packets[1].Payload[:2])
+	}
+
+	d := &LATMDepacketizer{Params: params}
+	var got [][]byte
+	for _, packet := range packets {
+		decoded, err := d.Decode(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, decoded...)
+	}
+	if !reflect.DeepEqual(got, aus) {
+		t.Errorf("decoded %d access units, want %d", len(got), len(aus))
+	}
+
+	inBand, _ := ParseLATMFmtp("96 object=2")
+	if _, err := (&LATMDepacketizer{Params: inBand}).Decode(packets[0]); err != ErrInBandMuxConfig {
+		t.Errorf("Decode() with cpresent=1: %v, want %v", err, ErrInBandMuxConfig)
+	}
+}
@@ -0,0 +1,51 @@
+package aac
+
+// bitReader reads MSB first from a byte slice.
+type bitReader struct {
+	buf []byte
+	pos int // in bits
+}
+
+func (r *bitReader) readBits(n int) (uint32, error) {
+	if r.pos+n > 8*len(r.buf) {
+		return 0, ErrShortConfig
+	}
+	var v uint32
+	for i := 0; i < n; i++ {
+		bit := r.buf[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v, nil
+}
+
+func (r *bitReader) readFlag() (bool, error) {
+	v, err := r.readBits(1)
+	return v == 1, err
+}
+
+// bitWriter appends MSB first to a byte slice.
+type bitWriter struct {
+	buf []byte
+	pos int // in bits
+}
+
+func (w *bitWriter) writeBits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>uint(i)&1 != 0 {
+			w.buf[w.pos/8] |= 1 << (7 - uint(w.pos%8))
+		}
+		w.pos++
+	}
+}
+
+func (w *bitWriter) writeFlag(flag bool) {
+	if flag {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+}
@@ -0,0 +1,257 @@
+// Package aac carries MPEG-4 audio over RTP: the mpeg4-generic payload of
+// RFC 3640 and the MP4A-LATM payload of RFC 6416, along with the
+// AudioSpecificConfig of ISO/IEC 14496-3 both describe their streams with.
+package aac
+
+import (
+	"encoding/hex"
+	"errors"
+)
+
+// Audio object types, ISO/IEC 14496-3 table 1.1.
+const (
+	ObjectTypeAACMain = 1
+	ObjectTypeAACLC   = 2
+	ObjectTypeAACSSR  = 3
+	ObjectTypeAACLTP  = 4
+	ObjectTypeSBR     = 5
+	ObjectTypePS      = 29
+	ObjectTypeEscape  = 31
+)
+
+var (
+	ErrShortConfig       = errors.New("aac: AudioSpecificConfig too short")
+	ErrUnsupportedConfig = errors.New("aac: unsupported AudioSpecificConfig")
+	ErrBadSampleRate     = errors.New("aac: bad sample rate")
+	ErrBadChannelCount   = errors.New("aac: bad channel count")
+)
+
+var sampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// AudioSpecificConfig describes a MPEG-4 audio stream, ISO/IEC 14496-3
+// section 1.6.2.1. Only AAC Main, LC, SSR and LTP are supported, possibly
+// with SBR and PS, and not the program_config_element of channel
+// configuration 0.
+type AudioSpecificConfig struct {
+	ObjectType   int
+	SampleRate   int
+	ChannelCount int
+	// FrameLength is the number of samples of a frame: 1024, or 960.
+	FrameLength int
+	// SBR and PS are set for HE-AAC and HE-AACv2 signaled explicitly, when
+	// ObjectType is that of the underlying core and ExtensionSampleRate the
+	// sample rate after SBR.
+	SBR                 bool
+	PS                  bool
+	ExtensionSampleRate int
+	DependsOnCoreCoder  bool
+	CoreCoderDelay      uint16
+}
+
+// ParseConfig decodes the hexadecimal AudioSpecificConfig of a fmtp
+// "config" parameter, e.g. "1190".
+func ParseConfig(config string) (*AudioSpecificConfig, error) {
+	buf, err := hex.DecodeString(config)
+	if err != nil {
+		return nil, ErrUnsupportedConfig
+	}
+	c := &AudioSpecificConfig{}
+	if err := c.Unmarshal(buf); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Unmarshal decodes an AudioSpecificConfig.
+func (c *AudioSpecificConfig) Unmarshal(buf []byte) error {
+	return c.read(&bitReader{buf: buf})
+}
+
+func (c *AudioSpecificConfig) read(r *bitReader) error {
+	*c = AudioSpecificConfig{}
+
+	objectType, err := readObjectType(r)
+	if err != nil {
+		return err
+	}
+	if c.SampleRate, err = readSampleRate(r); err != nil {
+		return err
+	}
+	channelConfig, err := r.readBits(4)
+	if err != nil {
+		return err
+	}
+	switch {
+	case channelConfig == 0 || channelConfig > 7:
+		return ErrUnsupportedConfig
+	case channelConfig == 7:
+		c.ChannelCount = 8
+	default:
+		c.ChannelCount = int(channelConfig)
+	}
+
+	if objectType == ObjectTypeSBR || objectType == ObjectTypePS {
+		c.SBR = true
+		c.PS = objectType == ObjectTypePS
+		if c.ExtensionSampleRate, err = readSampleRate(r); err != nil {
+			return err
+		}
+		if objectType, err = readObjectType(r); err != nil {
+			return err
+		}
+	}
+	c.ObjectType = objectType
+
+	switch objectType {
+	case ObjectTypeAACMain, ObjectTypeAACLC, ObjectTypeAACSSR, ObjectTypeAACLTP:
+	default:
+		return ErrUnsupportedConfig
+	}
+
+	// GASpecificConfig, section 4.4.1
+	c.FrameLength = 1024
+	if frameLengthFlag, err := r.readFlag(); err != nil {
+		return err
+	} else if frameLengthFlag {
+		c.FrameLength = 960
+	}
+	if c.DependsOnCoreCoder, err = r.readFlag(); err != nil {
+		return err
+	}
+	if c.DependsOnCoreCoder {
+		delay, err := r.readBits(14)
+		if err != nil {
+			return err
+		}
+		c.CoreCoderDelay = uint16(delay)
+	}
+	extensionFlag, err := r.readFlag()
+	if err != nil {
+		return err
+	}
+	if extensionFlag {
+		return ErrUnsupportedConfig
+	}
+	return nil
+}
+
+func readObjectType(r *bitReader) (int, error) {
+	objectType, err := r.readBits(5)
+	if err != nil {
+		return 0, err
+	}
+	if objectType == ObjectTypeEscape {
+		ext, err := r.readBits(6)
+		if err != nil {
+			return 0, err
+		}
+		objectType = 32 + ext
+	}
+	return int(objectType), nil
+}
+
+func readSampleRate(r *bitReader) (int, error) {
+	index, err := r.readBits(4)
+	if err != nil {
+		return 0, err
+	}
+	if index == 0xF {
+		rate, err := r.readBits(24)
+		return int(rate), err
+	}
+	if int(index) >= len(sampleRates) {
+		return 0, ErrBadSampleRate
+	}
+	return sampleRates[index], nil
+}
+
+// Marshal encodes the AudioSpecificConfig.
+func (c *AudioSpecificConfig) Marshal() ([]byte, error) {
+	w := &bitWriter{}
+	if err := c.write(w); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+func (c *AudioSpecificConfig) write(w *bitWriter) error {
+	var channelConfig uint32
+	switch {
+	case c.ChannelCount >= 1 && c.ChannelCount <= 6:
+		channelConfig = uint32(c.ChannelCount)
+	case c.ChannelCount == 8:
+		channelConfig = 7
+	default:
+		return ErrBadChannelCount
+	}
+	switch c.ObjectType {
+	case ObjectTypeAACMain, ObjectTypeAACLC, ObjectTypeAACSSR, ObjectTypeAACLTP:
+	default:
+		return ErrUnsupportedConfig
+	}
+
+	if c.SBR {
+		if c.PS {
+			writeObjectType(w, ObjectTypePS)
+		} else {
+			writeObjectType(w, ObjectTypeSBR)
+		}
+	} else {
+		writeObjectType(w, c.ObjectType)
+	}
+	if err := writeSampleRate(w, c.SampleRate); err != nil {
+		return err
+	}
+	w.writeBits(channelConfig, 4)
+	if c.SBR {
+		if err := writeSampleRate(w, c.ExtensionSampleRate); err != nil {
+			return err
+		}
+		writeObjectType(w, c.ObjectType)
+	}
+
+	w.writeFlag(c.FrameLength == 960)
+	w.writeFlag(c.DependsOnCoreCoder)
+	if c.DependsOnCoreCoder {
+		w.writeBits(uint32(c.CoreCoderDelay), 14)
+	}
+	// extensionFlag
+	w.writeFlag(false)
+	return nil
+}
+
+func writeObjectType(w *bitWriter, objectType int) {
+	if objectType >= 32 {
+		w.writeBits(ObjectTypeEscape, 5)
+		w.writeBits(uint32(objectType-32), 6)
+		return
+	}
+	w.writeBits(uint32(objectType), 5)
+}
+
+func writeSampleRate(w *bitWriter, rate int) error {
+	if rate <= 0 || rate >= 1<<24 {
+		return ErrBadSampleRate
+	}
+	for i, r := range sampleRates {
+		if r == rate {
+			w.writeBits(uint32(i), 4)
+			return nil
+		}
+	}
+	w.writeBits(0xF, 4)
+	w.writeBits(uint32(rate), 24)
+	return nil
+}
+
+// String returns the configuration in hexadecimal, as in a fmtp "config"
+// parameter.
+func (c *AudioSpecificConfig) String() string {
+	buf, err := c.Marshal()
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,458 @@
+package aac
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+// DefaultMTU is the size of the RTP packets a Packetizer makes when its
+// MTU isn't set.
+const DefaultMTU = 1400
+
+// MaxAccessUnitSize bounds the fragmented access units a Depacketizer
+// reassembles.
+const MaxAccessUnitSize = 1 << 20
+
+var (
+	ErrBadFmtp           = errors.New("aac: malformed fmtp")
+	ErrBadAUHeaders      = errors.New("aac: malformed AU header section")
+	ErrFragmentLost      = errors.New("aac: AU fragment lost")
+	ErrAccessUnitTooBig  = errors.New("aac: access unit too big")
+	ErrUnsupportedParams = errors.New("aac: unsupported mpeg4-generic parameters")
+	ErrMTUTooSmall       = errors.New("aac: MTU too small")
+)
+
+// Params are the "a=fmtp:" parameters of a mpeg4-generic stream, RFC 3640
+// section 4.1. The lengths are in bits.
+type Params struct {
+	StreamType     int
+	ProfileLevelID int
+	// Mode is e.g. "AAC-hbr" or "AAC-lbr".
+	Mode                    string
+	Config                  *AudioSpecificConfig
+	ConstantSize            int
+	ConstantDuration        int
+	SizeLength              int
+	IndexLength             int
+	IndexDeltaLength        int
+	CTSDeltaLength          int
+	DTSDeltaLength          int
+	RandomAccessIndication  bool
+	StreamStateIndication   int
+	AuxiliaryDataSizeLength int
+}
+
+// ParseFmtp reads the value of a "a=fmtp:" attribute, with or without its
+// leading payload type, e.g.
+// "97 profile-level-id=15;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=1190".
+// Parameter names are case insensitive; those it doesn't know are ignored.
+func ParseFmtp(fmtp string) (*Params, error) {
+	if i := strings.IndexByte(fmtp, ' '); i >= 0 && !strings.Contains(fmtp[:i], "=") {
+		fmtp = fmtp[i+1:]
+	}
+
+	params := &Params{}
+	for _, param := range strings.Split(fmtp, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.TrimSpace(value)
+		name = strings.ToLower(name)
+
+		var field *int
+		switch name {
+		case "":
+			continue
+		case "mode":
+			params.Mode = value
+			continue
+		case "config":
+			if value == "" {
+				continue
+			}
+			config, err := ParseConfig(value)
+			if err != nil {
+				return nil, err
+			}
+			params.Config = config
+			continue
+		case "randomaccessindication":
+			params.RandomAccessIndication = value == "1"
+			continue
+		case "streamtype":
+			field = &params.StreamType
+		case "profile-level-id":
+			field = &params.ProfileLevelID
+		case "constantsize":
+			field = &params.ConstantSize
+		case "constantduration":
+			field = &params.ConstantDuration
+		case "sizelength":
+			field = &params.SizeLength
+		case "indexlength":
+			field = &params.IndexLength
+		case "indexdeltalength":
+			field = &params.IndexDeltaLength
+		case "ctsdeltalength":
+			field = &params.CTSDeltaLength
+		case "dtsdeltalength":
+			field = &params.DTSDeltaLength
+		case "streamstateindication":
+			field = &params.StreamStateIndication
+		case "auxiliarydatasizelength":
+			field = &params.AuxiliaryDataSizeLength
+		default:
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 1<<24 {
+			return nil, ErrBadFmtp
+		}
+		*field = n
+	}
+
+	for _, length := range []int{params.SizeLength, params.IndexLength, params.IndexDeltaLength,
+		params.CTSDeltaLength, params.DTSDeltaLength, params.StreamStateIndication, params.AuxiliaryDataSizeLength} {
+		if length > 32 {
+			return nil, ErrBadFmtp
+		}
+	}
+	return params, nil
+}
+
+// String returns the parameters as the value of a "a=fmtp:", without the
+// payload type.
+func (p *Params) String() string {
+	var params []string
+	add := func(name string, value int) {
+		if value != 0 {
+			params = append(params, fmt.Sprintf("%s=%d", name, value))
+		}
+	}
+	add("streamtype", p.StreamType)
+	add("profile-level-id", p.ProfileLevelID)
+	if p.Mode != "" {
+		params = append(params, "mode="+p.Mode)
+	}
+	add("sizelength", p.SizeLength)
+	add("indexlength", p.IndexLength)
+	add("indexdeltalength", p.IndexDeltaLength)
+	add("ctsdeltalength", p.CTSDeltaLength)
+	add("dtsdeltalength", p.DTSDeltaLength)
+	if p.RandomAccessIndication {
+		params = append(params, "randomaccessindication=1")
+	}
+	add("streamstateindication", p.StreamStateIndication)
+	add("auxiliarydatasizelength", p.AuxiliaryDataSizeLength)
+	add("constantsize", p.ConstantSize)
+	add("constantduration", p.ConstantDuration)
+	if p.Config != nil {
+		params = append(params, "config="+p.Config.String())
+	}
+	return strings.Join(params, ";")
+}
+
+// hasAUHeaders reports whether packets start with an AU header section.
+func (p *Params) hasAUHeaders() bool {
+	return p.auHeaderBits(true) > 0
+}
+
+// auHeaderBits is the size of an AU header without its optional CTS and
+// DTS deltas, which are preceded by a flag.
+func (p *Params) auHeaderBits(first bool) int {
+	n := p.SizeLength + p.StreamStateIndication
+	if first {
+		n += p.IndexLength
+	} else {
+		n += p.IndexDeltaLength
+	}
+	if p.CTSDeltaLength > 0 {
+		n++
+	}
+	if p.DTSDeltaLength > 0 {
+		n++
+	}
+	if p.RandomAccessIndication {
+		n++
+	}
+	return n
+}
+
+// Depacketizer takes apart the RTP packets of a mpeg4-generic stream into
+// access units, RFC 3640 section 3.
+type Depacketizer struct {
+	Params *Params
+
+	started      bool
+	lastSeq      uint16
+	lastMarker   bool
+	fragment     []byte
+	fragmentSize int
+	timestamp    uint32
+	fragmenting  bool
+	skipping     bool
+}
+
+// Decode returns the access units a packet completes, in order. The
+// timestamp of the i-th one is that of the packet plus i frame lengths. An
+// access unit fragmented over several packets is returned with its last
+// fragment; one missing a fragment is dropped, with ErrFragmentLost.
+func (d *Depacketizer) Decode(packet *rtp.Packet) ([][]byte, error) {
+	gap := d.started && packet.SequenceNumber != d.lastSeq+1
+	afterMarker := !d.started || d.lastMarker
+	d.started = true
+	d.lastSeq = packet.SequenceNumber
+	d.lastMarker = packet.Marker
+
+	sizes, data, err := d.parseHeaders(packet.Payload)
+	if err != nil {
+		d.dropFragment()
+		return nil, err
+	}
+	if len(sizes) == 1 && sizes[0] > len(data) {
+		return d.decodeFragment(packet, sizes[0], data, gap, afterMarker)
+	}
+
+	// whole access units; a fragmented one in progress is lost
+	d.dropFragment()
+	d.skipping = false
+	var aus [][]byte
+	for _, size := range sizes {
+		if size > len(data) {
+			return nil, ErrBadAUHeaders
+		}
+		aus = append(aus, append([]byte(nil), data[:size]...))
+		data = data[size:]
+	}
+	return aus, nil
+}
+
+func (d *Depacketizer) decodeFragment(packet *rtp.Packet, size int, data []byte, gap, afterMarker bool) ([][]byte, error) {
+	if d.fragmenting && (gap || packet.Timestamp != d.timestamp || size != d.fragmentSize) {
+		d.dropFragment()
+		d.skipping = !packet.Marker
+		return nil, ErrFragmentLost
+	}
+	if !d.fragmenting {
+		if d.skipping || gap || !afterMarker {
+			// we missed the start of this access unit
+			report := !d.skipping
+			d.skipping = !packet.Marker
+			if report {
+				return nil, ErrFragmentLost
+			}
+			return nil, nil
+		}
+		if size > MaxAccessUnitSize {
+			d.skipping = !packet.Marker
+			return nil, ErrAccessUnitTooBig
+		}
+		d.fragmenting = true
+		d.fragmentSize = size
+		d.timestamp = packet.Timestamp
+	}
+
+	d.fragment = append(d.fragment, data...)
+	if len(d.fragment) < d.fragmentSize && !packet.Marker {
+		return nil, nil
+	}
+	au := d.fragment
+	d.dropFragment()
+	if len(au) != size {
+		return nil, ErrFragmentLost
+	}
+	return [][]byte{au}, nil
+}
+
+func (d *Depacketizer) dropFragment() {
+	d.fragment = nil
+	d.fragmenting = false
+}
+
+// parseHeaders reads the AU header and auxiliary sections of a payload,
+// returning the sizes of its access units and what follows the sections.
+func (d *Depacketizer) parseHeaders(payload []byte) ([]int, []byte, error) {
+	p := d.Params
+	if !p.hasAUHeaders() {
+		if p.ConstantSize == 0 {
+			return []int{len(payload)}, payload, nil
+		}
+		var sizes []int
+		for n := len(payload); n >= p.ConstantSize; n -= p.ConstantSize {
+			sizes = append(sizes, p.ConstantSize)
+		}
+		return sizes, payload, nil
+	}
+
+	if len(payload) < 2 {
+		return nil, nil, ErrBadAUHeaders
+	}
+	headersBits := int(payload[0])<<8 | int(payload[1])
+	headersBytes := (headersBits + 7) / 8
+	if len(payload) < 2+headersBytes {
+		return nil, nil, ErrBadAUHeaders
+	}
+	r := &bitReader{buf: payload[2 : 2+headersBytes]}
+	var sizes []int
+	for first := true; r.pos < headersBits; first = false {
+		if headersBits-r.pos < p.auHeaderBits(first) {
+			return nil, nil, ErrBadAUHeaders
+		}
+		size, _ := r.readBits(p.SizeLength)
+		if p.SizeLength == 0 {
+			size = uint32(p.ConstantSize)
+		}
+		if first {
+			r.readBits(p.IndexLength)
+		} else {
+			r.readBits(p.IndexDeltaLength)
+		}
+		for _, length := range []int{p.CTSDeltaLength, p.DTSDeltaLength} {
+			if length == 0 {
+				continue
+			}
+			if present, _ := r.readFlag(); present {
+				if _, err := r.readBits(length); err != nil {
+					return nil, nil, ErrBadAUHeaders
+				}
+			}
+		}
+		if p.RandomAccessIndication {
+			r.readBits(1)
+		}
+		r.readBits(p.StreamStateIndication)
+		sizes = append(sizes, int(size))
+	}
+	data := payload[2+headersBytes:]
+
+	if p.AuxiliaryDataSizeLength > 0 {
+		r := &bitReader{buf: data}
+		auxBits, err := r.readBits(p.AuxiliaryDataSizeLength)
+		if err != nil {
+			return nil, nil, ErrBadAUHeaders
+		}
+		auxBytes := (p.AuxiliaryDataSizeLength + int(auxBits) + 7) / 8
+		if len(data) < auxBytes {
+			return nil, nil, ErrBadAUHeaders
+		}
+		data = data[auxBytes:]
+	}
+	return sizes, data, nil
+}
+
+// Packetizer puts access units into the RTP packets of a mpeg4-generic
+// stream with AU headers made of a size and an index, as in the AAC-hbr
+// and AAC-lbr modes of RFC 3640.
+type Packetizer struct {
+	Params      *Params
+	PayloadType uint8
+	SSRC        uint32
+	// SequenceNumber is the sequence number of the next packet.
+	SequenceNumber uint16
+	// MTU is the largest RTP packet to make, header included.
+	MTU int
+}
+
+// Packetize returns the packets of consecutive access units, the first one
+// with the given timestamp, as many in each packet as fit. An access unit
+// too big for a packet is fragmented.
+func (p *Packetizer) Packetize(aus [][]byte, timestamp uint32) ([]*rtp.Packet, error) {
+	params := p.Params
+	if params.SizeLength == 0 || params.IndexLength != params.IndexDeltaLength || params.CTSDeltaLength > 0 ||
+		params.DTSDeltaLength > 0 || params.RandomAccessIndication || params.StreamStateIndication > 0 ||
+		params.AuxiliaryDataSizeLength > 0 {
+		return nil, ErrUnsupportedParams
+	}
+	headerBits := params.SizeLength + params.IndexLength
+	maxPayload := p.mtu() - rtp.HeaderSize
+	if maxPayload < 2+(headerBits+7)/8+1 {
+		return nil, ErrMTUTooSmall
+	}
+	frameLength := uint32(1024)
+	if params.Config != nil && params.Config.FrameLength > 0 {
+		frameLength = uint32(params.Config.FrameLength)
+	}
+
+	var packets []*rtp.Packet
+	for i := 0; i < len(aus); {
+		if len(aus[i]) >= 1<<uint(params.SizeLength) {
+			return nil, ErrAccessUnitTooBig
+		}
+		n, dataSize := 0, 0
+		for i+n < len(aus) {
+			size := 2 + ((n+1)*headerBits+7)/8 + dataSize + len(aus[i+n])
+			if size > maxPayload || (n > 0 && len(aus[i+n]) >= 1<<uint(params.SizeLength)) {
+				break
+			}
+			dataSize += len(aus[i+n])
+			n++
+		}
+		if n == 0 {
+			packets = append(packets, p.fragment(aus[i], headerBits, maxPayload, timestamp)...)
+			n = 1
+		} else {
+			packets = append(packets, p.packet(p.headers(aus[i:i+n], headerBits), aus[i:i+n], timestamp, true))
+		}
+		i += n
+		timestamp += uint32(n) * frameLength
+	}
+	return packets, nil
+}
+
+func (p *Packetizer) mtu() int {
+	if p.MTU > 0 {
+		return p.MTU
+	}
+	return DefaultMTU
+}
+
+// headers builds the AU header section of access units, with an index
+// (delta) of 0 as they are consecutive.
+func (p *Packetizer) headers(aus [][]byte, headerBits int) []byte {
+	w := &bitWriter{}
+	w.writeBits(uint32(len(aus)*headerBits), 16)
+	for _, au := range aus {
+		w.writeBits(uint32(len(au)), p.Params.SizeLength)
+		w.writeBits(0, p.Params.IndexLength)
+	}
+	return w.buf
+}
+
+func (p *Packetizer) packet(headers []byte, aus [][]byte, timestamp uint32, marker bool) *rtp.Packet {
+	payload := headers
+	for _, au := range aus {
+		payload = append(payload, au...)
+	}
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			Marker:         marker,
+			PayloadType:    p.PayloadType,
+			SequenceNumber: p.SequenceNumber,
+			Timestamp:      timestamp,
+			SSRC:           p.SSRC,
+		},
+		Payload: payload,
+	}
+	p.SequenceNumber++
+	return packet
+}
+
+// fragment splits an access unit over packets that each carry its AU
+// header, the marker bit being set on the last one, RFC 3640 section 3.2.3.
+func (p *Packetizer) fragment(au []byte, headerBits, maxPayload int, timestamp uint32) []*rtp.Packet {
+	headers := p.headers([][]byte{au}, headerBits)
+	room := maxPayload - len(headers)
+	var packets []*rtp.Packet
+	for data := au; len(data) > 0; {
+		n := len(data)
+		if n > room {
+			n = room
+		}
+		last := n == len(data)
+		packets = append(packets, p.packet(append([]byte(nil), headers...), [][]byte{data[:n]}, timestamp, last))
+		data = data[n:]
+	}
+	return packets
+}
@@ -0,0 +1,334 @@
+package aac
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+var (
+	ErrUnsupportedMuxConfig = errors.New("aac: unsupported StreamMuxConfig")
+	ErrBadAudioMuxElement   = errors.New("aac: malformed AudioMuxElement")
+	ErrInBandMuxConfig      = errors.New("aac: in-band StreamMuxConfig (cpresent=1) not supported")
+)
+
+// StreamMuxConfig is the LATM configuration of a MP4A-LATM stream,
+// ISO/IEC 14496-3 section 1.7.3. Only audioMuxVersion 0 with a single
+// program and layer is supported.
+type StreamMuxConfig struct {
+	// SubFrames is the number of access units of each AudioMuxElement.
+	SubFrames int
+	Config    AudioSpecificConfig
+	// BufferFullness is latmBufferFullness, 0xFF for variable rate.
+	BufferFullness uint8
+}
+
+// Unmarshal decodes a StreamMuxConfig.
+func (c *StreamMuxConfig) Unmarshal(buf []byte) error {
+	r := &bitReader{buf: buf}
+	audioMuxVersion, err := r.readBits(1)
+	if err != nil {
+		return err
+	}
+	if audioMuxVersion != 0 {
+		return ErrUnsupportedMuxConfig
+	}
+	allStreamsSameTimeFraming, _ := r.readFlag()
+	subFrames, _ := r.readBits(6)
+	programs, _ := r.readBits(4)
+	layers, err := r.readBits(3)
+	if err != nil {
+		return err
+	}
+	if !allStreamsSameTimeFraming || programs != 0 || layers != 0 {
+		return ErrUnsupportedMuxConfig
+	}
+	c.SubFrames = int(subFrames) + 1
+
+	if err := c.Config.read(r); err != nil {
+		return err
+	}
+
+	frameLengthType, err := r.readBits(3)
+	if err != nil {
+		return err
+	}
+	if frameLengthType != 0 {
+		return ErrUnsupportedMuxConfig
+	}
+	fullness, err := r.readBits(8)
+	if err != nil {
+		return err
+	}
+	c.BufferFullness = uint8(fullness)
+
+	otherDataPresent, _ := r.readFlag()
+	crcCheckPresent, err := r.readFlag()
+	if err != nil {
+		return err
+	}
+	if otherDataPresent || crcCheckPresent {
+		return ErrUnsupportedMuxConfig
+	}
+	return nil
+}
+
+// Marshal encodes the StreamMuxConfig.
+func (c *StreamMuxConfig) Marshal() ([]byte, error) {
+	if c.SubFrames < 1 || c.SubFrames > 64 {
+		return nil, ErrUnsupportedMuxConfig
+	}
+	w := &bitWriter{}
+	w.writeBits(0, 1)
+	w.writeFlag(true)
+	w.writeBits(uint32(c.SubFrames-1), 6)
+	w.writeBits(0, 4)
+	w.writeBits(0, 3)
+	if err := c.Config.write(w); err != nil {
+		return nil, err
+	}
+	w.writeBits(0, 3)
+	w.writeBits(uint32(c.BufferFullness), 8)
+	w.writeFlag(false)
+	w.writeFlag(false)
+	return w.buf, nil
+}
+
+// LATMParams are the "a=fmtp:" parameters of a MP4A-LATM stream, RFC 6416
+// section 7.1.
+type LATMParams struct {
+	ProfileLevelID int
+	Object         int
+	Bitrate        int
+	// CPresent tells whether the StreamMuxConfig is in-band; Config is
+	// only set when it isn't.
+	CPresent bool
+	Config   *StreamMuxConfig
+}
+
+// ParseLATMFmtp reads the value of a "a=fmtp:" attribute, with or without
+// its leading payload type, e.g.
+// "96 profile-level-id=30;object=2;cpresent=0;config=400024203fc0".
+func ParseLATMFmtp(fmtp string) (*LATMParams, error) {
+	if i := strings.IndexByte(fmtp, ' '); i >= 0 && !strings.Contains(fmtp[:i], "=") {
+		fmtp = fmtp[i+1:]
+	}
+
+	// cpresent defaults to 1
+	params := &LATMParams{CPresent: true}
+	for _, param := range strings.Split(fmtp, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.TrimSpace(value)
+		var err error
+		switch strings.ToLower(name) {
+		case "profile-level-id":
+			params.ProfileLevelID, err = strconv.Atoi(value)
+		case "object":
+			params.Object, err = strconv.Atoi(value)
+		case "bitrate":
+			params.Bitrate, err = strconv.Atoi(value)
+		case "cpresent":
+			params.CPresent = value != "0"
+		case "config":
+			var buf []byte
+			if buf, err = hex.DecodeString(value); err == nil {
+				params.Config = &StreamMuxConfig{}
+				if err := params.Config.Unmarshal(buf); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err != nil {
+			return nil, ErrBadFmtp
+		}
+	}
+	return params, nil
+}
+
+// String returns the parameters as the value of a "a=fmtp:", without the
+// payload type.
+func (p *LATMParams) String() string {
+	var params []string
+	if p.ProfileLevelID != 0 {
+		params = append(params, fmt.Sprintf("profile-level-id=%d", p.ProfileLevelID))
+	}
+	if p.Object != 0 {
+		params = append(params, fmt.Sprintf("object=%d", p.Object))
+	}
+	if p.Bitrate != 0 {
+		params = append(params, fmt.Sprintf("bitrate=%d", p.Bitrate))
+	}
+	if p.CPresent {
+		params = append(params, "cpresent=1")
+	} else {
+		params = append(params, "cpresent=0")
+	}
+	if p.Config != nil {
+		if buf, err := p.Config.Marshal(); err == nil {
+			params = append(params, "config="+hex.EncodeToString(buf))
+		}
+	}
+	return strings.Join(params, ";")
+}
+
+// LATMDepacketizer takes apart the RTP packets of a MP4A-LATM stream with
+// an out-of-band StreamMuxConfig into access units, RFC 6416 section 6.
+type LATMDepacketizer struct {
+	Params *LATMParams
+
+	element   []byte
+	timestamp uint32
+	started   bool
+	lastSeq   uint16
+	broken    bool
+}
+
+// Decode returns the access units of the AudioMuxElement a packet
+// completes, in order. An element spans packets of the same timestamp up
+// to the one with the marker bit; one missing a packet is dropped, with
+// ErrFragmentLost.
+func (d *LATMDepacketizer) Decode(packet *rtp.Packet) ([][]byte, error) {
+	if d.Params.CPresent || d.Params.Config == nil {
+		return nil, ErrInBandMuxConfig
+	}
+	gap := d.started && packet.SequenceNumber != d.lastSeq+1
+	d.started = true
+	d.lastSeq = packet.SequenceNumber
+
+	if len(d.element) > 0 || d.broken {
+		if packet.Timestamp != d.timestamp {
+			// a new element; the one in progress lost its end
+			d.element = nil
+			d.broken = false
+		} else if gap {
+			d.element = nil
+			d.broken = true
+		}
+	}
+	if len(d.element) == 0 {
+		d.timestamp = packet.Timestamp
+	}
+	if !d.broken {
+		d.element = append(d.element, packet.Payload...)
+		if len(d.element) > MaxAccessUnitSize {
+			d.element = nil
+			d.broken = true
+			return nil, ErrAccessUnitTooBig
+		}
+	}
+	if !packet.Marker {
+		return nil, nil
+	}
+
+	element, broken := d.element, d.broken
+	d.element = nil
+	d.broken = false
+	if broken {
+		return nil, ErrFragmentLost
+	}
+	return parseAudioMuxElement(element, d.Params.Config.SubFrames)
+}
+
+// parseAudioMuxElement splits the PayloadLengthInfo and PayloadMux pairs of
+// an AudioMuxElement without StreamMuxConfig.
+func parseAudioMuxElement(element []byte, subFrames int) ([][]byte, error) {
+	var aus [][]byte
+	for i := 0; i < subFrames; i++ {
+		size := 0
+		for {
+			if len(element) == 0 {
+				return nil, ErrBadAudioMuxElement
+			}
+			b := element[0]
+			element = element[1:]
+			size += int(b)
+			if b != 0xFF {
+				break
+			}
+		}
+		if size > len(element) {
+			return nil, ErrBadAudioMuxElement
+		}
+		aus = append(aus, append([]byte(nil), element[:size]...))
+		element = element[size:]
+	}
+	return aus, nil
+}
+
+// LATMPacketizer puts access units into the RTP packets of a MP4A-LATM
+// stream, one AudioMuxElement of Config.SubFrames access units at a time.
+// Elements too big for a packet are fragmented.
+type LATMPacketizer struct {
+	Params      *LATMParams
+	PayloadType uint8
+	SSRC        uint32
+	// SequenceNumber is the sequence number of the next packet.
+	SequenceNumber uint16
+	// MTU is the largest RTP packet to make, header included.
+	MTU int
+}
+
+// Packetize returns the packets of consecutive access units, the first one
+// with the given timestamp. The number of access units must be a multiple
+// of Config.SubFrames.
+func (p *LATMPacketizer) Packetize(aus [][]byte, timestamp uint32) ([]*rtp.Packet, error) {
+	if p.Params.CPresent || p.Params.Config == nil {
+		return nil, ErrInBandMuxConfig
+	}
+	config := p.Params.Config
+	if len(aus)%config.SubFrames != 0 {
+		return nil, ErrBadAudioMuxElement
+	}
+	mtu := p.MTU
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+	maxPayload := mtu - rtp.HeaderSize
+	if maxPayload < 1 {
+		return nil, ErrMTUTooSmall
+	}
+	frameLength := uint32(config.Config.FrameLength)
+	if frameLength == 0 {
+		frameLength = 1024
+	}
+
+	var packets []*rtp.Packet
+	for i := 0; i < len(aus); i += config.SubFrames {
+		var element []byte
+		for _, au := range aus[i : i+config.SubFrames] {
+			for n := len(au); ; n -= 0xFF {
+				if n < 0xFF {
+					element = append(element, byte(n))
+					break
+				}
+				element = append(element, 0xFF)
+			}
+			element = append(element, au...)
+		}
+
+		for len(element) > 0 {
+			n := len(element)
+			if n > maxPayload {
+				n = maxPayload
+			}
+			packets = append(packets, &rtp.Packet{
+				Header: rtp.Header{
+					Marker:         n == len(element),
+					PayloadType:    p.PayloadType,
+					SequenceNumber: p.SequenceNumber,
+					Timestamp:      timestamp,
+					SSRC:           p.SSRC,
+				},
+				Payload: element[:n],
+			})
+			p.SequenceNumber++
+			element = element[n:]
+		}
+		timestamp += uint32(config.SubFrames) * frameLength
+	}
+	return packets, nil
+}
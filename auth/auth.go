@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// Authenticator is a store of credentials. Passwords are never needed in the
+// clear: both Digest and Basic authentication are checked against
+// HA1 = MD5(username:realm:password), as kept in an htdigest file.
+type Authenticator interface {
+	// Realm is the protection space announced in our challenges.
+	Realm() string
+	// HA1 returns the hashed credentials of username, or false if the user
+	// is unknown.
+	HA1(username string) (string, bool)
+}
+
+// ComputeHA1 hashes the credentials of a user the way Authenticator.HA1 returns them.
+func ComputeHA1(username, realm, password string) string {
+	return md5Hex(username + ":" + realm + ":" + password)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Users is an Authenticator keeping its users in memory.
+type Users struct {
+	realm string
+	mutex sync.RWMutex
+	ha1s  map[string]string
+}
+
+func NewUsers(realm string) *Users {
+	return &Users{
+		realm: realm,
+		ha1s:  make(map[string]string),
+	}
+}
+
+func (u *Users) Realm() string {
+	return u.realm
+}
+
+func (u *Users) HA1(username string) (string, bool) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	ha1, existed := u.ha1s[username]
+	return ha1, existed
+}
+
+// Add adds a user, replacing any previous password.
+func (u *Users) Add(username, password string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.ha1s[username] = ComputeHA1(username, u.realm, password)
+}
+
+func (u *Users) Remove(username string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	delete(u.ha1s, username)
+}
+
+// parseParams parses the comma separated name=value list of a
+// WWW-Authenticate or Authorization header after its scheme. Values may be
+// quoted strings containing commas.
+func parseParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return params
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			value = b.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[name] = value
+	}
+}
+
+// splitScheme splits a header value such as `Digest realm="x"` into its
+// scheme and parameters.
+func splitScheme(header string) (scheme, rest string) {
+	header = strings.TrimSpace(header)
+	if i := strings.IndexAny(header, " \t"); i >= 0 {
+		return header[:i], strings.TrimSpace(header[i+1:])
+	}
+	return header, ""
+}
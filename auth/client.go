@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrUnsupportedChallenge = errors.New("auth: no supported challenge")
+
+// Client answers the challenges of a server on behalf of one user.
+type Client struct {
+	Username string
+	Password string
+
+	scheme string
+	params map[string]string
+	nc     int
+}
+
+func NewClient(username, password string) *Client {
+	return &Client{Username: username, Password: password}
+}
+
+// HandleChallenge takes the WWW-Authenticate headers of a 401 response,
+// preferring Digest over Basic. It returns false if retrying with the new
+// challenge is pointless, i.e. the server rejected credentials made for the
+// same challenge and didn't flag its nonce as stale.
+func (c *Client) HandleChallenge(challenges []string) (bool, error) {
+	var basic map[string]string
+	for _, challenge := range challenges {
+		scheme, rest := splitScheme(challenge)
+		switch {
+		case strings.EqualFold(scheme, "Digest"):
+			params := parseParams(rest)
+			retry := c.scheme != "Digest" || strings.EqualFold(params["stale"], "true") ||
+				params["realm"] != c.params["realm"]
+			c.scheme, c.params, c.nc = "Digest", params, 0
+			return retry, nil
+		case strings.EqualFold(scheme, "Basic"):
+			basic = parseParams(rest)
+		}
+	}
+
+	if basic == nil {
+		return false, ErrUnsupportedChallenge
+	}
+	retry := c.scheme != "Basic"
+	c.scheme, c.params = "Basic", basic
+	return retry, nil
+}
+
+// Authorization returns the Authorization header for a request, or "" until
+// a challenge has been handled.
+func (c *Client) Authorization(method, uri string) string {
+	switch c.scheme {
+	case "Basic":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+	case "Digest":
+		realm, nonce := c.params["realm"], c.params["nonce"]
+		ha1 := ComputeHA1(c.Username, realm, c.Password)
+		header := fmt.Sprintf("Digest username=%q, realm=%q, nonce=%q, uri=%q", c.Username, realm, nonce, uri)
+
+		params := map[string]string{"nonce": nonce}
+		if qopOffered(c.params["qop"], "auth") {
+			c.nc++
+			params["qop"] = "auth"
+			params["nc"] = fmt.Sprintf("%08x", c.nc)
+			params["cnonce"] = newCnonce()
+			header += fmt.Sprintf(", qop=auth, nc=%s, cnonce=%q", params["nc"], params["cnonce"])
+		}
+		header += fmt.Sprintf(", response=%q", digestResponse(ha1, method, uri, params))
+		if opaque, ok := c.params["opaque"]; ok {
+			header += fmt.Sprintf(", opaque=%q", opaque)
+		}
+		return header
+	}
+	return ""
+}
+
+func qopOffered(qop, want string) bool {
+	for _, offered := range strings.Split(qop, ",") {
+		if strings.TrimSpace(offered) == want {
+			return true
+		}
+	}
+	return false
+}
+
+func newCnonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultNonceLifetime is how long a nonce we hand out stays valid.
+const DefaultNonceLifetime = 5 * time.Minute
+
+var (
+	ErrNoCredentials  = errors.New("auth: no credentials")
+	ErrBadCredentials = errors.New("auth: bad credentials")
+	ErrStaleNonce     = errors.New("auth: stale nonce")
+)
+
+// Digest checks requests against an Authenticator using RFC 2617 Digest
+// authentication and, if AllowBasic is set, Basic authentication.
+//
+// Nonces carry their creation time and are signed with a per-Digest key, so
+// nothing has to be remembered about them; a nonce older than NonceLifetime
+// is answered with a stale challenge, which clients retry without asking
+// the user again.
+type Digest struct {
+	Authenticator Authenticator
+	NonceLifetime time.Duration
+	AllowBasic    bool
+	key           []byte
+}
+
+func NewDigest(authenticator Authenticator) *Digest {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &Digest{
+		Authenticator: authenticator,
+		NonceLifetime: DefaultNonceLifetime,
+		key:           key,
+	}
+}
+
+// Challenges returns the WWW-Authenticate headers of a 401 response. stale
+// tells the client its credentials were right but the nonce has expired.
+func (d *Digest) Challenges(stale bool) []string {
+	realm := d.Authenticator.Realm()
+	challenge := fmt.Sprintf("Digest realm=%q, nonce=%q", realm, d.newNonce(time.Now()))
+	if stale {
+		challenge += ", stale=true"
+	}
+
+	challenges := []string{challenge}
+	if d.AllowBasic {
+		challenges = append(challenges, fmt.Sprintf("Basic realm=%q", realm))
+	}
+	return challenges
+}
+
+// Check verifies the Authorization header of a request and returns the
+// authenticated username. It fails with ErrNoCredentials if the header is
+// missing or uses a scheme we don't accept, ErrStaleNonce if the digest
+// credentials are right but their nonce has expired, and ErrBadCredentials
+// otherwise.
+func (d *Digest) Check(method, uri, authorization string) (string, error) {
+	scheme, rest := splitScheme(authorization)
+	switch {
+	case strings.EqualFold(scheme, "Digest"):
+		return d.checkDigest(method, uri, parseParams(rest))
+	case strings.EqualFold(scheme, "Basic") && d.AllowBasic:
+		return d.checkBasic(rest)
+	}
+	return "", ErrNoCredentials
+}
+
+func (d *Digest) checkDigest(method, uri string, params map[string]string) (string, error) {
+	username := params["username"]
+	if params["realm"] != d.Authenticator.Realm() || params["uri"] != uri || params["response"] == "" {
+		return "", ErrBadCredentials
+	}
+	ha1, existed := d.Authenticator.HA1(username)
+	if !existed {
+		return "", ErrBadCredentials
+	}
+	created, ok := d.verifyNonce(params["nonce"])
+	if !ok {
+		return "", ErrBadCredentials
+	}
+
+	expected := digestResponse(ha1, method, uri, params)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return "", ErrBadCredentials
+	}
+	if time.Since(created) > d.NonceLifetime {
+		return "", ErrStaleNonce
+	}
+	return username, nil
+}
+
+func (d *Digest) checkBasic(encoded string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrBadCredentials
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", ErrBadCredentials
+	}
+
+	ha1, existed := d.Authenticator.HA1(parts[0])
+	if !existed {
+		return "", ErrBadCredentials
+	}
+	given := ComputeHA1(parts[0], d.Authenticator.Realm(), parts[1])
+	if subtle.ConstantTimeCompare([]byte(given), []byte(ha1)) != 1 {
+		return "", ErrBadCredentials
+	}
+	return parts[0], nil
+}
+
+// digestResponse computes the "response" parameter of RFC 2617 section
+// 3.2.2.1, with or without qop=auth.
+func digestResponse(ha1, method, uri string, params map[string]string) string {
+	ha2 := md5Hex(method + ":" + uri)
+	if params["qop"] == "auth" {
+		return md5Hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":"))
+	}
+	return md5Hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+}
+
+// A nonce is the hex creation time in nanoseconds followed by the hex
+// HMAC-SHA256 of that time.
+func (d *Digest) newNonce(created time.Time) string {
+	timestamp := strconv.FormatInt(created.UnixNano(), 16)
+	return timestamp + d.sign(timestamp)
+}
+
+func (d *Digest) verifyNonce(nonce string) (time.Time, bool) {
+	const signatureLength = 2 * sha256.Size
+	if len(nonce) <= signatureLength {
+		return time.Time{}, false
+	}
+	timestamp, signature := nonce[:len(nonce)-signatureLength], nonce[len(nonce)-signatureLength:]
+	if !hmac.Equal([]byte(signature), []byte(d.sign(timestamp))) {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(timestamp, 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+func (d *Digest) sign(timestamp string) string {
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write([]byte(timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
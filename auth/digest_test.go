@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testURI = "rtsp://example.com/live"
+
+func TestDigestWithClient(t *testing.T) {
+	users := NewUsers("streams")
+	users.Add("alice", "secret")
+	digest := NewDigest(users)
+
+	if _, err := digest.Check("DESCRIBE", testURI, ""); err != ErrNoCredentials {
+		t.Errorf("no credentials: %v, want %v", err, ErrNoCredentials)
+	}
+
+	for _, qop := range []string{"", ", qop=\"auth\""} {
+		client := NewClient("alice", "secret")
+		if retry, err := client.HandleChallenge([]string{digest.Challenges(false)[0] + qop}); !retry || err != nil {
+			t.Fatalf("HandleChallenge() = %v, %v", retry, err)
+		}
+		authorization := client.Authorization("DESCRIBE", testURI)
+		if username, err := digest.Check("DESCRIBE", testURI, authorization); username != "alice" || err != nil {
+			t.Errorf("Check(%q) = %q, %v", authorization, username, err)
+		}
+		if _, err := digest.Check("SETUP", testURI, authorization); err != ErrBadCredentials {
+			t.Errorf("Check() with another method: %v, want %v", err, ErrBadCredentials)
+		}
+	}
+
+	client := NewClient("alice", "wrong")
+	client.HandleChallenge(digest.Challenges(false))
+	if _, err := digest.Check("DESCRIBE", testURI, client.Authorization("DESCRIBE", testURI)); err != ErrBadCredentials {
+		t.Errorf("wrong password: %v, want %v", err, ErrBadCredentials)
+	}
+	if retry, _ := client.HandleChallenge(digest.Challenges(false)); retry {
+		t.Errorf("client retries a rejected password")
+	}
+}
+
+func TestDigestStaleNonce(t *testing.T) {
+	users := NewUsers("streams")
+	users.Add("alice", "secret")
+	digest := NewDigest(users)
+
+	client := NewClient("alice", "secret")
+	client.HandleChallenge([]string{`Digest realm="streams", nonce="` + digest.newNonce(time.Now().Add(-time.Hour)) + `"`})
+
+	if _, err := digest.Check("PLAY", testURI, client.Authorization("PLAY", testURI)); err != ErrStaleNonce {
+		t.Fatalf("old nonce: %v, want %v", err, ErrStaleNonce)
+	}
+	if retry, _ := client.HandleChallenge(digest.Challenges(true)); !retry {
+		t.Errorf("client doesn't retry after a stale nonce")
+	}
+	if _, err := digest.Check("PLAY", testURI, client.Authorization("PLAY", testURI)); err != nil {
+		t.Errorf("fresh nonce: %v", err)
+	}
+
+	// a forged nonce claiming to be fresh
+	forged := strings.Replace(client.Authorization("PLAY", testURI), "nonce=\"", "nonce=\"1", 1)
+	if _, err := digest.Check("PLAY", testURI, forged); err != ErrBadCredentials {
+		t.Errorf("forged nonce: %v, want %v", err, ErrBadCredentials)
+	}
+}
+
+func TestBasic(t *testing.T) {
+	users := NewUsers("streams")
+	users.Add("bob", "hunter2")
+	digest := NewDigest(users)
+
+	client := NewClient("bob", "hunter2")
+	client.HandleChallenge([]string{`Basic realm="streams"`})
+	authorization := client.Authorization("DESCRIBE", testURI)
+
+	if _, err := digest.Check("DESCRIBE", testURI, authorization); err != ErrNoCredentials {
+		t.Errorf("Basic while not allowed: %v, want %v", err, ErrNoCredentials)
+	}
+	digest.AllowBasic = true
+	if len(digest.Challenges(false)) != 2 {
+		t.Errorf("Challenges() = %q, want Digest and Basic", digest.Challenges(false))
+	}
+	if username, err := digest.Check("DESCRIBE", testURI, authorization); username != "bob" || err != nil {
+		t.Errorf("Check(%q) = %q, %v", authorization, username, err)
+	}
+}
+
+func TestParseHtdigest(t *testing.T) {
+	file := "# users\n" +
+		"alice:streams:" + ComputeHA1("alice", "streams", "secret") + "\n" +
+		"\n" +
+		"carol:other:" + ComputeHA1("carol", "other", "pw") + "\n"
+	h, err := ParseHtdigest(strings.NewReader(file), "streams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ha1, ok := h.HA1("alice"); !ok || ha1 != ComputeHA1("alice", "streams", "secret") {
+		t.Errorf("HA1(alice) = %q, %v", ha1, ok)
+	}
+	if _, ok := h.HA1("carol"); ok {
+		t.Errorf("user of another realm loaded")
+	}
+
+	if _, err := ParseHtdigest(strings.NewReader("alice:streams\n"), "streams"); err == nil {
+		t.Errorf("malformed line accepted")
+	}
+}
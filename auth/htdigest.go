@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Htdigest is an Authenticator reading the users of one realm from a file in
+// the format of Apache's htdigest tool, one "username:realm:HA1" per line.
+type Htdigest struct {
+	*Users
+}
+
+// LoadHtdigest reads the users of realm from the htdigest file at path.
+func LoadHtdigest(path, realm string) (*Htdigest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseHtdigest(file, realm)
+}
+
+// ParseHtdigest reads the users of realm in htdigest format from r. Users of
+// other realms, blank lines and lines starting with '#' are skipped.
+func ParseHtdigest(r io.Reader, realm string) (*Htdigest, error) {
+	h := &Htdigest{NewUsers(realm)}
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 || fields[0] == "" || len(fields[2]) != 32 {
+			return nil, fmt.Errorf("htdigest line %d: malformed entry", lineNumber)
+		}
+		if fields[1] != realm {
+			continue
+		}
+		h.ha1s[fields[0]] = strings.ToLower(fields[2])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
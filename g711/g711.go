@@ -0,0 +1,192 @@
+// Package g711 carries G.711 µ-law (PCMU) and A-law (PCMA) audio over RTP,
+// RFC 3551 section 4.5.14, and converts it from and to linear PCM.
+//
+// A G.711 payload is just one byte per sample, and its RTP timestamp
+// counts samples, so the payload of a packet can be used as it is.
+package g711
+
+import (
+	"errors"
+	"time"
+
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+const (
+	// ClockRate is the sample rate, and RTP clock rate, of G.711.
+	ClockRate = 8000
+
+	// PayloadTypeMuLaw and PayloadTypeALaw are the static payload types of
+	// PCMU and PCMA.
+	PayloadTypeMuLaw = 0
+	PayloadTypeALaw  = 8
+
+	// DefaultPacketDuration is the audio a Packetizer puts in a packet when
+	// its PacketDuration isn't set, as RFC 3551 recommends.
+	DefaultPacketDuration = 20 * time.Millisecond
+
+	muLawBias = 0x84
+	muLawClip = 32635
+)
+
+var ErrBadPacketDuration = errors.New("g711: packet duration shorter than a sample")
+
+// aLawSegmentEnds are the upper bounds of the A-law segments, on 13 bits.
+var aLawSegmentEnds = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+
+// MuLawToLinear decodes a µ-law sample.
+func MuLawToLinear(u byte) int16 {
+	u = ^u
+	t := int(u&0x0F)<<3 + muLawBias
+	t <<= (u & 0x70) >> 4
+	if u&0x80 != 0 {
+		return int16(muLawBias - t)
+	}
+	return int16(t - muLawBias)
+}
+
+// LinearToMuLaw encodes a sample in µ-law.
+func LinearToMuLaw(sample int16) byte {
+	var sign byte
+	v := int(sample)
+	if v < 0 {
+		v = -v
+		sign = 0x80
+	}
+	if v > muLawClip {
+		v = muLawClip
+	}
+	v += muLawBias
+
+	exponent := byte(7)
+	for mask := 0x4000; v&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := byte(v>>(exponent+3)) & 0x0F
+	return ^(sign | exponent<<4 | mantissa)
+}
+
+// ALawToLinear decodes an A-law sample.
+func ALawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0F) << 4
+	switch segment := (a & 0x70) >> 4; segment {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= segment - 1
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+// LinearToALaw encodes a sample in A-law.
+func LinearToALaw(sample int16) byte {
+	v := int(sample) >> 3
+	mask := byte(0xD5)
+	if v < 0 {
+		mask = 0x55
+		v = -v - 1
+	}
+
+	segment := 0
+	for segment < len(aLawSegmentEnds) && v > aLawSegmentEnds[segment] {
+		segment++
+	}
+	if segment == len(aLawSegmentEnds) {
+		return 0x7F ^ mask
+	}
+	a := byte(segment << 4)
+	if segment < 2 {
+		a |= byte(v>>1) & 0x0F
+	} else {
+		a |= byte(v>>uint(segment)) & 0x0F
+	}
+	return a ^ mask
+}
+
+// DecodeMuLaw decodes µ-law samples into linear PCM.
+func DecodeMuLaw(samples []byte) []int16 {
+	pcm := make([]int16, len(samples))
+	for i, sample := range samples {
+		pcm[i] = MuLawToLinear(sample)
+	}
+	return pcm
+}
+
+// EncodeMuLaw encodes linear PCM samples in µ-law.
+func EncodeMuLaw(pcm []int16) []byte {
+	samples := make([]byte, len(pcm))
+	for i, sample := range pcm {
+		samples[i] = LinearToMuLaw(sample)
+	}
+	return samples
+}
+
+// DecodeALaw decodes A-law samples into linear PCM.
+func DecodeALaw(samples []byte) []int16 {
+	pcm := make([]int16, len(samples))
+	for i, sample := range samples {
+		pcm[i] = ALawToLinear(sample)
+	}
+	return pcm
+}
+
+// EncodeALaw encodes linear PCM samples in A-law.
+func EncodeALaw(pcm []int16) []byte {
+	samples := make([]byte, len(pcm))
+	for i, sample := range pcm {
+		samples[i] = LinearToALaw(sample)
+	}
+	return samples
+}
+
+// Packetizer splits G.711 samples into RTP packets of PacketDuration.
+type Packetizer struct {
+	PayloadType uint8
+	SSRC        uint32
+	// SequenceNumber is the sequence number of the next packet.
+	SequenceNumber uint16
+	PacketDuration time.Duration
+}
+
+// Packetize returns the packets of consecutive samples, the first one with
+// the given timestamp. Only the first packet has the marker bit set when
+// first is, as for the start of a talkspurt.
+func (p *Packetizer) Packetize(samples []byte, timestamp uint32, first bool) ([]*rtp.Packet, error) {
+	duration := p.PacketDuration
+	if duration == 0 {
+		duration = DefaultPacketDuration
+	}
+	perPacket := int(duration * ClockRate / time.Second)
+	if perPacket < 1 {
+		return nil, ErrBadPacketDuration
+	}
+
+	var packets []*rtp.Packet
+	for len(samples) > 0 {
+		n := len(samples)
+		if n > perPacket {
+			n = perPacket
+		}
+		packets = append(packets, &rtp.Packet{
+			Header: rtp.Header{
+				Marker:         first && len(packets) == 0,
+				PayloadType:    p.PayloadType,
+				SequenceNumber: p.SequenceNumber,
+				Timestamp:      timestamp,
+				SSRC:           p.SSRC,
+			},
+			Payload: samples[:n],
+		})
+		p.SequenceNumber++
+		timestamp += uint32(n)
+		samples = samples[n:]
+	}
+	return packets, nil
+}
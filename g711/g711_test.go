@@ -0,0 +1,70 @@
+package g711
+
+import (
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		u := byte(i)
+		if got := LinearToMuLaw(MuLawToLinear(u)); got != u && u != 0x7F {
+			// 0x7F is the negative zero of µ-law
+			t.Errorf("µ-law %02X decodes to %d, which encodes to %02X", u, MuLawToLinear(u), got)
+		}
+		a := byte(i)
+		if got := LinearToALaw(ALawToLinear(a)); got != a {
+			t.Errorf("A-law %02X decodes to %d, which encodes to %02X", a, ALawToLinear(a), got)
+		}
+	}
+
+	var tests = []struct {
+		sample int16
+		mu, a  byte
+	}{
+		{0, 0xFF, 0xD5},
+		{32767, 0x80, 0xAA},
+		{-32768, 0x00, 0x2A},
+		{1000, 0xCE, 0xFA},
+	}
+	for _, test := range tests {
+		if got := LinearToMuLaw(test.sample); got != test.mu {
+			t.Errorf("LinearToMuLaw(%d) = %02X, want %02X", test.sample, got, test.mu)
+		}
+		if got := LinearToALaw(test.sample); got != test.a {
+			t.Errorf("LinearToALaw(%d) = %02X, want %02X", test.sample, got, test.a)
+		}
+	}
+
+	pcm := []int16{-5000, -100, 0, 100, 5000}
+	for i, sample := range DecodeALaw(EncodeALaw(pcm)) {
+		if d := int(sample) - int(pcm[i]); d < -200 || d > 200 {
+			t.Errorf("A-law round trip of %d gives %d", pcm[i], sample)
+		}
+	}
+	for i, sample := range DecodeMuLaw(EncodeMuLaw(pcm)) {
+		if d := int(sample) - int(pcm[i]); d < -200 || d > 200 {
+			t.Errorf("µ-law round trip of %d gives %d", pcm[i], sample)
+		}
+	}
+}
+
+func TestPacketize(t *testing.T) {
+	p := &Packetizer{PayloadType: PayloadTypeALaw, SequenceNumber: 7}
+	packets, err := p.Packetize(make([]byte, 400), 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 3 {
+		t.Fatalf("got %d packets, want 3", len(packets))
+	}
+	for i, packet := range packets {
+		wantSize := 160
+		if i == 2 {
+			wantSize = 80
+		}
+		if len(packet.Payload) != wantSize || packet.Timestamp != uint32(1000+160*i) ||
+			packet.SequenceNumber != uint16(7+i) || packet.Marker != (i == 0) {
+			t.Errorf("packet %d: %d samples, %+v", i, len(packet.Payload), packet.Header)
+		}
+	}
+}
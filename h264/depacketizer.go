@@ -0,0 +1,205 @@
+package h264
+
+import (
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+// MaxAccessUnitSize bounds the access units a Depacketizer builds, so that
+// a broken stream can't make it grow without end.
+const MaxAccessUnitSize = 8 << 20
+
+// AccessUnit is the NAL units of one picture, without start codes.
+type AccessUnit struct {
+	Timestamp uint32
+	NALUs     [][]byte
+}
+
+// Depacketizer reassembles access units from the RTP packets of a
+// packetization-mode 0 or 1 stream, RFC 6184 sections 5.6 to 5.8.
+//
+// If SPS and PPS are set, from ParseFmtp, they are put in front of
+// keyframes that don't carry their own, so that every keyframe can be
+// decoded on its own. In-band parameter sets replace them.
+type Depacketizer struct {
+	SPS [][]byte
+	PPS [][]byte
+
+	nalus     [][]byte
+	size      int
+	timestamp uint32
+	started   bool
+
+	fragment     []byte
+	fragmenting  bool
+	fragmentLost bool
+	lastSeq      uint16
+}
+
+// Decode takes the packets of a stream in sequence order and returns the
+// access unit they complete, at the packet with the marker bit. It returns
+// nil until then. An access unit whose last packet is lost is dropped when
+// the next one starts; a FU-A missing a fragment is dropped as well, with
+// ErrFragmentLost.
+func (d *Depacketizer) Decode(packet *rtp.Packet) (*AccessUnit, error) {
+	if d.started && packet.Timestamp != d.timestamp {
+		d.reset()
+	}
+	if !d.started {
+		d.started = true
+		d.timestamp = packet.Timestamp
+	}
+	gap := d.fragmenting && packet.SequenceNumber != d.lastSeq+1
+	d.lastSeq = packet.SequenceNumber
+
+	if err := d.decodePayload(packet.Payload, gap); err != nil {
+		if err == ErrAccessUnitTooBig {
+			d.reset()
+		}
+		return nil, err
+	}
+	if !packet.Marker {
+		return nil, nil
+	}
+
+	au := &AccessUnit{Timestamp: d.timestamp, NALUs: d.withParameterSets(d.nalus)}
+	d.reset()
+	if len(au.NALUs) == 0 {
+		return nil, nil
+	}
+	return au, nil
+}
+
+func (d *Depacketizer) reset() {
+	d.nalus = nil
+	d.size = 0
+	d.started = false
+	d.fragment = nil
+	d.fragmenting = false
+	d.fragmentLost = false
+}
+
+func (d *Depacketizer) decodePayload(payload []byte, gap bool) error {
+	if len(payload) == 0 {
+		return ErrEmptyNALU
+	}
+
+	switch NALUType(payload) {
+	case NALUTypeSTAPA:
+		buf := payload[1:]
+		if len(buf) == 0 {
+			return ErrBadSTAPA
+		}
+		for len(buf) > 0 {
+			if len(buf) < 2 {
+				return ErrBadSTAPA
+			}
+			size := int(buf[0])<<8 | int(buf[1])
+			if size == 0 || len(buf) < 2+size {
+				return ErrBadSTAPA
+			}
+			if err := d.addNALU(buf[2 : 2+size]); err != nil {
+				return err
+			}
+			buf = buf[2+size:]
+		}
+		return nil
+
+	case NALUTypeFUA:
+		return d.decodeFUA(payload, gap)
+
+	case NALUTypeSTAPB, NALUTypeMTAP16, NALUTypeMTAP24, NALUTypeFUB:
+		// interleaved mode
+		return ErrUnsupportedNALU
+
+	case 0, 30, 31:
+		// reserved
+		return ErrUnsupportedNALU
+	}
+	return d.addNALU(payload)
+}
+
+func (d *Depacketizer) decodeFUA(payload []byte, gap bool) error {
+	if len(payload) < 3 {
+		return ErrBadFUA
+	}
+	start := payload[1]&0x80 != 0
+	end := payload[1]&0x40 != 0
+
+	if start {
+		if d.fragmenting {
+			// the end of the previous one was lost
+			d.fragment = nil
+		}
+		header := payload[0]&0xE0 | payload[1]&0x1F
+		d.fragment = append([]byte{header}, payload[2:]...)
+		d.fragmenting = true
+		d.fragmentLost = false
+	} else {
+		if !d.fragmenting {
+			if d.fragmentLost {
+				// already reported
+				d.fragmentLost = !end
+				return nil
+			}
+			// we missed the start
+			d.fragmentLost = !end
+			return ErrFragmentLost
+		}
+		if gap {
+			d.fragment = nil
+			d.fragmenting = false
+			d.fragmentLost = !end
+			return ErrFragmentLost
+		}
+		d.fragment = append(d.fragment, payload[2:]...)
+	}
+	if d.size+len(d.fragment) > MaxAccessUnitSize {
+		return ErrAccessUnitTooBig
+	}
+
+	if end {
+		nalu := d.fragment
+		d.fragment = nil
+		d.fragmenting = false
+		return d.addNALU(nalu)
+	}
+	return nil
+}
+
+// addNALU appends a copy of nalu, as packet buffers are often reused.
+func (d *Depacketizer) addNALU(nalu []byte) error {
+	if d.size+len(nalu) > MaxAccessUnitSize {
+		return ErrAccessUnitTooBig
+	}
+	switch NALUType(nalu) {
+	case NALUTypeSPS:
+		d.SPS = [][]byte{append([]byte(nil), nalu...)}
+	case NALUTypePPS:
+		d.PPS = [][]byte{append([]byte(nil), nalu...)}
+	}
+	d.nalus = append(d.nalus, append([]byte(nil), nalu...))
+	d.size += len(nalu)
+	return nil
+}
+
+// withParameterSets puts SPS and PPS in front of a keyframe lacking them.
+func (d *Depacketizer) withParameterSets(nalus [][]byte) [][]byte {
+	if !IsKeyframe(nalus) || len(d.SPS) == 0 || len(d.PPS) == 0 {
+		return nalus
+	}
+	for _, nalu := range nalus {
+		if NALUType(nalu) == NALUTypeSPS {
+			return nalus
+		}
+	}
+
+	// after the access unit delimiter, if any
+	i := 0
+	if NALUType(nalus[0]) == NALUTypeAUD {
+		i = 1
+	}
+	au := append([][]byte(nil), nalus[:i]...)
+	au = append(au, d.SPS...)
+	au = append(au, d.PPS...)
+	return append(au, nalus[i:]...)
+}
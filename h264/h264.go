@@ -0,0 +1,164 @@
+// Package h264 carries H.264 video over RTP, RFC 6184: it reassembles
+// access units from single NAL unit, STAP-A and FU-A packets, splits them
+// back into packets, and reads the parameters of "a=fmtp:".
+package h264
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// NAL unit types, H.264 table 7-1 and RFC 6184 table 1.
+const (
+	NALUTypeNonIDR = 1
+	NALUTypeIDR    = 5
+	NALUTypeSEI    = 6
+	NALUTypeSPS    = 7
+	NALUTypePPS    = 8
+	NALUTypeAUD    = 9
+
+	NALUTypeSTAPA  = 24
+	NALUTypeSTAPB  = 25
+	NALUTypeMTAP16 = 26
+	NALUTypeMTAP24 = 27
+	NALUTypeFUA    = 28
+	NALUTypeFUB    = 29
+)
+
+var (
+	ErrEmptyNALU         = errors.New("h264: empty NAL unit")
+	ErrBadSTAPA          = errors.New("h264: malformed STAP-A")
+	ErrBadFUA            = errors.New("h264: malformed FU-A")
+	ErrFragmentLost      = errors.New("h264: FU-A fragment lost")
+	ErrUnsupportedNALU   = errors.New("h264: unsupported NAL unit type")
+	ErrAccessUnitTooBig  = errors.New("h264: access unit too big")
+	ErrBadParameterSets  = errors.New("h264: malformed sprop-parameter-sets")
+	ErrBadPacketization  = errors.New("h264: unsupported packetization-mode")
+	ErrBadProfileLevelID = errors.New("h264: malformed profile-level-id")
+	ErrMTUTooSmall       = errors.New("h264: MTU too small")
+)
+
+// NALUType returns the type of a NAL unit, from its header byte.
+func NALUType(nalu []byte) uint8 {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return nalu[0] & 0x1F
+}
+
+// IsKeyframe reports whether an access unit holds an IDR picture, which a
+// decoder can start from.
+func IsKeyframe(au [][]byte) bool {
+	for _, nalu := range au {
+		if NALUType(nalu) == NALUTypeIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRandomAccess reports whether a RTP payload starts an access unit a
+// decoder can start from: an IDR picture or the SPS in front of one. A new
+// viewer is only sent the stream from such a packet on.
+func IsRandomAccess(payload []byte) bool {
+	switch NALUType(payload) {
+	case NALUTypeIDR, NALUTypeSPS:
+		return true
+	case NALUTypeSTAPA:
+		for buf := payload[1:]; len(buf) >= 3; {
+			size := int(buf[0])<<8 | int(buf[1])
+			if size == 0 || len(buf) < 2+size {
+				return false
+			}
+			switch NALUType(buf[2:]) {
+			case NALUTypeIDR, NALUTypeSPS:
+				return true
+			}
+			buf = buf[2+size:]
+		}
+	case NALUTypeFUA:
+		// the start fragment of an IDR
+		return len(payload) >= 2 && payload[1]&0x80 != 0 && payload[1]&0x1F == NALUTypeIDR
+	}
+	return false
+}
+
+// Params are the "a=fmtp:" parameters of a H.264 stream, RFC 6184 section 8.1.
+type Params struct {
+	PacketizationMode int
+	// ProfileLevelID is profile_idc, the constraint flags and level_idc.
+	ProfileLevelID [3]byte
+	SPS            [][]byte
+	PPS            [][]byte
+}
+
+// ParseFmtp reads the value of a "a=fmtp:" attribute, with or without its
+// leading payload type, e.g.
+// "96 packetization-mode=1;profile-level-id=42001F;sprop-parameter-sets=Z0IAH52oFAFum4CAgIE=,aM48gA==".
+// Parameters it doesn't know are ignored.
+func ParseFmtp(fmtp string) (*Params, error) {
+	if i := strings.IndexByte(fmtp, ' '); i >= 0 && !strings.Contains(fmtp[:i], "=") {
+		fmtp = fmtp[i+1:]
+	}
+
+	params := &Params{}
+	for _, param := range strings.Split(fmtp, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(name) {
+		case "packetization-mode":
+			mode, err := strconv.Atoi(value)
+			if err != nil || mode < 0 || mode > 2 {
+				return nil, ErrBadPacketization
+			}
+			params.PacketizationMode = mode
+		case "profile-level-id":
+			if len(value) != 6 {
+				return nil, ErrBadProfileLevelID
+			}
+			id, err := strconv.ParseUint(value, 16, 32)
+			if err != nil {
+				return nil, ErrBadProfileLevelID
+			}
+			params.ProfileLevelID = [3]byte{byte(id >> 16), byte(id >> 8), byte(id)}
+		case "sprop-parameter-sets":
+			var err error
+			if params.SPS, params.PPS, err = ParseSpropParameterSets(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return params, nil
+}
+
+// ParseSpropParameterSets decodes the base64 parameter sets of
+// "sprop-parameter-sets", sorting them into SPS and PPS.
+func ParseSpropParameterSets(value string) (sps, pps [][]byte, err error) {
+	for _, set := range strings.Split(value, ",") {
+		if set == "" {
+			continue
+		}
+		nalu, err := base64.StdEncoding.DecodeString(set)
+		if err != nil || len(nalu) == 0 {
+			return nil, nil, ErrBadParameterSets
+		}
+		switch NALUType(nalu) {
+		case NALUTypeSPS:
+			sps = append(sps, nalu)
+		case NALUTypePPS:
+			pps = append(pps, nalu)
+		}
+	}
+	return sps, pps, nil
+}
+
+// SpropParameterSets encodes SPS and PPS for "sprop-parameter-sets".
+func SpropParameterSets(sps, pps [][]byte) string {
+	var sets []string
+	for _, nalu := range append(append([][]byte(nil), sps...), pps...) {
+		sets = append(sets, base64.StdEncoding.EncodeToString(nalu))
+	}
+	return strings.Join(sets, ",")
+}
@@ -0,0 +1,188 @@
+package h264
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+func TestParseFmtp(t *testing.T) {
+	var tests = []struct {
+		fmtp string
+		want *Params
+	}{
+		{
+			"96 packetization-mode=1;profile-level-id=4D401E;sprop-parameter-sets=J01AHqkYMB73oA==,KM4C+IA=",
+			&Params{
+				PacketizationMode: 1,
+				ProfileLevelID:    [3]byte{0x4D, 0x40, 0x1E},
+				SPS:               [][]byte{{0x27, 0x4D, 0x40, 0x1E, 0xA9, 0x18, 0x30, 0x1E, 0xF7, 0xA0}},
+				PPS:               [][]byte{{0x28, 0xCE, 0x02, 0xF8, 0x80}},
+			},
+		},
+		{
+			"packetization-mode=1; sprop-parameter-sets=Z0IAH52oFAFum4CAgIE=,aM48gA==; profile-level-id=42001F",
+			&Params{
+				PacketizationMode: 1,
+				ProfileLevelID:    [3]byte{0x42, 0x00, 0x1F},
+				SPS:               [][]byte{{0x67, 0x42, 0x00, 0x1F, 0x9D, 0xA8, 0x14, 0x01, 0x6E, 0x9B, 0x80, 0x80, 0x80, 0x81}},
+				PPS:               [][]byte{{0x68, 0xCE, 0x3C, 0x80}},
+			},
+		},
+	}
+	for _, test := range tests {
+		got, err := ParseFmtp(test.fmtp)
+		if err != nil {
+			t.Errorf("ParseFmtp(%q): %v", test.fmtp, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseFmtp(%q) = %+v, want %+v", test.fmtp, got, test.want)
+		}
+		if sprop := SpropParameterSets(got.SPS, got.PPS); !bytes.Contains([]byte(test.fmtp), []byte(sprop)) {
+			t.Errorf("SpropParameterSets() = %q", sprop)
+		}
+	}
+
+	for _, fmtp := range []string{"96 packetization-mode=3", "96 profile-level-id=4D40", "96 sprop-parameter-sets=!!"} {
+		if _, err := ParseFmtp(fmtp); err == nil {
+			t.Errorf("ParseFmtp(%q) succeeded", fmtp)
+		}
+	}
+}
+
+func testAccessUnit() [][]byte {
+	idr := make([]byte, 5000)
+	idr[0] = 0x65
+	for i := 1; i < len(idr); i++ {
+		idr[i] = byte(i)
+	}
+	return [][]byte{
+		{0x09, 0xF0},
+		{0x67, 0x42, 0x00, 0x1F, 0x9D, 0xA8},
+		{0x68, 0xCE, 0x3C, 0x80},
+		idr,
+		{0x06, 0x05, 0x01, 0x80},
+	}
+}
+
+func TestPacketizeRoundTrip(t *testing.T) {
+	au := testAccessUnit()
+	p := &Packetizer{PayloadType: 96, SSRC: 0x1234, SequenceNumber: 65534, MTU: 1200}
+	packets, err := p.Packetize(au, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// AUD, SPS and PPS in a STAP-A, the IDR in five FU-A, the SEI alone
+	var types []uint8
+	for i, packet := range packets {
+		if size := packet.MarshalSize(); size > 1200 {
+			t.Errorf("packet %d is %d bytes", i, size)
+		}
+		if packet.Marker != (i == len(packets)-1) {
+			t.Errorf("packet %d: marker = %v", i, packet.Marker)
+		}
+		if packet.SequenceNumber != uint16(65534+i) || packet.Timestamp != 3000 {
+			t.Errorf("packet %d: seq %d, timestamp %d", i, packet.SequenceNumber, packet.Timestamp)
+		}
+		types = append(types, NALUType(packet.Payload))
+	}
+	want := []uint8{NALUTypeSTAPA, NALUTypeFUA, NALUTypeFUA, NALUTypeFUA, NALUTypeFUA, NALUTypeFUA, NALUTypeSEI}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("packet types = %v, want %v", types, want)
+	}
+	if !IsRandomAccess(packets[0].Payload) || !IsRandomAccess(packets[1].Payload) || IsRandomAccess(packets[2].Payload) {
+		t.Errorf("IsRandomAccess() wrong on STAP-A or FU-A")
+	}
+
+	d := &Depacketizer{}
+	for i, packet := range packets {
+		// through the wire format, to reuse the buffer
+		data, _ := packet.Marshal()
+		var received rtp.Packet
+		received.Unmarshal(data)
+		got, err := d.Decode(&received)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < len(packets)-1 {
+			if got != nil {
+				t.Fatalf("access unit after packet %d", i)
+			}
+			continue
+		}
+		if got == nil || got.Timestamp != 3000 || !reflect.DeepEqual(got.NALUs, au) {
+			t.Errorf("Decode() = %+v", got)
+		}
+	}
+}
+
+func TestDepacketizerLoss(t *testing.T) {
+	p := &Packetizer{PayloadType: 96, MTU: 1200}
+	first, _ := p.Packetize(testAccessUnit(), 0)
+	second, _ := p.Packetize([][]byte{{0x41, 1, 2, 3}}, 3000)
+
+	d := &Depacketizer{}
+	var errs []error
+	var aus []*AccessUnit
+	for i, packet := range append(first, second...) {
+		if i == 3 {
+			// a FU-A fragment of the IDR
+			continue
+		}
+		au, err := d.Decode(packet)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if au != nil {
+			aus = append(aus, au)
+		}
+	}
+	if len(errs) != 1 || errs[0] != ErrFragmentLost {
+		t.Errorf("errors = %v, want one %v", errs, ErrFragmentLost)
+	}
+	// the IDR is gone, the rest survives
+	if len(aus) != 2 || len(aus[0].NALUs) != 4 || IsKeyframe(aus[0].NALUs) || len(aus[1].NALUs) != 1 {
+		t.Errorf("access units = %+v", aus)
+	}
+
+	// a lost marker packet drops the access unit
+	d = &Depacketizer{}
+	third, _ := p.Packetize([][]byte{{0x41, 4}, {0x41, 5}}, 6000)
+	third[0].Payload = []byte{0x41, 4}
+	third[0].Marker = false
+	if au, _ := d.Decode(third[0]); au != nil {
+		t.Errorf("access unit without its marker")
+	}
+	if au, _ := d.Decode(second[0]); au == nil || au.Timestamp != 3000 || len(au.NALUs) != 1 {
+		t.Errorf("Decode() after a lost marker = %+v", au)
+	}
+}
+
+func TestDepacketizerParameterSets(t *testing.T) {
+	params, _ := ParseFmtp("96 packetization-mode=1;sprop-parameter-sets=Z0IAH52oFAFum4CAgIE=,aM48gA==")
+	d := &Depacketizer{SPS: params.SPS, PPS: params.PPS}
+	idr := &rtp.Packet{Header: rtp.Header{Marker: true}, Payload: []byte{0x09, 0xF0}}
+	if _, err := d.Decode(idr); err != nil {
+		t.Fatal(err)
+	}
+
+	idr.Payload = []byte{0x65, 0x88, 0x84}
+	au, err := d.Decode(idr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{params.SPS[0], params.PPS[0], {0x65, 0x88, 0x84}}
+	if au == nil || !reflect.DeepEqual(au.NALUs, want) {
+		t.Errorf("keyframe = %x, want %x", au.NALUs, want)
+	}
+
+	for _, payload := range [][]byte{{}, {NALUTypeSTAPA, 0, 5, 1}, {NALUTypeFUA}, {NALUTypeMTAP16, 0}} {
+		if _, err := d.Decode(&rtp.Packet{Payload: payload}); err == nil {
+			t.Errorf("Decode(%x) succeeded", payload)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package h264
+
+import (
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+// DefaultMTU is the size of the RTP packets a Packetizer makes when its
+// MTU isn't set, leaving room for IP, UDP and tunnel headers.
+const DefaultMTU = 1400
+
+// Packetizer splits access units into the RTP packets of a
+// packetization-mode 1 stream: NAL units small enough are aggregated into
+// STAP-A, those too big are fragmented into FU-A.
+type Packetizer struct {
+	PayloadType uint8
+	SSRC        uint32
+	// SequenceNumber is the sequence number of the next packet.
+	SequenceNumber uint16
+	// MTU is the largest RTP packet to make, header included.
+	MTU int
+}
+
+// Packetize returns the packets of an access unit, the last one with the
+// marker bit set.
+func (p *Packetizer) Packetize(au [][]byte, timestamp uint32) ([]*rtp.Packet, error) {
+	maxPayload := p.mtu() - rtp.HeaderSize
+	if maxPayload < 3 {
+		return nil, ErrMTUTooSmall
+	}
+
+	var packets []*rtp.Packet
+	for i := 0; i < len(au); {
+		nalu := au[i]
+		if len(nalu) == 0 {
+			return nil, ErrEmptyNALU
+		}
+		if len(nalu) > maxPayload {
+			packets = append(packets, p.fragment(nalu, maxPayload, timestamp)...)
+			i++
+			continue
+		}
+
+		// take as many of the following NAL units as fit a STAP-A
+		n, size := 1, 1+2+len(nalu)
+		for i+n < len(au) && len(au[i+n]) > 0 && size+2+len(au[i+n]) <= maxPayload {
+			size += 2 + len(au[i+n])
+			n++
+		}
+		if n == 1 {
+			packets = append(packets, p.packet(nalu, timestamp))
+		} else {
+			packets = append(packets, p.packet(aggregate(au[i:i+n], size), timestamp))
+		}
+		i += n
+	}
+
+	if len(packets) > 0 {
+		packets[len(packets)-1].Marker = true
+	}
+	return packets, nil
+}
+
+func (p *Packetizer) mtu() int {
+	if p.MTU > 0 {
+		return p.MTU
+	}
+	return DefaultMTU
+}
+
+func (p *Packetizer) packet(payload []byte, timestamp uint32) *rtp.Packet {
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			PayloadType:    p.PayloadType,
+			SequenceNumber: p.SequenceNumber,
+			Timestamp:      timestamp,
+			SSRC:           p.SSRC,
+		},
+		Payload: payload,
+	}
+	p.SequenceNumber++
+	return packet
+}
+
+// aggregate builds a STAP-A of size bytes. Its F bit is set if any NAL
+// unit has it, its NRI is their highest, RFC 6184 section 5.7.1.
+func aggregate(nalus [][]byte, size int) []byte {
+	payload := make([]byte, 1, size)
+	var header byte
+	for _, nalu := range nalus {
+		header |= nalu[0] & 0x80
+		if nri := nalu[0] & 0x60; nri > header&0x60 {
+			header = header&^0x60 | nri
+		}
+		payload = append(payload, byte(len(nalu)>>8), byte(len(nalu)))
+		payload = append(payload, nalu...)
+	}
+	payload[0] = header | NALUTypeSTAPA
+	return payload
+}
+
+// fragment splits a NAL unit into FU-A, RFC 6184 section 5.8.
+func (p *Packetizer) fragment(nalu []byte, maxPayload int, timestamp uint32) []*rtp.Packet {
+	indicator := nalu[0]&0xE0 | NALUTypeFUA
+	header := nalu[0] & 0x1F
+	data := nalu[1:]
+
+	var packets []*rtp.Packet
+	for start := true; len(data) > 0; start = false {
+		n := len(data)
+		if n > maxPayload-2 {
+			n = maxPayload - 2
+		}
+		fuHeader := header
+		if start {
+			fuHeader |= 0x80
+		}
+		if n == len(data) {
+			fuHeader |= 0x40
+		}
+		payload := make([]byte, 2+n)
+		payload[0] = indicator
+		payload[1] = fuHeader
+		copy(payload[2:], data[:n])
+		packets = append(packets, p.packet(payload, timestamp))
+		data = data[n:]
+	}
+	return packets
+}
@@ -0,0 +1,215 @@
+package h265
+
+import (
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+// MaxAccessUnitSize bounds the access units a Depacketizer builds, so that
+// a broken stream can't make it grow without end.
+const MaxAccessUnitSize = 8 << 20
+
+// AccessUnit is the NAL units of one picture, without start codes.
+type AccessUnit struct {
+	Timestamp uint32
+	NALUs     [][]byte
+}
+
+// Depacketizer reassembles access units from RTP packets, RFC 7798
+// section 4.4. DONL must be set for streams with a sprop-max-don-diff
+// above 0; the decoding order numbers are dropped, as the packets of a
+// single stream are already in decoding order.
+//
+// If VPS, SPS and PPS are set, from ParseFmtp, they are put in front of
+// IRAP pictures that don't carry their own. In-band parameter sets replace
+// them.
+type Depacketizer struct {
+	DONL bool
+	VPS  [][]byte
+	SPS  [][]byte
+	PPS  [][]byte
+
+	nalus     [][]byte
+	size      int
+	timestamp uint32
+	started   bool
+
+	fragment     []byte
+	fragmenting  bool
+	fragmentLost bool
+	lastSeq      uint16
+}
+
+// Decode takes the packets of a stream in sequence order and returns the
+// access unit they complete, at the packet with the marker bit. It returns
+// nil until then. An access unit whose last packet is lost is dropped when
+// the next one starts; a fragmented NAL unit missing a fragment is dropped
+// as well, with ErrFragmentLost.
+func (d *Depacketizer) Decode(packet *rtp.Packet) (*AccessUnit, error) {
+	if d.started && packet.Timestamp != d.timestamp {
+		d.reset()
+	}
+	if !d.started {
+		d.started = true
+		d.timestamp = packet.Timestamp
+	}
+	gap := d.fragmenting && packet.SequenceNumber != d.lastSeq+1
+	d.lastSeq = packet.SequenceNumber
+
+	if err := d.decodePayload(packet.Payload, gap); err != nil {
+		if err == ErrAccessUnitTooBig {
+			d.reset()
+		}
+		return nil, err
+	}
+	if !packet.Marker {
+		return nil, nil
+	}
+
+	au := &AccessUnit{Timestamp: d.timestamp, NALUs: d.withParameterSets(d.nalus)}
+	d.reset()
+	if len(au.NALUs) == 0 {
+		return nil, nil
+	}
+	return au, nil
+}
+
+func (d *Depacketizer) reset() {
+	d.nalus = nil
+	d.size = 0
+	d.started = false
+	d.fragment = nil
+	d.fragmenting = false
+	d.fragmentLost = false
+}
+
+func (d *Depacketizer) decodePayload(payload []byte, gap bool) error {
+	if len(payload) < naluHeaderSize {
+		return ErrEmptyNALU
+	}
+
+	switch NALUType(payload) {
+	case NALUTypeAP:
+		var err error
+		ok := walkAP(payload, d.DONL, func(nalu []byte) {
+			if err == nil {
+				err = d.addNALU(nalu)
+			}
+		})
+		if !ok {
+			return ErrBadAP
+		}
+		return err
+
+	case NALUTypeFU:
+		return d.decodeFU(payload, gap)
+
+	case NALUTypePACI:
+		return ErrUnsupportedNALU
+	}
+
+	if d.DONL {
+		// single NAL unit packet: the DONL follows the header
+		if len(payload) < naluHeaderSize+2 {
+			return ErrEmptyNALU
+		}
+		nalu := make([]byte, 0, len(payload)-2)
+		nalu = append(nalu, payload[:naluHeaderSize]...)
+		return d.addNALU(append(nalu, payload[naluHeaderSize+2:]...))
+	}
+	return d.addNALU(payload)
+}
+
+// decodeFU handles a fragmentation unit, RFC 7798 section 4.4.3.
+func (d *Depacketizer) decodeFU(payload []byte, gap bool) error {
+	if len(payload) < naluHeaderSize+2 {
+		return ErrBadFU
+	}
+	fuHeader := payload[2]
+	start := fuHeader&0x80 != 0
+	end := fuHeader&0x40 != 0
+	data := payload[3:]
+
+	if start {
+		if d.DONL {
+			if len(data) < 2 {
+				return ErrBadFU
+			}
+			data = data[2:]
+		}
+		header := []byte{payload[0]&0x81 | (fuHeader&0x3F)<<1, payload[1]}
+		d.fragment = append(header, data...)
+		d.fragmenting = true
+		d.fragmentLost = false
+	} else {
+		if !d.fragmenting {
+			if d.fragmentLost {
+				// already reported
+				d.fragmentLost = !end
+				return nil
+			}
+			// we missed the start
+			d.fragmentLost = !end
+			return ErrFragmentLost
+		}
+		if gap {
+			d.fragment = nil
+			d.fragmenting = false
+			d.fragmentLost = !end
+			return ErrFragmentLost
+		}
+		d.fragment = append(d.fragment, data...)
+	}
+	if d.size+len(d.fragment) > MaxAccessUnitSize {
+		return ErrAccessUnitTooBig
+	}
+
+	if end {
+		nalu := d.fragment
+		d.fragment = nil
+		d.fragmenting = false
+		return d.addNALU(nalu)
+	}
+	return nil
+}
+
+// addNALU appends a copy of nalu, as packet buffers are often reused.
+func (d *Depacketizer) addNALU(nalu []byte) error {
+	if d.size+len(nalu) > MaxAccessUnitSize {
+		return ErrAccessUnitTooBig
+	}
+	switch NALUType(nalu) {
+	case NALUTypeVPS:
+		d.VPS = [][]byte{append([]byte(nil), nalu...)}
+	case NALUTypeSPS:
+		d.SPS = [][]byte{append([]byte(nil), nalu...)}
+	case NALUTypePPS:
+		d.PPS = [][]byte{append([]byte(nil), nalu...)}
+	}
+	d.nalus = append(d.nalus, append([]byte(nil), nalu...))
+	d.size += len(nalu)
+	return nil
+}
+
+// withParameterSets puts VPS, SPS and PPS in front of an IRAP picture
+// lacking them.
+func (d *Depacketizer) withParameterSets(nalus [][]byte) [][]byte {
+	if !IsKeyframe(nalus) || len(d.VPS) == 0 || len(d.SPS) == 0 || len(d.PPS) == 0 {
+		return nalus
+	}
+	for _, nalu := range nalus {
+		if NALUType(nalu) == NALUTypeVPS {
+			return nalus
+		}
+	}
+
+	// after the access unit delimiter, if any
+	i := 0
+	if NALUType(nalus[0]) == NALUTypeAUD {
+		i = 1
+	}
+	au := append([][]byte(nil), nalus[:i]...)
+	au = append(au, d.VPS...)
+	au = append(au, d.SPS...)
+	au = append(au, d.PPS...)
+	return append(au, nalus[i:]...)
+}
@@ -0,0 +1,212 @@
+// Package h265 carries H.265/HEVC video over RTP, RFC 7798: it reassembles
+// access units from single NAL unit, aggregation and fragmentation unit
+// packets, with or without decoding order numbers, splits them back into
+// packets, and reads the parameters of "a=fmtp:".
+package h265
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// NAL unit types, H.265 table 7-1 and RFC 7798 section 4.4.
+const (
+	NALUTypeTrailN   = 0
+	NALUTypeTrailR   = 1
+	NALUTypeBLAWLP   = 16
+	NALUTypeBLAWRADL = 17
+	NALUTypeBLANLP   = 18
+	NALUTypeIDRWRADL = 19
+	NALUTypeIDRNLP   = 20
+	NALUTypeCRA      = 21
+	NALUTypeVPS      = 32
+	NALUTypeSPS      = 33
+	NALUTypePPS      = 34
+	NALUTypeAUD      = 35
+	NALUTypeSEI      = 39
+
+	NALUTypeAP   = 48
+	NALUTypeFU   = 49
+	NALUTypePACI = 50
+
+	// IRAP pictures, which a decoder can start from, are types 16 to 23.
+	irapFirst = 16
+	irapLast  = 23
+
+	naluHeaderSize = 2
+)
+
+var (
+	ErrEmptyNALU        = errors.New("h265: empty NAL unit")
+	ErrBadAP            = errors.New("h265: malformed aggregation packet")
+	ErrBadFU            = errors.New("h265: malformed fragmentation unit")
+	ErrFragmentLost     = errors.New("h265: fragmentation unit lost")
+	ErrUnsupportedNALU  = errors.New("h265: unsupported NAL unit type")
+	ErrAccessUnitTooBig = errors.New("h265: access unit too big")
+	ErrBadParameterSets = errors.New("h265: malformed sprop-vps, sprop-sps or sprop-pps")
+	ErrBadMaxDONDiff    = errors.New("h265: malformed sprop-max-don-diff")
+	ErrMTUTooSmall      = errors.New("h265: MTU too small")
+)
+
+// NALUType returns the type of a NAL unit, from its header.
+func NALUType(nalu []byte) uint8 {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return nalu[0] >> 1 & 0x3F
+}
+
+// IsIRAP reports whether a NAL unit type is an IRAP picture: a BLA, IDR or
+// CRA.
+func IsIRAP(naluType uint8) bool {
+	return naluType >= irapFirst && naluType <= irapLast
+}
+
+// IsKeyframe reports whether an access unit holds an IRAP picture.
+func IsKeyframe(au [][]byte) bool {
+	for _, nalu := range au {
+		if IsIRAP(NALUType(nalu)) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRandomAccess reports whether a RTP payload starts an access unit a
+// decoder can start from: an IRAP picture or the VPS in front of one. donl
+// tells whether the stream carries decoding order numbers, which changes
+// the layout of aggregation packets.
+func IsRandomAccess(payload []byte, donl bool) bool {
+	switch naluType := NALUType(payload); {
+	case IsIRAP(naluType) || naluType == NALUTypeVPS:
+		return true
+	case naluType == NALUTypeAP:
+		random := false
+		walkAP(payload, donl, func(nalu []byte) {
+			if t := NALUType(nalu); IsIRAP(t) || t == NALUTypeVPS {
+				random = true
+			}
+		})
+		return random
+	case naluType == NALUTypeFU:
+		// the start fragment of an IRAP picture
+		return len(payload) >= 3 && payload[2]&0x80 != 0 && IsIRAP(payload[2]&0x3F)
+	}
+	return false
+}
+
+// walkAP calls fn for each NAL unit of an aggregation packet, RFC 7798
+// section 4.4.2, and reports whether it is well formed.
+func walkAP(payload []byte, donl bool, fn func(nalu []byte)) bool {
+	if len(payload) <= naluHeaderSize {
+		return false
+	}
+	buf := payload[naluHeaderSize:]
+	for first := true; len(buf) > 0; first = false {
+		if donl {
+			// DONL before the first NAL unit, DOND before the others
+			n := 1
+			if first {
+				n = 2
+			}
+			if len(buf) < n {
+				return false
+			}
+			buf = buf[n:]
+		}
+		if len(buf) < 2 {
+			return false
+		}
+		size := int(buf[0])<<8 | int(buf[1])
+		if size < naluHeaderSize || len(buf) < 2+size {
+			return false
+		}
+		fn(buf[2 : 2+size])
+		buf = buf[2+size:]
+	}
+	return true
+}
+
+// Params are the "a=fmtp:" parameters of a H.265 stream, RFC 7798 section 7.1.
+type Params struct {
+	ProfileID int
+	LevelID   int
+	// MaxDONDiff is sprop-max-don-diff. When it isn't 0, packets carry
+	// decoding order numbers.
+	MaxDONDiff int
+	VPS        [][]byte
+	SPS        [][]byte
+	PPS        [][]byte
+}
+
+// UsesDONL reports whether the packets of the stream carry DONL fields.
+func (p *Params) UsesDONL() bool {
+	return p.MaxDONDiff > 0
+}
+
+// ParseFmtp reads the value of a "a=fmtp:" attribute, with or without its
+// leading payload type, e.g.
+// "96 profile-id=1;sprop-vps=QAEMAf//AWAAAAMAAAMAAAMAAAMAlqwJ;sprop-sps=...;sprop-pps=...".
+// Parameters it doesn't know are ignored.
+func ParseFmtp(fmtp string) (*Params, error) {
+	if i := strings.IndexByte(fmtp, ' '); i >= 0 && !strings.Contains(fmtp[:i], "=") {
+		fmtp = fmtp[i+1:]
+	}
+
+	params := &Params{}
+	for _, param := range strings.Split(fmtp, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.TrimSpace(value)
+		var err error
+		switch strings.ToLower(name) {
+		case "profile-id":
+			params.ProfileID, _ = strconv.Atoi(value)
+		case "level-id":
+			params.LevelID, _ = strconv.Atoi(value)
+		case "sprop-max-don-diff":
+			params.MaxDONDiff, err = strconv.Atoi(value)
+			if err != nil || params.MaxDONDiff < 0 || params.MaxDONDiff > 32767 {
+				return nil, ErrBadMaxDONDiff
+			}
+		case "sprop-vps":
+			params.VPS, err = parseParameterSets(value, NALUTypeVPS)
+		case "sprop-sps":
+			params.SPS, err = parseParameterSets(value, NALUTypeSPS)
+		case "sprop-pps":
+			params.PPS, err = parseParameterSets(value, NALUTypePPS)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+// parseParameterSets decodes the base64 NAL units of a sprop-vps,
+// sprop-sps or sprop-pps, which must all be of naluType.
+func parseParameterSets(value string, naluType uint8) ([][]byte, error) {
+	var sets [][]byte
+	for _, set := range strings.Split(value, ",") {
+		if set == "" {
+			continue
+		}
+		nalu, err := base64.StdEncoding.DecodeString(set)
+		if err != nil || len(nalu) < naluHeaderSize || NALUType(nalu) != naluType {
+			return nil, ErrBadParameterSets
+		}
+		sets = append(sets, nalu)
+	}
+	return sets, nil
+}
+
+// SpropParameterSet encodes parameter sets for sprop-vps, sprop-sps or
+// sprop-pps.
+func SpropParameterSet(nalus [][]byte) string {
+	var sets []string
+	for _, nalu := range nalus {
+		sets = append(sets, base64.StdEncoding.EncodeToString(nalu))
+	}
+	return strings.Join(sets, ",")
+}
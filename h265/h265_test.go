@@ -0,0 +1,175 @@
+package h265
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+const (
+	testVPS = "QAEMAf//AWAAAAMAkAAAAwAAAwBdlZgJ"
+	testSPS = "QgEBAWAAAAMAkAAAAwAAAwBdoAKAgC0WWVmkkyvAQEAAAAMAQAAABkI="
+	testPPS = "RAHBcrRiQA=="
+)
+
+func TestParseFmtp(t *testing.T) {
+	params, err := ParseFmtp("96 profile-id=1; sprop-max-don-diff=2;sprop-vps=" + testVPS +
+		";sprop-sps=" + testSPS + ";sprop-pps=" + testPPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.ProfileID != 1 || params.MaxDONDiff != 2 || !params.UsesDONL() {
+		t.Errorf("params = %+v", params)
+	}
+	for _, set := range []struct {
+		nalus    [][]byte
+		naluType uint8
+		sprop    string
+	}{
+		{params.VPS, NALUTypeVPS, testVPS},
+		{params.SPS, NALUTypeSPS, testSPS},
+		{params.PPS, NALUTypePPS, testPPS},
+	} {
+		if len(set.nalus) != 1 || NALUType(set.nalus[0]) != set.naluType {
+			t.Errorf("parameter sets %x, want one of type %d", set.nalus, set.naluType)
+		}
+		if got := SpropParameterSet(set.nalus); got != set.sprop {
+			t.Errorf("SpropParameterSet() = %q, want %q", got, set.sprop)
+		}
+	}
+
+	for _, fmtp := range []string{"96 sprop-vps=" + testSPS, "96 sprop-pps=!!", "96 sprop-max-don-diff=-1"} {
+		if _, err := ParseFmtp(fmtp); err == nil {
+			t.Errorf("ParseFmtp(%q) succeeded", fmtp)
+		}
+	}
+}
+
+func testAccessUnit() [][]byte {
+	params, _ := ParseFmtp("sprop-vps=" + testVPS + ";sprop-sps=" + testSPS + ";sprop-pps=" + testPPS)
+	idr := make([]byte, 4000)
+	idr[0], idr[1] = NALUTypeIDRWRADL<<1, 1
+	for i := 2; i < len(idr); i++ {
+		idr[i] = byte(i)
+	}
+	return [][]byte{
+		{NALUTypeAUD << 1, 1, 0x50},
+		params.VPS[0],
+		params.SPS[0],
+		params.PPS[0],
+		idr,
+		{NALUTypeSEI << 1, 1, 5, 1, 0x80},
+	}
+}
+
+func TestPacketizeRoundTrip(t *testing.T) {
+	for _, donl := range []bool{false, true} {
+		au := testAccessUnit()
+		p := &Packetizer{PayloadType: 96, SequenceNumber: 100, MTU: 1200, DONL: donl, DON: 65535}
+		packets, err := p.Packetize(au, 9000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var types []uint8
+		for i, packet := range packets {
+			if size := packet.MarshalSize(); size > 1200 {
+				t.Errorf("donl=%v: packet %d is %d bytes", donl, i, size)
+			}
+			if packet.Marker != (i == len(packets)-1) {
+				t.Errorf("donl=%v: packet %d: marker = %v", donl, i, packet.Marker)
+			}
+			types = append(types, NALUType(packet.Payload))
+		}
+		// AUD and parameter sets in an AP, the IDR in four FUs, the SEI alone
+		want := []uint8{NALUTypeAP, NALUTypeFU, NALUTypeFU, NALUTypeFU, NALUTypeFU, NALUTypeSEI}
+		if !reflect.DeepEqual(types, want) {
+			t.Errorf("donl=%v: packet types = %v, want %v", donl, types, want)
+		}
+		if !IsRandomAccess(packets[0].Payload, donl) || !IsRandomAccess(packets[1].Payload, donl) ||
+			IsRandomAccess(packets[2].Payload, donl) {
+			t.Errorf("donl=%v: IsRandomAccess() wrong on AP or FU", donl)
+		}
+		if p.DON != uint16(65535+len(au)) {
+			t.Errorf("donl=%v: DON = %d after %d NAL units", donl, p.DON, len(au))
+		}
+		if donl && (packets[0].Payload[2] != 0xFF || packets[0].Payload[3] != 0xFF) {
+			t.Errorf("AP starts with DONL %x, want ffff", packets[0].Payload[2:4])
+		}
+
+		d := &Depacketizer{DONL: donl}
+		var got *AccessUnit
+		for _, packet := range packets {
+			data, _ := packet.Marshal()
+			var received rtp.Packet
+			received.Unmarshal(data)
+			if got, err = d.Decode(&received); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got == nil || got.Timestamp != 9000 || !reflect.DeepEqual(got.NALUs, au) {
+			t.Errorf("donl=%v: Decode() = %+v", donl, got)
+		}
+	}
+}
+
+func TestDepacketizer(t *testing.T) {
+	params, _ := ParseFmtp("sprop-vps=" + testVPS + ";sprop-sps=" + testSPS + ";sprop-pps=" + testPPS)
+	d := &Depacketizer{VPS: params.VPS, SPS: params.SPS, PPS: params.PPS}
+
+	cra := []byte{NALUTypeCRA << 1, 1, 0xAF}
+	au, err := d.Decode(&rtp.Packet{Header: rtp.Header{Marker: true}, Payload: cra})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{params.VPS[0], params.SPS[0], params.PPS[0], cra}
+	if au == nil || !IsKeyframe(au.NALUs) || !reflect.DeepEqual(au.NALUs, want) {
+		t.Errorf("keyframe = %x, want %x", au, want)
+	}
+
+	// a FU with a lost fragment
+	p := &Packetizer{MTU: 100}
+	packets, _ := p.Packetize([][]byte{make([]byte, 300)}, 3000)
+	packets = append(packets[:1], packets[2:]...)
+	var errs []error
+	for _, packet := range packets {
+		if au, err := d.Decode(packet); err != nil {
+			errs = append(errs, err)
+		} else if au != nil {
+			t.Errorf("access unit %x from a broken FU", au.NALUs)
+		}
+	}
+	if len(errs) != 1 || errs[0] != ErrFragmentLost {
+		t.Errorf("errors = %v, want one %v", errs, ErrFragmentLost)
+	}
+
+	for _, payload := range [][]byte{{0x01}, {NALUTypeAP << 1, 1, 0, 5, 1}, {NALUTypeFU << 1, 1}, {NALUTypePACI << 1, 1, 0}} {
+		if _, err := d.Decode(&rtp.Packet{Payload: payload}); err == nil {
+			t.Errorf("Decode(%x) succeeded", payload)
+		}
+	}
+}
+
+func TestIsRandomAccessShortPayload(t *testing.T) {
+	for _, payload := range [][]byte{{0x60}, {0x61}, {NALUTypeAP << 1, 1}, {NALUTypeFU << 1}} {
+		for _, donl := range []bool{false, true} {
+			if IsRandomAccess(payload, donl) {
+				t.Errorf("IsRandomAccess(%x, %v) = true", payload, donl)
+			}
+		}
+	}
+}
+
+func FuzzIsRandomAccess(f *testing.F) {
+	f.Add([]byte("00a"), false)
+	f.Add([]byte{0x60}, false)
+	f.Add([]byte{NALUTypeAP << 1, 1, 0xFF, 0xFF, 0, 3, NALUTypeVPS << 1, 1, 0}, true)
+	f.Add([]byte{NALUTypeFU << 1, 1, 0x80 | NALUTypeCRA}, false)
+
+	f.Fuzz(func(t *testing.T, payload []byte, donl bool) {
+		IsRandomAccess(payload, donl)
+		d := &Depacketizer{DONL: donl}
+		d.Decode(&rtp.Packet{Header: rtp.Header{Marker: true}, Payload: payload})
+	})
+}
@@ -0,0 +1,188 @@
+package h265
+
+import (
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+// DefaultMTU is the size of the RTP packets a Packetizer makes when its
+// MTU isn't set, leaving room for IP, UDP and tunnel headers.
+const DefaultMTU = 1400
+
+// Packetizer splits access units into RTP packets: NAL units small enough
+// are aggregated into APs, those too big are fragmented into FUs.
+type Packetizer struct {
+	PayloadType uint8
+	SSRC        uint32
+	// SequenceNumber is the sequence number of the next packet.
+	SequenceNumber uint16
+	// MTU is the largest RTP packet to make, header included.
+	MTU int
+	// DONL adds decoding order numbers, for a stream described with a
+	// sprop-max-don-diff above 0. DON is that of the next NAL unit.
+	DONL bool
+	DON  uint16
+}
+
+// Packetize returns the packets of an access unit, the last one with the
+// marker bit set.
+func (p *Packetizer) Packetize(au [][]byte, timestamp uint32) ([]*rtp.Packet, error) {
+	maxPayload := p.mtu() - rtp.HeaderSize
+	if maxPayload < naluHeaderSize+1+p.donlSize()+1 {
+		return nil, ErrMTUTooSmall
+	}
+
+	var packets []*rtp.Packet
+	for i := 0; i < len(au); {
+		nalu := au[i]
+		if len(nalu) < naluHeaderSize {
+			return nil, ErrEmptyNALU
+		}
+		if p.donlSize()+len(nalu) > maxPayload {
+			packets = append(packets, p.fragment(nalu, maxPayload, timestamp)...)
+			i++
+			continue
+		}
+
+		// take as many of the following NAL units as fit an AP
+		n, size := 1, naluHeaderSize+p.donlSize()+2+len(nalu)
+		for i+n < len(au) && len(au[i+n]) >= naluHeaderSize {
+			next := size + 2 + len(au[i+n])
+			if p.DONL {
+				next++
+			}
+			if next > maxPayload {
+				break
+			}
+			size = next
+			n++
+		}
+		if n == 1 {
+			packets = append(packets, p.packet(p.single(nalu), timestamp))
+		} else {
+			packets = append(packets, p.packet(p.aggregate(au[i:i+n], size), timestamp))
+		}
+		i += n
+	}
+
+	if len(packets) > 0 {
+		packets[len(packets)-1].Marker = true
+	}
+	return packets, nil
+}
+
+func (p *Packetizer) mtu() int {
+	if p.MTU > 0 {
+		return p.MTU
+	}
+	return DefaultMTU
+}
+
+func (p *Packetizer) donlSize() int {
+	if p.DONL {
+		return 2
+	}
+	return 0
+}
+
+// appendDONL appends the DONL of the next NAL unit, if DONL is set.
+func (p *Packetizer) appendDONL(payload []byte) []byte {
+	if !p.DONL {
+		return payload
+	}
+	return append(payload, byte(p.DON>>8), byte(p.DON))
+}
+
+func (p *Packetizer) packet(payload []byte, timestamp uint32) *rtp.Packet {
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			PayloadType:    p.PayloadType,
+			SequenceNumber: p.SequenceNumber,
+			Timestamp:      timestamp,
+			SSRC:           p.SSRC,
+		},
+		Payload: payload,
+	}
+	p.SequenceNumber++
+	return packet
+}
+
+// single builds a single NAL unit packet, RFC 7798 section 4.4.1.
+func (p *Packetizer) single(nalu []byte) []byte {
+	if !p.DONL {
+		p.DON++
+		return nalu
+	}
+	payload := make([]byte, 0, len(nalu)+2)
+	payload = append(payload, nalu[:naluHeaderSize]...)
+	payload = p.appendDONL(payload)
+	p.DON++
+	return append(payload, nalu[naluHeaderSize:]...)
+}
+
+// aggregate builds an AP of size bytes, RFC 7798 section 4.4.2. Its F bit
+// is set if any NAL unit has it, its LayerId and TID are their lowest.
+func (p *Packetizer) aggregate(nalus [][]byte, size int) []byte {
+	payload := make([]byte, naluHeaderSize, size)
+	var forbidden byte
+	layerID, tid := byte(0x3F), byte(0x07)
+	for i, nalu := range nalus {
+		forbidden |= nalu[0] & 0x80
+		if l := (nalu[0]&0x01)<<5 | nalu[1]>>3; l < layerID {
+			layerID = l
+		}
+		if t := nalu[1] & 0x07; t < tid {
+			tid = t
+		}
+
+		if i == 0 {
+			payload = p.appendDONL(payload)
+		} else if p.DONL {
+			// DOND: the DON of this NAL unit minus that of the previous one, minus 1
+			payload = append(payload, 0)
+		}
+		p.DON++
+		payload = append(payload, byte(len(nalu)>>8), byte(len(nalu)))
+		payload = append(payload, nalu...)
+	}
+	payload[0] = forbidden | NALUTypeAP<<1 | layerID>>5
+	payload[1] = layerID<<3 | tid
+	return payload
+}
+
+// fragment splits a NAL unit into FUs, RFC 7798 section 4.4.3.
+func (p *Packetizer) fragment(nalu []byte, maxPayload int, timestamp uint32) []*rtp.Packet {
+	payloadHeader := []byte{nalu[0]&0x81 | NALUTypeFU<<1, nalu[1]}
+	naluType := NALUType(nalu)
+	data := nalu[naluHeaderSize:]
+
+	var packets []*rtp.Packet
+	for start := true; len(data) > 0; start = false {
+		room := maxPayload - naluHeaderSize - 1
+		if start {
+			room -= p.donlSize()
+		}
+		n := len(data)
+		if n > room {
+			n = room
+		}
+
+		fuHeader := naluType
+		if start {
+			fuHeader |= 0x80
+		}
+		if n == len(data) {
+			fuHeader |= 0x40
+		}
+		payload := make([]byte, 0, naluHeaderSize+1+p.donlSize()+n)
+		payload = append(payload, payloadHeader...)
+		payload = append(payload, fuHeader)
+		if start {
+			payload = p.appendDONL(payload)
+		}
+		payload = append(payload, data[:n]...)
+		packets = append(packets, p.packet(payload, timestamp))
+		data = data[n:]
+	}
+	p.DON++
+	return packets
+}
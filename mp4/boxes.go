@@ -0,0 +1,587 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// forEachBox calls fn with the type and body of every box in buf.
+func forEachBox(buf []byte, fn func(boxType string, body []byte) error) error {
+	for len(buf) > 0 {
+		if len(buf) < 8 {
+			return ErrBadBox
+		}
+		size := uint64(binary.BigEndian.Uint32(buf))
+		boxType := string(buf[4:8])
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(buf))
+		case 1:
+			if len(buf) < 16 {
+				return ErrBadBox
+			}
+			size = binary.BigEndian.Uint64(buf[8:])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(buf)) {
+			return ErrBadBox
+		}
+		if err := fn(boxType, buf[headerSize:size]); err != nil {
+			return err
+		}
+		buf = buf[size:]
+	}
+	return nil
+}
+
+// findBox returns the body of the first box of a type in buf, or nil.
+func findBox(buf []byte, boxType string) []byte {
+	var found []byte
+	forEachBox(buf, func(t string, body []byte) error {
+		if found == nil && t == boxType {
+			found = body
+		}
+		return nil
+	})
+	return found
+}
+
+// fullBox returns the version of a full box and what follows its flags.
+func fullBox(body []byte) (version byte, rest []byte, err error) {
+	if len(body) < 4 {
+		return 0, nil, ErrBadBox
+	}
+	return body[0], body[4:], nil
+}
+
+// parseTimes reads the timescale and duration of a "mvhd" or "mdhd" box.
+func parseTimes(body []byte) (timescale uint32, duration uint64, err error) {
+	version, body, err := fullBox(body)
+	if err != nil {
+		return 0, 0, err
+	}
+	if version == 1 {
+		if len(body) < 28 {
+			return 0, 0, ErrBadBox
+		}
+		return binary.BigEndian.Uint32(body[16:]), binary.BigEndian.Uint64(body[20:]), nil
+	}
+	if len(body) < 16 {
+		return 0, 0, ErrBadBox
+	}
+	duration = uint64(binary.BigEndian.Uint32(body[12:]))
+	if duration == 0xFFFFFFFF {
+		duration = 0
+	}
+	return binary.BigEndian.Uint32(body[8:]), duration, nil
+}
+
+func parseMovie(moov []byte) (*File, error) {
+	f := &File{}
+	err := forEachBox(moov, func(boxType string, body []byte) error {
+		switch boxType {
+		case "mvhd":
+			timescale, duration, err := parseTimes(body)
+			if err != nil {
+				return err
+			}
+			if timescale > 0 {
+				f.Duration = (&Track{Timescale: timescale}).Time(duration)
+			}
+		case "trak":
+			track, err := parseTrack(body)
+			if err != nil {
+				return err
+			}
+			if track != nil {
+				f.Tracks = append(f.Tracks, track)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Tracks) == 0 {
+		return nil, ErrNoTracks
+	}
+	for _, track := range f.Tracks {
+		if track.Duration > f.Duration {
+			f.Duration = track.Duration
+		}
+	}
+	return f, nil
+}
+
+// parseTrack reads a "trak" box. It returns nil for a track of a format
+// that isn't supported, or without samples.
+func parseTrack(trak []byte) (*Track, error) {
+	t := &Track{}
+	if tkhd := findBox(trak, "tkhd"); tkhd != nil {
+		version, body, err := fullBox(tkhd)
+		if err != nil {
+			return nil, err
+		}
+		idOffset := 8
+		if version == 1 {
+			idOffset = 16
+		}
+		if len(body) < idOffset+4 {
+			return nil, ErrBadBox
+		}
+		t.ID = binary.BigEndian.Uint32(body[idOffset:])
+	}
+
+	mdia := findBox(trak, "mdia")
+	mdhd := findBox(mdia, "mdhd")
+	hdlr := findBox(mdia, "hdlr")
+	stbl := findBox(findBox(mdia, "minf"), "stbl")
+	if mdhd == nil || hdlr == nil || stbl == nil {
+		return nil, ErrBadBox
+	}
+	timescale, duration, err := parseTimes(mdhd)
+	if err != nil {
+		return nil, err
+	}
+	if timescale == 0 {
+		return nil, ErrBadBox
+	}
+	t.Timescale = timescale
+	t.Duration = t.Time(duration)
+	if len(hdlr) < 12 {
+		return nil, ErrBadBox
+	}
+	t.Handler = string(hdlr[8:12])
+
+	supported, err := t.parseSampleDescription(findBox(stbl, "stsd"))
+	if err != nil || !supported {
+		return nil, err
+	}
+	if err := t.parseSampleTables(stbl); err != nil {
+		return nil, err
+	}
+	if len(t.Samples) == 0 {
+		return nil, nil
+	}
+	if t.Duration == 0 {
+		t.Duration = t.trackDuration()
+	}
+	return t, nil
+}
+
+// parseSampleDescription reads the first sample entry of a "stsd" box,
+// reporting whether it is of a supported format.
+func (t *Track) parseSampleDescription(stsd []byte) (bool, error) {
+	_, body, err := fullBox(stsd)
+	if err != nil {
+		return false, err
+	}
+	if len(body) < 4 || binary.BigEndian.Uint32(body) == 0 {
+		return false, ErrBadBox
+	}
+	var entry []byte
+	err = forEachBox(body[4:], func(boxType string, body []byte) error {
+		if entry == nil {
+			t.Format, entry = boxType, body
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	switch t.Format {
+	case FormatAVC1, FormatAVC3, FormatHVC1, FormatHEV1:
+		// the VisualSampleEntry fields come before the boxes
+		if len(entry) < 78 {
+			return false, ErrBadBox
+		}
+		t.Width = int(binary.BigEndian.Uint16(entry[24:]))
+		t.Height = int(binary.BigEndian.Uint16(entry[26:]))
+		if t.Format == FormatAVC1 || t.Format == FormatAVC3 {
+			return true, t.parseAVCConfig(findBox(entry[78:], "avcC"))
+		}
+		return true, t.parseHEVCConfig(findBox(entry[78:], "hvcC"))
+	case FormatMP4A:
+		// the AudioSampleEntry fields, which QuickTime sound
+		// descriptions of version 1 and 2 extend
+		if len(entry) < 28 {
+			return false, ErrBadBox
+		}
+		t.ChannelCount = int(binary.BigEndian.Uint16(entry[16:]))
+		t.SampleRate = int(binary.BigEndian.Uint32(entry[24:]) >> 16)
+		boxes := entry[28:]
+		switch binary.BigEndian.Uint16(entry[8:]) {
+		case 1:
+			boxes = skip(boxes, 16)
+		case 2:
+			boxes = skip(boxes, 36)
+		}
+		return true, t.parseESDS(findBox(boxes, "esds"))
+	}
+	return false, nil
+}
+
+// parseAVCConfig reads an AVCDecoderConfigurationRecord, ISO/IEC 14496-15
+// section 5.3.3.1.
+func (t *Track) parseAVCConfig(avcC []byte) error {
+	if len(avcC) < 6 {
+		return ErrBadBox
+	}
+	t.NALULengthSize = int(avcC[4]&0x03) + 1
+	buf := avcC[5:]
+	for _, sets := range []*[][]byte{&t.SPS, &t.PPS} {
+		if len(buf) < 1 {
+			return ErrBadBox
+		}
+		count := int(buf[0])
+		if sets == &t.SPS {
+			count &= 0x1F
+		}
+		buf = buf[1:]
+		for i := 0; i < count; i++ {
+			var nalu []byte
+			var err error
+			if nalu, buf, err = readParameterSet(buf); err != nil {
+				return err
+			}
+			*sets = append(*sets, nalu)
+		}
+	}
+	return nil
+}
+
+// parseHEVCConfig reads a HEVCDecoderConfigurationRecord, ISO/IEC 14496-15
+// section 8.3.3.1.
+func (t *Track) parseHEVCConfig(hvcC []byte) error {
+	if len(hvcC) < 23 {
+		return ErrBadBox
+	}
+	t.NALULengthSize = int(hvcC[21]&0x03) + 1
+	buf := hvcC[23:]
+	for arrays := int(hvcC[22]); arrays > 0; arrays-- {
+		if len(buf) < 3 {
+			return ErrBadBox
+		}
+		naluType := buf[0] & 0x3F
+		count := int(binary.BigEndian.Uint16(buf[1:]))
+		buf = buf[3:]
+		for i := 0; i < count; i++ {
+			var nalu []byte
+			var err error
+			if nalu, buf, err = readParameterSet(buf); err != nil {
+				return err
+			}
+			switch naluType {
+			case 32:
+				t.VPS = append(t.VPS, nalu)
+			case 33:
+				t.SPS = append(t.SPS, nalu)
+			case 34:
+				t.PPS = append(t.PPS, nalu)
+			}
+		}
+	}
+	return nil
+}
+
+func readParameterSet(buf []byte) (nalu, rest []byte, err error) {
+	if len(buf) < 2 {
+		return nil, nil, ErrBadBox
+	}
+	length := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+length || length == 0 {
+		return nil, nil, ErrBadBox
+	}
+	return buf[2 : 2+length], buf[2+length:], nil
+}
+
+// parseESDS finds the AudioSpecificConfig in the ES_Descriptor of an
+// "esds" box, ISO/IEC 14496-1 section 7.2.6.5.
+func (t *Track) parseESDS(esds []byte) error {
+	_, body, err := fullBox(esds)
+	if err != nil {
+		return err
+	}
+	tag, es, _, err := readDescriptor(body)
+	if err != nil || tag != 0x03 || len(es) < 3 {
+		return ErrBadBox
+	}
+	flags := es[2]
+	es = es[3:]
+	if flags&0x80 != 0 {
+		es = skip(es, 2)
+	}
+	if flags&0x40 != 0 && len(es) > 0 {
+		es = skip(es, 1+int(es[0]))
+	}
+	if flags&0x20 != 0 {
+		es = skip(es, 2)
+	}
+
+	for len(es) > 0 {
+		tag, decoderConfig, rest, err := readDescriptor(es)
+		if err != nil {
+			return err
+		}
+		es = rest
+		if tag != 0x04 {
+			continue
+		}
+		// objectTypeIndication, streamType, bufferSizeDB, maxBitrate and
+		// avgBitrate come before the DecoderSpecificInfo
+		for buf := skip(decoderConfig, 13); len(buf) > 0; {
+			tag, info, rest, err := readDescriptor(buf)
+			if err != nil {
+				return err
+			}
+			if tag == 0x05 {
+				t.AudioConfig = info
+				return nil
+			}
+			buf = rest
+		}
+	}
+	return ErrBadBox
+}
+
+// readDescriptor reads the tag and body of a descriptor, whose size takes
+// 7 bits of up to 4 bytes.
+func readDescriptor(buf []byte) (tag byte, body, rest []byte, err error) {
+	if len(buf) < 2 {
+		return 0, nil, nil, ErrBadBox
+	}
+	tag = buf[0]
+	size := 0
+	i := 1
+	for ; i < len(buf) && i <= 4; i++ {
+		size = size<<7 | int(buf[i]&0x7F)
+		if buf[i]&0x80 == 0 {
+			break
+		}
+	}
+	if i >= len(buf) || i > 4 || size > len(buf)-i-1 {
+		return 0, nil, nil, ErrBadBox
+	}
+	return tag, buf[i+1 : i+1+size], buf[i+1+size:], nil
+}
+
+func skip(buf []byte, n int) []byte {
+	if n > len(buf) {
+		return nil
+	}
+	return buf[n:]
+}
+
+// parseSampleTables builds the samples of the track from the boxes of its
+// "stbl": sizes, chunk offsets and the sample to chunk map place them in
+// the file, the time to sample and composition offset tables time them.
+func (t *Track) parseSampleTables(stbl []byte) error {
+	sizes, err := parseSampleSizes(stbl)
+	if err != nil {
+		return err
+	}
+	chunkOffsets, err := parseChunkOffsets(stbl)
+	if err != nil {
+		return err
+	}
+	t.Samples = make([]Sample, len(sizes))
+	for i, size := range sizes {
+		t.Samples[i].Size = size
+	}
+
+	// sample to chunk: runs of chunks with the same number of samples
+	entries, err := tableEntries(findBox(stbl, "stsc"), 12)
+	if err != nil {
+		return err
+	}
+	sample := 0
+	for i, entry := range entries {
+		firstChunk := int(binary.BigEndian.Uint32(entry))
+		samplesPerChunk := int(binary.BigEndian.Uint32(entry[4:]))
+		lastChunk := len(chunkOffsets)
+		if i+1 < len(entries) {
+			lastChunk = int(binary.BigEndian.Uint32(entries[i+1])) - 1
+		}
+		if firstChunk < 1 || lastChunk > len(chunkOffsets) {
+			return ErrBadBox
+		}
+		for chunk := firstChunk; chunk <= lastChunk; chunk++ {
+			offset := chunkOffsets[chunk-1]
+			for j := 0; j < samplesPerChunk && sample < len(t.Samples); j++ {
+				t.Samples[sample].Offset = offset
+				offset += int64(t.Samples[sample].Size)
+				sample++
+			}
+		}
+	}
+	if sample < len(t.Samples) {
+		return ErrBadBox
+	}
+
+	// time to sample: runs of samples with the same duration
+	entries, err = tableEntries(findBox(stbl, "stts"), 8)
+	if err != nil {
+		return err
+	}
+	var decodeTime uint64
+	sample = 0
+	for _, entry := range entries {
+		count := binary.BigEndian.Uint32(entry)
+		delta := binary.BigEndian.Uint32(entry[4:])
+		for ; count > 0 && sample < len(t.Samples); count-- {
+			t.Samples[sample].DecodeTime = decodeTime
+			t.Samples[sample].Duration = delta
+			decodeTime += uint64(delta)
+			sample++
+		}
+	}
+	for ; sample < len(t.Samples); sample++ {
+		t.Samples[sample].DecodeTime = decodeTime
+	}
+
+	if ctts := findBox(stbl, "ctts"); ctts != nil {
+		entries, err := tableEntries(ctts, 8)
+		if err != nil {
+			return err
+		}
+		sample = 0
+		for _, entry := range entries {
+			count := binary.BigEndian.Uint32(entry)
+			offset := int32(binary.BigEndian.Uint32(entry[4:]))
+			for ; count > 0 && sample < len(t.Samples); count-- {
+				t.Samples[sample].CompositionOffset = offset
+				sample++
+			}
+		}
+	}
+
+	// without a sync sample table every sample is one
+	stss := findBox(stbl, "stss")
+	if stss == nil {
+		for i := range t.Samples {
+			t.Samples[i].IsSync = true
+		}
+		return nil
+	}
+	entries, err = tableEntries(stss, 4)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if n := int(binary.BigEndian.Uint32(entry)); n >= 1 && n <= len(t.Samples) {
+			t.Samples[n-1].IsSync = true
+		}
+	}
+	return nil
+}
+
+// tableEntries splits the body of a full box made of an entry count and
+// entries of entrySize bytes.
+func tableEntries(box []byte, entrySize int) ([][]byte, error) {
+	_, body, err := fullBox(box)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 4 {
+		return nil, ErrBadBox
+	}
+	count := binary.BigEndian.Uint32(body)
+	body = body[4:]
+	if uint64(count)*uint64(entrySize) > uint64(len(body)) {
+		return nil, ErrBadBox
+	}
+	entries := make([][]byte, count)
+	for i := range entries {
+		entries[i] = body[i*entrySize : (i+1)*entrySize]
+	}
+	return entries, nil
+}
+
+// parseSampleSizes reads the "stsz" or compact "stz2" box.
+func parseSampleSizes(stbl []byte) ([]uint32, error) {
+	if stsz := findBox(stbl, "stsz"); stsz != nil {
+		_, body, err := fullBox(stsz)
+		if err != nil {
+			return nil, err
+		}
+		if len(body) < 8 {
+			return nil, ErrBadBox
+		}
+		sampleSize := binary.BigEndian.Uint32(body)
+		count := binary.BigEndian.Uint32(body[4:])
+		body = body[8:]
+		if sampleSize == 0 && uint64(count)*4 > uint64(len(body)) || count > maxMovieSize {
+			return nil, ErrBadBox
+		}
+		sizes := make([]uint32, count)
+		for i := range sizes {
+			if sampleSize != 0 {
+				sizes[i] = sampleSize
+			} else {
+				sizes[i] = binary.BigEndian.Uint32(body[4*i:])
+			}
+		}
+		return sizes, nil
+	}
+
+	_, body, err := fullBox(findBox(stbl, "stz2"))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 8 {
+		return nil, ErrBadBox
+	}
+	fieldSize := int(body[3])
+	count := binary.BigEndian.Uint32(body[4:])
+	body = body[8:]
+	if fieldSize != 4 && fieldSize != 8 && fieldSize != 16 || uint64(count)*uint64(fieldSize) > uint64(len(body))*8 {
+		return nil, ErrBadBox
+	}
+	sizes := make([]uint32, count)
+	for i := range sizes {
+		switch fieldSize {
+		case 4:
+			sizes[i] = uint32(body[i/2]>>(4*uint(1-i%2))) & 0x0F
+		case 8:
+			sizes[i] = uint32(body[i])
+		case 16:
+			sizes[i] = uint32(binary.BigEndian.Uint16(body[2*i:]))
+		}
+	}
+	return sizes, nil
+}
+
+// parseChunkOffsets reads the "stco" or 64-bit "co64" box.
+func parseChunkOffsets(stbl []byte) ([]int64, error) {
+	if co64 := findBox(stbl, "co64"); co64 != nil {
+		entries, err := tableEntries(co64, 8)
+		if err != nil {
+			return nil, err
+		}
+		offsets := make([]int64, len(entries))
+		for i, entry := range entries {
+			offsets[i] = int64(binary.BigEndian.Uint64(entry))
+		}
+		return offsets, nil
+	}
+	entries, err := tableEntries(findBox(stbl, "stco"), 4)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]int64, len(entries))
+	for i, entry := range entries {
+		offsets[i] = int64(binary.BigEndian.Uint32(entry))
+	}
+	return offsets, nil
+}
+
+// trackDuration is the end of the last sample of a track.
+func (t *Track) trackDuration() time.Duration {
+	if len(t.Samples) == 0 {
+		return 0
+	}
+	last := t.Samples[len(t.Samples)-1]
+	return t.Time(last.DecodeTime + uint64(last.Duration))
+}
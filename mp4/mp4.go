@@ -0,0 +1,210 @@
+// Package mp4 reads ISO base media files, ISO/IEC 14496-12, such as MP4
+// and QuickTime movies: the tracks of their movie box, with the codec
+// configuration of H.264, H.265 and AAC tracks and the sample tables that
+// locate every sample in the file.
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// Handler types of tracks, from their "hdlr" box.
+const (
+	HandlerVideo = "vide"
+	HandlerAudio = "soun"
+)
+
+// Sample entry formats of the supported tracks, from their "stsd" box.
+const (
+	FormatAVC1 = "avc1"
+	FormatAVC3 = "avc3"
+	FormatHVC1 = "hvc1"
+	FormatHEV1 = "hev1"
+	FormatMP4A = "mp4a"
+)
+
+// maxMovieSize bounds the "moov" box Parse reads into memory.
+const maxMovieSize = 64 << 20
+
+var (
+	ErrBadBox      = errors.New("mp4: malformed box")
+	ErrNoMovie     = errors.New("mp4: no moov box")
+	ErrMovieTooBig = errors.New("mp4: moov box too big")
+	ErrNoTracks    = errors.New("mp4: no supported track")
+	ErrBadSample   = errors.New("mp4: malformed sample")
+)
+
+// File is the movie of an ISO base media file.
+type File struct {
+	// Duration is that of the movie header or else of the longest track.
+	Duration time.Duration
+	// Tracks are those with a supported format and samples, in file order.
+	Tracks []*Track
+}
+
+// Track is one track of a File.
+type Track struct {
+	ID uint32
+	// Handler is HandlerVideo or HandlerAudio.
+	Handler string
+	// Format is the type of the sample entry, e.g. FormatAVC1.
+	Format string
+	// Timescale is the number of time units of the samples in a second.
+	Timescale uint32
+	Duration  time.Duration
+	Width     int
+	Height    int
+
+	// NALULengthSize is the size of the length that precedes every NAL
+	// unit of a H.264 or H.265 sample, and VPS, SPS and PPS the parameter
+	// sets of its "avcC" or "hvcC" box.
+	NALULengthSize int
+	VPS            [][]byte
+	SPS            [][]byte
+	PPS            [][]byte
+
+	// AudioConfig is the AudioSpecificConfig of an AAC track, from its
+	// "esds" box, and SampleRate and ChannelCount those of its sample entry.
+	AudioConfig  []byte
+	SampleRate   int
+	ChannelCount int
+
+	Samples []Sample
+}
+
+// Sample is where a sample is in the file and when it plays. Times are in
+// Timescale units.
+type Sample struct {
+	Offset int64
+	Size   uint32
+	// DecodeTime is when the sample is decoded; it is presented
+	// CompositionOffset later.
+	DecodeTime        uint64
+	CompositionOffset int32
+	Duration          uint32
+	// IsSync is set for samples a decoder can start from.
+	IsSync bool
+}
+
+// Parse reads the movie box of a file of the given size. Edit lists are
+// ignored, and fragmented files, whose samples are described outside the
+// movie box, are not supported.
+func Parse(r io.ReaderAt, size int64) (*File, error) {
+	var header [16]byte
+	for offset := int64(0); offset+8 <= size; {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return nil, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+		switch boxSize {
+		case 0:
+			boxSize = size - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if boxSize < headerSize || boxSize > size-offset {
+			return nil, ErrBadBox
+		}
+
+		if boxType == "moov" {
+			if boxSize > maxMovieSize {
+				return nil, ErrMovieTooBig
+			}
+			body := make([]byte, boxSize-headerSize)
+			if _, err := r.ReadAt(body, offset+headerSize); err != nil {
+				return nil, err
+			}
+			return parseMovie(body)
+		}
+		offset += boxSize
+	}
+	return nil, ErrNoMovie
+}
+
+// Time converts a time in Timescale units.
+func (t *Track) Time(units uint64) time.Duration {
+	timescale := uint64(t.Timescale)
+	return time.Duration(units/timescale)*time.Second + time.Duration(units%timescale*uint64(time.Second)/timescale)
+}
+
+// SampleFrom returns the index of the first sample decoded at d or later,
+// len(t.Samples) if there is none.
+func (t *Track) SampleFrom(d time.Duration) int {
+	return sort.Search(len(t.Samples), func(i int) bool {
+		return t.Time(t.Samples[i].DecodeTime) >= d
+	})
+}
+
+// NearestSyncSample returns the index of the sync sample decoded closest
+// to d, the earlier one of two as close.
+func (t *Track) NearestSyncSample(d time.Duration) int {
+	before, after := -1, -1
+	i := t.SampleFrom(d)
+	for j := i - 1; j >= 0; j-- {
+		if t.Samples[j].IsSync {
+			before = j
+			break
+		}
+	}
+	for j := i; j < len(t.Samples); j++ {
+		if t.Samples[j].IsSync {
+			after = j
+			break
+		}
+	}
+	switch {
+	case before < 0 && after < 0:
+		return 0
+	case before < 0:
+		return after
+	case after < 0:
+		return before
+	}
+	if t.Time(t.Samples[after].DecodeTime)-d < d-t.Time(t.Samples[before].DecodeTime) {
+		return after
+	}
+	return before
+}
+
+// ReadSample reads the data of sample i from the file.
+func (t *Track) ReadSample(r io.ReaderAt, i int) ([]byte, error) {
+	sample := t.Samples[i]
+	data := make([]byte, sample.Size)
+	if _, err := r.ReadAt(data, sample.Offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// NALUs splits a H.264 or H.265 sample into its NAL units.
+func (t *Track) NALUs(sample []byte) ([][]byte, error) {
+	var nalus [][]byte
+	for len(sample) > 0 {
+		if len(sample) < t.NALULengthSize {
+			return nil, ErrBadSample
+		}
+		var length int
+		for _, b := range sample[:t.NALULengthSize] {
+			length = length<<8 | int(b)
+		}
+		sample = sample[t.NALULengthSize:]
+		if length > len(sample) {
+			return nil, ErrBadSample
+		}
+		if length > 0 {
+			nalus = append(nalus, sample[:length])
+		}
+		sample = sample[length:]
+	}
+	return nalus, nil
+}
@@ -0,0 +1,211 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], boxType)
+	return append(b, body...)
+}
+
+func be(values ...interface{}) []byte {
+	var b bytes.Buffer
+	for _, v := range values {
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	return b.Bytes()
+}
+
+// table is the body of a full box made of an entry count and entries.
+func table(entries ...[]byte) []byte {
+	return append(be(uint32(0), uint32(len(entries))), bytes.Join(entries, nil)...)
+}
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xC0, 0x1E, 0xD9}
+	testPPS = []byte{0x68, 0xCE, 0x3C, 0x80}
+)
+
+// testVideoSample is a sample of one NAL unit, an IDR slice for a sync sample.
+func testVideoSample(i int, sync bool) []byte {
+	nalu := []byte{0x41, byte(i), 0xAA, 0xBB}
+	if sync {
+		nalu[0] = 0x65
+	}
+	return append(be(uint32(len(nalu))), nalu...)
+}
+
+// buildTestFile returns a movie with its moov box after the media: six
+// 30 fps H.264 samples of which the first and fourth are sync samples, in
+// two chunks, interleaved with two chunks of two AAC samples at 48 kHz.
+func buildTestFile() (file []byte, videoSamples, audioSamples [][]byte) {
+	for i := 0; i < 6; i++ {
+		videoSamples = append(videoSamples, testVideoSample(i, i%3 == 0))
+	}
+	for i := 0; i < 4; i++ {
+		audioSamples = append(audioSamples, bytes.Repeat([]byte{byte(0x10 + i)}, 10+i))
+	}
+
+	ftyp := box("ftyp", []byte("isom"), be(uint32(512)), []byte("isomavc1"))
+	chunks := [][][]byte{videoSamples[:3], audioSamples[:2], videoSamples[3:], audioSamples[2:]}
+	var mdat []byte
+	var chunkOffsets []uint32
+	for _, chunk := range chunks {
+		chunkOffsets = append(chunkOffsets, uint32(len(ftyp)+8+len(mdat)))
+		mdat = append(mdat, bytes.Join(chunk, nil)...)
+	}
+
+	sizes := func(samples [][]byte) []byte {
+		var entries [][]byte
+		for _, sample := range samples {
+			entries = append(entries, be(uint32(len(sample))))
+		}
+		return append(be(uint32(0), uint32(0)), table(entries...)[4:]...)
+	}
+	trak := func(id uint32, handler string, timescale, duration uint32, stsd, stbl []byte) []byte {
+		return box("trak",
+			box("tkhd", be(uint32(3), uint32(0), uint32(0), id, uint32(0), duration)),
+			box("mdia",
+				box("mdhd", be(uint32(0), uint32(0), uint32(0), timescale, duration, uint32(0))),
+				box("hdlr", be(uint32(0), uint32(0)), []byte(handler), make([]byte, 13)),
+				box("minf", box("stbl", box("stsd", table(stsd)), stbl))))
+	}
+
+	avcC := box("avcC", []byte{1, 0x42, 0xC0, 0x1E, 0xFF, 0xE1}, be(uint16(len(testSPS))), testSPS,
+		[]byte{1}, be(uint16(len(testPPS))), testPPS)
+	avc1 := box("avc1", make([]byte, 24), be(uint16(320), uint16(240)), make([]byte, 50), avcC)
+	video := trak(1, HandlerVideo, 90000, 18000, avc1, bytes.Join([][]byte{
+		box("stts", table(be(uint32(6), uint32(3000)))),
+		box("ctts", table(be(uint32(1), uint32(0)), be(uint32(5), uint32(3000)))),
+		box("stss", table(be(uint32(1)), be(uint32(4)))),
+		box("stsc", table(be(uint32(1), uint32(3), uint32(1)))),
+		box("stsz", sizes(videoSamples)),
+		box("stco", table(be(chunkOffsets[0]), be(chunkOffsets[2]))),
+	}, nil))
+
+	esds := box("esds", be(uint32(0)),
+		[]byte{0x03, 0x80, 0x80, 0x80, 22, 0, 2, 0},
+		[]byte{0x04, 17, 0x40, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0x05, 2, 0x11, 0x90})
+	mp4a := box("mp4a", make([]byte, 8), be(uint16(0), uint16(0), uint32(0), uint16(2), uint16(16),
+		uint32(0), uint32(48000<<16)), esds)
+	audio := trak(2, HandlerAudio, 48000, 4096, mp4a, bytes.Join([][]byte{
+		box("stts", table(be(uint32(4), uint32(1024)))),
+		box("stsc", table(be(uint32(1), uint32(2), uint32(1)))),
+		box("stsz", sizes(audioSamples)),
+		box("co64", table(be(uint64(chunkOffsets[1])), be(uint64(chunkOffsets[3])))),
+	}, nil))
+
+	moov := box("moov", box("mvhd", be(uint32(0), uint32(0), uint32(0), uint32(1000), uint32(200)), make([]byte, 80)),
+		video, audio)
+	file = bytes.Join([][]byte{ftyp, box("mdat", mdat), moov}, nil)
+	return file, videoSamples, audioSamples
+}
+
+func TestParse(t *testing.T) {
+	file, videoSamples, audioSamples := buildTestFile()
+	f, err := Parse(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Duration != 200*time.Millisecond || len(f.Tracks) != 2 {
+		t.Fatalf("Duration %v, %d tracks", f.Duration, len(f.Tracks))
+	}
+
+	video, audio := f.Tracks[0], f.Tracks[1]
+	if video.ID != 1 || video.Handler != HandlerVideo || video.Format != FormatAVC1 || video.Timescale != 90000 ||
+		video.Duration != 200*time.Millisecond || video.Width != 320 || video.Height != 240 || video.NALULengthSize != 4 ||
+		!reflect.DeepEqual(video.SPS, [][]byte{testSPS}) || !reflect.DeepEqual(video.PPS, [][]byte{testPPS}) {
+		t.Errorf("video track %+v", video)
+	}
+	if audio.ID != 2 || audio.Handler != HandlerAudio || audio.Format != FormatMP4A || audio.SampleRate != 48000 ||
+		audio.ChannelCount != 2 || !bytes.Equal(audio.AudioConfig, []byte{0x11, 0x90}) {
+		t.Errorf("audio track %+v", audio)
+	}
+
+	for i, want := range videoSamples {
+		sample := video.Samples[i]
+		wantOffset := int32(3000)
+		if i == 0 {
+			wantOffset = 0
+		}
+		if sample.DecodeTime != uint64(3000*i) || sample.Duration != 3000 || sample.IsSync != (i%3 == 0) ||
+			sample.CompositionOffset != wantOffset {
+			t.Errorf("video sample %d: %+v", i, sample)
+		}
+		data, err := video.ReadSample(bytes.NewReader(file), i)
+		if err != nil || !bytes.Equal(data, want) {
+			t.Errorf("video sample %d = %x, %v, want %x", i, data, err, want)
+		}
+		if nalus, err := video.NALUs(data); err != nil || len(nalus) != 1 || !bytes.Equal(nalus[0], want[4:]) {
+			t.Errorf("NALUs of video sample %d = %x, %v", i, nalus, err)
+		}
+	}
+	for i, want := range audioSamples {
+		data, err := audio.ReadSample(bytes.NewReader(file), i)
+		if err != nil || !bytes.Equal(data, want) || audio.Samples[i].DecodeTime != uint64(1024*i) || !audio.Samples[i].IsSync {
+			t.Errorf("audio sample %d = %x, %+v, %v", i, data, audio.Samples[i], err)
+		}
+	}
+}
+
+func TestSeek(t *testing.T) {
+	file, _, _ := buildTestFile()
+	f, err := Parse(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, audio := f.Tracks[0], f.Tracks[1]
+
+	// the sync samples start at 0 and 100 ms
+	for _, test := range []struct {
+		at   time.Duration
+		want int
+	}{
+		{0, 0},
+		{40 * time.Millisecond, 0},
+		{50 * time.Millisecond, 0},
+		{60 * time.Millisecond, 3},
+		{time.Second, 3},
+	} {
+		if got := video.NearestSyncSample(test.at); got != test.want {
+			t.Errorf("NearestSyncSample(%v) = %d, want %d", test.at, got, test.want)
+		}
+	}
+	// the audio samples start every 21.3 ms
+	if got := audio.SampleFrom(30 * time.Millisecond); got != 2 {
+		t.Errorf("audio sample from 30 ms = %d, want 2", got)
+	}
+	if got := audio.SampleFrom(time.Second); got != len(audio.Samples) {
+		t.Errorf("audio sample from the end = %d", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	file, _, _ := buildTestFile()
+	for _, test := range []struct {
+		name string
+		file []byte
+	}{
+		{"no moov", file[:len(file)-len(findBox(file, "moov"))-8]},
+		{"truncated moov", file[:len(file)-10]},
+		{"no supported track", box("moov", box("mvhd", make([]byte, 100)))},
+	} {
+		if _, err := Parse(bytes.NewReader(test.file), int64(len(test.file))); err == nil {
+			t.Errorf("%s: Parse succeeded", test.name)
+		}
+	}
+
+	track := &Track{NALULengthSize: 4}
+	if _, err := track.NALUs([]byte{0, 0, 0, 9, 1}); err != ErrBadSample {
+		t.Errorf("NALUs of a truncated sample: %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+// Package opus carries Opus audio over RTP, RFC 7587. Each RTP packet
+// holds exactly one Opus packet, so depacketizing is just taking the
+// payload; the RTP clock always runs at 48 kHz.
+package opus
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+const (
+	// ClockRate is the RTP clock rate of Opus, whatever its sample rate.
+	ClockRate = 48000
+
+	maxPacketDuration = 120 * time.Millisecond
+)
+
+var (
+	ErrEmptyPacket = errors.New("opus: empty packet")
+	ErrBadPacket   = errors.New("opus: malformed packet")
+	ErrBadFmtp     = errors.New("opus: malformed fmtp")
+)
+
+// frameDurations are the frame durations of the configurations of the TOC
+// byte, RFC 6716 section 3.1, in units of 2.5 ms.
+var frameDurations = [32]int{
+	// SILK
+	4, 8, 16, 24, 4, 8, 16, 24, 4, 8, 16, 24,
+	// Hybrid
+	4, 8, 4, 8,
+	// CELT
+	1, 2, 4, 8, 1, 2, 4, 8, 1, 2, 4, 8, 1, 2, 4, 8,
+}
+
+// PacketDuration returns the duration of the audio of an Opus packet, from
+// its TOC byte and frame count.
+func PacketDuration(packet []byte) (time.Duration, error) {
+	if len(packet) == 0 {
+		return 0, ErrEmptyPacket
+	}
+	toc := packet[0]
+	frames := 1
+	switch toc & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, ErrBadPacket
+		}
+		frames = int(packet[1] & 0x3F)
+		if frames == 0 {
+			return 0, ErrBadPacket
+		}
+	}
+	duration := time.Duration(frames*frameDurations[toc>>3]) * 2500 * time.Microsecond
+	if duration > maxPacketDuration {
+		return 0, ErrBadPacket
+	}
+	return duration, nil
+}
+
+// IsStereo reports whether the TOC byte of a packet says it is coded in
+// stereo.
+func IsStereo(packet []byte) bool {
+	return len(packet) > 0 && packet[0]&0x04 != 0
+}
+
+// Params are the "a=fmtp:" parameters of an Opus stream, RFC 7587 section
+// 6.1. Zero values are the defaults.
+type Params struct {
+	MaxPlaybackRate     int
+	SpropMaxCaptureRate int
+	MaxPTime            int
+	PTime               int
+	MaxAverageBitrate   int
+	Stereo              bool
+	SpropStereo         bool
+	CBR                 bool
+	UseInbandFEC        bool
+	UseDTX              bool
+}
+
+// ParseFmtp reads the value of a "a=fmtp:" attribute, with or without its
+// leading payload type, e.g. "111 minptime=10;useinbandfec=1;stereo=1".
+// Parameters it doesn't know are ignored.
+func ParseFmtp(fmtp string) (*Params, error) {
+	if i := strings.IndexByte(fmtp, ' '); i >= 0 && !strings.Contains(fmtp[:i], "=") {
+		fmtp = fmtp[i+1:]
+	}
+
+	params := &Params{}
+	for _, param := range strings.Split(fmtp, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.TrimSpace(value)
+
+		var number *int
+		var flag *bool
+		switch strings.ToLower(name) {
+		case "maxplaybackrate":
+			number = &params.MaxPlaybackRate
+		case "sprop-maxcapturerate":
+			number = &params.SpropMaxCaptureRate
+		case "maxptime":
+			number = &params.MaxPTime
+		case "ptime":
+			number = &params.PTime
+		case "maxaveragebitrate":
+			number = &params.MaxAverageBitrate
+		case "stereo":
+			flag = &params.Stereo
+		case "sprop-stereo":
+			flag = &params.SpropStereo
+		case "cbr":
+			flag = &params.CBR
+		case "useinbandfec":
+			flag = &params.UseInbandFEC
+		case "usedtx":
+			flag = &params.UseDTX
+		}
+
+		switch {
+		case number != nil:
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, ErrBadFmtp
+			}
+			*number = n
+		case flag != nil:
+			if value != "0" && value != "1" {
+				return nil, ErrBadFmtp
+			}
+			*flag = value == "1"
+		}
+	}
+	return params, nil
+}
+
+// String returns the parameters as the value of a "a=fmtp:", without the
+// payload type.
+func (p *Params) String() string {
+	var params []string
+	for _, param := range []struct {
+		name  string
+		value int
+	}{
+		{"maxplaybackrate", p.MaxPlaybackRate},
+		{"sprop-maxcapturerate", p.SpropMaxCaptureRate},
+		{"maxptime", p.MaxPTime},
+		{"ptime", p.PTime},
+		{"maxaveragebitrate", p.MaxAverageBitrate},
+	} {
+		if param.value != 0 {
+			params = append(params, fmt.Sprintf("%s=%d", param.name, param.value))
+		}
+	}
+	for _, param := range []struct {
+		name  string
+		value bool
+	}{
+		{"stereo", p.Stereo},
+		{"sprop-stereo", p.SpropStereo},
+		{"cbr", p.CBR},
+		{"useinbandfec", p.UseInbandFEC},
+		{"usedtx", p.UseDTX},
+	} {
+		if param.value {
+			params = append(params, param.name+"=1")
+		}
+	}
+	return strings.Join(params, ";")
+}
+
+// Packetizer puts Opus packets into RTP packets, one each.
+type Packetizer struct {
+	PayloadType uint8
+	SSRC        uint32
+	// SequenceNumber is the sequence number of the next packet.
+	SequenceNumber uint16
+}
+
+// Packetize returns the RTP packets of consecutive Opus packets, the first
+// one with the given timestamp.
+func (p *Packetizer) Packetize(packets [][]byte, timestamp uint32) ([]*rtp.Packet, error) {
+	var rtpPackets []*rtp.Packet
+	for _, packet := range packets {
+		duration, err := PacketDuration(packet)
+		if err != nil {
+			return nil, err
+		}
+		rtpPackets = append(rtpPackets, &rtp.Packet{
+			Header: rtp.Header{
+				PayloadType:    p.PayloadType,
+				SequenceNumber: p.SequenceNumber,
+				Timestamp:      timestamp,
+				SSRC:           p.SSRC,
+			},
+			Payload: packet,
+		})
+		p.SequenceNumber++
+		timestamp += uint32(duration * ClockRate / time.Second)
+	}
+	return rtpPackets, nil
+}
@@ -0,0 +1,61 @@
+package opus
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPacketDuration(t *testing.T) {
+	var tests = []struct {
+		packet []byte
+		want   time.Duration
+	}{
+		{[]byte{0x08}, 20 * time.Millisecond},          // SILK 20ms, one frame
+		{[]byte{0x78, 0}, 20 * time.Millisecond},       // Hybrid 20ms
+		{[]byte{0xF9, 0, 0}, 40 * time.Millisecond},    // CELT 20ms, two frames
+		{[]byte{0x83, 0x05}, 12500 * time.Microsecond}, // CELT 2.5ms, five frames
+		{[]byte{0x1B, 0x02}, 120 * time.Millisecond},   // SILK 60ms, two frames
+	}
+	for _, test := range tests {
+		got, err := PacketDuration(test.packet)
+		if err != nil || got != test.want {
+			t.Errorf("PacketDuration(%x) = %v, %v, want %v", test.packet, got, err, test.want)
+		}
+	}
+	for _, packet := range [][]byte{nil, {0x03}, {0x03, 0x00}, {0x1B, 0x03}} {
+		if _, err := PacketDuration(packet); err == nil {
+			t.Errorf("PacketDuration(%x) succeeded", packet)
+		}
+	}
+}
+
+func TestParseFmtp(t *testing.T) {
+	params, err := ParseFmtp("111 minptime=10; useinbandfec=1;stereo=1;maxaveragebitrate=64000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Params{MaxAverageBitrate: 64000, Stereo: true, UseInbandFEC: true}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("ParseFmtp() = %+v, want %+v", params, want)
+	}
+	if got := params.String(); got != "maxaveragebitrate=64000;stereo=1;useinbandfec=1" {
+		t.Errorf("String() = %q", got)
+	}
+	if _, err := ParseFmtp("stereo=yes"); err == nil {
+		t.Errorf("ParseFmtp() accepted stereo=yes")
+	}
+}
+
+func TestPacketize(t *testing.T) {
+	p := &Packetizer{PayloadType: 111, SequenceNumber: 65535}
+	packets, err := p.Packetize([][]byte{{0xFC, 1}, {0xF9, 1, 2}, {0xFC, 3}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []uint32{0, 960, 2880} {
+		if packets[i].Timestamp != want || packets[i].SequenceNumber != uint16(65535+i) {
+			t.Errorf("packet %d: %+v", i, packets[i].Header)
+		}
+	}
+}
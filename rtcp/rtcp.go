@@ -0,0 +1,507 @@
+// Package rtcp reads and writes compound RTCP packets, RFC 3550 section 6.
+package rtcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	TypeSR   = 200
+	TypeRR   = 201
+	TypeSDES = 202
+	TypeBYE  = 203
+	TypeAPP  = 204
+
+	headerSize          = 4
+	receptionReportSize = 24
+	maxCount            = 31
+)
+
+var (
+	ErrShortPacket   = errors.New("rtcp: packet too short")
+	ErrBadVersion    = errors.New("rtcp: not RTP version 2")
+	ErrBadLength     = errors.New("rtcp: bad length")
+	ErrBadPadding    = errors.New("rtcp: bad padding")
+	ErrTooManyItems  = errors.New("rtcp: more than 31 reports, chunks or sources")
+	ErrItemTooLong   = errors.New("rtcp: SDES item or BYE reason longer than 255 bytes")
+	ErrNotCompound   = errors.New("rtcp: compound packet doesn't start with SR or RR")
+	ErrBadSDESChunk  = errors.New("rtcp: malformed SDES chunk")
+	ErrBadAppName    = errors.New("rtcp: APP name isn't 4 bytes")
+	ErrBadAppSubType = errors.New("rtcp: APP subtype above 31")
+)
+
+// Packet is one of the packets of a compound RTCP packet: *SenderReport,
+// *ReceiverReport, *SourceDescription, *Goodbye, *App or *RawPacket.
+type Packet interface {
+	// Marshal returns the packet in wire format, padded to 32 bits.
+	Marshal() ([]byte, error)
+}
+
+// header is the first 32 bits of every RTCP packet.
+type header struct {
+	padding bool
+	count   uint8
+	ptype   uint8
+	length  int // in bytes, excluding the header
+}
+
+func parseHeader(buf []byte) (header, error) {
+	if len(buf) < headerSize {
+		return header{}, ErrShortPacket
+	}
+	if buf[0]>>6 != 2 {
+		return header{}, ErrBadVersion
+	}
+	h := header{
+		padding: buf[0]&0x20 != 0,
+		count:   buf[0] & 0x1F,
+		ptype:   buf[1],
+		length:  4 * int(binary.BigEndian.Uint16(buf[2:4])),
+	}
+	if len(buf) < headerSize+h.length {
+		return header{}, ErrBadLength
+	}
+	return h, nil
+}
+
+func putHeader(buf []byte, count int, ptype uint8, size int) {
+	buf[0] = 2<<6 | uint8(count)
+	buf[1] = ptype
+	binary.BigEndian.PutUint16(buf[2:4], uint16(size/4-1))
+}
+
+// Unmarshal parses a compound RTCP packet. Packets of unknown types are
+// returned as *RawPacket.
+func Unmarshal(buf []byte) ([]Packet, error) {
+	var packets []Packet
+	for len(buf) > 0 {
+		h, err := parseHeader(buf)
+		if err != nil {
+			return nil, err
+		}
+		body := buf[headerSize : headerSize+h.length]
+		if h.padding {
+			if len(body) == 0 || int(body[len(body)-1]) > len(body) || body[len(body)-1] == 0 {
+				return nil, ErrBadPadding
+			}
+			body = body[:len(body)-int(body[len(body)-1])]
+		}
+
+		var packet Packet
+		switch h.ptype {
+		case TypeSR:
+			packet, err = unmarshalSenderReport(h, body)
+		case TypeRR:
+			packet, err = unmarshalReceiverReport(h, body)
+		case TypeSDES:
+			packet, err = unmarshalSourceDescription(h, body)
+		case TypeBYE:
+			packet, err = unmarshalGoodbye(h, body)
+		case TypeAPP:
+			packet, err = unmarshalApp(h, body)
+		default:
+			raw := RawPacket(append([]byte(nil), buf[:headerSize+h.length]...))
+			packet = &raw
+		}
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, packet)
+		buf = buf[headerSize+h.length:]
+	}
+	if len(packets) == 0 {
+		return nil, ErrShortPacket
+	}
+	return packets, nil
+}
+
+// Marshal builds a compound packet. RFC 3550 wants it to start with a SR or
+// RR, which is checked.
+func Marshal(packets []Packet) ([]byte, error) {
+	if len(packets) == 0 {
+		return nil, ErrNotCompound
+	}
+	switch packets[0].(type) {
+	case *SenderReport, *ReceiverReport:
+	default:
+		return nil, ErrNotCompound
+	}
+
+	var buf []byte
+	for _, packet := range packets {
+		b, err := packet.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b...)
+	}
+	return buf, nil
+}
+
+// ReceptionReport is a report block of a SR or RR, about one source.
+type ReceptionReport struct {
+	SSRC         uint32
+	FractionLost uint8
+	// TotalLost is a signed 24 bit number: duplicates can make it negative.
+	TotalLost int32
+	// LastSequence is the extended highest sequence number received.
+	LastSequence uint32
+	Jitter       uint32
+	// LastSenderReport is the middle 32 bits of the NTP time of the last SR
+	// from the source, Delay the time since then in units of 1/65536 seconds.
+	LastSenderReport uint32
+	Delay            uint32
+}
+
+func unmarshalReports(buf []byte, count int) ([]ReceptionReport, []byte, error) {
+	if len(buf) < count*receptionReportSize {
+		return nil, nil, ErrShortPacket
+	}
+	if count == 0 {
+		return nil, buf, nil
+	}
+	reports := make([]ReceptionReport, count)
+	for i := range reports {
+		b := buf[i*receptionReportSize:]
+		totalLost := int32(binary.BigEndian.Uint32(b[4:8])&0xFFFFFF) << 8 >> 8
+		reports[i] = ReceptionReport{
+			SSRC:             binary.BigEndian.Uint32(b[0:4]),
+			FractionLost:     b[4],
+			TotalLost:        totalLost,
+			LastSequence:     binary.BigEndian.Uint32(b[8:12]),
+			Jitter:           binary.BigEndian.Uint32(b[12:16]),
+			LastSenderReport: binary.BigEndian.Uint32(b[16:20]),
+			Delay:            binary.BigEndian.Uint32(b[20:24]),
+		}
+	}
+	return reports, buf[count*receptionReportSize:], nil
+}
+
+func putReports(buf []byte, reports []ReceptionReport) int {
+	for i, report := range reports {
+		b := buf[i*receptionReportSize:]
+		binary.BigEndian.PutUint32(b[0:4], report.SSRC)
+		binary.BigEndian.PutUint32(b[4:8], uint32(report.TotalLost)&0xFFFFFF)
+		b[4] = report.FractionLost
+		binary.BigEndian.PutUint32(b[8:12], report.LastSequence)
+		binary.BigEndian.PutUint32(b[12:16], report.Jitter)
+		binary.BigEndian.PutUint32(b[16:20], report.LastSenderReport)
+		binary.BigEndian.PutUint32(b[20:24], report.Delay)
+	}
+	return len(reports) * receptionReportSize
+}
+
+// SenderReport is a SR, RFC 3550 section 6.4.1.
+type SenderReport struct {
+	SSRC        uint32
+	NTPTime     uint64
+	RTPTime     uint32
+	PacketCount uint32
+	OctetCount  uint32
+	Reports     []ReceptionReport
+	// ProfileExtensions is kept as is, padded to 32 bits.
+	ProfileExtensions []byte
+}
+
+func unmarshalSenderReport(h header, body []byte) (*SenderReport, error) {
+	if len(body) < 24 {
+		return nil, ErrShortPacket
+	}
+	sr := &SenderReport{
+		SSRC:        binary.BigEndian.Uint32(body[0:4]),
+		NTPTime:     binary.BigEndian.Uint64(body[4:12]),
+		RTPTime:     binary.BigEndian.Uint32(body[12:16]),
+		PacketCount: binary.BigEndian.Uint32(body[16:20]),
+		OctetCount:  binary.BigEndian.Uint32(body[20:24]),
+	}
+	var err error
+	var rest []byte
+	if sr.Reports, rest, err = unmarshalReports(body[24:], int(h.count)); err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		sr.ProfileExtensions = append([]byte(nil), rest...)
+	}
+	return sr, nil
+}
+
+func (sr *SenderReport) Marshal() ([]byte, error) {
+	if len(sr.Reports) > maxCount {
+		return nil, ErrTooManyItems
+	}
+	size := headerSize + 24 + len(sr.Reports)*receptionReportSize + pad4(len(sr.ProfileExtensions))
+	buf := make([]byte, size)
+	putHeader(buf, len(sr.Reports), TypeSR, size)
+	b := buf[headerSize:]
+	binary.BigEndian.PutUint32(b[0:4], sr.SSRC)
+	binary.BigEndian.PutUint64(b[4:12], sr.NTPTime)
+	binary.BigEndian.PutUint32(b[12:16], sr.RTPTime)
+	binary.BigEndian.PutUint32(b[16:20], sr.PacketCount)
+	binary.BigEndian.PutUint32(b[20:24], sr.OctetCount)
+	n := 24 + putReports(b[24:], sr.Reports)
+	copy(b[n:], sr.ProfileExtensions)
+	return buf, nil
+}
+
+// ReceiverReport is a RR, RFC 3550 section 6.4.2.
+type ReceiverReport struct {
+	SSRC              uint32
+	Reports           []ReceptionReport
+	ProfileExtensions []byte
+}
+
+func unmarshalReceiverReport(h header, body []byte) (*ReceiverReport, error) {
+	if len(body) < 4 {
+		return nil, ErrShortPacket
+	}
+	rr := &ReceiverReport{SSRC: binary.BigEndian.Uint32(body[0:4])}
+	var err error
+	var rest []byte
+	if rr.Reports, rest, err = unmarshalReports(body[4:], int(h.count)); err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		rr.ProfileExtensions = append([]byte(nil), rest...)
+	}
+	return rr, nil
+}
+
+func (rr *ReceiverReport) Marshal() ([]byte, error) {
+	if len(rr.Reports) > maxCount {
+		return nil, ErrTooManyItems
+	}
+	size := headerSize + 4 + len(rr.Reports)*receptionReportSize + pad4(len(rr.ProfileExtensions))
+	buf := make([]byte, size)
+	putHeader(buf, len(rr.Reports), TypeRR, size)
+	b := buf[headerSize:]
+	binary.BigEndian.PutUint32(b[0:4], rr.SSRC)
+	n := 4 + putReports(b[4:], rr.Reports)
+	copy(b[n:], rr.ProfileExtensions)
+	return buf, nil
+}
+
+type SDESType uint8
+
+const (
+	SDESEnd SDESType = iota
+	SDESCNAME
+	SDESName
+	SDESEmail
+	SDESPhone
+	SDESLocation
+	SDESTool
+	SDESNote
+	SDESPrivate
+)
+
+type SDESItem struct {
+	Type SDESType
+	Text string
+}
+
+type SDESChunk struct {
+	Source uint32
+	Items  []SDESItem
+}
+
+// SourceDescription is a SDES, RFC 3550 section 6.5.
+type SourceDescription struct {
+	Chunks []SDESChunk
+}
+
+// NewCNAME returns a SDES giving the CNAME of ssrc, which every compound
+// packet should carry.
+func NewCNAME(ssrc uint32, cname string) *SourceDescription {
+	return &SourceDescription{Chunks: []SDESChunk{{
+		Source: ssrc,
+		Items:  []SDESItem{{SDESCNAME, cname}},
+	}}}
+}
+
+func unmarshalSourceDescription(h header, body []byte) (*SourceDescription, error) {
+	sdes := &SourceDescription{}
+	for i := 0; i < int(h.count); i++ {
+		if len(body) < 4 {
+			return nil, ErrBadSDESChunk
+		}
+		chunk := SDESChunk{Source: binary.BigEndian.Uint32(body[0:4])}
+		n := 4
+		for {
+			if n >= len(body) {
+				return nil, ErrBadSDESChunk
+			}
+			itemType := SDESType(body[n])
+			if itemType == SDESEnd {
+				// the chunk is null terminated and padded to 32 bits
+				n = pad4(n + 1)
+				break
+			}
+			if n+2 > len(body) || n+2+int(body[n+1]) > len(body) {
+				return nil, ErrBadSDESChunk
+			}
+			length := int(body[n+1])
+			chunk.Items = append(chunk.Items, SDESItem{itemType, string(body[n+2 : n+2+length])})
+			n += 2 + length
+		}
+		if n > len(body) {
+			return nil, ErrBadSDESChunk
+		}
+		sdes.Chunks = append(sdes.Chunks, chunk)
+		body = body[n:]
+	}
+	return sdes, nil
+}
+
+func (sdes *SourceDescription) Marshal() ([]byte, error) {
+	if len(sdes.Chunks) > maxCount {
+		return nil, ErrTooManyItems
+	}
+	size := headerSize
+	for _, chunk := range sdes.Chunks {
+		chunkSize := 4
+		for _, item := range chunk.Items {
+			if len(item.Text) > 255 {
+				return nil, ErrItemTooLong
+			}
+			chunkSize += 2 + len(item.Text)
+		}
+		size += pad4(chunkSize + 1)
+	}
+
+	buf := make([]byte, size)
+	putHeader(buf, len(sdes.Chunks), TypeSDES, size)
+	n := headerSize
+	for _, chunk := range sdes.Chunks {
+		start := n
+		binary.BigEndian.PutUint32(buf[n:], chunk.Source)
+		n += 4
+		for _, item := range chunk.Items {
+			buf[n] = uint8(item.Type)
+			buf[n+1] = uint8(len(item.Text))
+			n += 2 + copy(buf[n+2:], item.Text)
+		}
+		n = start + pad4(n-start+1)
+	}
+	return buf, nil
+}
+
+// Goodbye is a BYE, RFC 3550 section 6.6.
+type Goodbye struct {
+	Sources []uint32
+	Reason  string
+}
+
+func unmarshalGoodbye(h header, body []byte) (*Goodbye, error) {
+	if len(body) < 4*int(h.count) {
+		return nil, ErrShortPacket
+	}
+	bye := &Goodbye{}
+	for i := 0; i < int(h.count); i++ {
+		bye.Sources = append(bye.Sources, binary.BigEndian.Uint32(body[4*i:]))
+	}
+	if rest := body[4*h.count:]; len(rest) > 0 {
+		if 1+int(rest[0]) > len(rest) {
+			return nil, ErrShortPacket
+		}
+		bye.Reason = string(rest[1 : 1+rest[0]])
+	}
+	return bye, nil
+}
+
+func (bye *Goodbye) Marshal() ([]byte, error) {
+	if len(bye.Sources) > maxCount {
+		return nil, ErrTooManyItems
+	}
+	if len(bye.Reason) > 255 {
+		return nil, ErrItemTooLong
+	}
+	size := headerSize + 4*len(bye.Sources)
+	if bye.Reason != "" {
+		size += pad4(1 + len(bye.Reason))
+	}
+	buf := make([]byte, size)
+	putHeader(buf, len(bye.Sources), TypeBYE, size)
+	n := headerSize
+	for _, source := range bye.Sources {
+		binary.BigEndian.PutUint32(buf[n:], source)
+		n += 4
+	}
+	if bye.Reason != "" {
+		buf[n] = uint8(len(bye.Reason))
+		copy(buf[n+1:], bye.Reason)
+	}
+	return buf, nil
+}
+
+// App is an APP packet, RFC 3550 section 6.7.
+type App struct {
+	SubType uint8
+	SSRC    uint32
+	Name    string // 4 ASCII characters
+	Data    []byte // padded to 32 bits when marshaled
+}
+
+func unmarshalApp(h header, body []byte) (*App, error) {
+	if len(body) < 8 {
+		return nil, ErrShortPacket
+	}
+	return &App{
+		SubType: h.count,
+		SSRC:    binary.BigEndian.Uint32(body[0:4]),
+		Name:    string(body[4:8]),
+		Data:    append([]byte(nil), body[8:]...),
+	}, nil
+}
+
+func (app *App) Marshal() ([]byte, error) {
+	if app.SubType > maxCount {
+		return nil, ErrBadAppSubType
+	}
+	if len(app.Name) != 4 {
+		return nil, ErrBadAppName
+	}
+	size := headerSize + 8 + pad4(len(app.Data))
+	buf := make([]byte, size)
+	putHeader(buf, int(app.SubType), TypeAPP, size)
+	binary.BigEndian.PutUint32(buf[4:8], app.SSRC)
+	copy(buf[8:12], app.Name)
+	copy(buf[12:], app.Data)
+	return buf, nil
+}
+
+// RawPacket is a packet of a type we don't know, kept in wire format.
+type RawPacket []byte
+
+func (raw *RawPacket) Marshal() ([]byte, error) {
+	return *raw, nil
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// ntpEpochOffset is the number of seconds from 1900 to 1970.
+const ntpEpochOffset = 2208988800
+
+// NTPTime converts t to the 64 bit NTP timestamp of sender reports.
+func NTPTime(t time.Time) uint64 {
+	nanos := t.UnixNano()
+	seconds := uint64(nanos/1e9) + ntpEpochOffset
+	fraction := (uint64(nanos%1e9) << 32) / 1e9
+	return seconds<<32 | fraction
+}
+
+// TimeFromNTP converts a 64 bit NTP timestamp back to a time.
+func TimeFromNTP(ntp uint64) time.Time {
+	seconds := int64(ntp>>32) - ntpEpochOffset
+	nanos := int64((ntp & 0xFFFFFFFF) * 1e9 >> 32)
+	return time.Unix(seconds, nanos)
+}
+
+// MiddleNTP returns the middle 32 bits of a NTP timestamp, as found in the
+// LastSenderReport of reception reports.
+func MiddleNTP(ntp uint64) uint32 {
+	return uint32(ntp >> 16)
+}
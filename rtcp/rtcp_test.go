@@ -0,0 +1,124 @@
+package rtcp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompoundRoundTrip(t *testing.T) {
+	raw := RawPacket{2 << 6, 205, 0, 1, 1, 2, 3, 4}
+	packets := []Packet{
+		&SenderReport{
+			SSRC:        0x11223344,
+			NTPTime:     0xE1234567_89ABCDEF,
+			RTPTime:     90000,
+			PacketCount: 10,
+			OctetCount:  12000,
+			Reports: []ReceptionReport{{
+				SSRC:             0xAABBCCDD,
+				FractionLost:     64,
+				TotalLost:        -2,
+				LastSequence:     0x0001FFFF,
+				Jitter:           30,
+				LastSenderReport: 0x456789AB,
+				Delay:            65536,
+			}},
+		},
+		&ReceiverReport{SSRC: 0x01020304, ProfileExtensions: []byte{1, 2, 3, 4}},
+		&SourceDescription{Chunks: []SDESChunk{
+			{Source: 0x11223344, Items: []SDESItem{{SDESCNAME, "server@host"}, {SDESTool, "test"}}},
+			{Source: 0x55667788, Items: []SDESItem{{SDESCNAME, "abc"}}},
+		}},
+		&Goodbye{Sources: []uint32{0x11223344, 0x55667788}, Reason: "done"},
+		&App{SubType: 3, SSRC: 0x11223344, Name: "TEST", Data: []byte{9, 8, 7, 6}},
+		&raw,
+	}
+
+	buf, err := Marshal(packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf)%4 != 0 {
+		t.Errorf("compound packet of %d bytes isn't padded to 32 bits", len(buf))
+	}
+	got, err := Unmarshal(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, packets) {
+		for i := range got {
+			t.Errorf("packet %d = %+v", i, got[i])
+		}
+	}
+}
+
+func TestUnmarshalPadding(t *testing.T) {
+	bye, _ := (&Goodbye{Sources: []uint32{7}}).Marshal()
+	// pad the BYE by 4 bytes
+	padded := append(bye, 0, 0, 0, 4)
+	padded[0] |= 0x20
+	padded[3]++
+
+	rr, _ := (&ReceiverReport{SSRC: 7}).Marshal()
+	packets, err := Unmarshal(append(rr, padded...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 2 || !reflect.DeepEqual(packets[1], &Goodbye{Sources: []uint32{7}}) {
+		t.Errorf("Unmarshal() = %+v", packets)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	rr, _ := (&ReceiverReport{SSRC: 7, Reports: []ReceptionReport{{SSRC: 8}}}).Marshal()
+	badPadding := append([]byte(nil), rr...)
+	badPadding[0] |= 0x20
+	badVersion := append([]byte(nil), rr...)
+	badVersion[0] &^= 0xC0
+	badCount := append([]byte(nil), rr...)
+	badCount[0]++
+
+	var tests = []struct {
+		name string
+		buf  []byte
+		err  error
+	}{
+		{"empty", nil, ErrShortPacket},
+		{"short header", rr[:3], ErrShortPacket},
+		{"bad version", badVersion, ErrBadVersion},
+		{"truncated", rr[:len(rr)-4], ErrBadLength},
+		{"bad padding", badPadding, ErrBadPadding},
+		{"missing report", badCount, ErrShortPacket},
+		{"sdes without end", []byte{2<<6 | 1, TypeSDES, 0, 2, 0, 0, 0, 1, 1, 2, 'a', 'b'}, ErrBadSDESChunk},
+	}
+	for _, test := range tests {
+		if _, err := Unmarshal(test.buf); err != test.err {
+			t.Errorf("%s: Unmarshal() error = %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	if _, err := Marshal([]Packet{&Goodbye{}}); err != ErrNotCompound {
+		t.Errorf("Marshal() of a lone BYE: %v, want %v", err, ErrNotCompound)
+	}
+	if _, err := (&App{Name: "TOOLONG"}).Marshal(); err != ErrBadAppName {
+		t.Errorf("Marshal() of a bad APP: %v, want %v", err, ErrBadAppName)
+	}
+}
+
+func TestNTPTime(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 500000000, time.UTC)
+	ntp := NTPTime(now)
+	if seconds := ntp >> 32; seconds != uint64(now.Unix())+ntpEpochOffset {
+		t.Errorf("NTP seconds = %d", seconds)
+	}
+	if fraction := uint32(ntp); fraction != 1<<31 {
+		t.Errorf("NTP fraction = %08X, want %08X", fraction, uint32(1<<31))
+	}
+	if back := TimeFromNTP(ntp); back.Sub(now).Abs() > time.Microsecond {
+		t.Errorf("TimeFromNTP(NTPTime(%v)) = %v", now, back)
+	}
+	if middle := MiddleNTP(ntp); middle != uint32(ntp>>16) {
+		t.Errorf("MiddleNTP() = %08X", middle)
+	}
+}
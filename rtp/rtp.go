@@ -0,0 +1,355 @@
+// Package rtp reads and writes RTP packets, RFC 3550, including the header
+// extensions of RFC 8285.
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	Version = 2
+
+	HeaderSize = 12
+	MaxCSRC    = 15
+
+	// ExtensionProfileOneByte and ExtensionProfileTwoByte are the "defined by
+	// profile" values of RFC 8285 header extensions. The low 4 bits of the
+	// two-byte profile are application bits.
+	ExtensionProfileOneByte = 0xBEDE
+	ExtensionProfileTwoByte = 0x1000
+
+	oneByteMaxID      = 14
+	oneByteMaxLength  = 16
+	twoByteMaxLength  = 255
+	oneByteStopID     = 15
+	extensionHeaderSz = 4
+)
+
+var (
+	ErrShortPacket      = errors.New("rtp: packet too short")
+	ErrBadVersion       = errors.New("rtp: not RTP version 2")
+	ErrBadPadding       = errors.New("rtp: bad padding")
+	ErrBadExtension     = errors.New("rtp: malformed header extension")
+	ErrTooManyCSRC      = errors.New("rtp: more than 15 CSRCs")
+	ErrBufferTooSmall   = errors.New("rtp: buffer too small")
+	ErrExtensionTooLong = errors.New("rtp: header extension too long")
+)
+
+// Extension is one element of a RFC 8285 header extension. For any other
+// extension profile the whole extension is a single Extension with ID 0.
+type Extension struct {
+	ID      uint8
+	Payload []byte
+}
+
+// Header is the header of a RTP packet.
+type Header struct {
+	Version          uint8 // zero means Version when marshaling
+	Marker           bool
+	PayloadType      uint8
+	SequenceNumber   uint16
+	Timestamp        uint32
+	SSRC             uint32
+	CSRC             []uint32
+	Extension        bool
+	ExtensionProfile uint16
+	Extensions       []Extension
+}
+
+// Packet is a RTP packet. The Payload and extension payloads of an
+// unmarshaled packet refer to the buffer it was read from.
+type Packet struct {
+	Header
+	Payload     []byte
+	PaddingSize uint8
+}
+
+// Unmarshal parses a packet from buf. The CSRC and Extensions slices of p
+// are reused, so unmarshaling into the same Packet again doesn't allocate.
+func (p *Packet) Unmarshal(buf []byte) error {
+	n, err := p.Header.Unmarshal(buf)
+	if err != nil {
+		return err
+	}
+
+	end := len(buf)
+	p.PaddingSize = 0
+	if buf[0]&0x20 != 0 {
+		if end <= n {
+			return ErrBadPadding
+		}
+		p.PaddingSize = buf[end-1]
+		if p.PaddingSize == 0 || int(p.PaddingSize) > end-n {
+			return ErrBadPadding
+		}
+		end -= int(p.PaddingSize)
+	}
+	p.Payload = buf[n:end]
+	return nil
+}
+
+// Unmarshal parses the header at the start of buf and returns its size.
+func (h *Header) Unmarshal(buf []byte) (int, error) {
+	if len(buf) < HeaderSize {
+		return 0, ErrShortPacket
+	}
+	h.Version = buf[0] >> 6
+	if h.Version != Version {
+		return 0, ErrBadVersion
+	}
+	h.Extension = buf[0]&0x10 != 0
+	h.Marker = buf[1]&0x80 != 0
+	h.PayloadType = buf[1] & 0x7F
+	h.SequenceNumber = binary.BigEndian.Uint16(buf[2:4])
+	h.Timestamp = binary.BigEndian.Uint32(buf[4:8])
+	h.SSRC = binary.BigEndian.Uint32(buf[8:12])
+
+	n := HeaderSize
+	csrcCount := int(buf[0] & 0x0F)
+	if len(buf) < n+4*csrcCount {
+		return 0, ErrShortPacket
+	}
+	h.CSRC = h.CSRC[:0]
+	for i := 0; i < csrcCount; i++ {
+		h.CSRC = append(h.CSRC, binary.BigEndian.Uint32(buf[n:]))
+		n += 4
+	}
+
+	h.ExtensionProfile = 0
+	h.Extensions = h.Extensions[:0]
+	if !h.Extension {
+		return n, nil
+	}
+	if len(buf) < n+extensionHeaderSz {
+		return 0, ErrShortPacket
+	}
+	h.ExtensionProfile = binary.BigEndian.Uint16(buf[n:])
+	length := 4 * int(binary.BigEndian.Uint16(buf[n+2:]))
+	n += extensionHeaderSz
+	if len(buf) < n+length {
+		return 0, ErrShortPacket
+	}
+	if err := h.unmarshalExtensions(buf[n : n+length]); err != nil {
+		return 0, err
+	}
+	return n + length, nil
+}
+
+func (h *Header) unmarshalExtensions(buf []byte) error {
+	switch {
+	case h.ExtensionProfile == ExtensionProfileOneByte:
+		for i := 0; i < len(buf); {
+			id := buf[i] >> 4
+			if id == 0 {
+				// padding
+				i++
+				continue
+			}
+			if id == oneByteStopID {
+				return nil
+			}
+			length := int(buf[i]&0x0F) + 1
+			i++
+			if i+length > len(buf) {
+				return ErrBadExtension
+			}
+			h.Extensions = append(h.Extensions, Extension{ID: id, Payload: buf[i : i+length]})
+			i += length
+		}
+	case h.ExtensionProfile&0xFFF0 == ExtensionProfileTwoByte:
+		for i := 0; i < len(buf); {
+			id := buf[i]
+			if id == 0 {
+				i++
+				continue
+			}
+			if i+2 > len(buf) {
+				return ErrBadExtension
+			}
+			length := int(buf[i+1])
+			i += 2
+			if i+length > len(buf) {
+				return ErrBadExtension
+			}
+			h.Extensions = append(h.Extensions, Extension{ID: id, Payload: buf[i : i+length]})
+			i += length
+		}
+	default:
+		h.Extensions = append(h.Extensions, Extension{Payload: buf})
+	}
+	return nil
+}
+
+// GetExtension returns the payload of the extension element id, or nil.
+func (h *Header) GetExtension(id uint8) []byte {
+	for _, extension := range h.Extensions {
+		if extension.ID == id {
+			return extension.Payload
+		}
+	}
+	return nil
+}
+
+// SetExtension adds or replaces the RFC 8285 extension element id. The
+// profile switches from one-byte to two-byte elements when id or the
+// payload doesn't fit the former.
+func (h *Header) SetExtension(id uint8, payload []byte) error {
+	if id == 0 || len(payload) > twoByteMaxLength {
+		return ErrBadExtension
+	}
+	if !h.Extension || h.ExtensionProfile == 0 {
+		h.Extension = true
+		h.ExtensionProfile = ExtensionProfileOneByte
+	}
+	if h.ExtensionProfile == ExtensionProfileOneByte && !fitsOneByte(id, payload) {
+		h.ExtensionProfile = ExtensionProfileTwoByte
+	}
+
+	for i := range h.Extensions {
+		if h.Extensions[i].ID == id {
+			h.Extensions[i].Payload = payload
+			return nil
+		}
+	}
+	h.Extensions = append(h.Extensions, Extension{ID: id, Payload: payload})
+	return nil
+}
+
+func fitsOneByte(id uint8, payload []byte) bool {
+	return id <= oneByteMaxID && len(payload) >= 1 && len(payload) <= oneByteMaxLength
+}
+
+// MarshalSize returns the size of the header once marshaled.
+func (h *Header) MarshalSize() int {
+	n := HeaderSize + 4*len(h.CSRC)
+	if h.Extension {
+		n += extensionHeaderSz + h.extensionSize()
+	}
+	return n
+}
+
+// extensionSize is the size of the extension payload, padded to 32 bits.
+func (h *Header) extensionSize() int {
+	n := 0
+	switch {
+	case h.ExtensionProfile == ExtensionProfileOneByte:
+		for _, extension := range h.Extensions {
+			n += 1 + len(extension.Payload)
+		}
+	case h.ExtensionProfile&0xFFF0 == ExtensionProfileTwoByte:
+		for _, extension := range h.Extensions {
+			n += 2 + len(extension.Payload)
+		}
+	default:
+		for _, extension := range h.Extensions {
+			n += len(extension.Payload)
+		}
+	}
+	return (n + 3) &^ 3
+}
+
+// MarshalTo writes the header to buf and returns its size.
+func (h *Header) MarshalTo(buf []byte) (int, error) {
+	if len(h.CSRC) > MaxCSRC {
+		return 0, ErrTooManyCSRC
+	}
+	size := h.MarshalSize()
+	if len(buf) < size {
+		return 0, ErrBufferTooSmall
+	}
+
+	version := h.Version
+	if version == 0 {
+		version = Version
+	}
+	buf[0] = version<<6 | uint8(len(h.CSRC))
+	if h.Extension {
+		buf[0] |= 0x10
+	}
+	buf[1] = h.PayloadType & 0x7F
+	if h.Marker {
+		buf[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(buf[2:4], h.SequenceNumber)
+	binary.BigEndian.PutUint32(buf[4:8], h.Timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.SSRC)
+
+	n := HeaderSize
+	for _, csrc := range h.CSRC {
+		binary.BigEndian.PutUint32(buf[n:], csrc)
+		n += 4
+	}
+	if !h.Extension {
+		return n, nil
+	}
+
+	extensionSize := h.extensionSize()
+	if extensionSize/4 > 0xFFFF {
+		return 0, ErrExtensionTooLong
+	}
+	binary.BigEndian.PutUint16(buf[n:], h.ExtensionProfile)
+	binary.BigEndian.PutUint16(buf[n+2:], uint16(extensionSize/4))
+	n += extensionHeaderSz
+	end := n + extensionSize
+
+	for _, extension := range h.Extensions {
+		switch {
+		case h.ExtensionProfile == ExtensionProfileOneByte:
+			if !fitsOneByte(extension.ID, extension.Payload) {
+				return 0, ErrBadExtension
+			}
+			buf[n] = extension.ID<<4 | uint8(len(extension.Payload)-1)
+			n++
+		case h.ExtensionProfile&0xFFF0 == ExtensionProfileTwoByte:
+			if extension.ID == 0 || len(extension.Payload) > twoByteMaxLength {
+				return 0, ErrBadExtension
+			}
+			buf[n] = extension.ID
+			buf[n+1] = uint8(len(extension.Payload))
+			n += 2
+		}
+		n += copy(buf[n:], extension.Payload)
+	}
+	for ; n < end; n++ {
+		buf[n] = 0
+	}
+	return n, nil
+}
+
+// MarshalSize returns the size of the packet once marshaled.
+func (p *Packet) MarshalSize() int {
+	return p.Header.MarshalSize() + len(p.Payload) + int(p.PaddingSize)
+}
+
+// MarshalTo writes the packet to buf and returns its size. It doesn't allocate.
+func (p *Packet) MarshalTo(buf []byte) (int, error) {
+	if len(buf) < p.MarshalSize() {
+		return 0, ErrBufferTooSmall
+	}
+	n, err := p.Header.MarshalTo(buf)
+	if err != nil {
+		return 0, err
+	}
+	n += copy(buf[n:], p.Payload)
+	if p.PaddingSize > 0 {
+		buf[0] |= 0x20
+		for i := 0; i < int(p.PaddingSize)-1; i++ {
+			buf[n] = 0
+			n++
+		}
+		buf[n] = p.PaddingSize
+		n++
+	}
+	return n, nil
+}
+
+// Marshal returns the packet as a new buffer.
+func (p *Packet) Marshal() ([]byte, error) {
+	buf := make([]byte, p.MarshalSize())
+	n, err := p.MarshalTo(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
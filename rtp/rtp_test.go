@@ -0,0 +1,150 @@
+package rtp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshal(t *testing.T) {
+	buf := []byte{
+		0xB1, 0xE0, 0x12, 0x34, // V=2, P, X, CC=1, M, PT=96, seq
+		0x00, 0x00, 0x10, 0x00, // timestamp
+		0xDE, 0xAD, 0xBE, 0xEF, // SSRC
+		0x00, 0x00, 0x00, 0x07, // CSRC
+		0xBE, 0xDE, 0x00, 0x02, // one-byte extension, 2 words
+		0x10, 0xAA, 0x00, 0x21, // ID 1 len 1, padding, ID 2 len 2
+		0xBB, 0xCC, 0x00, 0x00,
+		'h', 'i', 0x00, 0x02, // payload, 2 bytes of padding
+	}
+
+	var p Packet
+	if err := p.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	want := Packet{
+		Header: Header{
+			Version:          2,
+			Marker:           true,
+			PayloadType:      96,
+			SequenceNumber:   0x1234,
+			Timestamp:        0x1000,
+			SSRC:             0xDEADBEEF,
+			CSRC:             []uint32{7},
+			Extension:        true,
+			ExtensionProfile: ExtensionProfileOneByte,
+			Extensions:       []Extension{{1, []byte{0xAA}}, {2, []byte{0xBB, 0xCC}}},
+		},
+		Payload:     []byte("hi"),
+		PaddingSize: 2,
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("Unmarshal() = %+v, want %+v", p, want)
+	}
+	if got := p.GetExtension(2); !bytes.Equal(got, []byte{0xBB, 0xCC}) {
+		t.Errorf("GetExtension(2) = %x", got)
+	}
+
+	out, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// our extension elements are packed: no padding between them
+	var again Packet
+	if err := again.Unmarshal(out); err != nil || !reflect.DeepEqual(again, want) {
+		t.Errorf("Unmarshal(Marshal()) = %+v, %v", again, err)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	valid := []byte{0x80, 96, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1}
+	var tests = []struct {
+		buf []byte
+		err error
+	}{
+		{valid[:11], ErrShortPacket},
+		{append([]byte{0x40}, valid[1:]...), ErrBadVersion},
+		{append([]byte{0x81}, valid[1:]...), ErrShortPacket},
+		{append([]byte{0x90}, valid[1:]...), ErrShortPacket},
+		{append(append([]byte{0x90}, valid[1:]...), 0xBE, 0xDE, 0, 1, 0x13, 0, 0, 0), ErrBadExtension},
+		{append(append([]byte{0xA0}, valid[1:]...), 'x', 5), ErrBadPadding},
+		{append(append([]byte{0xA0}, valid[1:]...), 'x', 0), ErrBadPadding},
+	}
+	for _, test := range tests {
+		var p Packet
+		if err := p.Unmarshal(test.buf); err != test.err {
+			t.Errorf("Unmarshal(%x) error = %v, want %v", test.buf, err, test.err)
+		}
+	}
+}
+
+func TestSetExtension(t *testing.T) {
+	p := Packet{Header: Header{PayloadType: 111, SequenceNumber: 9}, Payload: []byte{1, 2, 3}}
+	p.SetExtension(3, []byte{0x42})
+	if p.ExtensionProfile != ExtensionProfileOneByte {
+		t.Errorf("profile = %04x, want one-byte", p.ExtensionProfile)
+	}
+	p.SetExtension(3, []byte{0x43})
+	p.SetExtension(20, []byte{})
+	if p.ExtensionProfile != ExtensionProfileTwoByte {
+		t.Errorf("profile = %04x, want two-byte", p.ExtensionProfile)
+	}
+
+	buf, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Packet
+	if err := got.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Extensions) != 2 || !bytes.Equal(got.GetExtension(3), []byte{0x43}) ||
+		got.GetExtension(20) == nil || !bytes.Equal(got.Payload, p.Payload) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestNoAllocations(t *testing.T) {
+	p := Packet{Header: Header{CSRC: []uint32{1, 2}, PayloadType: 96}, Payload: make([]byte, 1200)}
+	p.SetExtension(1, []byte{1, 2, 3})
+	buf, _ := p.Marshal()
+
+	var parsed Packet
+	parsed.Unmarshal(buf)
+	out := make([]byte, 1500)
+	allocs := testing.AllocsPerRun(100, func() {
+		parsed.Unmarshal(buf)
+		parsed.SequenceNumber++
+		parsed.MarshalTo(out)
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per Unmarshal/MarshalTo, want 0", allocs)
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	f.Add([]byte{0x80, 96, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 'x'})
+	f.Add([]byte{0xB1, 0xE0, 0x12, 0x34, 0, 0, 0x10, 0, 0xDE, 0xAD, 0xBE, 0xEF, 0, 0, 0, 7,
+		0xBE, 0xDE, 0, 2, 0x10, 0xAA, 0, 0x21, 0xBB, 0xCC, 0, 0, 'h', 'i', 0, 2})
+	f.Add([]byte{0x90, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x10, 0x00, 0, 1, 5, 1, 9, 0})
+	f.Add([]byte{0x90, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x12, 0x34, 0, 1, 1, 2, 3, 4})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		var p Packet
+		if p.Unmarshal(buf) != nil {
+			return
+		}
+		first, err := p.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal() of %x: %v", buf, err)
+		}
+		var again Packet
+		if err := again.Unmarshal(first); err != nil {
+			t.Fatalf("Unmarshal(%x): %v", first, err)
+		}
+		second, err := again.Marshal()
+		if err != nil || !bytes.Equal(first, second) {
+			t.Fatalf("round trip of %x: %x, then %x, %v", buf, first, second, err)
+		}
+	})
+}
@@ -1,18 +1,26 @@
 package rtsp_server
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/golang/go/src/pkg/strconv"
 	"github.com/yangxianzhi/CommonUtilities"
+	"github.com/yangxianzhi/my-streaming-server/auth"
 	"github.com/yangxianzhi/my-streaming-server/rtsp"
 	"github.com/yangxianzhi/my-streaming-server/sdp"
-	"net"
-	"strings"
 )
 
 type RTSPClientConnection struct {
 	socket         net.Conn
+	writer         *RichConn
+	writeMutex     sync.Mutex
 	localPort      string
 	remotePort     string
 	localAddr      string
@@ -22,22 +30,26 @@ type RTSPClientConnection struct {
 	responseBuffer string
 	clientSession  *RTSPClientSession
 	server         *RTSPServer
-	//digest         *auth.Digest
-	sdpInfo sdp.Info
+	sdpInfo        sdp.Info
 	reqInfo rtsp.Request
+	// stream registered by an ANNOUNCE on this connection, dropped on
+	// disconnect if no session ever started publishing to it
+	announcedMediaSession *ServerMediaSession
 }
 
 func newRTSPClientConnection(server *RTSPServer, socket net.Conn) *RTSPClientConnection {
-	localAddr := strings.Split(socket.LocalAddr().String(), ":")
-	remoteAddr := strings.Split(socket.RemoteAddr().String(), ":")
+	// SplitHostPort copes with the brackets of IPv6 addresses, which
+	// contain colons themselves
+	localAddr, localPort, _ := net.SplitHostPort(socket.LocalAddr().String())
+	remoteAddr, remotePort, _ := net.SplitHostPort(socket.RemoteAddr().String())
 	return &RTSPClientConnection{
 		server:     server,
 		socket:     socket,
-		localAddr:  localAddr[0],
-		localPort:  localAddr[1],
-		remoteAddr: remoteAddr[0],
-		remotePort: remoteAddr[1],
-		//digest:     auth.NewDigest(),
+		writer:     &RichConn{socket, socketWriteTimeout},
+		localAddr:  localAddr,
+		localPort:  localPort,
+		remoteAddr: remoteAddr,
+		remotePort: remotePort,
 	}
 }
 
@@ -49,7 +61,38 @@ func (c *RTSPClientConnection) handleMethodOptions() {
 		c.currentCSeq, SERVER, VERSION, rtsp.DateHeader(), rtsp.PublicHeader())
 }
 
-func (c *RTSPClientConnection) handleMethodAnnounce() {
+func (c *RTSPClientConnection) handleMethodAnnounce(req *rtsp.Request) {
+	contentType := req.Header.Get(rtsp.Headers[rtsp.MySSContentTypeHeader])
+	if contentType != "" && !strings.HasPrefix(contentType, "application/sdp") {
+		c.setRTSPResponse("415 Unsupported Media Type")
+		return
+	}
+
+	sdpInfo, err := sdp.ParseSdp(req.Body)
+	if err != nil || len(sdpInfo.StreamInfoArray) == 0 {
+		c.handleCommandBad()
+		return
+	}
+
+	streamName := streamNameFromURL(req.URL)
+	if streamName == "" {
+		c.handleCommandBad()
+		return
+	}
+
+	sms := newLiveServerMediaSession(streamName, sdpInfo)
+	if !c.server.addServerMediaSession(sms) {
+		// somebody else is already publishing under this name
+		sms.close()
+		c.setRTSPResponse("403 Forbidden")
+		return
+	}
+	if c.announcedMediaSession != nil && !c.announcedMediaSession.hasPublisher() {
+		c.server.removeServerMediaSession(c.announcedMediaSession)
+	}
+	c.announcedMediaSession = sms
+	c.sdpInfo = sdpInfo
+
 	c.responseBuffer = fmt.Sprintf("RTSP/1.0 200 OK\r\n"+
 		"CSeq: %s\r\n"+
 		"Server:%s %s\r\n"+
@@ -57,6 +100,42 @@ func (c *RTSPClientConnection) handleMethodAnnounce() {
 		c.currentCSeq, SERVER, VERSION, rtsp.DateHeader())
 }
 
+func (c *RTSPClientConnection) handleCommandDescribe(req *rtsp.Request) {
+	streamName := streamNameFromURL(req.URL)
+	sms, existed := c.server.lookupServerMediaSession(streamName)
+	if !existed {
+		c.handleCommandNotFound()
+		return
+	}
+
+	accept := req.Header.Get(rtsp.Headers[rtsp.MySSAcceptHeader])
+	if accept != "" && !strings.Contains(accept, "application/sdp") && !strings.Contains(accept, "*/*") {
+		c.setRTSPResponse("406 Not Acceptable")
+		return
+	}
+
+	rtspURL := c.rtspURL(req.URL, streamName)
+	sdpDescription := sms.generateSDPDescription(rtspURL, c.localAddr)
+
+	c.responseBuffer = fmt.Sprintf("RTSP/1.0 200 OK\r\n"+
+		"CSeq: %s\r\n"+
+		"%s"+
+		"Content-Base: %s/\r\n"+
+		"Content-Type: application/sdp\r\n"+
+		"Content-Length: %d\r\n\r\n"+
+		"%s",
+		c.currentCSeq, rtsp.DateHeader(), rtspURL, len(sdpDescription), sdpDescription)
+}
+
+// rtspURL is the URL clients use for streamName, preferring the host they addressed us by.
+func (c *RTSPClientConnection) rtspURL(requestURL *url.URL, streamName string) string {
+	host := requestURL.Host
+	if host == "" {
+		host = net.JoinHostPort(c.localAddr, c.localPort)
+	}
+	return fmt.Sprintf("rtsp://%s/%s", host, streamName)
+}
+
 func (c *RTSPClientConnection) handleCommandGetParameter() {
 	c.setRTSPResponse("200 OK")
 }
@@ -65,6 +144,17 @@ func (c *RTSPClientConnection) handleCommandSetParameter() {
 	c.setRTSPResponse("200 OK")
 }
 
+func (c *RTSPClientConnection) handleCommandBad() {
+	c.setRTSPResponse("400 Bad Request")
+}
+
+func (c *RTSPClientConnection) handleCommandNotSupported() {
+	c.responseBuffer = fmt.Sprintf("RTSP/1.0 405 Method Not Allowed\r\n"+
+		"CSeq: %s\r\n"+
+		"%s%s\r\n",
+		c.currentCSeq, rtsp.DateHeader(), rtsp.PublicHeader())
+}
+
 func (c *RTSPClientConnection) handleCommandNotFound() {
 	c.setRTSPResponse("404 Stream Not Found")
 }
@@ -76,6 +166,36 @@ func (c *RTSPClientConnection) handleCommandSessionNotFound() {
 func (c *RTSPClientConnection) handleCommandUnsupportedTransport() {
 	c.setRTSPResponse("461 Unsupported Transport")
 }
+
+func (c *RTSPClientConnection) handleCommandUnauthorized(stale bool) {
+	var challenges string
+	for _, challenge := range c.server.digest.Challenges(stale) {
+		challenges += fmt.Sprintf("WWW-Authenticate: %s\r\n", challenge)
+	}
+	c.responseBuffer = fmt.Sprintf("RTSP/1.0 401 Unauthorized\r\n"+
+		"CSeq: %s\r\n"+
+		"%s%s\r\n",
+		c.currentCSeq, rtsp.DateHeader(), challenges)
+}
+
+// authenticationOK checks the credentials of a request when the server
+// requires them for it, and sets up a 401 response if they are missing or
+// wrong.
+func (c *RTSPClientConnection) authenticationOK(req *rtsp.Request) bool {
+	if !c.server.requiresAuth(req.Method, streamNameFromURL(req.URL)) {
+		return true
+	}
+
+	authorization := req.Header.Get(rtsp.Headers[rtsp.MySSAuthorizationHeader])
+	if _, err := c.server.digest.Check(req.Method, req.URL.String(), authorization); err != nil {
+		if err == auth.ErrBadCredentials {
+			fmt.Printf("authentication failed for %s %s from %s\n", req.Method, req.URL, c.remoteAddr)
+		}
+		c.handleCommandUnauthorized(err == auth.ErrStaleNonce)
+		return false
+	}
+	return true
+}
 func (c *RTSPClientConnection) setRTSPResponse(responseStr string) {
 	c.responseBuffer = fmt.Sprintf("RTSP/1.0 %s\r\n"+
 		"CSeq: %s\r\n"+
@@ -90,101 +210,177 @@ func (c *RTSPClientConnection) setRTSPResponseWithSessionID(responseStr string,
 		responseStr, c.currentCSeq, rtsp.DateHeader(), sessionID)
 }
 
-const rtspBufferSize = 10000
+// limit on how long a stalled client may block writes to its connection
+const socketWriteTimeout = 5 * time.Second
 
 func (c *RTSPClientConnection) incomingRequestHandler() {
 	defer c.socket.Close()
 
-	var isClose bool
-	buffer := make([]byte, rtspBufferSize)
+	reader := rtsp.NewReader(c.socket)
 	for {
-		//timeoutTCPConn := &RichConn{c.socket, (time.Duration(1) * time.Millisecond)}
-		//b := bufio.NewReadWriter(bufio.NewReaderSize(timeoutTCPConn,rtspBufferSize),bufio.NewWriterSize(timeoutTCPConn,rtspBufferSize))
-		//length, err := io.ReadFull(b, buffer)
-		length, err := c.socket.Read(buffer)
-
-		switch err {
-		case nil:
-			err = c.handleRequestBytes(buffer, length)
+		isFrame, err := reader.IsInterleavedFrame()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("failed to read from the connection: %v", err)
+			}
+			break
+		}
+
+		if isFrame {
+			frame, err := reader.ReadInterleavedFrame()
 			if err != nil {
-				fmt.Printf("Failed to handle Request Bytes: %v", err)
-				isClose = true
+				fmt.Printf("failed to read interleaved frame: %v", err)
+				break
 			}
-		default:
-			fmt.Printf("default: %v", err)
-			if err.Error() == "EOF" {
-				isClose = true
+			c.handleInterleavedFrame(uint(frame.Channel), frame.Payload)
+			continue
+		}
+
+		req, err := reader.ReadRequest()
+		if err != nil {
+			if protocolErr, ok := err.(*rtsp.ProtocolError); ok {
+				// answer what we can, then give up on the connection since
+				// we no longer know where the next message starts
+				c.currentCSeq = ""
+				if req != nil {
+					c.currentCSeq = req.Header.Get(rtsp.Headers[rtsp.MySSCSeqHeader])
+				}
+				c.setRTSPResponse(protocolErr.Status())
+				c.writeBytes([]byte(c.responseBuffer))
 			}
+			fmt.Printf("Failed to read request: %v", err)
+			break
 		}
 
-		if isClose {
+		if err = c.handleRequest(req); err != nil {
+			fmt.Printf("Failed to handle Request: %v", err)
 			break
 		}
 	}
 
-	fmt.Printf("disconnected the connection[%s:%s].", c.remoteAddr, c.remotePort)
+	fmt.Printf("disconnected the connection[%s].", net.JoinHostPort(c.remoteAddr, c.remotePort))
 	if c.clientSession != nil {
 		c.clientSession.destroy()
 	}
+	if c.announcedMediaSession != nil && !c.announcedMediaSession.hasPublisher() {
+		c.server.removeServerMediaSession(c.announcedMediaSession)
+	}
 }
 
-func (c *RTSPClientConnection) handleRequestBytes(buffer []byte, length int) error {
-	if length > 0 && buffer[0] == '$' {
-		return nil
+// handleInterleavedFrame routes a RTP or RTCP packet received on the RTSP
+// connection to the track that was set up with its channel.
+func (c *RTSPClientConnection) handleInterleavedFrame(channelID uint, packet []byte) {
+	if c.clientSession == nil {
+		return
 	}
+	c.clientSession.handleInterleavedPacket(channelID, packet)
+}
 
-	if req, err := rtsp.ReadRequest(buffer, length); err != nil {
-		return err
-	} else {
-		c.currentCSeq = req.Header.Get(rtsp.Headers[rtsp.MySSCSeqHeader])
-		c.sessionIDStr = req.Header.Get(rtsp.Headers[rtsp.MySSSessionHeader])
-		switch req.Method {
-		case rtsp.OPTIONS:
-			c.handleMethodOptions()
-		case rtsp.ANNOUNCE:
-			contentLength, _ := strconv.Atoi(req.Header.Get(rtsp.Headers[rtsp.MySSContentLengthHeader]))
-			if contentLength > 0 {
-				if len(req.Body) < contentLength {
-					buffer1 := make([]byte, rtspBufferSize)
-					c.socket.Read(buffer1)
-					req.Body = req.Body + string(buffer1[:])
-				}
-				if _, err := sdp.ParseSdp(req.Body); err != nil {
+// writeBytes sends a RTSP response or an interleaved frame. Both are written
+// under one lock so that media frames never split a response.
+func (c *RTSPClientConnection) writeBytes(b []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := c.writer.Write(b)
+	return err
+}
+
+func (c *RTSPClientConnection) handleRequest(req *rtsp.Request) error {
+	c.responseBuffer = ""
+	c.currentCSeq = req.Header.Get(rtsp.Headers[rtsp.MySSCSeqHeader])
+	c.sessionIDStr = parseSessionHeader(req.Header.Get(rtsp.Headers[rtsp.MySSSessionHeader]))
+	if !c.authenticationOK(req) {
+		return c.writeBytes([]byte(c.responseBuffer))
+	}
+	if clientSession, existed := c.server.getClientSession(c.sessionIDStr); existed {
+		// any request naming a session keeps it alive
+		clientSession.noteLiveness()
+	}
+
+	switch req.Method {
+	case rtsp.OPTIONS:
+		c.handleMethodOptions()
+	case rtsp.DESCRIBE:
+		c.handleCommandDescribe(req)
+	case rtsp.ANNOUNCE:
+		c.handleMethodAnnounce(req)
+	case rtsp.SETUP:
+		if c.sessionIDStr == "" {
+			for {
+				c.sessionIDStr = fmt.Sprintf("%08X", commonutilities.OurRandom32())
+				if _, existed := c.server.getClientSession(c.sessionIDStr); !existed {
 					break
 				}
 			}
-			c.handleMethodAnnounce()
-		case rtsp.SETUP:
-			if c.sessionIDStr == "" {
-				for {
-					c.sessionIDStr = fmt.Sprintf("%08X", commonutilities.OurRandom32())
-					if _, existed := c.server.getClientSession(c.sessionIDStr); !existed {
-						break
-					}
-				}
-				c.clientSession = c.newClientSession(c.sessionIDStr)
-				c.server.addClientSession(c.sessionIDStr, c.clientSession)
-			} else {
-				var existed bool
-				if c.clientSession, existed = c.server.getClientSession(c.sessionIDStr); !existed {
-					c.handleCommandSessionNotFound()
-				}
+			c.clientSession = c.newClientSession(c.sessionIDStr)
+			c.server.addClientSession(c.sessionIDStr, c.clientSession)
+		} else {
+			var existed bool
+			if c.clientSession, existed = c.server.getClientSession(c.sessionIDStr); !existed {
+				c.handleCommandSessionNotFound()
 			}
+		}
 
-			if c.clientSession != nil {
-				c.clientSession.handleCommandSetup(req.UrlPreSuffix, req.UrlSuffix, reqStr)
+		if c.clientSession != nil {
+			c.clientSession.handleCommandSetup(req)
+		}
+	case rtsp.PLAY, rtsp.RECORD, rtsp.PAUSE, rtsp.TEARDOWN, rtsp.GET_PARAMETER, rtsp.SET_PARAMETER:
+		if c.sessionIDStr == "" {
+			switch req.Method {
+			case rtsp.GET_PARAMETER:
+				c.handleCommandGetParameter()
+			case rtsp.SET_PARAMETER:
+				c.handleCommandSetParameter()
+			default:
+				c.handleCommandSessionNotFound()
 			}
+			break
 		}
-		sendBytes, err := c.socket.Write([]byte(c.responseBuffer))
-		if err != nil {
-			fmt.Printf("failed to send response buffer.%d", sendBytes)
-			return err
+		clientSession, existed := c.server.getClientSession(c.sessionIDStr)
+		if !existed {
+			c.handleCommandSessionNotFound()
+			break
 		}
-		fmt.Printf("send response:\n%s", c.responseBuffer)
+		clientSession.handleCommandWithinSession(req.Method, req)
+	default:
+		c.handleCommandNotSupported()
 	}
+
+	if err := c.writeBytes([]byte(c.responseBuffer)); err != nil {
+		fmt.Printf("failed to send response buffer.%v", err)
+		return err
+	}
+	fmt.Printf("send response:\n%s", c.responseBuffer)
 	return nil
 }
 
+// parseSessionHeader strips parameters such as ";timeout=60" from a "Session:" header value.
+func parseSessionHeader(session string) string {
+	if i := strings.Index(session, ";"); i >= 0 {
+		session = session[:i]
+	}
+	return strings.TrimSpace(session)
+}
+
+// streamNameFromURL is the stream name of a request URL, its path made
+// canonical: every use of the name, from the authentication rules to the
+// file of the content directory, must see the same one, or "/./private"
+// would get past a rule for "private".
+func streamNameFromURL(u *url.URL) string {
+	return strings.Trim(path.Clean("/"+u.Path), "/")
+}
+
+// sendInterleavedFrame writes a RTP or RTCP packet to the RTSP connection,
+// framed as described in RFC 2326 section 10.12.
+func (c *RTSPClientConnection) sendInterleavedFrame(channelID uint, packet []byte) error {
+	frame := make([]byte, 4+len(packet))
+	frame[0] = '$'
+	frame[1] = byte(channelID)
+	binary.BigEndian.PutUint16(frame[2:4], uint16(len(packet)))
+	copy(frame[4:], packet)
+	return c.writeBytes(frame)
+}
+
 func (c *RTSPClientConnection) newClientSession(sessionID string) *RTSPClientSession {
 	return newRTSPClientSession(c, sessionID)
 }
@@ -0,0 +1,310 @@
+package rtsp_server
+
+import (
+	"os"
+	"time"
+
+	"github.com/yangxianzhi/CommonUtilities"
+	"github.com/yangxianzhi/my-streaming-server/aac"
+	"github.com/yangxianzhi/my-streaming-server/h264"
+	"github.com/yangxianzhi/my-streaming-server/h265"
+	"github.com/yangxianzhi/my-streaming-server/mp4"
+	"github.com/yangxianzhi/my-streaming-server/rtcp"
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+// filePlayer plays the tracks of a file that a RTSPClientSession has set
+// up, from any position and at the pace of their decoding times. Every
+// session has its own, with its own position in the file. Its outputs
+// belong to the goroutine that plays them while it runs, so they are only
+// changed while it is paused.
+type filePlayer struct {
+	file     *os.File
+	duration time.Duration
+	outputs  []*fileOutput
+	end      time.Duration // of the range being played
+	stop     chan struct{} // nil while paused
+	done     chan struct{}
+}
+
+// fileOutput sends one track of a file to the client of a StreamServerState,
+// as an RTP stream of its own.
+type fileOutput struct {
+	streamState   *StreamServerState
+	track         *mp4.Track
+	clockRate     uint32
+	timestampBase uint32 // the RTP timestamp of npt 0
+	packetize     func(sample []byte, isSync bool, timestamp uint32) ([]*rtp.Packet, error)
+	seq           uint16 // of the next packet
+	next          int    // the index of the next sample
+	packetCount   uint32
+	octetCount    uint32
+}
+
+func newFilePlayer(source *fileSource) (*filePlayer, error) {
+	file, err := os.Open(source.path)
+	if err != nil {
+		return nil, err
+	}
+	return &filePlayer{file: file, duration: source.movie.Duration}, nil
+}
+
+// addOutput has the player send the track streamState has set up, from the
+// start of the file. It does nothing for a track the player already sends.
+func (p *filePlayer) addOutput(streamState *StreamServerState) error {
+	for _, o := range p.outputs {
+		if o.streamState == streamState {
+			return nil
+		}
+	}
+	o, err := newFileOutput(streamState)
+	if err != nil {
+		return err
+	}
+	p.outputs = append(p.outputs, o)
+	return nil
+}
+
+// removeOutput stops sending the track of streamState, while the others
+// play on.
+func (p *filePlayer) removeOutput(streamState *StreamServerState) {
+	playing := p.stop != nil
+	p.pause()
+	for i, o := range p.outputs {
+		if o.streamState == streamState {
+			o.sendGoodbye()
+			p.outputs = append(p.outputs[:i], p.outputs[i+1:]...)
+			break
+		}
+	}
+	if playing {
+		p.play(p.position(), p.end)
+	}
+}
+
+// position is the npt of the next sample the player sends, the duration of
+// the file once it has sent them all.
+func (p *filePlayer) position() time.Duration {
+	position := p.duration
+	for _, o := range p.outputs {
+		if at, ok := o.nextTime(); ok && at < position {
+			position = at
+		}
+	}
+	return position
+}
+
+// seek moves the player to npt or rather, so that the client can decode
+// the video from where it starts, to the nearest sync sample of the video
+// track. It returns the npt it has moved to.
+func (p *filePlayer) seek(npt time.Duration) time.Duration {
+	for _, o := range p.outputs {
+		if o.track.Handler == mp4.HandlerVideo && len(o.track.Samples) > 0 {
+			npt = o.track.Time(o.track.Samples[o.track.NearestSyncSample(npt)].DecodeTime)
+			break
+		}
+	}
+	for _, o := range p.outputs {
+		o.next = o.track.SampleFrom(npt)
+	}
+	return npt
+}
+
+// play starts sending the samples from position from, which the player
+// has to be at, up to end.
+func (p *filePlayer) play(from, end time.Duration) {
+	p.pause()
+	p.end = end
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.run(p.stop, p.done, from, end)
+}
+
+// pause stops sending samples and waits for the player goroutine to finish.
+func (p *filePlayer) pause() {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop, p.done = nil, nil
+}
+
+// close stops the player for good, telling the clients that the streams end.
+func (p *filePlayer) close() {
+	p.pause()
+	for _, o := range p.outputs {
+		o.sendGoodbye()
+	}
+	p.outputs = nil
+	p.file.Close()
+}
+
+// run sends every sample at the time its decoding time is due, measured
+// from the start of the run at npt from, and sender reports in between.
+func (p *filePlayer) run(stop, done chan struct{}, from, end time.Duration) {
+	defer close(done)
+	start := time.Now()
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		var output *fileOutput
+		var at time.Duration
+		for _, o := range p.outputs {
+			if t, ok := o.nextTime(); ok && (output == nil || t < at) {
+				output, at = o, t
+			}
+		}
+		if output == nil || at >= end {
+			return
+		}
+
+		if wait := time.Until(start.Add(at - from)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case now := <-ticker.C:
+				timer.Stop()
+				for _, o := range p.outputs {
+					o.sendSenderReport(now, from+now.Sub(start))
+				}
+				continue
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+		output.sendSample(p.file)
+	}
+}
+
+// newFileOutput makes the packetizer of the track of streamState, which
+// sends the parameter sets of a video track in band too, ahead of every
+// sync sample, for clients that don't take them from the SDP.
+func newFileOutput(streamState *StreamServerState) (*fileOutput, error) {
+	subsession := streamState.subsession
+	o := &fileOutput{
+		streamState:   streamState,
+		track:         subsession.track,
+		clockRate:     subsession.timestampFrequency(),
+		timestampBase: commonutilities.OurRandom32(),
+		seq:           uint16(commonutilities.OurRandom32()),
+	}
+	format := subsession.streamInfo.PreferredFormat()
+	switch o.track.Format {
+	case mp4.FormatAVC1, mp4.FormatAVC3:
+		parameterSets := append(append([][]byte(nil), o.track.SPS...), o.track.PPS...)
+		packetizer := &h264.Packetizer{PayloadType: format.PayloadType, SSRC: streamState.ssrc, SequenceNumber: o.seq}
+		o.packetize = func(sample []byte, isSync bool, timestamp uint32) ([]*rtp.Packet, error) {
+			au, err := o.track.NALUs(sample)
+			if err != nil {
+				return nil, err
+			}
+			if isSync {
+				au = append(parameterSets[:len(parameterSets):len(parameterSets)], au...)
+			}
+			return packetizer.Packetize(au, timestamp)
+		}
+	case mp4.FormatHVC1, mp4.FormatHEV1:
+		parameterSets := append(append(append([][]byte(nil), o.track.VPS...), o.track.SPS...), o.track.PPS...)
+		packetizer := &h265.Packetizer{PayloadType: format.PayloadType, SSRC: streamState.ssrc, SequenceNumber: o.seq}
+		o.packetize = func(sample []byte, isSync bool, timestamp uint32) ([]*rtp.Packet, error) {
+			au, err := o.track.NALUs(sample)
+			if err != nil {
+				return nil, err
+			}
+			if isSync {
+				au = append(parameterSets[:len(parameterSets):len(parameterSets)], au...)
+			}
+			return packetizer.Packetize(au, timestamp)
+		}
+	default:
+		params, err := format.AACParams()
+		if err != nil {
+			return nil, err
+		}
+		packetizer := &aac.Packetizer{Params: params, PayloadType: format.PayloadType, SSRC: streamState.ssrc, SequenceNumber: o.seq}
+		o.packetize = func(sample []byte, isSync bool, timestamp uint32) ([]*rtp.Packet, error) {
+			return packetizer.Packetize([][]byte{sample}, timestamp)
+		}
+	}
+	return o, nil
+}
+
+// nextTime is the decoding time of the next sample; ok is false once the
+// output has sent them all.
+func (o *fileOutput) nextTime() (at time.Duration, ok bool) {
+	if o.next >= len(o.track.Samples) {
+		return 0, false
+	}
+	return o.track.Time(o.track.Samples[o.next].DecodeTime), true
+}
+
+// rtpTime is the RTP timestamp of npt.
+func (o *fileOutput) rtpTime(npt time.Duration) uint32 {
+	return o.timestampBase + uint32(int64(npt.Seconds()*float64(o.clockRate)))
+}
+
+// sendSample sends the next sample, timestamped with its presentation time.
+// A sample that can't be read or packetized is skipped.
+func (o *fileOutput) sendSample(r *os.File) {
+	i := o.next
+	o.next++
+	data, err := o.track.ReadSample(r, i)
+	if err != nil {
+		return
+	}
+	sample := o.track.Samples[i]
+	presentationTime := int64(sample.DecodeTime) + int64(sample.CompositionOffset)
+	timestamp := o.timestampBase + uint32(presentationTime*int64(o.clockRate)/int64(o.track.Timescale))
+	packets, err := o.packetize(data, sample.IsSync, timestamp)
+	if err != nil {
+		return
+	}
+	for _, packet := range packets {
+		buf, err := packet.Marshal()
+		if err != nil {
+			continue
+		}
+		o.streamState.sendRTP(buf)
+		o.packetCount++
+		o.octetCount += uint32(len(packet.Payload))
+		o.seq = packet.SequenceNumber + 1
+	}
+}
+
+// sendSenderReport sends a SR for the stream, at npt, along with our CNAME.
+func (o *fileOutput) sendSenderReport(now time.Time, npt time.Duration) {
+	packet, err := rtcp.Marshal([]rtcp.Packet{
+		&rtcp.SenderReport{
+			SSRC:        o.streamState.ssrc,
+			NTPTime:     rtcp.NTPTime(now),
+			RTPTime:     o.rtpTime(npt),
+			PacketCount: o.packetCount,
+			OctetCount:  o.octetCount,
+		},
+		rtcp.NewCNAME(o.streamState.ssrc, rtcpCNAME),
+	})
+	if err == nil {
+		o.streamState.sendRTCP(packet)
+	}
+}
+
+// sendGoodbye tells the client that our stream ends.
+func (o *fileOutput) sendGoodbye() {
+	ssrc := o.streamState.ssrc
+	packet, err := rtcp.Marshal([]rtcp.Packet{
+		&rtcp.ReceiverReport{SSRC: ssrc},
+		rtcp.NewCNAME(ssrc, rtcpCNAME),
+		&rtcp.Goodbye{Sources: []uint32{ssrc}},
+	})
+	if err == nil {
+		o.streamState.sendRTCP(packet)
+	}
+}
@@ -0,0 +1,171 @@
+package rtsp_server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yangxianzhi/my-streaming-server/aac"
+	"github.com/yangxianzhi/my-streaming-server/h264"
+	"github.com/yangxianzhi/my-streaming-server/h265"
+	"github.com/yangxianzhi/my-streaming-server/mp4"
+	"github.com/yangxianzhi/my-streaming-server/sdp"
+)
+
+// fileSource is the MP4 file of the content directory a ServerMediaSession
+// plays on demand, as it was when the stream was made from it.
+type fileSource struct {
+	path    string
+	size    int64
+	modTime time.Time
+	movie   *mp4.File
+}
+
+// contentPath is the file of the content directory a stream name refers
+// to. Cleaning the name as an absolute path keeps ".." inside the directory.
+// It is "" for a name with a separator of the system's own, such as '\' on
+// Windows, which the cleaning and the authentication rules don't see.
+func (s *RTSPServer) contentPath(streamName string) string {
+	if os.PathSeparator != '/' && strings.ContainsRune(streamName, os.PathSeparator) {
+		return ""
+	}
+	return filepath.Join(s.contentDir, filepath.FromSlash(path.Clean("/"+streamName)))
+}
+
+// lookupFileServerMediaSession returns the stream of the file a stream name
+// refers to, made the first time it is asked for and again whenever the
+// file has changed since. existing is the stream made before, if any; it
+// goes away with the file.
+func (s *RTSPServer) lookupFileServerMediaSession(streamName string, existing *ServerMediaSession) (*ServerMediaSession, bool) {
+	filePath := s.contentPath(streamName)
+	if filePath == "" {
+		return nil, false
+	}
+	info, err := os.Stat(filePath)
+	if existing != nil {
+		if err == nil && info.Size() == existing.source.size && info.ModTime().Equal(existing.source.modTime) {
+			return existing, true
+		}
+		s.removeServerMediaSession(existing)
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, false
+	}
+
+	sms, err := newFileServerMediaSession(streamName, filePath)
+	if err != nil {
+		fmt.Printf("can't serve %s: %v\n", filePath, err)
+		return nil, false
+	}
+
+	// another request may have made the stream of the file meanwhile, or a
+	// live stream of the same name been announced: that one is kept, so
+	// that all sessions of the name share a stream
+	s.mediaSessionMutex.Lock()
+	defer s.mediaSessionMutex.Unlock()
+	if current, existed := s.serverMediaSessions[streamName]; existed {
+		sms.close()
+		return current, true
+	}
+	s.registerServerMediaSession(sms)
+	return sms, true
+}
+
+// newFileServerMediaSession makes the stream of an MP4 file, described by
+// an SDP with one track for each H.264, H.265 and AAC track of the movie.
+func newFileServerMediaSession(streamName, filePath string) (*ServerMediaSession, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	movie, err := mp4.Parse(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	var description strings.Builder
+	fmt.Fprintf(&description, "v=0\r\ns=%s\r\nt=0 0\r\n", path.Base(streamName))
+	var tracks []*mp4.Track
+	for _, track := range movie.Tracks {
+		media, err := trackDescription(track, 96+len(tracks))
+		if err != nil {
+			fmt.Printf("%s: skipping track %d: %v\n", filePath, track.ID, err)
+			continue
+		}
+		tracks = append(tracks, track)
+		description.WriteString(media)
+		fmt.Fprintf(&description, "a=control:trackID=%d\r\n", len(tracks))
+	}
+	if len(tracks) == 0 {
+		return nil, mp4.ErrNoTracks
+	}
+	sdpInfo, err := sdp.ParseSdp(description.String())
+	if err != nil {
+		return nil, err
+	}
+
+	sms := newServerMediaSession(streamName, sdpInfo)
+	sms.source = &fileSource{path: filePath, size: info.Size(), modTime: info.ModTime(), movie: movie}
+	for i, subsession := range sms.subsessions {
+		subsession.track = tracks[i]
+	}
+	return sms, nil
+}
+
+// trackDescription returns the "m=", "a=rtpmap:" and "a=fmtp:" lines of a
+// track sent with a dynamic payload type.
+func trackDescription(track *mp4.Track, payloadType int) (string, error) {
+	switch track.Format {
+	case mp4.FormatAVC1, mp4.FormatAVC3:
+		fmtp := "packetization-mode=1"
+		if len(track.SPS) > 0 && len(track.SPS[0]) >= 4 {
+			fmtp += ";profile-level-id=" + strings.ToUpper(hex.EncodeToString(track.SPS[0][1:4]))
+		}
+		if len(track.SPS) > 0 && len(track.PPS) > 0 {
+			fmtp += ";sprop-parameter-sets=" + h264.SpropParameterSets(track.SPS, track.PPS)
+		}
+		return fmt.Sprintf("m=video 0 RTP/AVP %[1]d\r\na=rtpmap:%[1]d H264/90000\r\na=fmtp:%[1]d %[2]s\r\n",
+			payloadType, fmtp), nil
+	case mp4.FormatHVC1, mp4.FormatHEV1:
+		var params []string
+		for _, set := range []struct {
+			name  string
+			nalus [][]byte
+		}{{"sprop-vps", track.VPS}, {"sprop-sps", track.SPS}, {"sprop-pps", track.PPS}} {
+			if len(set.nalus) > 0 {
+				params = append(params, set.name+"="+h265.SpropParameterSet(set.nalus))
+			}
+		}
+		media := fmt.Sprintf("m=video 0 RTP/AVP %[1]d\r\na=rtpmap:%[1]d H265/90000\r\n", payloadType)
+		if len(params) > 0 {
+			media += fmt.Sprintf("a=fmtp:%d %s\r\n", payloadType, strings.Join(params, ";"))
+		}
+		return media, nil
+	case mp4.FormatMP4A:
+		config := &aac.AudioSpecificConfig{}
+		if err := config.Unmarshal(track.AudioConfig); err != nil {
+			return "", err
+		}
+		params := &aac.Params{
+			StreamType:       5,
+			ProfileLevelID:   1,
+			Mode:             "AAC-hbr",
+			SizeLength:       13,
+			IndexLength:      3,
+			IndexDeltaLength: 3,
+			Config:           config,
+		}
+		return fmt.Sprintf("m=audio 0 RTP/AVP %[1]d\r\na=rtpmap:%[1]d MPEG4-GENERIC/%[2]d/%[3]d\r\na=fmtp:%[1]d %[4]s\r\n",
+			payloadType, config.SampleRate, config.ChannelCount, params), nil
+	}
+	return "", fmt.Errorf("unsupported format %q", track.Format)
+}
@@ -0,0 +1,253 @@
+package rtsp_server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yangxianzhi/my-streaming-server/auth"
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+	"github.com/yangxianzhi/my-streaming-server/rtsp"
+)
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], boxType)
+	return append(b, body...)
+}
+
+func mp4Fields(values ...interface{}) []byte {
+	var b bytes.Buffer
+	for _, v := range values {
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	return b.Bytes()
+}
+
+// buildTestMovie returns a 200 ms MP4 file of a H.264 track of six 30 fps
+// samples, of which the first and fourth are sync samples.
+func buildTestMovie() []byte {
+	sps := []byte{0x67, 0x42, 0xC0, 0x1E, 0xD9}
+	pps := []byte{0x68, 0xCE, 0x3C, 0x80}
+	ftyp := mp4Box("ftyp", []byte("isom"), mp4Fields(uint32(512)), []byte("isomavc1"))
+	var mdat, sizes []byte
+	for i := 0; i < 6; i++ {
+		nalu := []byte{0x41, byte(i), 0xAA, 0xBB}
+		if i%3 == 0 {
+			nalu[0] = 0x65
+		}
+		mdat = append(mdat, mp4Fields(uint32(len(nalu)))...)
+		mdat = append(mdat, nalu...)
+		sizes = append(sizes, mp4Fields(uint32(4+len(nalu)))...)
+	}
+
+	avcC := mp4Box("avcC", []byte{1, 0x42, 0xC0, 0x1E, 0xFF, 0xE1}, mp4Fields(uint16(len(sps))), sps,
+		[]byte{1}, mp4Fields(uint16(len(pps))), pps)
+	avc1 := mp4Box("avc1", make([]byte, 24), mp4Fields(uint16(320), uint16(240)), make([]byte, 50), avcC)
+	stbl := mp4Box("stbl",
+		mp4Box("stsd", mp4Fields(uint32(0), uint32(1)), avc1),
+		mp4Box("stts", mp4Fields(uint32(0), uint32(1), uint32(6), uint32(3000))),
+		mp4Box("stss", mp4Fields(uint32(0), uint32(2), uint32(1), uint32(4))),
+		mp4Box("stsc", mp4Fields(uint32(0), uint32(1), uint32(1), uint32(6), uint32(1))),
+		mp4Box("stsz", mp4Fields(uint32(0), uint32(0), uint32(6)), sizes),
+		mp4Box("stco", mp4Fields(uint32(0), uint32(1), uint32(len(ftyp)+8))))
+	trak := mp4Box("trak",
+		mp4Box("tkhd", mp4Fields(uint32(3), uint32(0), uint32(0), uint32(1), uint32(0), uint32(18000))),
+		mp4Box("mdia",
+			mp4Box("mdhd", mp4Fields(uint32(0), uint32(0), uint32(0), uint32(90000), uint32(18000), uint32(0))),
+			mp4Box("hdlr", mp4Fields(uint32(0), uint32(0)), []byte("vide"), make([]byte, 13)),
+			mp4Box("minf", stbl)))
+	moov := mp4Box("moov", mp4Box("mvhd", mp4Fields(uint32(0), uint32(0), uint32(0), uint32(1000), uint32(200)),
+		make([]byte, 80)), trak)
+	return bytes.Join([][]byte{ftyp, mp4Box("mdat", mdat), moov}, nil)
+}
+
+func TestFileStream(t *testing.T) {
+	dir := t.TempDir()
+	moviePath := filepath.Join(dir, "clips", "test.mp4")
+	if err := os.MkdirAll(filepath.Dir(moviePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(moviePath, buildTestMovie(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := New()
+	server.SetBindAddresses("127.0.0.1")
+	server.SetContentDirectory(dir)
+	if err := server.Listen(45690); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Destroy()
+
+	if got, want := server.contentPath("../../clips/test.mp4"), moviePath; got != want {
+		t.Errorf("contentPath of an escaping name = %s, want %s", got, want)
+	}
+
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 45692})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	const streamURL = "rtsp://127.0.0.1:45690/clips/test.mp4"
+	ctx := context.Background()
+	session := rtsp.NewSession()
+	defer session.Close()
+	if _, resp, err := session.Describe(ctx, "rtsp://127.0.0.1:45690/clips/none.mp4"); err != nil || resp.StatusCode != rtsp.NotFound {
+		t.Errorf("DESCRIBE of a missing file: %v, %v", resp, err)
+	}
+	info, _, err := session.Describe(ctx, streamURL)
+	if err != nil || info == nil {
+		t.Fatalf("DESCRIBE: %v", err)
+	}
+	if r, _ := info.Attribute("range"); r != "npt=0-0.200" || len(info.StreamInfoArray) != 1 {
+		t.Fatalf("range %q, %d streams", r, len(info.StreamInfoArray))
+	}
+	format := info.StreamInfoArray[0].PreferredFormat()
+	if format == nil || format.EncodingName != "H264" || format.Param("sprop-parameter-sets") != "Z0LAHtk=,aM48gA==" ||
+		format.Param("profile-level-id") != "42C01E" {
+		t.Errorf("format %+v", format)
+	}
+
+	if _, err := session.Setup(ctx, streamURL, "RTP/AVP;unicast;client_port=45692-45693"); err != nil {
+		t.Fatal(err)
+	}
+	play := func(rangeHeader string) *rtsp.Response {
+		req, _ := rtsp.NewRequest(rtsp.PLAY, streamURL, "", "")
+		req.Header.Set("Session", session.SessionID())
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := session.Do(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := play("npt=1-"); resp.StatusCode != rtsp.InvalidRange {
+		t.Errorf("PLAY after the end: %d", resp.StatusCode)
+	}
+
+	// 60 ms is closer to the sync sample at 100 ms than to the one at 0
+	resp := play("npt=0.06-")
+	if resp.StatusCode != rtsp.OK || resp.Header.Get("Range") != "npt=0.100-0.200" {
+		t.Fatalf("seeking PLAY: %d, Range: %s", resp.StatusCode, resp.Header.Get("Range"))
+	}
+	rtpInfo, err := rtsp.ParseRTPInfo(resp.Header.Get("RTP-Info"))
+	if err != nil || len(rtpInfo) != 1 || !strings.HasSuffix(rtpInfo[0].URL, "/trackID=1") {
+		t.Fatalf("RTP-Info: %s", resp.Header.Get("RTP-Info"))
+	}
+
+	// the sync sample comes first, with the parameter sets
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 1500)
+	n, _, err := receiver.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packet rtp.Packet
+	if err := packet.Unmarshal(buffer[:n]); err != nil || packet.SequenceNumber != rtpInfo[0].Seq ||
+		packet.Timestamp != rtpInfo[0].RTPTime || !bytes.Contains(packet.Payload, []byte{0x67, 0x42, 0xC0, 0x1E}) {
+		t.Errorf("first packet %+v, RTP-Info %s: %v", packet, rtpInfo[0], err)
+	}
+
+	// once the file has been played to the end, it starts over
+	time.Sleep(200 * time.Millisecond)
+	if resp := play(""); resp.StatusCode != rtsp.OK || resp.Header.Get("Range") != "npt=0.000-0.200" {
+		t.Errorf("PLAY at the end: %d, Range: %s", resp.StatusCode, resp.Header.Get("Range"))
+	}
+
+	// a file that changes is served anew, one that is removed goes away
+	sms, _ := server.lookupServerMediaSession("clips/test.mp4")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(moviePath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if changed, existed := server.lookupServerMediaSession("clips/test.mp4"); !existed || changed == sms {
+		t.Error("the stream of a changed file wasn't remade")
+	}
+	os.Remove(moviePath)
+	if _, existed := server.lookupServerMediaSession("clips/test.mp4"); existed {
+		t.Error("the stream outlived its file")
+	}
+}
+
+func TestFileStreamAuthenticationCanonicalPath(t *testing.T) {
+	dir := t.TempDir()
+	moviePath := filepath.Join(dir, "private", "a.mp4")
+	if err := os.MkdirAll(filepath.Dir(moviePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(moviePath, buildTestMovie(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	users := auth.NewUsers("streams")
+	users.Add("alice", "secret")
+	server := New()
+	server.SetBindAddresses("127.0.0.1")
+	server.SetContentDirectory(dir)
+	server.SetAuthenticator(users, AuthRule{Path: "private"})
+	if err := server.Listen(45694); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Destroy()
+
+	// other spellings of the protected path don't get around the rule
+	for _, path := range []string{"/private/a.mp4", "/./private/a.mp4", "/x/../private/a.mp4", "//private/./a.mp4"} {
+		session := rtsp.NewSession()
+		req, _ := rtsp.NewRequest(rtsp.DESCRIBE, "rtsp://127.0.0.1:45694"+path, "", "")
+		resp, err := session.Do(context.Background(), req)
+		session.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != rtsp.Unauthorized {
+			t.Errorf("DESCRIBE %s: %d, want %d", path, resp.StatusCode, rtsp.Unauthorized)
+		}
+	}
+}
+
+func TestFileStreamConcurrentLookup(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.mp4"), buildTestMovie(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := New()
+	server.SetContentDirectory(dir)
+	defer server.Destroy()
+
+	// the first requests for a file all get the one stream made of it
+	const lookups = 32
+	start := make(chan struct{})
+	found := make(chan *ServerMediaSession)
+	for i := 0; i < lookups; i++ {
+		go func() {
+			<-start
+			sms, _ := server.lookupServerMediaSession("a.mp4")
+			found <- sms
+		}()
+	}
+	close(start)
+	first := <-found
+	for i := 1; i < lookups; i++ {
+		if sms := <-found; sms == nil || sms != first {
+			t.Errorf("lookups made streams %p and %p", first, sms)
+		}
+	}
+	if sms, _ := server.lookupServerMediaSession("a.mp4"); sms != first {
+		t.Errorf("stream %p registered, lookups got %p", sms, first)
+	}
+}
@@ -0,0 +1,338 @@
+package rtsp_server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yangxianzhi/my-streaming-server/h264"
+	"github.com/yangxianzhi/my-streaming-server/h265"
+	"github.com/yangxianzhi/my-streaming-server/mp4"
+	"github.com/yangxianzhi/my-streaming-server/sdp"
+)
+
+// ServerMediaSession is a named stream that clients can play. Live streams
+// are registered by a publisher with ANNOUNCE and fed with RECORD, or by a
+// relay of a UDP broadcast; the MP4 files of the content directory are
+// played on demand.
+type ServerMediaSession struct {
+	streamName   string
+	sdpInfo      sdp.Info
+	subsessions  []*ServerMediaSubsession
+	mutex        sync.Mutex
+	publisher    *RTSPClientSession
+	relay        *relay      // set for a relayed stream, which has no publisher
+	source       *fileSource // set for a file, which neither
+	creationTime time.Time
+
+	// where the tracks get their multicast group, nil without multicast
+	multicastPool *MulticastPool
+}
+
+// ServerMediaSubsession is a single track (one "m=" line) of a ServerMediaSession.
+type ServerMediaSubsession struct {
+	trackID         string
+	controlPath     string // see controlPath
+	streamInfo      *sdp.StreamInfo
+	mediaSession    *ServerMediaSession
+	reflector       *ReflectorStream // nil for the track of a file
+	track           *mp4.Track       // the track of a file
+	packetsReceived uint64
+	bytesReceived   uint64
+
+	multicastMutex sync.Mutex
+	multicast      *multicastGroup
+}
+
+func newLiveServerMediaSession(streamName string, sdpInfo sdp.Info) *ServerMediaSession {
+	sms := newServerMediaSession(streamName, sdpInfo)
+	for _, subsession := range sms.subsessions {
+		subsession.reflector = newReflectorStream(subsession)
+	}
+	return sms
+}
+
+func newServerMediaSession(streamName string, sdpInfo sdp.Info) *ServerMediaSession {
+	sms := &ServerMediaSession{
+		streamName:   streamName,
+		sdpInfo:      sdpInfo,
+		creationTime: time.Now(),
+	}
+	for i, streamInfo := range sdpInfo.StreamInfoArray {
+		subsession := &ServerMediaSubsession{
+			trackID:      trackIDFromControl(streamInfo.TrackName, i),
+			controlPath:  controlPath(streamName, streamInfo.TrackName),
+			streamInfo:   streamInfo,
+			mediaSession: sms,
+		}
+		sms.subsessions = append(sms.subsessions, subsession)
+	}
+	return sms
+}
+
+// trackIDFromControl turns an "a=control:" value into the track suffix used in
+// request URLs. Absolute control URLs are reduced to their last path segment.
+func trackIDFromControl(control string, index int) string {
+	if i := strings.LastIndex(control, "/"); i >= 0 {
+		control = control[i+1:]
+	}
+	if control == "" || control == "*" {
+		control = fmt.Sprintf("trackID=%d", index+1)
+	}
+	return control
+}
+
+// controlPath resolves an "a=control:" value against the URL of the stream
+// as its base, as RFC 2326 appendix C.1.1 says, and returns the path of the
+// result without its slashes, e.g. "live/cam1/streamid=0". It is the URL
+// the publisher of the stream sets the track up with; "" if the control
+// doesn't name a track of its own.
+func controlPath(streamName, control string) string {
+	if control == "" || control == "*" {
+		return ""
+	}
+	ref, err := url.Parse(control)
+	if err != nil {
+		return ""
+	}
+	base := &url.URL{Path: "/" + streamName + "/"}
+	return strings.Trim(base.ResolveReference(ref).Path, "/")
+}
+
+func (sms *ServerMediaSession) StreamName() string {
+	return sms.streamName
+}
+
+func (sms *ServerMediaSession) SubsessionCount() int {
+	return len(sms.subsessions)
+}
+
+// generateSDPDescription rebuilds the SDP of the stream for a DESCRIBE
+// response, pointing the "a=control:" of every track at this server.
+func (sms *ServerMediaSession) generateSDPDescription(rtspURL, serverAddr string) string {
+	sessionName := sms.sdpInfo.SessionName
+	if sessionName == "" {
+		sessionName = sms.streamName
+	}
+
+	// SDP has no place for the zone of a link-local IPv6 address
+	serverAddr, _, _ = strings.Cut(serverAddr, "%")
+	info := sdp.Info{
+		Origin: sdp.Origin{
+			Username:       "-",
+			SessionID:      uint64(sms.creationTime.Unix()),
+			SessionVersion: 1,
+			NetworkType:    "IN",
+			AddressType:    sdp.AddressType(serverAddr),
+			Address:        serverAddr,
+		},
+		SessionName:        sessionName,
+		SessionInformation: sms.sdpInfo.SessionInformation,
+		Connection: &sdp.Connection{
+			NetworkType: "IN",
+			AddressType: sdp.AddressType(serverAddr),
+			Address:     sdp.UnspecifiedAddress(serverAddr),
+		},
+		Attributes: []sdp.Attribute{
+			{Key: "tool", Value: SERVER + " " + VERSION},
+			{Key: "control", Value: "*"},
+			{Key: "range", Value: sms.rangeAttribute()},
+		},
+	}
+	for _, attribute := range sms.sdpInfo.Attributes {
+		if !isServerSideAttribute(attribute.Key) {
+			info.Attributes = append(info.Attributes, attribute)
+		}
+	}
+
+	for _, subsession := range sms.subsessions {
+		// publishers advertise their own ports and addresses
+		streamInfo := subsession.streamInfo.Clone()
+		streamInfo.Port = 0
+		streamInfo.Connections = nil
+		// only groups a multicast SETUP has already allocated, describing a
+		// stream mustn't use up the pool
+		if g := subsession.currentMulticastGroup(); g != nil {
+			streamInfo.Port = uint16(g.port)
+			streamInfo.Connections = []sdp.Connection{g.connection()}
+		}
+		streamInfo.SetAttribute("control", rtspURL+"/"+subsession.trackID)
+		info.StreamInfoArray = append(info.StreamInfoArray, streamInfo)
+	}
+	return string(info.Marshal())
+}
+
+// rangeAttribute is the "a=range:" of the stream: open ended for a live
+// stream, up to its duration for a file.
+func (sms *ServerMediaSession) rangeAttribute() string {
+	if sms.source != nil {
+		return fmt.Sprintf("npt=0-%.3f", sms.source.movie.Duration.Seconds())
+	}
+	return "npt=0-"
+}
+
+// isServerSideAttribute reports whether a session level attribute of the
+// original SDP is replaced by one the server generates itself.
+func isServerSideAttribute(key string) bool {
+	switch key {
+	case "tool", "control", "range":
+		return true
+	}
+	return false
+}
+
+// close stops the reflectors of every track, detaching all players, and
+// gives their multicast groups back.
+func (sms *ServerMediaSession) close() {
+	for _, subsession := range sms.subsessions {
+		if subsession.reflector != nil {
+			subsession.reflector.close()
+		}
+		subsession.multicastMutex.Lock()
+		if subsession.multicast != nil {
+			subsession.multicast.close()
+			subsession.multicast = nil
+		}
+		subsession.multicastMutex.Unlock()
+	}
+}
+
+func (sms *ServerMediaSession) lookupSubsession(trackID string) *ServerMediaSubsession {
+	for _, subsession := range sms.subsessions {
+		if strings.EqualFold(subsession.trackID, trackID) {
+			return subsession
+		}
+	}
+	return nil
+}
+
+// lookupControl finds the track path, the path of a request URL without its
+// slashes, is the control URL of: "<stream>/<trackID>", as in the SDP we
+// describe the stream with, or the control URL of the SDP it was announced
+// with.
+func (sms *ServerMediaSession) lookupControl(path string) *ServerMediaSubsession {
+	for _, subsession := range sms.subsessions {
+		if subsession.controlPath != "" && subsession.controlPath == path {
+			return subsession
+		}
+	}
+	if trackID, ok := strings.CutPrefix(path, sms.streamName+"/"); ok {
+		return sms.lookupSubsession(trackID)
+	}
+	return nil
+}
+
+// setPublisher marks session as the source of this stream. It fails if
+// another session is already publishing, or the stream is relayed or a file.
+func (sms *ServerMediaSession) setPublisher(session *RTSPClientSession) bool {
+	sms.mutex.Lock()
+	defer sms.mutex.Unlock()
+	if sms.relay != nil || sms.source != nil || sms.publisher != nil && sms.publisher != session {
+		return false
+	}
+	sms.publisher = session
+	return true
+}
+
+// hasPublisher reports whether the stream has a live source: a publishing
+// session or a relay. A live stream replaces the stream of a file.
+func (sms *ServerMediaSession) hasPublisher() bool {
+	sms.mutex.Lock()
+	defer sms.mutex.Unlock()
+	return sms.publisher != nil || sms.relay != nil
+}
+
+func (sms *ServerMediaSession) clearPublisher(session *RTSPClientSession) bool {
+	sms.mutex.Lock()
+	defer sms.mutex.Unlock()
+	if sms.publisher != session {
+		return false
+	}
+	sms.publisher = nil
+	return true
+}
+
+func (sub *ServerMediaSubsession) TrackID() string {
+	return sub.trackID
+}
+
+// timestampFrequency is the RTP clock rate of the track, taken from its
+// "a=rtpmap:" or, for static payload types without one, the RFC 3551 table.
+func (sub *ServerMediaSubsession) timestampFrequency() uint32 {
+	if format := sub.streamInfo.PreferredFormat(); format != nil && format.ClockRate > 0 {
+		return format.ClockRate
+	}
+	if sub.streamInfo.PayloadType == sdp.AudioPayloadType {
+		return 8000
+	}
+	return 90000
+}
+
+// encodingName is the encoding of the track from its "a=rtpmap:", in upper
+// case, e.g. "H264".
+func (sub *ServerMediaSubsession) encodingName() string {
+	if format := sub.streamInfo.PreferredFormat(); format != nil {
+		return strings.ToUpper(format.EncodingName)
+	}
+	return ""
+}
+
+// randomAccessCheck returns what tells the RTP payloads of the track a new
+// viewer can start with, or nil for codecs where any will do.
+func (sub *ServerMediaSubsession) randomAccessCheck() func(payload []byte) bool {
+	switch sub.encodingName() {
+	case "H264":
+		return h264.IsRandomAccess
+	case "H265":
+		donl := false
+		if params, err := sub.streamInfo.PreferredFormat().H265Params(); err == nil {
+			donl = params.UsesDONL()
+		}
+		return func(payload []byte) bool {
+			return h265.IsRandomAccess(payload, donl)
+		}
+	}
+	return nil
+}
+
+// multicastGroup returns the group the track is multicast to, allocating
+// it the first time, or nil if the server has no multicast pool.
+func (sub *ServerMediaSubsession) multicastGroup() (*multicastGroup, error) {
+	pool := sub.mediaSession.multicastPool
+	if pool == nil {
+		return nil, nil
+	}
+	sub.multicastMutex.Lock()
+	defer sub.multicastMutex.Unlock()
+	if sub.multicast == nil {
+		g, err := pool.allocate()
+		if err != nil {
+			return nil, err
+		}
+		sub.multicast = g
+	}
+	return sub.multicast, nil
+}
+
+// currentMulticastGroup returns the group the track is multicast to, or
+// nil if no player has set it up as multicast yet.
+func (sub *ServerMediaSubsession) currentMulticastGroup() *multicastGroup {
+	sub.multicastMutex.Lock()
+	defer sub.multicastMutex.Unlock()
+	return sub.multicast
+}
+
+// handleIncomingRTP is called for every RTP packet the publisher sends on this track.
+func (sub *ServerMediaSubsession) handleIncomingRTP(packet []byte) {
+	atomic.AddUint64(&sub.packetsReceived, 1)
+	atomic.AddUint64(&sub.bytesReceived, uint64(len(packet)))
+	sub.reflector.pushPacket(packet, false)
+}
+
+// handleIncomingRTCP is called for every RTCP packet the publisher sends on this track.
+func (sub *ServerMediaSubsession) handleIncomingRTCP(packet []byte) {
+	sub.reflector.pushPacket(packet, true)
+}
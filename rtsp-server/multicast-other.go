@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package rtsp_server
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// setMulticastTTL fails where we don't know how to set the TTL, rather than
+// advertise one the packets won't have.
+func setMulticastTTL(conn *net.UDPConn, ttl int, ipv6 bool) error {
+	return fmt.Errorf("setting the multicast TTL is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package rtsp_server
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastTTL sets the TTL, or the hop limit for IPv6, of the multicast
+// packets conn sends.
+func setMulticastTTL(conn *net.UDPConn, ttl int, ipv6 bool) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if ipv6 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl)
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+		if sockErr == syscall.EINVAL {
+			// OpenBSD, NetBSD and Solaris only take an unsigned char
+			sockErr = syscall.SetsockoptByte(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, byte(ttl))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
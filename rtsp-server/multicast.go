@@ -0,0 +1,215 @@
+package rtsp_server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/yangxianzhi/CommonUtilities"
+	"github.com/yangxianzhi/my-streaming-server/sdp"
+)
+
+// MulticastPool hands out the multicast groups live tracks are sent to: a
+// group address of a range and an even port of a range, with RTCP on the
+// odd port above it.
+type MulticastPool struct {
+	mutex      sync.Mutex
+	firstGroup net.IP
+	numGroups  int
+	minPort    int
+	numPorts   int // pairs
+	ttl        int
+	next       int
+	inUse      map[int]bool
+}
+
+func newMulticastPool(firstGroup string, numGroups, minPort, maxPort, ttl int) (*MulticastPool, error) {
+	group := net.ParseIP(firstGroup)
+	if group == nil || !group.IsMulticast() {
+		return nil, fmt.Errorf("invalid multicast group %q", firstGroup)
+	}
+	if group4 := group.To4(); group4 != nil {
+		group = group4
+	}
+	if numGroups <= 0 {
+		return nil, fmt.Errorf("invalid number of multicast groups %d", numGroups)
+	}
+	if last := groupAddress(group, numGroups-1); !last.IsMulticast() {
+		return nil, fmt.Errorf("multicast groups %s and %d above it leave the multicast range", firstGroup, numGroups-1)
+	}
+	if minPort%2 != 0 {
+		minPort++
+	}
+	if minPort <= 0 || maxPort > 65535 || maxPort <= minPort {
+		return nil, fmt.Errorf("invalid multicast port range %d-%d", minPort, maxPort)
+	}
+	if ttl < 1 || ttl > 255 {
+		return nil, fmt.Errorf("invalid multicast TTL %d", ttl)
+	}
+	return &MulticastPool{
+		firstGroup: group,
+		numGroups:  numGroups,
+		minPort:    minPort,
+		numPorts:   (maxPort - minPort + 1) / 2,
+		ttl:        ttl,
+		inUse:      make(map[int]bool),
+	}, nil
+}
+
+// checkTTL makes sure the TTL can be set on the sockets of the groups, so
+// that a misconfiguration shows up before the first multicast SETUP.
+func (p *MulticastPool) checkTTL() error {
+	network := "udp4"
+	if p.firstGroup.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := setMulticastTTL(conn, p.ttl, network == "udp6"); err != nil {
+		return fmt.Errorf("cannot set multicast TTL %d: %v", p.ttl, err)
+	}
+	return nil
+}
+
+// groupAddress returns the address i above group.
+func groupAddress(group net.IP, i int) net.IP {
+	address := make(net.IP, len(group))
+	copy(address, group)
+	for j := len(address) - 1; j >= 0 && i > 0; j-- {
+		sum := int(address[j]) + i
+		address[j] = byte(sum)
+		i = sum >> 8
+	}
+	return address
+}
+
+// allocate opens the socket of a new group, going round-robin through the
+// pool like the RTPPortAllocator does.
+func (p *MulticastPool) allocate() (*multicastGroup, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	numSlots := p.numGroups * p.numPorts
+	for i := 0; i < numSlots; i++ {
+		slot := p.next
+		p.next = (p.next + 1) % numSlots
+		if p.inUse[slot] {
+			continue
+		}
+
+		g := &multicastGroup{
+			pool:  p,
+			slot:  slot,
+			group: groupAddress(p.firstGroup, slot%p.numGroups),
+			port:  p.minPort + 2*(slot/p.numGroups),
+			ttl:   p.ttl,
+			ssrc:  commonutilities.OurRandom32(),
+		}
+		if err := g.open(); err != nil {
+			return nil, err
+		}
+		p.inUse[slot] = true
+		return g, nil
+	}
+	return nil, errors.New("no free multicast group")
+}
+
+func (p *MulticastPool) release(slot int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.inUse, slot)
+}
+
+// multicastGroup is where a track is sent for all of its multicast viewers
+// at once, by a single ReflectorOutput that runs while any of them plays.
+type multicastGroup struct {
+	pool     *MulticastPool
+	slot     int
+	group    net.IP
+	port     int
+	ttl      int
+	ssrc     uint32
+	conn     *net.UDPConn
+	rtpAddr  *net.UDPAddr
+	rtcpAddr *net.UDPAddr
+
+	mutex   sync.Mutex
+	viewers int
+	output  *ReflectorOutput
+}
+
+func (g *multicastGroup) open() (err error) {
+	network := "udp4"
+	if g.group.To4() == nil {
+		network = "udp6"
+	}
+	if g.conn, err = net.ListenUDP(network, nil); err != nil {
+		return err
+	}
+	if err = setMulticastTTL(g.conn, g.ttl, network == "udp6"); err != nil {
+		g.conn.Close()
+		return err
+	}
+	g.rtpAddr = &net.UDPAddr{IP: g.group, Port: g.port}
+	g.rtcpAddr = &net.UDPAddr{IP: g.group, Port: g.port + 1}
+	return nil
+}
+
+// connection is the "c=" line that advertises the group in SDP. A TTL is
+// only written for IPv4 groups, RFC 4566 section 5.7.
+func (g *multicastGroup) connection() sdp.Connection {
+	connection := sdp.Connection{
+		NetworkType: "IN",
+		AddressType: sdp.AddressType(g.group.String()),
+		Address:     g.group.String(),
+	}
+	if g.group.To4() != nil {
+		connection.TTL = g.ttl
+	}
+	return connection
+}
+
+func (g *multicastGroup) sendRTP(packet []byte) {
+	g.conn.WriteToUDP(packet, g.rtpAddr)
+}
+
+func (g *multicastGroup) sendRTCP(packet []byte) {
+	g.conn.WriteToUDP(packet, g.rtcpAddr)
+}
+
+// addViewer starts sending the track to the group for its first viewer,
+// and returns the output all of them share.
+func (g *multicastGroup) addViewer(reflector *ReflectorStream) *ReflectorOutput {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.viewers++
+	if g.output == nil {
+		g.output = reflector.addOutput(g, g.ssrc)
+	}
+	return g.output
+}
+
+// removeViewer stops sending the track once its last viewer has gone.
+func (g *multicastGroup) removeViewer(reflector *ReflectorStream) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.viewers > 0 {
+		g.viewers--
+	}
+	if g.viewers == 0 && g.output != nil {
+		g.output.sendGoodbye()
+		reflector.removeOutput(g.output)
+		g.output = nil
+	}
+}
+
+// close gives the group back to its pool. The reflector of the track has
+// been closed by then, with the output.
+func (g *multicastGroup) close() {
+	g.conn.Close()
+	g.pool.release(g.slot)
+}
@@ -0,0 +1,150 @@
+package rtsp_server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+	"github.com/yangxianzhi/my-streaming-server/rtsp"
+	"github.com/yangxianzhi/my-streaming-server/sdp"
+)
+
+func TestMulticastPool(t *testing.T) {
+	pool, err := newMulticastPool("239.255.42.254", 2, 45601, 45605, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.checkTTL(); err != nil {
+		t.Errorf("checkTTL() = %v", err)
+	}
+
+	// two groups, two port pairs from the even port above 45601
+	var groups []*multicastGroup
+	want := []string{"239.255.42.254:45602", "239.255.42.255:45602", "239.255.42.254:45604", "239.255.42.255:45604"}
+	for i := range want {
+		g, err := pool.allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := g.rtpAddr.String(); got != want[i] {
+			t.Errorf("group %d at %s, want %s", i, got, want[i])
+		}
+		groups = append(groups, g)
+	}
+	if _, err := pool.allocate(); err == nil {
+		t.Error("allocated more groups than the pool has")
+	}
+	groups[1].close()
+	if g, err := pool.allocate(); err != nil || g.rtpAddr.String() != want[1] {
+		t.Errorf("allocate() after release = %v, %v", g, err)
+	}
+
+	for _, args := range [][]interface{}{
+		{"10.0.0.1", 1, 45600, 45601, 1},
+		{"239.255.255.255", 2, 45600, 45601, 1},
+		{"239.255.42.1", 1, 45600, 45600, 1},
+		{"239.255.42.1", 1, 45600, 45601, 0},
+	} {
+		if _, err := newMulticastPool(args[0].(string), args[1].(int), args[2].(int), args[3].(int), args[4].(int)); err == nil {
+			t.Errorf("newMulticastPool%v succeeded", args)
+		}
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	server := New()
+	server.SetBindAddresses("127.0.0.1")
+	if err := server.SetMulticastPool("239.255.42.1", 1, 45620, 45623, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Listen(45610); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Destroy()
+
+	sdpInfo, err := sdp.ParseSdp("v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=mic\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 0 RTP/AVP 0\r\n" +
+		"a=control:trackID=1\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sms := newLiveServerMediaSession("mic", sdpInfo)
+	server.addServerMediaSession(sms)
+	defer server.removeServerMediaSession(sms)
+
+	receiver, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP("239.255.42.1"), Port: 45620})
+	if err != nil {
+		t.Skipf("no multicast: %v", err)
+	}
+	defer receiver.Close()
+
+	// two viewers share the group; DESCRIBE advertises it once the first
+	// SETUP has allocated it
+	var ssrcs []uint32
+	for i := 0; i < 2; i++ {
+		session := rtsp.NewSession()
+		defer session.Close()
+		info, _, err := session.Describe(context.Background(), "rtsp://127.0.0.1:45610/mic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamInfo := info.StreamInfoArray[0]
+		if i == 0 && (len(streamInfo.Connections) != 0 || streamInfo.Port != 0) {
+			t.Errorf("m= %s, c= %v before any multicast SETUP", streamInfo.MediaLine(), streamInfo.Connections)
+		}
+		if c := streamInfo.Connections; i > 0 && (len(c) != 1 || c[0].String() != "IN IP4 239.255.42.1/4" || streamInfo.Port != 45620) {
+			t.Errorf("m= %s, c= %v", streamInfo.MediaLine(), c)
+		}
+
+		control, _ := streamInfo.Attribute("control")
+		resp, err := session.Setup(context.Background(), control, "RTP/AVP;multicast")
+		if err != nil {
+			t.Fatal(err)
+		}
+		transports, err := rtsp.ParseTransport(resp.Header.Get("Transport"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport := transports[0]
+		if !transport.Multicast || transport.Destination != "239.255.42.1" || transport.TTL != 4 ||
+			transport.Port == nil || transport.Port.Start != 45620 || transport.Port.End != 45621 || len(transport.SSRC) != 1 {
+			t.Errorf("Transport: %s", resp.Header.Get("Transport"))
+		} else {
+			ssrcs = append(ssrcs, transport.SSRC[0])
+		}
+
+		if _, err := session.Play(context.Background(), "rtsp://127.0.0.1:45610/mic", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ssrcs) == 2 && ssrcs[0] != ssrcs[1] {
+		t.Errorf("viewers got SSRCs %x and %x", ssrcs[0], ssrcs[1])
+	}
+
+	sms.subsessions[0].handleIncomingRTP(newTestRTPPacket(7, 1000, 0xCAFE))
+
+	// the packet arrives once, from the one sender of the group
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 1500)
+	n, _, err := receiver.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packet rtp.Packet
+	if err := packet.Unmarshal(buffer[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if len(ssrcs) > 0 && packet.SSRC != ssrcs[0] {
+		t.Errorf("SSRC = %x, want %x", packet.SSRC, ssrcs[0])
+	}
+	receiver.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := receiver.ReadFromUDP(buffer); err == nil {
+		t.Error("the packet was sent to the group more than once")
+	}
+}
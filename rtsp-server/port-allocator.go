@@ -0,0 +1,84 @@
+package rtsp_server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	defaultRTPPortMin = 6970
+	defaultRTPPortMax = 9999
+)
+
+// RTPPortAllocator hands out RTP/RTCP port pairs from a range shared by all
+// sessions of a server: RTP on an even port, RTCP on the odd port above it.
+type RTPPortAllocator struct {
+	mutex   sync.Mutex
+	minPort int
+	maxPort int
+	next    int
+	inUse   map[int]bool
+}
+
+func newRTPPortAllocator(minPort, maxPort int) (*RTPPortAllocator, error) {
+	if minPort%2 != 0 {
+		minPort++
+	}
+	if minPort <= 0 || maxPort > 65535 || maxPort <= minPort {
+		return nil, fmt.Errorf("invalid RTP port range %d-%d", minPort, maxPort)
+	}
+	return &RTPPortAllocator{
+		minPort: minPort,
+		maxPort: maxPort,
+		next:    minPort,
+		inUse:   make(map[int]bool),
+	}, nil
+}
+
+// allocate binds the next free pair of the range on host. Pairs are handed
+// out round-robin so that a pair released by TEARDOWN is not immediately
+// reused while stray packets may still arrive on it. Ports some other
+// process holds are skipped.
+func (a *RTPPortAllocator) allocate(host string) (rtpConn, rtcpConn *net.UDPConn, err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	numPairs := (a.maxPort - a.minPort + 1) / 2
+	for i := 0; i < numPairs; i++ {
+		port := a.next
+		a.next += 2
+		if a.next+1 > a.maxPort {
+			a.next = a.minPort
+		}
+		if a.inUse[port] {
+			continue
+		}
+
+		rtpConn, err = net.ListenUDP("udp", udpAddr(host, port))
+		if err != nil {
+			continue
+		}
+		rtcpConn, err = net.ListenUDP("udp", udpAddr(host, port+1))
+		if err != nil {
+			rtpConn.Close()
+			continue
+		}
+		a.inUse[port] = true
+		return rtpConn, rtcpConn, nil
+	}
+	return nil, nil, fmt.Errorf("no free RTP/RTCP port pair in %d-%d", a.minPort, a.maxPort)
+}
+
+// release returns the pair starting at rtpPort to the range.
+func (a *RTPPortAllocator) release(rtpPort int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.inUse, rtpPort)
+}
+
+func (a *RTPPortAllocator) numInUse() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return len(a.inUse)
+}
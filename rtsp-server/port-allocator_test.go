@@ -0,0 +1,59 @@
+package rtsp_server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRTPPortAllocator(t *testing.T) {
+	const minPort, maxPort = 41001, 41007 // an odd minimum is rounded up
+	a, err := newRTPPortAllocator(minPort, maxPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// somebody else already holds the second pair
+	blocker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 41004})
+	if err != nil {
+		t.Skipf("can't bind test port: %v", err)
+	}
+	defer blocker.Close()
+
+	var rtpPorts []int
+	var conns []*net.UDPConn
+	for {
+		rtpConn, rtcpConn, err := a.allocate("127.0.0.1")
+		if err != nil {
+			break
+		}
+		conns = append(conns, rtpConn, rtcpConn)
+		rtpPort := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		rtcpPort := rtcpConn.LocalAddr().(*net.UDPAddr).Port
+		if rtpPort%2 != 0 || rtcpPort != rtpPort+1 {
+			t.Errorf("allocated %d-%d, want an even RTP port and RTCP right above it", rtpPort, rtcpPort)
+		}
+		rtpPorts = append(rtpPorts, rtpPort)
+	}
+	if len(rtpPorts) != 2 || rtpPorts[0] != 41002 || rtpPorts[1] != 41006 {
+		t.Fatalf("allocated RTP ports %v, want [41002 41006]", rtpPorts)
+	}
+	if a.numInUse() != 2 {
+		t.Errorf("numInUse() = %d, want 2", a.numInUse())
+	}
+
+	// a released pair can be handed out again
+	conns[0].Close()
+	conns[1].Close()
+	a.release(41002)
+	rtpConn, rtcpConn, err := a.allocate("127.0.0.1")
+	if err != nil {
+		t.Fatalf("allocate after release: %v", err)
+	}
+	defer rtpConn.Close()
+	defer rtcpConn.Close()
+	if port := rtpConn.LocalAddr().(*net.UDPAddr).Port; port != 41002 {
+		t.Errorf("reallocated RTP port %d, want 41002", port)
+	}
+	conns[2].Close()
+	conns[3].Close()
+}
@@ -0,0 +1,403 @@
+package rtsp_server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yangxianzhi/CommonUtilities"
+	"github.com/yangxianzhi/my-streaming-server/rtcp"
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+const (
+	reflectorQueueSize = 512
+	outputQueueSize    = 256
+
+	// RFC 3550 section 6.2 suggests a 5 second minimum interval
+	senderReportInterval = 5 * time.Second
+	// how long a new output waits for a keyframe before it gives up and
+	// starts with whatever comes
+	keyframeWaitLimit = 10 * time.Second
+)
+
+// rtcpCNAME is the canonical name in the SDES of our RTCP.
+var rtcpCNAME = func() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("%s@%s", SERVER, hostname)
+}()
+
+type reflectorPacket struct {
+	data    []byte
+	isRTCP  bool
+	arrival time.Time
+}
+
+// ReflectorStream fans the packets a publisher sends on one track out to
+// every session playing that track.
+type ReflectorStream struct {
+	subsession *ServerMediaSubsession
+	queue      chan reflectorPacket
+	mutex      sync.RWMutex
+	outputs    map[*ReflectorOutput]struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	// the RTP timestamp of the publisher at a time of ours, from its last
+	// sender report
+	srMutex   sync.Mutex
+	hasSR     bool
+	srSSRC    uint32
+	srRTPTime uint32
+	srArrival time.Time
+}
+
+// outputSink is where a ReflectorOutput sends its stream: the client of a
+// StreamServerState, or the multicast group of a track.
+type outputSink interface {
+	sendRTP(packet []byte)
+	sendRTCP(packet []byte)
+}
+
+// ReflectorOutput is a playing StreamServerState, or multicast group,
+// attached to a ReflectorStream. Each output rewrites SSRC, sequence numbers
+// and timestamps so that its client sees a stream starting at
+// seqBase/timestampBase, whenever it joined, and sends its own sender
+// reports for that stream.
+type ReflectorOutput struct {
+	reflector     *ReflectorStream
+	sink          outputSink
+	clockRate     uint32
+	queue         chan reflectorPacket
+	done          chan struct{}
+	closeOnce     sync.Once
+	ssrc          uint32
+	seqBase       uint16
+	timestampBase uint32
+	// isRandomAccess tells the packets a video output may start with, or
+	// is nil if any will do
+	isRandomAccess func(payload []byte) bool
+	waitStart      time.Time
+
+	synced          bool
+	srcSSRC         uint32
+	seqOffset       uint16
+	timestampOffset uint32
+	rtpPacket       rtp.Packet // reused by sendRTP
+	packetCount     uint32
+	octetCount      uint32
+
+	// the last packet sent, also read by rtpInfo, and whether the client
+	// has paused the output
+	positionMutex sync.Mutex
+	hasSent       bool
+	paused        bool
+	resuming      bool
+	lastSeq       uint16
+	lastTimestamp uint32
+	lastArrival   time.Time
+}
+
+func newReflectorStream(subsession *ServerMediaSubsession) *ReflectorStream {
+	r := &ReflectorStream{
+		subsession: subsession,
+		queue:      make(chan reflectorPacket, reflectorQueueSize),
+		outputs:    make(map[*ReflectorOutput]struct{}),
+		done:       make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *ReflectorStream) run() {
+	for {
+		select {
+		case packet := <-r.queue:
+			if packet.isRTCP {
+				// outputs send their own reports
+				r.handlePublisherRTCP(packet)
+				continue
+			}
+			r.mutex.RLock()
+			for output := range r.outputs {
+				output.enqueue(packet)
+			}
+			r.mutex.RUnlock()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// pushPacket queues a packet from the publisher. Packets are dropped rather
+// than blocking the receiver when the queue is full.
+func (r *ReflectorStream) pushPacket(data []byte, isRTCP bool) {
+	select {
+	case r.queue <- reflectorPacket{data: data, isRTCP: isRTCP, arrival: time.Now()}:
+	default:
+	}
+}
+
+// handlePublisherRTCP takes the NTP to RTP timestamp mapping of the
+// publisher's sender reports, which our sender reports are derived from.
+func (r *ReflectorStream) handlePublisherRTCP(packet reflectorPacket) {
+	packets, err := rtcp.Unmarshal(packet.data)
+	if err != nil {
+		return
+	}
+	for _, p := range packets {
+		if sr, ok := p.(*rtcp.SenderReport); ok {
+			r.srMutex.Lock()
+			r.hasSR = true
+			r.srSSRC = sr.SSRC
+			r.srRTPTime = sr.RTPTime
+			r.srArrival = packet.arrival
+			r.srMutex.Unlock()
+		}
+	}
+}
+
+// publisherRTPTime estimates the RTP timestamp of the publisher's stream at
+// time t, if it has sent a sender report for ssrc.
+func (r *ReflectorStream) publisherRTPTime(ssrc uint32, t time.Time, clockRate uint32) (uint32, bool) {
+	if r == nil {
+		return 0, false
+	}
+	r.srMutex.Lock()
+	defer r.srMutex.Unlock()
+	if !r.hasSR || r.srSSRC != ssrc {
+		return 0, false
+	}
+	return r.srRTPTime + uint32(int64(t.Sub(r.srArrival).Seconds()*float64(clockRate))), true
+}
+
+func (r *ReflectorStream) addOutput(sink outputSink, ssrc uint32) *ReflectorOutput {
+	output := &ReflectorOutput{
+		reflector:     r,
+		sink:          sink,
+		clockRate:     r.subsession.timestampFrequency(),
+		queue:         make(chan reflectorPacket, outputQueueSize),
+		done:          make(chan struct{}),
+		ssrc:          ssrc,
+		seqBase:       uint16(commonutilities.OurRandom32()),
+		timestampBase: commonutilities.OurRandom32(),
+
+		isRandomAccess: r.subsession.randomAccessCheck(),
+	}
+
+	r.mutex.Lock()
+	r.outputs[output] = struct{}{}
+	r.mutex.Unlock()
+
+	go output.run()
+	return output
+}
+
+func (r *ReflectorStream) removeOutput(output *ReflectorOutput) {
+	r.mutex.Lock()
+	delete(r.outputs, output)
+	r.mutex.Unlock()
+	output.close()
+}
+
+// pauseOutput stops feeding an output without losing its place in the
+// stream, for resumeOutput to carry on from.
+func (r *ReflectorStream) pauseOutput(output *ReflectorOutput) {
+	r.mutex.Lock()
+	delete(r.outputs, output)
+	r.mutex.Unlock()
+
+	output.positionMutex.Lock()
+	output.paused = true
+	output.positionMutex.Unlock()
+}
+
+// resumeOutput feeds a paused output again. Its sequence numbers go on
+// from the last packet it sent, and its timestamps from there by the time
+// it was paused, starting at the next keyframe like a new output.
+func (r *ReflectorStream) resumeOutput(output *ReflectorOutput) {
+	output.positionMutex.Lock()
+	output.paused = false
+	output.resuming = true
+	output.positionMutex.Unlock()
+
+	r.mutex.Lock()
+	r.outputs[output] = struct{}{}
+	r.mutex.Unlock()
+}
+
+func (r *ReflectorStream) numOutputs() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.outputs)
+}
+
+// close stops the reflector and every output still attached to it.
+func (r *ReflectorStream) close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.mutex.Lock()
+		for output := range r.outputs {
+			output.close()
+		}
+		r.outputs = make(map[*ReflectorOutput]struct{})
+		r.mutex.Unlock()
+	})
+}
+
+func (o *ReflectorOutput) enqueue(packet reflectorPacket) {
+	select {
+	case o.queue <- packet:
+	default:
+		// the client can't keep up; drop rather than stall the other outputs
+	}
+}
+
+func (o *ReflectorOutput) run() {
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case packet := <-o.queue:
+			o.sendRTP(packet)
+		case now := <-ticker.C:
+			o.sendSenderReport(now)
+		case <-o.done:
+			return
+		}
+	}
+}
+
+func (o *ReflectorOutput) close() {
+	o.closeOnce.Do(func() {
+		close(o.done)
+	})
+}
+
+// sync maps the publisher's sequence numbers and timestamps onto ours. The
+// first packet maps onto the bases; after a publisher restart (new SSRC) the
+// output carries on from the last packet it sent.
+func (o *ReflectorOutput) sync(srcSSRC uint32, srcSeq uint16, srcTimestamp uint32, arrival time.Time) {
+	if !o.synced {
+		o.seqOffset = o.seqBase - srcSeq
+		o.timestampOffset = o.timestampBase - srcTimestamp
+	} else {
+		elapsed := arrival.Sub(o.lastArrival)
+		nextTimestamp := o.lastTimestamp + uint32(elapsed.Seconds()*float64(o.clockRate))
+		o.seqOffset = o.lastSeq + 1 - srcSeq
+		o.timestampOffset = nextTimestamp - srcTimestamp
+	}
+	o.srcSSRC = srcSSRC
+	o.synced = true
+	o.waitStart = time.Time{}
+}
+
+// startsHere reports whether the packet in o.rtpPacket is one the output
+// can start with: a viewer joining a video stream mid-way gets nothing
+// until the next keyframe, which it could not decode without.
+func (o *ReflectorOutput) startsHere(arrival time.Time) bool {
+	if o.isRandomAccess == nil {
+		return true
+	}
+	if o.waitStart.IsZero() {
+		o.waitStart = arrival
+	}
+	return o.isRandomAccess(o.rtpPacket.Payload) || arrival.Sub(o.waitStart) >= keyframeWaitLimit
+}
+
+func (o *ReflectorOutput) sendRTP(packet reflectorPacket) {
+	o.positionMutex.Lock()
+	paused, resuming := o.paused, o.resuming
+	o.positionMutex.Unlock()
+	if paused || o.rtpPacket.Unmarshal(packet.data) != nil {
+		return
+	}
+
+	starting := !o.synced || resuming
+	if starting && !o.startsHere(packet.arrival) {
+		return
+	}
+	if starting || o.rtpPacket.SSRC != o.srcSSRC {
+		o.sync(o.rtpPacket.SSRC, o.rtpPacket.SequenceNumber, o.rtpPacket.Timestamp, packet.arrival)
+	}
+	o.rtpPacket.SequenceNumber += o.seqOffset
+	o.rtpPacket.Timestamp += o.timestampOffset
+	o.rtpPacket.SSRC = o.ssrc
+
+	data, err := o.rtpPacket.Marshal()
+	if err != nil {
+		return
+	}
+	o.positionMutex.Lock()
+	o.hasSent = true
+	o.resuming = false
+	o.lastSeq = o.rtpPacket.SequenceNumber
+	o.lastTimestamp = o.rtpPacket.Timestamp
+	o.lastArrival = packet.arrival
+	o.positionMutex.Unlock()
+	o.packetCount++
+	o.octetCount += uint32(len(o.rtpPacket.Payload))
+	o.sink.sendRTP(data)
+}
+
+// rtpInfo returns the sequence number and RTP timestamp of the next
+// packet of the output, for the "RTP-Info:" of a PLAY response: the bases
+// for a new output, the continuation of the stream for an output that is
+// resumed or that multicast viewers join while it runs.
+func (o *ReflectorOutput) rtpInfo(now time.Time) (seq uint16, rtpTime uint32) {
+	o.positionMutex.Lock()
+	defer o.positionMutex.Unlock()
+	if !o.hasSent {
+		return o.seqBase, o.timestampBase
+	}
+	return o.lastSeq + 1, o.lastTimestamp + uint32(int64(now.Sub(o.lastArrival).Seconds()*float64(o.clockRate)))
+}
+
+// sendSenderReport sends a SR for the rewritten stream, along with our CNAME.
+// It runs on the output goroutine, like sendRTP.
+func (o *ReflectorOutput) sendSenderReport(now time.Time) {
+	o.positionMutex.Lock()
+	idle := o.paused || o.resuming
+	o.positionMutex.Unlock()
+	if !o.synced || idle {
+		return
+	}
+
+	var rtpTime uint32
+	if srcRTPTime, ok := o.reflector.publisherRTPTime(o.srcSSRC, now, o.clockRate); ok {
+		rtpTime = srcRTPTime + o.timestampOffset
+	} else {
+		rtpTime = o.lastTimestamp + uint32(int64(now.Sub(o.lastArrival).Seconds()*float64(o.clockRate)))
+	}
+
+	packet, err := rtcp.Marshal([]rtcp.Packet{
+		&rtcp.SenderReport{
+			SSRC:        o.ssrc,
+			NTPTime:     rtcp.NTPTime(now),
+			RTPTime:     rtpTime,
+			PacketCount: o.packetCount,
+			OctetCount:  o.octetCount,
+		},
+		rtcp.NewCNAME(o.ssrc, rtcpCNAME),
+	})
+	if err == nil {
+		o.sink.sendRTCP(packet)
+	}
+}
+
+// sendGoodbye tells the client that our stream ends.
+func (o *ReflectorOutput) sendGoodbye() {
+	packet, err := rtcp.Marshal([]rtcp.Packet{
+		&rtcp.ReceiverReport{SSRC: o.ssrc},
+		rtcp.NewCNAME(o.ssrc, rtcpCNAME),
+		&rtcp.Goodbye{Sources: []uint32{o.ssrc}},
+	})
+	if err == nil {
+		o.sink.sendRTCP(packet)
+	}
+}
@@ -0,0 +1,278 @@
+package rtsp_server
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yangxianzhi/my-streaming-server/h264"
+	"github.com/yangxianzhi/my-streaming-server/rtcp"
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+func newTestRTPPacket(seq uint16, timestamp, ssrc uint32) []byte {
+	packet := rtp.Packet{
+		Header: rtp.Header{
+			PayloadType:    96,
+			SequenceNumber: seq,
+			Timestamp:      timestamp,
+			SSRC:           ssrc,
+		},
+		Payload: make([]byte, 4),
+	}
+	data, _ := packet.Marshal()
+	return data
+}
+
+func TestReflectorRewritesForLateJoiner(t *testing.T) {
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	portAllocator, _ := newRTPPortAllocator(40000, 40999)
+	rtpConn, rtcpConn, err := portAllocator.allocate("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subsession := &ServerMediaSubsession{trackID: "trackID=1"}
+
+	streamState := &StreamServerState{
+		subsession:    subsession,
+		rtpConn:       rtpConn,
+		rtcpConn:      rtcpConn,
+		clientRTPAddr: client.LocalAddr().(*net.UDPAddr),
+	}
+	defer streamState.close()
+
+	output := &ReflectorOutput{
+		sink:          streamState,
+		clockRate:     90000,
+		ssrc:          0x11223344,
+		seqBase:       1000,
+		timestampBase: 5000,
+	}
+	arrival := time.Now()
+	buffer := make([]byte, 1500)
+	for i := 0; i < 3; i++ {
+		// the publisher is already far into its stream when we join
+		src := newTestRTPPacket(uint16(60000+i), uint32(900000+3000*i), 0xAABBCCDD)
+		output.sendRTP(reflectorPacket{data: src, arrival: arrival})
+
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := client.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := buffer[:n]
+		if seq := binary.BigEndian.Uint16(got[2:4]); seq != uint16(1000+i) {
+			t.Errorf("packet %d: seq = %d, want %d", i, seq, 1000+i)
+		}
+		if ts := binary.BigEndian.Uint32(got[4:8]); ts != uint32(5000+3000*i) {
+			t.Errorf("packet %d: timestamp = %d, want %d", i, ts, 5000+3000*i)
+		}
+		if ssrc := binary.BigEndian.Uint32(got[8:12]); ssrc != output.ssrc {
+			t.Errorf("packet %d: ssrc = %08X, want %08X", i, ssrc, output.ssrc)
+		}
+	}
+
+	// a restarted publisher must not make the output jump
+	src := newTestRTPPacket(7, 123, 0x01020304)
+	output.sendRTP(reflectorPacket{data: src, arrival: arrival.Add(time.Second)})
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := client.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := buffer[:n]
+	if seq := binary.BigEndian.Uint16(got[2:4]); seq != 1003 {
+		t.Errorf("after restart: seq = %d, want 1003", seq)
+	}
+	if ts := binary.BigEndian.Uint32(got[4:8]); ts != 5000+6000+90000 {
+		t.Errorf("after restart: timestamp = %d, want %d", ts, 5000+6000+90000)
+	}
+}
+
+func TestReflectorWaitsForKeyframe(t *testing.T) {
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	portAllocator, _ := newRTPPortAllocator(42000, 42999)
+	rtpConn, rtcpConn, err := portAllocator.allocate("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamState := &StreamServerState{
+		subsession:    &ServerMediaSubsession{trackID: "trackID=1"},
+		rtpConn:       rtpConn,
+		rtcpConn:      rtcpConn,
+		clientRTPAddr: client.LocalAddr().(*net.UDPAddr),
+	}
+	defer streamState.close()
+
+	output := &ReflectorOutput{
+		sink:           streamState,
+		clockRate:      90000,
+		ssrc:           0x11223344,
+		seqBase:        1000,
+		isRandomAccess: h264.IsRandomAccess,
+	}
+	arrival := time.Now()
+	send := func(seq uint16, nalu ...byte) {
+		packet := rtp.Packet{
+			Header:  rtp.Header{PayloadType: 96, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, SSRC: 0xAABBCCDD},
+			Payload: nalu,
+		}
+		data, _ := packet.Marshal()
+		output.sendRTP(reflectorPacket{data: data, arrival: arrival})
+	}
+	send(1, h264.NALUTypeNonIDR, 1)
+	send(2, h264.NALUTypeNonIDR, 2)
+	send(3, h264.NALUTypeIDR, 3)
+	send(4, h264.NALUTypeNonIDR, 4)
+
+	buffer := make([]byte, 1500)
+	for _, want := range []byte{3, 4} {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := client.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got rtp.Packet
+		if err := got.Unmarshal(buffer[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if got.Payload[1] != want || got.SequenceNumber != uint16(1000+int(want)-3) {
+			t.Errorf("got packet %d with seq %d, want packet %d with seq %d", got.Payload[1], got.SequenceNumber, want, 1000+int(want)-3)
+		}
+	}
+}
+
+func TestSenderReportFollowsPublisher(t *testing.T) {
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	portAllocator, _ := newRTPPortAllocator(41000, 41999)
+	rtpConn, rtcpConn, err := portAllocator.allocate("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subsession := &ServerMediaSubsession{trackID: "trackID=1"}
+	streamState := &StreamServerState{
+		subsession:     subsession,
+		rtpConn:        rtpConn,
+		rtcpConn:       rtcpConn,
+		clientRTCPAddr: client.LocalAddr().(*net.UDPAddr),
+	}
+	defer streamState.close()
+
+	reflector := &ReflectorStream{subsession: subsession}
+	output := &ReflectorOutput{
+		reflector:     reflector,
+		sink:          streamState,
+		clockRate:     90000,
+		ssrc:          0x11223344,
+		timestampBase: 5000,
+	}
+	arrival := time.Now()
+	output.sendRTP(reflectorPacket{data: newTestRTPPacket(1, 900000, 0xAABBCCDD), arrival: arrival})
+
+	// the publisher says its clock is 3000 ahead of the packet we got
+	sr, _ := rtcp.Marshal([]rtcp.Packet{&rtcp.SenderReport{SSRC: 0xAABBCCDD, RTPTime: 903000}})
+	reflector.handlePublisherRTCP(reflectorPacket{data: sr, isRTCP: true, arrival: arrival})
+
+	now := arrival.Add(time.Second)
+	output.sendSenderReport(now)
+	buffer := make([]byte, 1500)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := client.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, err := rtcp.Unmarshal(buffer[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("got %d packets, want SR and SDES", len(packets))
+	}
+	got, ok := packets[0].(*rtcp.SenderReport)
+	if !ok {
+		t.Fatalf("first packet is %T, want a SR", packets[0])
+	}
+	want := &rtcp.SenderReport{
+		SSRC:        output.ssrc,
+		NTPTime:     rtcp.NTPTime(now),
+		RTPTime:     5000 + 3000 + 90000,
+		PacketCount: 1,
+		OctetCount:  4,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SR = %+v, want %+v", got, want)
+	}
+	if sdes, ok := packets[1].(*rtcp.SourceDescription); !ok || sdes.Chunks[0].Items[0].Text != rtcpCNAME {
+		t.Errorf("second packet = %+v, want our CNAME", packets[1])
+	}
+}
+
+// testSink keeps what an output sends.
+type testSink struct {
+	rtp [][]byte
+}
+
+func (s *testSink) sendRTP(packet []byte) { s.rtp = append(s.rtp, packet) }
+
+func (s *testSink) sendRTCP(packet []byte) {}
+
+func TestReflectorPauseResume(t *testing.T) {
+	sink := &testSink{}
+	r := &ReflectorStream{outputs: make(map[*ReflectorOutput]struct{})}
+	output := &ReflectorOutput{
+		reflector:     r,
+		sink:          sink,
+		clockRate:     90000,
+		ssrc:          0x11223344,
+		seqBase:       1000,
+		timestampBase: 5000,
+	}
+	r.outputs[output] = struct{}{}
+
+	arrival := time.Now()
+	output.sendRTP(reflectorPacket{data: newTestRTPPacket(60000, 900000, 0xAABBCCDD), arrival: arrival})
+	r.pauseOutput(output)
+	if r.numOutputs() != 0 {
+		t.Error("a paused output is still fed")
+	}
+	// packets still queued when the client paused are dropped
+	output.sendRTP(reflectorPacket{data: newTestRTPPacket(60001, 903000, 0xAABBCCDD), arrival: arrival})
+	if len(sink.rtp) != 1 {
+		t.Fatalf("%d packets sent, want 1", len(sink.rtp))
+	}
+
+	// two seconds later the stream goes on where it was
+	resumed := arrival.Add(2 * time.Second)
+	r.resumeOutput(output)
+	if seq, rtpTime := output.rtpInfo(resumed); seq != 1001 || rtpTime != 5000+180000 {
+		t.Errorf("rtpInfo() = %d, %d, want 1001, %d", seq, rtpTime, 5000+180000)
+	}
+	output.sendRTP(reflectorPacket{data: newTestRTPPacket(60060, 1080000, 0xAABBCCDD), arrival: resumed})
+	if len(sink.rtp) != 2 {
+		t.Fatalf("%d packets sent, want 2", len(sink.rtp))
+	}
+	var packet rtp.Packet
+	if err := packet.Unmarshal(sink.rtp[1]); err != nil {
+		t.Fatal(err)
+	}
+	if packet.SequenceNumber != 1001 || packet.Timestamp != 5000+180000 || packet.SSRC != output.ssrc {
+		t.Errorf("after resume: seq %d, timestamp %d, ssrc %08X", packet.SequenceNumber, packet.Timestamp, packet.SSRC)
+	}
+}
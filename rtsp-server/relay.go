@@ -0,0 +1,223 @@
+package rtsp_server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yangxianzhi/my-streaming-server/sdp"
+)
+
+// relayCheckInterval is how often a relay looks at the schedule of its SDP
+// to see whether it should start or stop.
+const relayCheckInterval = time.Second
+
+// relay serves an existing UDP broadcast as a live stream: it receives the
+// RTP and RTCP of every stream of an SDP, sent to multicast groups or to
+// ports of this host, and reflects them to the players of its
+// ServerMediaSession like the packets of a publisher.
+//
+// With "a=x-broadcastcontrol:TIME", the default, the relay only runs, and
+// its stream only exists, while the "t=" and "r=" lines of the SDP say the
+// broadcast takes place; it goes away for good once the broadcast has
+// ended. With "a=x-broadcastcontrol:RTSP" it runs until it is removed.
+type relay struct {
+	server     *RTSPServer
+	streamName string
+	sdpInfo    sdp.Info
+	done       chan struct{}
+	finished   chan struct{}
+	closeOnce  sync.Once
+
+	// while running
+	sms     *ServerMediaSession
+	conns   []*net.UDPConn
+	lastErr string
+}
+
+// AddRelay serves the broadcast sdpInfo describes under streamName. Each
+// stream of the SDP is received on the port of its "m=" line, at the
+// address of its "c=" line: a multicast group is joined, any other address
+// is taken to be one of this host.
+func (s *RTSPServer) AddRelay(streamName string, sdpInfo sdp.Info) error {
+	if len(sdpInfo.StreamInfoArray) == 0 {
+		return errors.New("relay SDP has no streams")
+	}
+	for _, streamInfo := range sdpInfo.StreamInfoArray {
+		if streamInfo.IsTCP || streamInfo.Port == 0 || sdpInfo.StreamConnection(streamInfo) == nil {
+			return fmt.Errorf("relay SDP stream %q is not a UDP broadcast", streamInfo.MediaLine())
+		}
+	}
+	if sdpInfo.SessionControlType == sdp.SDPTimeControl && sdpInfo.HasEnded(time.Now()) {
+		return errors.New("relay SDP broadcast has ended")
+	}
+
+	r := &relay{
+		server:     s,
+		streamName: streamName,
+		sdpInfo:    sdpInfo,
+		done:       make(chan struct{}),
+		finished:   make(chan struct{}),
+	}
+	s.mediaSessionMutex.Lock()
+	if _, existed := s.relays[streamName]; existed {
+		s.mediaSessionMutex.Unlock()
+		return fmt.Errorf("stream %q is already relayed", streamName)
+	}
+	s.relays[streamName] = r
+	s.mediaSessionMutex.Unlock()
+
+	if r.isActive(time.Now()) {
+		if err := r.start(); err != nil {
+			s.removeRelay(r)
+			return err
+		}
+	}
+	go r.run()
+	return nil
+}
+
+// RemoveRelay stops the relay of streamName, if there is one, detaching
+// its players.
+func (s *RTSPServer) RemoveRelay(streamName string) {
+	s.mediaSessionMutex.Lock()
+	r := s.relays[streamName]
+	delete(s.relays, streamName)
+	s.mediaSessionMutex.Unlock()
+
+	if r != nil {
+		r.close()
+	}
+}
+
+// removeRelay unregisters r, unless its name has been reused by a newer relay.
+func (s *RTSPServer) removeRelay(r *relay) {
+	s.mediaSessionMutex.Lock()
+	defer s.mediaSessionMutex.Unlock()
+	if s.relays[r.streamName] == r {
+		delete(s.relays, r.streamName)
+	}
+}
+
+func (r *relay) isActive(now time.Time) bool {
+	return r.sdpInfo.SessionControlType == sdp.RTSPSessionControl || r.sdpInfo.IsActive(now)
+}
+
+func (r *relay) run() {
+	defer close(r.finished)
+	defer r.stop()
+
+	ticker := time.NewTicker(relayCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if r.sdpInfo.SessionControlType == sdp.SDPTimeControl && r.sdpInfo.HasEnded(now) {
+				fmt.Printf("relay %s: the broadcast has ended\n", r.streamName)
+				r.server.removeRelay(r)
+				return
+			}
+			if !r.isActive(now) {
+				r.stop()
+			} else if r.sms == nil {
+				if err := r.start(); err != nil && err.Error() != r.lastErr {
+					fmt.Printf("relay %s: %v\n", r.streamName, err)
+					r.lastErr = err.Error()
+				}
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// start joins the broadcast and registers the stream.
+func (r *relay) start() (err error) {
+	if r.sms != nil {
+		return nil
+	}
+
+	sms := newLiveServerMediaSession(r.streamName, r.sdpInfo)
+	sms.relay = r
+	var conns []*net.UDPConn
+	defer func() {
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			// stops the reflectors of the stream, which run from the start
+			sms.close()
+		}
+	}()
+	for _, subsession := range sms.subsessions {
+		streamInfo := subsession.streamInfo
+		address := r.sdpInfo.StreamConnection(streamInfo).Address
+		rtpConn, err := listenBroadcast(address, int(streamInfo.Port))
+		if err != nil {
+			return err
+		}
+		conns = append(conns, rtpConn)
+		rtcpConn, err := listenBroadcast(address, int(streamInfo.Port)+1)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, rtcpConn)
+		go receiveLoop(rtpConn, subsession.handleIncomingRTP)
+		go receiveLoop(rtcpConn, subsession.handleIncomingRTCP)
+	}
+	if !r.server.addServerMediaSession(sms) {
+		return fmt.Errorf("stream %q is already being published", r.streamName)
+	}
+
+	r.sms = sms
+	r.conns = conns
+	r.lastErr = ""
+	return nil
+}
+
+// stop leaves the broadcast and unregisters the stream, detaching its players.
+func (r *relay) stop() {
+	if r.sms == nil {
+		return
+	}
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+	r.server.removeServerMediaSession(r.sms)
+	r.sms = nil
+	r.conns = nil
+}
+
+// close stops the relay for good and waits until it has.
+func (r *relay) close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	<-r.finished
+}
+
+// listenBroadcast binds the socket a broadcast to address:port is received
+// on. A multicast group is joined on a socket bound to any address, as
+// joining requires; any other address is bound to as is, so that we only
+// take in what is sent to it.
+func listenBroadcast(address string, port int) (*net.UDPConn, error) {
+	addr := udpAddr(address, port)
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		network := "udp4"
+		if addr.IP.To4() == nil {
+			network = "udp6"
+		}
+		return net.ListenMulticastUDP(network, nil, addr)
+	}
+	if addr.IP == nil {
+		// a host name
+		var err error
+		if addr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(address, strconv.Itoa(port))); err != nil {
+			return nil, err
+		}
+	}
+	return net.ListenUDP("udp", addr)
+}
@@ -0,0 +1,201 @@
+package rtsp_server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+	"github.com/yangxianzhi/my-streaming-server/rtsp"
+	"github.com/yangxianzhi/my-streaming-server/sdp"
+)
+
+func TestRelay(t *testing.T) {
+	server := New()
+	server.SetBindAddresses("127.0.0.1")
+	if err := server.Listen(45640); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Destroy()
+
+	sdpInfo, err := sdp.ParseSdp("v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=radio\r\n" +
+		"c=IN IP4 239.255.42.2/1\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 45650 RTP/AVP 0\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddRelay("radio", sdpInfo); err != nil {
+		t.Skipf("no multicast: %v", err)
+	}
+	if err := server.AddRelay("radio", sdpInfo); err == nil {
+		t.Error("relayed the same stream twice")
+	}
+
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 45652})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	// a unicast player of the relayed broadcast
+	session := rtsp.NewSession()
+	defer session.Close()
+	info, _, err := session.Describe(context.Background(), "rtsp://127.0.0.1:45640/radio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	control, _ := info.StreamInfoArray[0].Attribute("control")
+	if _, err := session.Setup(context.Background(), control, "RTP/AVP;unicast;client_port=45652-45653"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Play(context.Background(), "rtsp://127.0.0.1:45640/radio", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody can publish under the name of a relay
+	sms, _ := server.lookupServerMediaSession("radio")
+	if sms.setPublisher(&RTSPClientSession{}) {
+		t.Error("a publisher took over the relay")
+	}
+
+	sender, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP("239.255.42.2"), Port: 45650})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write(newTestRTPPacket(100, 8000, 0xBEEF)); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 1500)
+	n, _, err := receiver.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packet rtp.Packet
+	if err := packet.Unmarshal(buffer[:n]); err != nil || packet.PayloadType != 96 {
+		t.Errorf("relayed packet %x: %v", buffer[:n], err)
+	}
+
+	server.RemoveRelay("radio")
+	if _, existed := server.lookupServerMediaSession("radio"); existed {
+		t.Error("the stream outlived its relay")
+	}
+}
+
+func TestRelayStartFailureLeaksNothing(t *testing.T) {
+	server := New()
+	defer server.Destroy()
+
+	relaySDP := func(ports ...int) sdp.Info {
+		description := "v=0\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\n"
+		for _, port := range ports {
+			description += fmt.Sprintf("m=audio %d RTP/AVP 0\r\n", port)
+		}
+		info, err := sdp.ParseSdp(description)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	// one relay's name is taken by a publisher, the other's second port
+	published := newLiveServerMediaSession("busy", relaySDP(45662))
+	published.setPublisher(&RTSPClientSession{})
+	server.addServerMediaSession(published)
+	defer server.removeServerMediaSession(published)
+	taken, err := listenBroadcast("127.0.0.1", 45665)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	for _, r := range []*relay{
+		{server: server, streamName: "busy", sdpInfo: relaySDP(45662)},
+		{server: server, streamName: "free", sdpInfo: relaySDP(45662, 45664)},
+	} {
+		before := runtime.NumGoroutine()
+		for i := 0; i < 20; i++ {
+			if err := r.start(); err == nil {
+				t.Fatalf("relay %s started", r.streamName)
+			}
+		}
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if after := runtime.NumGoroutine(); after > before {
+			t.Errorf("relay %s: %d goroutines after failing to start, %d before", r.streamName, after, before)
+		}
+	}
+}
+
+func TestListenBroadcastUnicast(t *testing.T) {
+	// two broadcasts on the same port to different addresses
+	first, err := listenBroadcast("127.0.0.1", 45670)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if got := first.LocalAddr().String(); got != "127.0.0.1:45670" {
+		t.Errorf("bound to %s, want 127.0.0.1:45670", got)
+	}
+	second, err := listenBroadcast("127.0.0.2", 45670)
+	if err != nil {
+		t.Skipf("no 127.0.0.2: %v", err)
+	}
+	second.Close()
+
+	if conn, err := listenBroadcast("localhost", 45671); err != nil {
+		t.Error(err)
+	} else {
+		if ip := conn.LocalAddr().(*net.UDPAddr).IP; !ip.IsLoopback() {
+			t.Errorf("bound to %s for localhost", ip)
+		}
+		conn.Close()
+	}
+}
+
+func TestRelaySchedule(t *testing.T) {
+	server := New()
+	defer server.Destroy()
+
+	const ntpUnixOffset = 2208988800
+	relaySDP := func(start, stop int64) sdp.Info {
+		info, err := sdp.ParseSdp(fmt.Sprintf("v=0\r\n"+
+			"c=IN IP4 239.255.42.3/1\r\n"+
+			"t=%d %d\r\n"+
+			"m=audio 45660 RTP/AVP 0\r\n", start+ntpUnixOffset, stop+ntpUnixOffset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	now := time.Now().Unix()
+	if err := server.AddRelay("past", relaySDP(now-7200, now-3600)); err == nil {
+		t.Error("relayed a broadcast that has ended")
+	}
+	if err := server.AddRelay("later", relaySDP(now+3600, now+7200)); err != nil {
+		t.Fatal(err)
+	}
+	if _, existed := server.lookupServerMediaSession("later"); existed {
+		t.Error("a broadcast is served before it starts")
+	}
+
+	info := relaySDP(now+3600, now+7200)
+	info.SessionControlType = sdp.RTSPSessionControl
+	if err := server.AddRelay("rtsp", info); err != nil {
+		t.Skipf("no multicast: %v", err)
+	}
+	if _, existed := server.lookupServerMediaSession("rtsp"); !existed {
+		t.Error("a RTSP controlled relay waits for its times")
+	}
+}
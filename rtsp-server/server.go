@@ -1,52 +1,219 @@
 package rtsp_server
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+
+	"github.com/yangxianzhi/my-streaming-server/auth"
+	"github.com/yangxianzhi/my-streaming-server/rtsp"
 )
 
 const (
 	SERVER = "my-streaming-server"
 	VERSION = "1.0"
+
+	defaultReclamationTestSeconds = 65
 )
 
 type RTSPServer struct {
 	rtspPort 				int
-	rtspListen				*net.TCPListener
+	rtspListeners			[]*net.TCPListener
+	bindAddrs				[]string
 	sessionMutex           sync.Mutex
 	clientSessions         map[string]*RTSPClientSession
+	mediaSessionMutex      sync.Mutex
+	serverMediaSessions    map[string]*ServerMediaSession
+	relays                 map[string]*relay
+	rtpPortAllocator       *RTPPortAllocator
+	multicastPool          *MulticastPool
+	contentDir             string
+	reclamationTestSeconds int
+	digest                 *auth.Digest
+	authRules              []AuthRule
+}
+
+// AuthRule requires authentication for the requests on the streams under
+// Path (every stream if empty) whose method is one of Methods (every method
+// if empty).
+type AuthRule struct {
+	Path    string
+	Methods []string
 }
 
 func New() *RTSPServer {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	rtpPortAllocator, _ := newRTPPortAllocator(defaultRTPPortMin, defaultRTPPortMax)
 	return &RTSPServer{
-		clientSessions: make(map[string]*RTSPClientSession),
+		clientSessions:      make(map[string]*RTSPClientSession),
+		serverMediaSessions: make(map[string]*ServerMediaSession),
+		relays:              make(map[string]*relay),
+		rtpPortAllocator:    rtpPortAllocator,
+		reclamationTestSeconds: defaultReclamationTestSeconds,
+	}
+}
+
+// SetReclamationTestSeconds sets how long a session may stay silent before
+// it is torn down. Zero keeps sessions until their connection closes.
+func (s *RTSPServer) SetReclamationTestSeconds(seconds int) {
+	s.reclamationTestSeconds = seconds
+}
+
+// SetAuthenticator turns on authentication of the clients against
+// authenticator. Without rules every request but OPTIONS has to be
+// authenticated. A nil authenticator turns authentication off again.
+func (s *RTSPServer) SetAuthenticator(authenticator auth.Authenticator, rules ...AuthRule) {
+	if authenticator == nil {
+		s.digest = nil
+		s.authRules = nil
+		return
+	}
+
+	allowBasic := s.digest != nil && s.digest.AllowBasic
+	s.digest = auth.NewDigest(authenticator)
+	s.digest.AllowBasic = allowBasic
+	s.authRules = rules
+	if len(s.authRules) == 0 {
+		s.authRules = []AuthRule{{Methods: []string{rtsp.DESCRIBE, rtsp.ANNOUNCE, rtsp.SETUP, rtsp.PLAY,
+			rtsp.RECORD, rtsp.PAUSE, rtsp.TEARDOWN, rtsp.GET_PARAMETER, rtsp.SET_PARAMETER}}}
+	}
+}
+
+// SetBasicAuthAllowed lets clients authenticate with Basic authentication,
+// which sends the password in the clear, besides Digest. It takes effect
+// after SetAuthenticator.
+func (s *RTSPServer) SetBasicAuthAllowed(allowed bool) {
+	if s.digest != nil {
+		s.digest.AllowBasic = allowed
+	}
+}
+
+// requiresAuth reports whether a request needs to be authenticated.
+func (s *RTSPServer) requiresAuth(method, path string) bool {
+	if s.digest == nil {
+		return false
 	}
+	for _, rule := range s.authRules {
+		if rule.matches(method, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *AuthRule) matches(method, path string) bool {
+	rulePath := strings.Trim(rule.Path, "/")
+	if rulePath != "" && path != rulePath && !strings.HasPrefix(path, rulePath+"/") {
+		return false
+	}
+	if len(rule.Methods) == 0 {
+		return true
+	}
+	for _, m := range rule.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRTPPortRange sets the UDP ports used for RTP/RTCP. It should be called
+// before Start; RTP uses the even ports of the range.
+func (s *RTSPServer) SetRTPPortRange(minPort, maxPort int) error {
+	rtpPortAllocator, err := newRTPPortAllocator(minPort, maxPort)
+	if err != nil {
+		return err
+	}
+	s.rtpPortAllocator = rtpPortAllocator
+	return nil
+}
+
+// SetMulticastPool lets players SETUP live streams as multicast: each track
+// is then sent once, to a group address from firstGroup and the numGroups-1
+// above it and a port pair from minPort-maxPort, with the given TTL, and
+// its DESCRIBE advertises that group once a player has set it up. It
+// fails if the TTL can't be set on this system. It should be called before
+// Start.
+func (s *RTSPServer) SetMulticastPool(firstGroup string, numGroups, minPort, maxPort, ttl int) error {
+	multicastPool, err := newMulticastPool(firstGroup, numGroups, minPort, maxPort, ttl)
+	if err != nil {
+		return err
+	}
+	if err := multicastPool.checkTTL(); err != nil {
+		return err
+	}
+	s.multicastPool = multicastPool
+	return nil
+}
+
+// SetContentDirectory serves the MP4 files under dir on demand, each as the
+// stream named after its path relative to dir, e.g. "movies/trailer.mp4".
+// Live streams take precedence over files of the same name.
+func (s *RTSPServer) SetContentDirectory(dir string) {
+	s.contentDir = dir
+}
+
+// SetBindAddresses sets the local addresses Listen accepts RTSP
+// connections on, IPv4 or IPv6, e.g. "0.0.0.0" and "::1". Without any the
+// server listens on every address of both families.
+func (s *RTSPServer) SetBindAddresses(addrs ...string) {
+	s.bindAddrs = addrs
 }
 
 func (s *RTSPServer) Destroy() {
-	s.rtspListen.Close()
+	for _, l := range s.rtspListeners {
+		l.Close()
+	}
+
+	s.mediaSessionMutex.Lock()
+	var streamNames []string
+	for streamName := range s.relays {
+		streamNames = append(streamNames, streamName)
+	}
+	s.mediaSessionMutex.Unlock()
+	for _, streamName := range streamNames {
+		s.RemoveRelay(streamName)
+	}
 }
 
 func (server *RTSPServer) Listen(port int) (err error) {
 	server.rtspPort = port
 
-	server.rtspListen, err = server.setupOurSocket(port)
-
-	return err
+	bindAddrs := server.bindAddrs
+	if len(bindAddrs) == 0 {
+		bindAddrs = []string{""}
+	}
+	for _, bindAddr := range bindAddrs {
+		l, err := server.setupOurSocket(bindAddr, port)
+		if err != nil {
+			server.Destroy()
+			server.rtspListeners = nil
+			return err
+		}
+		server.rtspListeners = append(server.rtspListeners, l)
+	}
+	return nil
 }
 
 func (server *RTSPServer) Start() {
-	go server.incomingConnectionHandler(server.rtspListen)
+	for _, l := range server.rtspListeners {
+		go server.incomingConnectionHandler(l)
+	}
 }
 
-func (server *RTSPServer) setupOurSocket(port int) (*net.TCPListener, error) {
-	tcpAddr := fmt.Sprintf("0.0.0.0:%d", port)
-	addr, _ := net.ResolveTCPAddr("tcp", tcpAddr)
-
+// setupOurSocket listens on bindAddr, or on the unspecified address of
+// both IPv4 and IPv6 if it is empty.
+func (server *RTSPServer) setupOurSocket(bindAddr string, port int) (*net.TCPListener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(bindAddr, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
 	return net.ListenTCP("tcp", addr)
 }
 
@@ -54,6 +221,9 @@ func (server *RTSPServer) incomingConnectionHandler(l *net.TCPListener) {
 	for {
 		tcpConn, err := l.AcceptTCP()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			fmt.Printf("failed to accept client.%s", err.Error())
 			continue
 		}
@@ -90,3 +260,73 @@ func (s *RTSPServer) removeClientSession(sessionID string) {
 	defer s.sessionMutex.Unlock()
 	delete(s.clientSessions, sessionID)
 }
+
+// lookupServerMediaSession finds the stream of a name: a registered live
+// stream, or else a file of the content directory.
+func (s *RTSPServer) lookupServerMediaSession(streamName string) (sms *ServerMediaSession, existed bool) {
+	s.mediaSessionMutex.Lock()
+	sms, existed = s.serverMediaSessions[streamName]
+	s.mediaSessionMutex.Unlock()
+	if s.contentDir == "" || existed && sms.source == nil {
+		return sms, existed
+	}
+	return s.lookupFileServerMediaSession(streamName, sms)
+}
+
+// resolveControlURL maps the URL of a request onto the stream it controls
+// and, for a non-aggregate operation, the track. The URL of a stream, with
+// or without the trailing slash of the Content-Base we describe it with, is
+// the aggregate control URL of all its tracks, and subsession is nil for
+// it. Stream names may contain slashes, so the stream of a track URL is
+// looked for at every '/' of its path, from the last. sms is nil if the URL
+// names neither a stream nor a track of one.
+func (s *RTSPServer) resolveControlURL(u *url.URL) (sms *ServerMediaSession, subsession *ServerMediaSubsession) {
+	path := streamNameFromURL(u)
+	if sms, existed := s.lookupServerMediaSession(path); existed {
+		return sms, nil
+	}
+	for i := strings.LastIndex(path, "/"); i > 0; i = strings.LastIndex(path[:i], "/") {
+		if sms, existed := s.lookupServerMediaSession(path[:i]); existed {
+			if subsession := sms.lookupControl(path); subsession != nil {
+				return sms, subsession
+			}
+		}
+	}
+	return nil, nil
+}
+
+// addServerMediaSession registers sms under its stream name. An existing
+// stream is only replaced when nobody is publishing to it any more.
+func (s *RTSPServer) addServerMediaSession(sms *ServerMediaSession) bool {
+	s.mediaSessionMutex.Lock()
+	defer s.mediaSessionMutex.Unlock()
+	existing, existed := s.serverMediaSessions[sms.streamName]
+	if existed && existing.hasPublisher() {
+		return false
+	}
+	if existed {
+		existing.close()
+	}
+	s.registerServerMediaSession(sms)
+	return true
+}
+
+// registerServerMediaSession puts sms in the map of streams. The caller
+// holds s.mediaSessionMutex and has dealt with any stream of the name.
+func (s *RTSPServer) registerServerMediaSession(sms *ServerMediaSession) {
+	if sms.source == nil {
+		// files are played on demand, never multicast
+		sms.multicastPool = s.multicastPool
+	}
+	s.serverMediaSessions[sms.streamName] = sms
+}
+
+// removeServerMediaSession unregisters sms, unless its name has been reused by a newer stream.
+func (s *RTSPServer) removeServerMediaSession(sms *ServerMediaSession) {
+	s.mediaSessionMutex.Lock()
+	defer s.mediaSessionMutex.Unlock()
+	if s.serverMediaSessions[sms.streamName] == sms {
+		delete(s.serverMediaSessions, sms.streamName)
+		sms.close()
+	}
+}
@@ -2,27 +2,67 @@ package rtsp_server
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/djwackey/dorsvr/livemedia"
+	"github.com/yangxianzhi/CommonUtilities"
+	"github.com/yangxianzhi/my-streaming-server/rtcp"
+	"github.com/yangxianzhi/my-streaming-server/rtsp"
 )
 
+// sessionState is the state of a RTSPClientSession in the state machine of
+// RFC 2326 appendix A.1.
+type sessionState int
+
+const (
+	stateInit  sessionState = iota // no track set up yet
+	stateReady                     // set up, or paused
+	statePlaying
+	stateRecording
+)
+
+// maxInterleavedChannel is the highest channel of an interleaved frame,
+// RFC 2326 section 10.12, whose header gives it one byte.
+const maxInterleavedChannel = 255
+
 type RTSPClientSession struct {
+	lastLivenessTime     int64 // UnixNano, accessed atomically
+	mutex                sync.Mutex
 	isMulticast          bool
 	isTimerRunning       bool
+	isDestroyed          bool
 	streamAfterSETUP     bool
+	isPublisher          bool
+	state                sessionState
 	numStreamStates      int
 	TCPStreamIDCount     uint
 	sessionID            string
 	connection           *RTSPClientConnection
+	serverMediaSession   *ServerMediaSession
+	streamStates         []*StreamServerState
+	livenessDone         chan struct{}
+
+	// the normal play time of a player: how long it has played before the
+	// last PLAY, and since when it plays
+	playedBefore time.Duration
+	playingSince time.Time
+	// pauses the streams at the end of the range of a PLAY
+	playEndTimer *time.Timer
+	// plays the tracks set up of a file
+	player *filePlayer
 }
 
 func newRTSPClientSession(connection *RTSPClientConnection, sessionID string) *RTSPClientSession {
 	s := &RTSPClientSession{
-		sessionID:  sessionID,
-		connection: connection,
+		sessionID:    sessionID,
+		connection:   connection,
+		livenessDone: make(chan struct{}),
 	}
 	s.noteLiveness()
+	s.startLivenessTimer()
 	return s
 }
 
@@ -30,237 +70,442 @@ func (s *RTSPClientSession) server() *RTSPServer {
 	return s.connection.server
 }
 
+// destroy tears the session down. It is called when the client's connection
+// closes or when the session has been idle for too long.
 func (s *RTSPClientSession) destroy() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.destroyLocked()
+}
+
+func (s *RTSPClientSession) destroyLocked() {
+	if s.isDestroyed {
+		return
+	}
+	s.isDestroyed = true
+
 	// turn off any liveness check:
-	//s.livenessTimeoutTimer.Stop()
-	//
-	//s.server().removeClientSession(s.sessionID)
-	//
-	//if s.serverMediaSession != nil {
-	//	streamName := s.serverMediaSession.StreamName()
-	//	s.server().removeServerMediaSession(streamName)
-	//}
-}
-
-func (s *RTSPClientSession) handleCommandSetup(urlPreSuffix, urlSuffix, reqStr string) {
-	//streamName, trackID := urlPreSuffix, urlSuffix
-
-	//sms := s.server().lookupServerMediaSession(streamName)
-	//if sms == nil {
-	//	if s.serverMediaSession == nil {
-	//		s.connection.handleCommandNotFound()
-	//	} else {
-	//		s.connection.handleCommandBad()
-	//	}
-	//	return
-	//}
-	//
-	//if s.serverMediaSession == nil {
-	//	s.serverMediaSession = sms
-	//} else if sms != s.serverMediaSession {
-	//	s.connection.handleCommandBad()
-	//	return
-	//}
-	//
-	//if s.streamStates == nil {
-	//	s.numStreamStates = s.serverMediaSession.SubsessionCounter
-	//
-	//	s.streamStates = new(StreamServerState)
-	//	for i := 0; i < s.numStreamStates; i++ {
-	//		s.streamStates.subsession = s.serverMediaSession.Subsessions[i]
-	//	}
-	//}
-	//
-	//// Look up information for the specified subsession (track):
-	//var subsession livemedia.IServerMediaSubsession
-	//if trackID != "" {
-	//	for streamNum := 0; streamNum < s.numStreamStates; streamNum++ {
-	//		subsession = s.streamStates.subsession
-	//		if subsession != nil && strings.EqualFold(trackID, subsession.TrackID()) {
-	//			break
-	//		}
-	//	}
-	//} else {
-	//	if s.numStreamStates != 1 && s.streamStates == nil {
-	//		s.connection.handleCommandBad()
-	//		return
-	//	}
-	//	subsession = s.streamStates.subsession
-	//}
-
-	// Look for a "Transport:" header in the request string, to extract client parameters:
-	transportHeader := livemedia.ParseTransportHeader(reqStr)
-	rtpChannelID := transportHeader.RTPChannelID
-	rtcpChannelID := transportHeader.RTCPChannelID
-	streamingMode := transportHeader.StreamingMode
-	clientRTPPort := transportHeader.ClientRTPPortNum
-	clientRTCPPort := transportHeader.ClientRTCPPortNum
-	streamingModeStr := transportHeader.StreamingModeStr
-
-	if streamingMode == livemedia.RTP_TCP && rtpChannelID == 0xFF {
-		rtpChannelID = s.TCPStreamIDCount
-		rtcpChannelID = s.TCPStreamIDCount + 1
+	if s.livenessDone != nil {
+		close(s.livenessDone)
 	}
-	if streamingMode == livemedia.RTP_TCP {
-		rtcpChannelID = s.TCPStreamIDCount + 2
+	s.server().removeClientSession(s.sessionID)
+	s.stopPlayEndTimer()
+
+	if s.player != nil {
+		s.player.close()
+		s.player = nil
 	}
+	for _, streamState := range s.streamStates {
+		streamState.stopPlaying()
+		streamState.close()
+	}
+	s.streamStates = nil
+	s.numStreamStates = 0
 
-	_, sawRangeHeader := livemedia.ParseRangeHeader(reqStr)
-	if sawRangeHeader {
-		s.streamAfterSETUP = true
-	} else if livemedia.ParsePlayNowHeader(reqStr) {
-		s.streamAfterSETUP = true
-	} else {
-		s.streamAfterSETUP = false
+	if s.serverMediaSession != nil && s.serverMediaSession.clearPublisher(s) {
+		// the publisher has gone away, so the live stream ends with it
+		s.server().removeServerMediaSession(s.serverMediaSession)
+	}
+}
+
+// sessionHeader is the value of the "Session:" header of our responses,
+// which tells the client how often it has to show signs of life.
+func (s *RTSPClientSession) sessionHeader() string {
+	if seconds := s.server().reclamationTestSeconds; seconds > 0 {
+		return fmt.Sprintf("%s;timeout=%d", s.sessionID, seconds)
+	}
+	return s.sessionID
+}
+
+func (s *RTSPClientSession) lookupStreamState(subsession *ServerMediaSubsession) *StreamServerState {
+	for _, streamState := range s.streamStates {
+		if streamState.subsession == subsession {
+			return streamState
+		}
+	}
+	return nil
+}
+
+// handleInterleavedPacket hands a packet that arrived on the RTSP connection
+// to the track whose interleaved channels it was sent on.
+func (s *RTSPClientSession) handleInterleavedPacket(channelID uint, packet []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, streamState := range s.streamStates {
+		if !streamState.isTCP {
+			continue
+		}
+		switch channelID {
+		case streamState.rtpChannelID:
+			if s.state == stateRecording {
+				s.handleIncomingRTP(streamState, packet)
+			}
+			return
+		case streamState.rtcpChannelID:
+			if s.state == stateRecording || !streamState.isRecord {
+				s.handleIncomingRTCP(streamState, packet)
+			}
+			return
+		}
+	}
+}
+
+// handleIncomingRTP is called for the RTP a publisher sends us.
+func (s *RTSPClientSession) handleIncomingRTP(streamState *StreamServerState, packet []byte) {
+	s.noteLiveness()
+	streamState.subsession.handleIncomingRTP(packet)
+}
+
+// handleIncomingRTCP is called for the RTCP the client sends us on a track:
+// the sender reports of a publisher, or the receiver reports of a player. A
+// BYE ends the session.
+func (s *RTSPClientSession) handleIncomingRTCP(streamState *StreamServerState, packet []byte) {
+	s.noteLiveness()
+
+	packets, err := rtcp.Unmarshal(packet)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, p := range packets {
+		switch p := p.(type) {
+		case *rtcp.ReceiverReport:
+			streamState.noteReceptionReports(p.Reports, now)
+		case *rtcp.SenderReport:
+			streamState.noteReceptionReports(p.Reports, now)
+		case *rtcp.Goodbye:
+			fmt.Printf("session %s: RTCP BYE received\n", s.sessionID)
+			// we may be called with s.mutex held
+			go s.destroy()
+			return
+		}
+	}
+
+	if streamState.isRecord {
+		streamState.subsession.handleIncomingRTCP(packet)
+	}
+}
+
+// receptionStats returns what the receiver reports of the client tell
+// about each of the tracks we play to it.
+func (s *RTSPClientSession) receptionStats() []receptionStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var stats []receptionStats
+	for _, streamState := range s.streamStates {
+		if !streamState.isRecord {
+			stats = append(stats, streamState.receptionStats())
+		}
+	}
+	return stats
+}
+
+func (s *RTSPClientSession) handleCommandSetup(req *rtsp.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.isDestroyed {
+		s.connection.handleCommandSessionNotFound()
+		return
+	}
+
+	// The URL names a track or, for single track streams, just the stream:
+	sms, subsession := s.server().resolveControlURL(req.URL)
+	if sms == nil {
+		if s.serverMediaSession == nil {
+			s.connection.handleCommandNotFound()
+		} else {
+			s.connection.handleCommandBad()
+		}
+		return
+	}
+	if s.serverMediaSession != nil && sms != s.serverMediaSession {
+		s.connection.handleCommandBad()
+		return
+	}
+	if subsession == nil {
+		if sms.SubsessionCount() != 1 {
+			// the tracks of the stream have to be set up one by one
+			s.connection.setRTSPResponse("459 Aggregate Operation Not Allowed")
+			return
+		}
+		subsession = sms.subsessions[0]
+	}
+	s.serverMediaSession = sms
+
+	// Look for a "Transport:" header, and pick the first of the transports it offers that we support:
+	transports, err := rtsp.ParseTransport(req.Header.Get(rtsp.Headers[rtsp.MySSTransportHeader]))
+	if err != nil {
+		s.connection.handleCommandBad()
+		return
+	}
+	transport := s.chooseTransport(transports)
+	if transport == nil {
+		s.connection.handleCommandUnsupportedTransport()
+		return
+	}
+
+	if s.state == statePlaying || s.state == stateRecording {
+		// changing the transport of a running stream isn't supported
+		s.handleCommandNotValidInState()
+		return
+	}
+
+	var group *multicastGroup
+	if transport.Multicast {
+		if group, err = subsession.multicastGroup(); err != nil {
+			fmt.Printf("failed to allocate a multicast group: %v\n", err)
+			s.connection.setRTSPResponse("453 Not Enough Bandwidth")
+			return
+		}
+	}
+
+	isRecord := transport.IsRecord()
+	if len(s.streamStates) > 0 && isRecord != s.isPublisher {
+		// a session either plays or records, never both
+		s.handleCommandNotValidInState()
+		return
+	}
+	// the first track a publisher sets up claims the stream
+	claimed := isRecord && len(s.streamStates) == 0
+	if isRecord && !sms.setPublisher(s) {
+		s.handleCommandNotValidInState()
+		return
+	}
+	prevState, prevPublisher, prevMulticast := s.state, s.isPublisher, s.isMulticast
+	s.isPublisher = isRecord
+	s.isMulticast = transport.Multicast
+
+	streamState := s.lookupStreamState(subsession)
+	created := streamState == nil
+	if created {
+		streamState = &StreamServerState{
+			subsession: subsession,
+			ssrc:       commonutilities.OurRandom32(),
+		}
+		s.streamStates = append(s.streamStates, streamState)
+		s.numStreamStates = len(s.streamStates)
+	}
+	streamState.isRecord = isRecord
+	s.state = stateReady
+	// undoSetup leaves the session and the stream as they were before a
+	// SETUP that fails from here on
+	undoSetup := func() {
+		if created {
+			streamState.close()
+			s.streamStates = s.streamStates[:len(s.streamStates)-1]
+			s.numStreamStates = len(s.streamStates)
+		}
+		if claimed {
+			sms.clearPublisher(s)
+		}
+		s.state, s.isPublisher, s.isMulticast = prevState, prevPublisher, prevMulticast
+	}
+
+	var rtpChannelID, rtcpChannelID uint
+	if transport.IsTCP() {
+		rtpChannelID, rtcpChannelID, _ = s.interleavedChannels(transport)
+		s.TCPStreamIDCount += 2
 	}
 
+	s.streamAfterSETUP = req.Header.Get(rtsp.Headers[rtsp.MySSRangeHeader]) != "" ||
+		req.Header.Get("x-playNow") != ""
+
 	sourceAddrStr := s.connection.localAddr
 	destAddrStr := s.connection.remoteAddr
 
-	//var tcpSocketNum net.Conn
-	//if streamingMode == livemedia.RTP_TCP {
-	//	tcpSocketNum = s.connection.socket
-	//}
-
-	//streamParameter := subsession.GetStreamParameters(tcpSocketNum,
-	//	destAddrStr,
-	//	s.sessionID,
-	//	clientRTPPort,
-	//	clientRTCPPort,
-	//	rtpChannelID,
-	//	rtcpChannelID)
-	//serverRTPPort := streamParameter.ServerRTPPort
-	//serverRTCPPort := streamParameter.ServerRTCPPort
-	//
-	//s.streamStates.streamToken = streamParameter.StreamToken
-
-	serverRTPPort := 0
-	serverRTCPPort := 0
+	var clientRTPPort, clientRTCPPort int
+	if transport.ClientPort != nil {
+		clientRTPPort = transport.ClientPort.Start
+		clientRTCPPort = transport.ClientPort.End
+		if clientRTCPPort == clientRTPPort {
+			clientRTCPPort++
+		}
+	}
+
+	streamState.isTCP = transport.IsTCP()
+	streamState.rtpChannelID = rtpChannelID
+	streamState.rtcpChannelID = rtcpChannelID
+	streamState.clientRTPPort = clientRTPPort
+	streamState.clientRTCPPort = clientRTCPPort
+	streamState.destAddr = destAddrStr
+	streamState.connection = s.connection
+	streamState.multicast = group
+	if group != nil {
+		// the stream the viewer gets is the one of the group
+		streamState.ssrc = group.ssrc
+	}
+
+	if !transport.IsTCP() && !s.isMulticast {
+		// allocate the sockets that carry this track's RTP and RTCP:
+		if err := streamState.allocatePorts(s.server().rtpPortAllocator, sourceAddrStr); err != nil {
+			fmt.Printf("failed to allocate server ports: %v\n", err)
+			undoSetup()
+			s.connection.setRTSPResponse("453 Not Enough Bandwidth")
+			return
+		}
+		streamState.setClientAddr(destAddrStr, clientRTPPort, clientRTCPPort)
+		if !isRecord {
+			streamState.startReceiving(nil, func(packet []byte) {
+				s.handleIncomingRTCP(streamState, packet)
+			})
+		}
+	}
 
+	if sms.source != nil {
+		if err := s.addFileOutput(streamState); err != nil {
+			fmt.Printf("can't play %s: %v\n", sms.source.path, err)
+			undoSetup()
+			s.connection.handleCommandNotFound()
+			return
+		}
+	}
+
+	serverPort := &rtsp.PortRange{Start: streamState.serverRTPPort(), End: streamState.serverRTCPPort()}
+	response := &rtsp.Transport{
+		Protocol:       "RTP",
+		Profile:        "AVP",
+		LowerTransport: transport.LowerTransport,
+		Unicast:        !s.isMulticast,
+		Multicast:      s.isMulticast,
+		Destination:    destAddrStr,
+		Source:         sourceAddrStr,
+	}
 	if s.isMulticast {
-		switch streamingMode {
-		case livemedia.RTP_UDP:
-			s.connection.responseBuffer = fmt.Sprintf("RTSP/1.0 200 OK\r\n"+
-				"CSeq: %s\r\n"+
-				"%s"+
-				"Transport: RTP/AVP;multicast;destination=%s;source=%s;port=%d-%d;ttl=%d\r\n"+
-				"Session: %s\r\n\r\n", s.connection.currentCSeq,
-				livemedia.DateHeader(),
-				destAddrStr,
-				sourceAddrStr,
-				serverRTPPort,
-				serverRTCPPort,
-				transportHeader.DestinationTTL,
-				s.sessionID)
-		case livemedia.RTP_TCP:
-			// multicast streams can't be sent via TCP
-			s.connection.handleCommandUnsupportedTransport()
-		case livemedia.RAW_UDP:
-			s.connection.responseBuffer = fmt.Sprintf("RTSP/1.0 200 OK\r\n"+
-				"CSeq: %s\r\n"+
-				"%s"+
-				"Transport: %s;multicast;destination=%s;source=%d;port=%d;ttl=%d\r\n"+
-				"Session: %s\r\n\r\n", s.connection.currentCSeq,
-				livemedia.DateHeader(),
-				destAddrStr,
-				sourceAddrStr,
-				serverRTPPort,
-				serverRTCPPort,
-				transportHeader.DestinationTTL,
-				s.sessionID)
+		response.Destination = group.group.String()
+		response.Port = &rtsp.PortRange{Start: group.port, End: group.port + 1}
+		response.TTL = group.ttl
+	} else if transport.IsTCP() {
+		response.Interleaved = &rtsp.PortRange{Start: int(rtpChannelID), End: int(rtcpChannelID)}
+	} else {
+		response.ClientPort = transport.ClientPort
+		response.ServerPort = serverPort
+	}
+	if isRecord {
+		response.Mode = "record"
+	} else {
+		response.SSRC = []uint32{streamState.ssrc}
+	}
+
+	s.connection.responseBuffer = fmt.Sprintf("RTSP/1.0 200 OK\r\n"+
+		"CSeq: %s\r\n"+
+		"%s"+
+		"Transport: %s\r\n"+
+		"Session: %s\r\n\r\n", s.connection.currentCSeq,
+		rtsp.DateHeader(),
+		response.String(),
+		s.sessionHeader())
+}
+
+// addFileOutput has the player of the session send the track of a file
+// that streamState sets up, opening the file with the first track.
+func (s *RTSPClientSession) addFileOutput(streamState *StreamServerState) error {
+	if s.player == nil {
+		player, err := newFilePlayer(streamState.subsession.mediaSession.source)
+		if err != nil {
+			return err
+		}
+		s.player = player
+	}
+	return s.player.addOutput(streamState)
+}
+
+// chooseTransport returns the first of the transports offered by the client
+// that this session can serve, or nil if there is none.
+func (s *RTSPClientSession) chooseTransport(transports []*rtsp.Transport) *rtsp.Transport {
+	for _, transport := range transports {
+		if !transport.IsRTP() || transport.Profile != "AVP" {
+			continue
+		}
+		switch transport.LowerTransport {
+		case "TCP":
+			if s.isMulticast {
+				// multicast streams can't be sent via TCP
+				continue
+			}
+			if _, _, ok := s.interleavedChannels(transport); !ok {
+				continue
+			}
+		case "", "UDP":
+			if len(s.streamStates) > 0 && transport.Multicast != s.isMulticast {
+				// all tracks of a session are either unicast or multicast
+				continue
+			}
+			if !transport.Multicast && transport.ClientPort == nil {
+				continue
+			}
+			if transport.Multicast && (transport.IsRecord() || s.serverMediaSession.multicastPool == nil) {
+				continue
+			}
 		default:
+			continue
+		}
+		return transport
+	}
+	return nil
+}
+
+// interleavedChannels returns the channels the RTP and RTCP of a TCP
+// transport are sent on: those the client asked for, or else the next ones
+// of the session. ok is false if they don't fit in the one byte channel of
+// an interleaved frame.
+func (s *RTSPClientSession) interleavedChannels(transport *rtsp.Transport) (rtpChannelID, rtcpChannelID uint, ok bool) {
+	if transport.Interleaved != nil {
+		rtpChannelID = uint(transport.Interleaved.Start)
+		rtcpChannelID = uint(transport.Interleaved.End)
+		if rtcpChannelID == rtpChannelID {
+			rtcpChannelID++
 		}
 	} else {
-		switch streamingMode {
-		case livemedia.RTP_UDP:
-			s.connection.responseBuffer = fmt.Sprintf("RTSP/1.0 200 OK\r\n"+
-				"CSeq: %s\r\n"+
-				"%s"+
-				"Transport: RTP/AVP;unicast;destination=%s;source=%s;client_port=%d-%d;server_port=%d-%d\r\n"+
-				"Session: %s\r\n\r\n", s.connection.currentCSeq,
-				livemedia.DateHeader(),
-				destAddrStr,
-				sourceAddrStr,
-				clientRTPPort,
-				clientRTCPPort,
-				serverRTPPort,
-				serverRTCPPort,
-				s.sessionID)
-		case livemedia.RTP_TCP:
-			s.connection.responseBuffer = fmt.Sprintf("RTSP/1.0 200 OK\r\n"+
-				"CSeq: %s\r\n"+
-				"%s"+
-				"Transport: RTP/AVP/TCP;unicast;destination=%s;source=%s;interleaved=%d-%d\r\n"+
-				"Session: %s\r\n\r\n", s.connection.currentCSeq,
-				livemedia.DateHeader(),
-				destAddrStr,
-				sourceAddrStr,
-				rtpChannelID,
-				rtcpChannelID,
-				s.sessionID)
-		case livemedia.RAW_UDP:
-			s.connection.responseBuffer = fmt.Sprintf("RTSP/1.0 200 OK\r\n"+
-				"CSeq: %s\r\n"+
-				"%s"+
-				"Transport: %s;unicast;destination=%s;source=%s;client_port=%d;server_port=%d\r\n"+
-				"Session: %s\r\n\r\n", s.connection.currentCSeq,
-				livemedia.DateHeader(),
-				streamingModeStr,
-				destAddrStr,
-				sourceAddrStr,
-				clientRTPPort,
-				serverRTPPort,
-				s.sessionID)
-		}
-	}
-}
-
-func (s *RTSPClientSession) handleCommandWithinSession(cmdName, urlPreSuffix, urlSuffix, fullRequestStr string) {
-	//s.noteLiveness()
-	//
-	//var subsession livemedia.IServerMediaSubsession
-	//if s.serverMediaSession == nil { // There wasn't a previous SETUP!
-	//	s.connection.handleCommandNotSupported()
-	//	return
-	//} else if urlSuffix != "" && strings.EqualFold(s.serverMediaSession.StreamName(), urlPreSuffix) {
-	//	// Non-aggregated operation.
-	//	// Look up the media subsession whose track id is "urlSuffix":
-	//	for i := 0; i < s.serverMediaSession.SubsessionCounter; i++ {
-	//		subsession = s.serverMediaSession.Subsessions[i]
-	//
-	//		if strings.EqualFold(subsession.TrackID(), urlSuffix) {
-	//			break
-	//		}
-	//	}
-	//
-	//	if subsession == nil { // no such track!
-	//		s.connection.handleCommandNotFound()
-	//		return
-	//	}
-	//} else if strings.EqualFold(s.serverMediaSession.StreamName(), urlSuffix) ||
-	//	urlSuffix == "" && strings.EqualFold(s.serverMediaSession.StreamName(), urlPreSuffix) {
-	//	// Aggregated operation
-	//	subsession = nil
-	//} else if urlPreSuffix != "" && urlSuffix != "" {
-	//	// Aggregated operation, if <urlPreSuffix>/<urlSuffix> is the session (stream) name:
-	//	if strings.EqualFold(s.serverMediaSession.StreamName(), urlPreSuffix) &&
-	//		s.serverMediaSession.StreamName() == "" &&
-	//		strings.EqualFold(s.serverMediaSession.StreamName(), urlSuffix) {
-	//		subsession = nil
-	//	} else {
-	//		s.connection.handleCommandNotFound()
-	//		return
-	//	}
-	//} else { // the request doesn't match a known stream and/or track at all!
-	//	s.connection.handleCommandNotFound()
-	//	return
-	//}
+		rtpChannelID = s.TCPStreamIDCount
+		rtcpChannelID = s.TCPStreamIDCount + 1
+	}
+	return rtpChannelID, rtcpChannelID, rtpChannelID <= maxInterleavedChannel && rtcpChannelID <= maxInterleavedChannel
+}
+
+func (s *RTSPClientSession) handleCommandWithinSession(cmdName string, req *rtsp.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.isDestroyed {
+		s.connection.handleCommandSessionNotFound()
+		return
+	}
+
+	// Find out whether the request is an aggregate operation on the stream
+	// of the session, or a non-aggregate one on one of its tracks. Without
+	// a SETUP there is nothing to match, and the state machine answers.
+	var subsession *ServerMediaSubsession
+	if s.serverMediaSession != nil {
+		var sms *ServerMediaSession
+		sms, subsession = s.server().resolveControlURL(req.URL)
+		if sms != s.serverMediaSession || subsession != nil && s.lookupStreamState(subsession) == nil {
+			if cmdName == rtsp.TEARDOWN || cmdName == rtsp.GET_PARAMETER || cmdName == rtsp.SET_PARAMETER {
+				// keep-alives are answered, and the session ended, whatever
+				// URL they name, e.g. one of a stream that has gone away
+				subsession = nil
+			} else {
+				// the request doesn't match the stream or a track of the session
+				s.connection.handleCommandNotFound()
+				return
+			}
+		}
+		if subsession != nil && len(s.streamStates) > 1 && cmdName != rtsp.TEARDOWN &&
+			cmdName != rtsp.GET_PARAMETER && cmdName != rtsp.SET_PARAMETER {
+			// the tracks of a session share one timeline, so they are
+			// played, paused and recorded together
+			s.connection.setRTSPResponseWithSessionID("460 Only Aggregate Operation Allowed", s.sessionHeader())
+			return
+		}
+	}
 
 	switch cmdName {
 	case "TEARDOWN":
-		s.handleCommandTearDown()
+		s.handleCommandTearDown(subsession)
 	case "PLAY":
-		s.handleCommandPlay(nil/*subsession*/, fullRequestStr)
+		s.handleCommandPlay(subsession, req)
+	case "RECORD":
+		s.handleCommandRecord()
 	case "PAUSE":
 		s.handleCommandPause()
 	case "GET_PARAMETER":
@@ -270,183 +515,346 @@ func (s *RTSPClientSession) handleCommandWithinSession(cmdName, urlPreSuffix, ur
 	}
 }
 
-func (s *RTSPClientSession) handleCommandPlay(subsession livemedia.IServerMediaSubsession, fullRequestStr string) {
-	//rtspURL := s.server().RtspURL(s.serverMediaSession.StreamName())
-	//
-	//// Parse the client's "Scale:" header, if any:
-	//scale, sawScaleHeader := livemedia.ParseScaleHeader(fullRequestStr)
-	//
-	//// Try to set the stream's scale factor to this value:
-	//if subsession == nil {
-	//	scale = s.serverMediaSession.TestScaleFactor()
-	//} else {
-	//	scale = subsession.TestScaleFactor(scale)
-	//}
-	//
-	//var buf string
-	//if sawScaleHeader {
-	//	buf = fmt.Sprintf("Scale: %f\r\n", scale)
-	//}
-	//scaleHeaderStr := buf
-	//
-	//buf = ""
-	//var rangeStart, rangeEnd, duration float32
-	//var absStartTime, absEndTime string
-	//
-	//rangeHeader, sawRangeHeader := livemedia.ParseRangeHeader(fullRequestStr)
-	//if sawRangeHeader && rangeHeader.AbsStartTime == "" {
-	//	if subsession == nil {
-	//		duration = s.serverMediaSession.Duration()
-	//	} else {
-	//		//duration = subsession.Duration()
-	//	}
-	//	if duration < 0 {
-	//		duration = -duration
-	//	}
-	//
-	//	rangeStart = rangeHeader.RangeStart
-	//	rangeEnd = rangeHeader.RangeEnd
-	//	absStartTime = rangeHeader.AbsStartTime
-	//	absEndTime = rangeHeader.AbsEndTime
-	//
-	//	if rangeStart < 0 {
-	//		rangeStart = 0
-	//	} else if rangeStart > duration {
-	//		rangeStart = duration
-	//	}
-	//	if rangeEnd < 0 {
-	//		rangeEnd = 0
-	//	} else if rangeEnd > duration {
-	//		rangeEnd = duration
-	//	}
-	//
-	//	if (scale > 0.0 && rangeStart > rangeEnd && rangeEnd > 0.0) || (scale < 0.0 && rangeStart < rangeEnd) {
-	//		// "rangeStart" and "rangeEnd" were the wrong way around; swap them:
-	//		rangeStart, rangeEnd = rangeEnd, rangeStart
-	//	}
-	//
-	//	// We're seeking by 'absolute' time:
-	//	if absEndTime == "" {
-	//		buf = fmt.Sprintf("Range: clock=%s-\r\n", absStartTime)
-	//	} else {
-	//		buf = fmt.Sprintf("Range: clock=%s-%s\r\n", absStartTime, absEndTime)
-	//	}
-	//} else {
-	//	// We're seeking by relative (NPT) time:
-	//	if rangeEnd == 0.0 && scale >= 0.0 {
-	//		buf = fmt.Sprintf("Range: npt=%.3f-\r\n", rangeStart)
-	//	} else {
-	//		buf = fmt.Sprintf("Range: npt=%.3f-%.3f\r\n", rangeStart, rangeEnd)
-	//	}
-	//}
-	//
-	//for i := 0; i < s.numStreamStates; i++ {
-	//	if subsession == nil || s.numStreamStates == 1 {
-	//		if sawScaleHeader {
-	//			if s.streamStates.subsession != nil {
-	//				//s.streamStates.subsession.setStreamScale(s.ourSessionID, s.streamStates.streamToken, scale)
-	//			}
-	//		}
-	//		if sawRangeHeader {
-	//			// Special case handling for seeking by 'absolute' time:
-	//			if absStartTime != "" {
-	//				if s.streamStates.subsession != nil {
-	//					s.streamStates.subsession.SeekStream(s.sessionID, s.streamStates.streamToken, 0)
-	//				}
-	//			} else { // Seeking by relative (NPT) time:
-	//				var streamDuration float32 = 0.0                   // by default; means: stream until the end of the media
-	//				if rangeEnd > 0.0 && (rangeEnd+0.001) < duration { // the 0.001 is because we limited the values to 3 decimal places
-	//					// We want the stream to end early.  Set the duration we want:
-	//					streamDuration = rangeEnd - rangeStart
-	//					if streamDuration < 0.0 {
-	//						streamDuration = -streamDuration // should happen only if scale < 0.0
-	//					}
-	//				}
-	//				if s.streamStates.subsession != nil {
-	//					s.streamStates.subsession.SeekStream(s.sessionID, s.streamStates.streamToken, streamDuration)
-	//				}
-	//			}
-	//		}
-	//	}
-	//}
-	//
-	//rangeHeaderStr := buf
-	//
-	//rtpSeqNum, rtpTimestamp := s.streamStates.subsession.StartStream(s.sessionID, s.streamStates.streamToken,
-	//	s.noteLiveness, s.connection.handleAlternativeRequestByte)
-	//urlSuffix := s.streamStates.subsession.TrackID()
-	//
-	//// Create a "RTP-INFO" line. It will get filled in from each subsession's state:
-	//rtpInfoFmt := "RTP-INFO: " +
-	//	"%s" +
-	//	"url=%s/%s" +
-	//	";seq=%d" +
-	//	";rtptime=%d"
-	//
-	//rtpInfo := fmt.Sprintf(rtpInfoFmt, "", rtspURL, urlSuffix, rtpSeqNum, rtpTimestamp)
-	//
-	//// Fill in the response:
-	//s.connection.responseBuffer = fmt.Sprintf("RTSP/1.0 200 OK\r\n"+
-	//	"CSeq: %s\r\n"+
-	//	"%s"+
-	//	"%s"+
-	//	"%s"+
-	//	"Session: %s\r\n"+
-	//	"%s\r\n\r\n", s.connection.currentCSeq,
-	//	livemedia.DateHeader(),
-	//	scaleHeaderStr,
-	//	rangeHeaderStr,
-	//	s.sessionID,
-	//	rtpInfo)
+func (s *RTSPClientSession) handleCommandPlay(subsession *ServerMediaSubsession, req *rtsp.Request) {
+	if s.isPublisher || s.state != stateReady && s.state != statePlaying {
+		// PLAY is only valid after a SETUP for playing
+		s.handleCommandNotValidInState()
+		return
+	}
+
+	var requested *rtsp.Range
+	if header := req.Header.Get(rtsp.Headers[rtsp.MySSRangeHeader]); header != "" {
+		var err error
+		if requested, err = rtsp.ParseRange(header); err != nil {
+			s.connection.handleCommandBad()
+			return
+		}
+	}
+	var scaleHeaders string
+	for _, header := range []int{rtsp.MySSScaleHeader, rtsp.MySSSpeedHeader} {
+		name := rtsp.Headers[header]
+		if value := req.Header.Get(name); value != "" {
+			if _, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+				s.connection.handleCommandBad()
+				return
+			}
+			// streams play at their own pace
+			scaleHeaders += name + ": 1.0\r\n"
+		}
+	}
+
+	if s.player != nil {
+		s.handleCommandPlayFile(requested, scaleHeaders, req)
+		return
+	}
+
+	now := time.Now()
+	position := s.playedBefore
+	if s.state == statePlaying {
+		position += now.Sub(s.playingSince)
+	}
+	// a live stream can't seek, so only the end of a range counts
+	responseRange, playFor, ok := playRange(requested, position, now)
+	if !ok {
+		s.connection.setRTSPResponse("457 Invalid Range")
+		return
+	}
+
+	rtspURL := s.connection.rtspURL(req.URL, s.serverMediaSession.StreamName())
+
+	// Attach every track to the reflector of the live stream, and describe
+	// where its rewritten RTP stream starts:
+	var rtpInfo []*rtsp.RTPInfo
+	for _, streamState := range s.streamStates {
+		if subsession != nil && streamState.subsession != subsession {
+			continue
+		}
+		seq, rtpTime := streamState.startPlaying().rtpInfo(now)
+		rtpInfo = append(rtpInfo, &rtsp.RTPInfo{
+			URL:        rtspURL + "/" + streamState.subsession.trackID,
+			Seq:        seq,
+			RTPTime:    rtpTime,
+			HasSeq:     true,
+			HasRTPTime: true,
+		})
+	}
+	if s.state != statePlaying {
+		s.playingSince = now
+		s.state = statePlaying
+	}
+	s.stopPlayEndTimer()
+	if playFor > 0 {
+		s.playEndTimer = time.AfterFunc(playFor, s.handlePlayEnd)
+	}
+	s.setPlayResponse(responseRange, scaleHeaders, rtpInfo)
+}
+
+// handleCommandPlayFile plays the tracks of a file from the start of the
+// requested range, snapped to a sync sample, or else from where they were
+// paused, up to the end of the range or of the file. A PLAY without a
+// range once the file has been played to the end starts it over.
+func (s *RTSPClientSession) handleCommandPlayFile(requested *rtsp.Range, scaleHeaders string, req *rtsp.Request) {
+	duration := s.serverMediaSession.source.movie.Duration
+	start, end := s.player.position(), duration
+	seek := start >= duration
+	if seek {
+		start = 0
+	}
+	unit := "npt"
+	if requested != nil {
+		if requested.Unit == "clock" {
+			// a file has no wall clock time
+			s.connection.setRTSPResponse("457 Invalid Range")
+			return
+		}
+		unit = requested.Unit
+		if requested.HasStart {
+			start, seek = requested.Start, true
+		}
+		if requested.HasEnd && requested.End < end {
+			end = requested.End
+		}
+	}
+	if start >= duration || end <= start {
+		s.connection.setRTSPResponse("457 Invalid Range")
+		return
+	}
+
+	s.player.pause()
+	if seek {
+		start = s.player.seek(start)
+	}
+	rtspURL := s.connection.rtspURL(req.URL, s.serverMediaSession.StreamName())
+	var rtpInfo []*rtsp.RTPInfo
+	for _, o := range s.player.outputs {
+		rtpInfo = append(rtpInfo, &rtsp.RTPInfo{
+			URL:        rtspURL + "/" + o.streamState.subsession.trackID,
+			Seq:        o.seq,
+			RTPTime:    o.rtpTime(start),
+			HasSeq:     true,
+			HasRTPTime: true,
+		})
+	}
+	s.player.play(start, end)
+	s.state = statePlaying
+	s.stopPlayEndTimer()
+	s.playEndTimer = time.AfterFunc(end-start, s.handlePlayEnd)
+
+	responseRange := &rtsp.Range{Unit: unit, Start: start, HasStart: true, End: end, HasEnd: true}
+	s.setPlayResponse(responseRange, scaleHeaders, rtpInfo)
+}
+
+// setPlayResponse answers a PLAY with the range that plays and where the
+// RTP stream of every track continues.
+func (s *RTSPClientSession) setPlayResponse(responseRange *rtsp.Range, scaleHeaders string, rtpInfo []*rtsp.RTPInfo) {
+	s.connection.responseBuffer = fmt.Sprintf("RTSP/1.0 200 OK\r\n"+
+		"CSeq: %s\r\n"+
+		"%s"+
+		"Range: %s\r\n"+
+		"%s"+
+		"Session: %s\r\n"+
+		"RTP-Info: %s\r\n\r\n", s.connection.currentCSeq,
+		rtsp.DateHeader(),
+		responseRange,
+		scaleHeaders,
+		s.sessionHeader(),
+		rtsp.FormatRTPInfo(rtpInfo))
+}
+
+// playRange returns the range a PLAY of a live stream actually plays, in the
+// unit of the requested one, from the current normal play time position or
+// clock time now. playFor is how long until the end of the requested range,
+// 0 if it has none; ok is false if that end has already passed.
+func playRange(requested *rtsp.Range, position time.Duration, now time.Time) (responseRange *rtsp.Range, playFor time.Duration, ok bool) {
+	if requested == nil {
+		return &rtsp.Range{Unit: "npt", Start: position, HasStart: true}, 0, true
+	}
+
+	responseRange = &rtsp.Range{Unit: requested.Unit, HasStart: true, HasEnd: requested.HasEnd}
+	if requested.Unit == "clock" {
+		responseRange.StartTime = now
+		if requested.HasEnd {
+			responseRange.EndTime = requested.EndTime
+			playFor = requested.EndTime.Sub(now)
+		}
+	} else {
+		responseRange.Start = position
+		if requested.HasEnd {
+			responseRange.End = requested.End
+			playFor = requested.End - position
+		}
+	}
+	if requested.HasEnd && playFor <= 0 {
+		return nil, 0, false
+	}
+	return responseRange, playFor, true
+}
+
+// handlePlayEnd pauses the streams when the range of a PLAY has been played.
+func (s *RTSPClientSession) handlePlayEnd() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.isDestroyed && s.state == statePlaying {
+		s.pauseLocked(time.Now())
+	}
+}
+
+func (s *RTSPClientSession) stopPlayEndTimer() {
+	if s.playEndTimer != nil {
+		s.playEndTimer.Stop()
+		s.playEndTimer = nil
+	}
+}
+
+func (s *RTSPClientSession) handleCommandRecord() {
+	if !s.isPublisher || s.state != stateReady && s.state != stateRecording {
+		// RECORD is only valid after a SETUP with "mode=record"
+		s.handleCommandNotValidInState()
+		return
+	}
+
+	for _, streamState := range s.streamStates {
+		streamState := streamState
+		streamState.startReceiving(func(packet []byte) {
+			if s.isRecording() {
+				s.handleIncomingRTP(streamState, packet)
+			}
+		}, func(packet []byte) {
+			s.handleIncomingRTCP(streamState, packet)
+		})
+	}
+	s.state = stateRecording
+
+	s.connection.setRTSPResponseWithSessionID("200 OK", s.sessionHeader())
+}
+
+// isRecording reports whether a publisher is between RECORD and PAUSE. It
+// is called for the media it sends over UDP, which is dropped otherwise.
+func (s *RTSPClientSession) isRecording() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state == stateRecording
 }
 
+// handleCommandPause stops the streams of a player, which a later PLAY
+// resumes where they were, or the recording of a publisher.
 func (s *RTSPClientSession) handleCommandPause() {
-	//s.streamStates.subsession.PauseStream(s.streamStates.streamToken)
+	if s.state == stateInit {
+		s.handleCommandNotValidInState()
+		return
+	}
+	if s.state == statePlaying {
+		s.pauseLocked(time.Now())
+	}
+	s.state = stateReady
 
-	//for i := 0; i < s.numStreamStates; i++ {
-	//	s.streamStates[i].subsession.PauseStream()
-	//}
+	s.connection.setRTSPResponseWithSessionID("200 OK", s.sessionHeader())
+}
 
-	s.connection.setRTSPResponseWithSessionID("200 OK", s.sessionID)
+func (s *RTSPClientSession) pauseLocked(now time.Time) {
+	s.stopPlayEndTimer()
+	if s.player != nil {
+		s.player.pause()
+	}
+	for _, streamState := range s.streamStates {
+		streamState.pausePlaying()
+	}
+	s.playedBefore += now.Sub(s.playingSince)
+	s.state = stateReady
+}
+
+// handleCommandNotValidInState answers a request that the state machine of
+// the session doesn't allow with 455, listing the methods it does.
+func (s *RTSPClientSession) handleCommandNotValidInState() {
+	methods := []string{rtsp.GET_PARAMETER, rtsp.SET_PARAMETER, rtsp.TEARDOWN}
+	switch s.state {
+	case stateInit:
+		methods = append(methods, rtsp.SETUP)
+	case stateReady:
+		methods = append(methods, rtsp.SETUP, rtsp.PAUSE)
+		if s.isPublisher {
+			methods = append(methods, rtsp.RECORD)
+		} else {
+			methods = append(methods, rtsp.PLAY)
+		}
+	case statePlaying:
+		methods = append(methods, rtsp.PLAY, rtsp.PAUSE)
+	case stateRecording:
+		methods = append(methods, rtsp.RECORD, rtsp.PAUSE)
+	}
+	s.connection.responseBuffer = fmt.Sprintf("RTSP/1.0 455 Method Not Valid in This State\r\n"+
+		"CSeq: %s\r\n"+
+		"%s"+
+		"Allow: %s\r\n"+
+		"Session: %s\r\n\r\n", s.connection.currentCSeq,
+		rtsp.DateHeader(),
+		strings.Join(methods, ", "),
+		s.sessionHeader())
 }
 
 func (s *RTSPClientSession) handleCommandGetParameter() {
-	s.connection.setRTSPResponseWithSessionID("200 OK", s.sessionID)
+	s.connection.setRTSPResponseWithSessionID("200 OK", s.sessionHeader())
 }
 
 func (s *RTSPClientSession) handleCommandSetParameter() {
-	s.connection.setRTSPResponseWithSessionID("200 OK", s.sessionID)
+	s.connection.setRTSPResponseWithSessionID("200 OK", s.sessionHeader())
 }
 
-func (s *RTSPClientSession) handleCommandTearDown() {
-	//s.streamStates.subsession.DeleteStream(s.sessionID, s.streamStates.streamToken)
-
-	//for i := 0; i < s.numStreamStates; i++ {
-	//	s.streamStates[i].subsession.DeleteStream()
-	//}
-
+// handleCommandTearDown ends the session or, for the URL of one of several
+// tracks, stops just that track.
+func (s *RTSPClientSession) handleCommandTearDown(subsession *ServerMediaSubsession) {
+	if subsession != nil && len(s.streamStates) > 1 {
+		for i, streamState := range s.streamStates {
+			if streamState.subsession == subsession {
+				if s.player != nil {
+					s.player.removeOutput(streamState)
+				}
+				streamState.stopPlaying()
+				streamState.close()
+				s.streamStates = append(s.streamStates[:i], s.streamStates[i+1:]...)
+				s.numStreamStates = len(s.streamStates)
+				break
+			}
+		}
+		s.connection.setRTSPResponseWithSessionID("200 OK", s.sessionHeader())
+		return
+	}
 	s.connection.setRTSPResponse("200 OK")
-	s.destroy()
+	s.destroyLocked()
 }
 
+// noteLiveness postpones the reclamation of the session. It is called for
+// every request on the session and for the media and RTCP the client sends,
+// so it may run on several goroutines at once.
 func (s *RTSPClientSession) noteLiveness() {
-	//if !s.isTimerRunning {
-	//	go s.livenessTimeoutTask(time.Second * s.server().reclamationTestSeconds)
-	//	s.isTimerRunning = true
-	//} else {
-	//	//fmt.Println("noteLiveness", s.livenessTimeoutTimer)
-	//	s.livenessTimeoutTimer.Reset(time.Second * s.server().reclamationTestSeconds)
-	//}
+	atomic.StoreInt64(&s.lastLivenessTime, time.Now().UnixNano())
 }
 
+func (s *RTSPClientSession) startLivenessTimer() {
+	if seconds := s.server().reclamationTestSeconds; seconds > 0 && !s.isTimerRunning {
+		s.isTimerRunning = true
+		go s.livenessTimeoutTask(time.Duration(seconds) * time.Second)
+	}
+}
+
+// livenessTimeoutTask destroys the session once nothing has called
+// noteLiveness for d.
 func (s *RTSPClientSession) livenessTimeoutTask(d time.Duration) {
-	//s.livenessTimeoutTimer = time.NewTimer(d)
-	//
-	//for {
-	//	select {
-	//	case <-s.livenessTimeoutTimer.C:
-	//		fmt.Println("livenessTimeoutTask")
-	//		s.destroy()
-	//	}
-	//}
+	livenessTimeoutTimer := time.NewTimer(d)
+	defer livenessTimeoutTimer.Stop()
+
+	for {
+		select {
+		case <-livenessTimeoutTimer.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastLivenessTime)))
+			if idle >= d {
+				fmt.Printf("session %s timed out after %v\n", s.sessionID, idle)
+				s.destroy()
+				return
+			}
+			livenessTimeoutTimer.Reset(d - idle)
+		case <-s.livenessDone:
+			return
+		}
+	}
 }
@@ -0,0 +1,439 @@
+package rtsp_server
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/yangxianzhi/my-streaming-server/rtcp"
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+	"github.com/yangxianzhi/my-streaming-server/rtsp"
+	"github.com/yangxianzhi/my-streaming-server/sdp"
+)
+
+func TestIdleSessionReclaimed(t *testing.T) {
+	server := New()
+	server.SetReclamationTestSeconds(1)
+	c := &RTSPClientConnection{server: server}
+
+	idle := newRTSPClientSession(c, "0000000A")
+	server.addClientSession(idle.sessionID, idle)
+	active := newRTSPClientSession(c, "0000000B")
+	server.addClientSession(active.sessionID, active)
+	defer active.destroy()
+
+	if got := active.sessionHeader(); got != "0000000B;timeout=1" {
+		t.Errorf("sessionHeader() = %q, want %q", got, "0000000B;timeout=1")
+	}
+
+	deadline := time.Now().Add(1500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		active.noteLiveness()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if _, existed := server.getClientSession(idle.sessionID); existed {
+		t.Errorf("idle session still exists after its timeout")
+	}
+	if _, existed := server.getClientSession(active.sessionID); !existed {
+		t.Errorf("active session was reclaimed")
+	}
+}
+
+func TestReceiverReports(t *testing.T) {
+	server := New()
+	c := &RTSPClientConnection{server: server}
+	s := newRTSPClientSession(c, "0000000C")
+	server.addClientSession(s.sessionID, s)
+	defer s.destroy()
+
+	streamState := &StreamServerState{
+		subsession: &ServerMediaSubsession{trackID: "trackID=1"},
+		ssrc:       0x11223344,
+	}
+	s.streamStates = append(s.streamStates, streamState)
+
+	// we sent a SR 250ms ago, which the client held for 50ms
+	sent := time.Now().Add(-250 * time.Millisecond)
+	rr, _ := rtcp.Marshal([]rtcp.Packet{&rtcp.ReceiverReport{
+		SSRC: 0x55667788,
+		Reports: []rtcp.ReceptionReport{
+			{SSRC: 0x99999999, TotalLost: 100},
+			{
+				SSRC:             0x11223344,
+				FractionLost:     64,
+				TotalLost:        3,
+				Jitter:           42,
+				LastSenderReport: rtcp.MiddleNTP(rtcp.NTPTime(sent)),
+				Delay:            65536 / 20,
+			},
+		},
+	}})
+	s.handleIncomingRTCP(streamState, rr)
+
+	stats := s.receptionStats()
+	if len(stats) != 1 {
+		t.Fatalf("got stats for %d tracks, want 1", len(stats))
+	}
+	got := stats[0]
+	if got.trackID != "trackID=1" || got.fractionLost != 0.25 || got.totalLost != 3 || got.jitter != 42 {
+		t.Errorf("stats = %+v", got)
+	}
+	if got.roundTripTime < 150*time.Millisecond || got.roundTripTime > 400*time.Millisecond {
+		t.Errorf("round trip time = %v, want about 200ms", got.roundTripTime)
+	}
+
+	bye, _ := rtcp.Marshal([]rtcp.Packet{
+		&rtcp.ReceiverReport{SSRC: 0x55667788},
+		&rtcp.Goodbye{Sources: []uint32{0x55667788}},
+	})
+	s.handleIncomingRTCP(streamState, bye)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, existed := server.getClientSession(s.sessionID); !existed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("session still exists after a RTCP BYE")
+}
+
+func TestPlayPause(t *testing.T) {
+	server := New()
+	server.SetBindAddresses("127.0.0.1")
+	if err := server.Listen(45670); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Destroy()
+
+	sdpInfo, err := sdp.ParseSdp("v=0\r\n" +
+		"s=mic\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 0 RTP/AVP 0\r\n" +
+		"a=control:trackID=1\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sms := newLiveServerMediaSession("mic", sdpInfo)
+	server.addServerMediaSession(sms)
+	defer server.removeServerMediaSession(sms)
+
+	const streamURL = "rtsp://127.0.0.1:45670/mic"
+	ctx := context.Background()
+	session := rtsp.NewSession()
+	defer session.Close()
+	if _, err := session.Setup(ctx, streamURL+"/trackID=1", "RTP/AVP;unicast;client_port=45672-45673"); err != nil {
+		t.Fatal(err)
+	}
+	request := func(method, header, value string) *rtsp.Response {
+		req, _ := rtsp.NewRequest(method, streamURL, "", "")
+		req.Header.Set("Session", session.SessionID())
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		resp, err := session.Do(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// a player can't RECORD
+	if resp := request(rtsp.RECORD, "", ""); resp.StatusCode != rtsp.MethodNotValidInThisState ||
+		resp.Header.Get("Allow") != "GET_PARAMETER, SET_PARAMETER, TEARDOWN, SETUP, PAUSE, PLAY" {
+		t.Errorf("RECORD: %d, Allow: %s", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+	if resp := request(rtsp.PLAY, "Range", "npt=zero-"); resp.StatusCode != rtsp.BadRequest {
+		t.Errorf("PLAY with a bad range: %d", resp.StatusCode)
+	}
+
+	resp := request(rtsp.PLAY, "Scale", "2")
+	if resp.StatusCode != rtsp.OK || resp.Header.Get("Range") != "npt=0.000-" || resp.Header.Get("Scale") != "1.0" {
+		t.Errorf("PLAY: %d, Range: %s, Scale: %s", resp.StatusCode, resp.Header.Get("Range"), resp.Header.Get("Scale"))
+	}
+	rtpInfo, err := rtsp.ParseRTPInfo(resp.Header.Get("RTP-Info"))
+	if err != nil || len(rtpInfo) != 1 || rtpInfo[0].URL != streamURL+"/trackID=1" {
+		t.Fatalf("RTP-Info: %s", resp.Header.Get("RTP-Info"))
+	}
+	if resp := request(rtsp.SETUP, "Transport", "RTP/AVP;unicast;client_port=45674-45675"); resp.StatusCode != rtsp.MethodNotValidInThisState {
+		t.Errorf("SETUP while playing: %d", resp.StatusCode)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if resp := request(rtsp.PAUSE, "", ""); resp.StatusCode != rtsp.OK {
+		t.Errorf("PAUSE: %d", resp.StatusCode)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// nothing was sent, so the stream resumes where it started, and the
+	// play time leaves out the pause
+	resp = request(rtsp.PLAY, "Range", "npt=0-3600")
+	playRange, err := rtsp.ParseRange(resp.Header.Get("Range"))
+	if resp.StatusCode != rtsp.OK || err != nil || playRange.Start < 100*time.Millisecond ||
+		playRange.Start > 190*time.Millisecond || playRange.End != time.Hour {
+		t.Errorf("resuming PLAY: %d, Range: %s", resp.StatusCode, resp.Header.Get("Range"))
+	}
+	resumed, err := rtsp.ParseRTPInfo(resp.Header.Get("RTP-Info"))
+	if err != nil || len(resumed) != 1 || resumed[0].Seq != rtpInfo[0].Seq || resumed[0].RTPTime != rtpInfo[0].RTPTime {
+		t.Errorf("RTP-Info %s after resuming %s", resp.Header.Get("RTP-Info"), rtpInfo)
+	}
+
+	if resp := request(rtsp.PLAY, "Range", "npt=0-0.05"); resp.StatusCode != rtsp.InvalidRange {
+		t.Errorf("PLAY of a range that has been played: %d", resp.StatusCode)
+	}
+}
+
+func TestControlURL(t *testing.T) {
+	server := New()
+	server.SetBindAddresses("127.0.0.1")
+	if err := server.Listen(45680); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Destroy()
+
+	// controls as a publisher announces them, one absolute and one relative
+	sdpInfo, err := sdp.ParseSdp("v=0\r\n" +
+		"s=cam\r\n" +
+		"t=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=control:rtsp://10.0.0.1/live/cam1/streamid=0\r\n" +
+		"m=audio 0 RTP/AVP 0\r\n" +
+		"a=control:streamid=1\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sms := newLiveServerMediaSession("live/cam1", sdpInfo)
+	server.addServerMediaSession(sms)
+	defer server.removeServerMediaSession(sms)
+
+	for _, test := range []struct {
+		url        string
+		sms        *ServerMediaSession
+		subsession *ServerMediaSubsession
+	}{
+		{"rtsp://127.0.0.1/live/cam1", sms, nil},
+		{"rtsp://127.0.0.1/live/cam1/", sms, nil},
+		{"rtsp://127.0.0.1/live/cam1/streamid=0", sms, sms.subsessions[0]},
+		{"rtsp://127.0.0.1/live/cam1/STREAMID=1", sms, sms.subsessions[1]},
+		{"rtsp://127.0.0.1/live", nil, nil},
+		{"rtsp://127.0.0.1/live/cam1/streamid=2", nil, nil},
+		{"rtsp://127.0.0.1/live/cam2/streamid=0", nil, nil},
+	} {
+		u, _ := url.Parse(test.url)
+		if gotSMS, gotSubsession := server.resolveControlURL(u); gotSMS != test.sms || gotSubsession != test.subsession {
+			t.Errorf("resolveControlURL(%s) = %v, %v", test.url, gotSMS, gotSubsession)
+		}
+	}
+
+	const streamURL = "rtsp://127.0.0.1:45680/live/cam1"
+	ctx := context.Background()
+	session := rtsp.NewSession()
+	defer session.Close()
+	if resp, err := session.Setup(ctx, streamURL, "RTP/AVP;unicast;client_port=45682-45683"); err != nil ||
+		resp.StatusCode != rtsp.AggregateOperationNotAllowed {
+		t.Errorf("SETUP of the stream of two tracks: %v, %v", resp, err)
+	}
+	if resp, err := session.Setup(ctx, streamURL+"/streamid=0", "RTP/AVP;unicast;client_port=45682-45683"); err != nil ||
+		resp.StatusCode != rtsp.OK {
+		t.Fatalf("SETUP of the first track: %v, %v", resp, err)
+	}
+	request := func(method, urlStr string) int {
+		req, _ := rtsp.NewRequest(method, urlStr, "", "")
+		req.Header.Set("Session", session.SessionID())
+		if method == rtsp.SETUP {
+			req.Header.Set("Transport", "RTP/AVP;unicast;client_port=45684-45685")
+		}
+		resp, err := session.Do(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	if code := request(rtsp.SETUP, streamURL+"/streamid=1"); code != rtsp.OK {
+		t.Fatalf("SETUP of the second track: %d", code)
+	}
+
+	if code := request(rtsp.PLAY, streamURL+"/streamid=0"); code != rtsp.OnlyAggregateOperationAllowed {
+		t.Errorf("PLAY of one of two tracks: %d", code)
+	}
+	if code := request(rtsp.PLAY, "rtsp://127.0.0.1:45680/live/cam2"); code != rtsp.NotFound {
+		t.Errorf("PLAY of another stream: %d", code)
+	}
+	if code := request(rtsp.PLAY, streamURL+"/"); code != rtsp.OK {
+		t.Errorf("PLAY of the Content-Base: %d", code)
+	}
+	if code := request(rtsp.GET_PARAMETER, "rtsp://127.0.0.1:45680/"); code != rtsp.OK {
+		t.Errorf("GET_PARAMETER: %d", code)
+	}
+
+	// tearing down one track leaves the other, which can then be
+	// controlled by itself
+	if code := request(rtsp.TEARDOWN, streamURL+"/streamid=1"); code != rtsp.OK {
+		t.Errorf("TEARDOWN of one track: %d", code)
+	}
+	if code := request(rtsp.PAUSE, streamURL+"/streamid=1"); code != rtsp.NotFound {
+		t.Errorf("PAUSE of a track that was torn down: %d", code)
+	}
+	if code := request(rtsp.PAUSE, streamURL+"/streamid=0"); code != rtsp.OK {
+		t.Errorf("PAUSE of the last track: %d", code)
+	}
+	if code := request(rtsp.TEARDOWN, streamURL); code != rtsp.OK {
+		t.Errorf("TEARDOWN: %d", code)
+	}
+	if code := request(rtsp.PLAY, streamURL); code != rtsp.SessionNotFound {
+		t.Errorf("PLAY after TEARDOWN: %d", code)
+	}
+}
+
+func TestRecordFeedsViewer(t *testing.T) {
+	server := New()
+	server.SetBindAddresses("127.0.0.1")
+	if err := server.Listen(45550); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Destroy()
+
+	const streamURL = "rtsp://127.0.0.1:45550/mic"
+	ctx := context.Background()
+	publisher := rtsp.NewSession()
+	defer publisher.Close()
+	if resp, err := publisher.Announce(ctx, streamURL, testAnnounceSDP); err != nil || resp.StatusCode != rtsp.OK {
+		t.Fatalf("ANNOUNCE: %v, %v", resp, err)
+	}
+	resp, err := publisher.Setup(ctx, streamURL+"/trackID=1", "RTP/AVP;unicast;client_port=45552-45553;mode=record")
+	if err != nil || resp.StatusCode != rtsp.OK {
+		t.Fatalf("SETUP: %v, %v", resp, err)
+	}
+	transports, err := rtsp.ParseTransport(resp.Header.Get("Transport"))
+	if err != nil || transports[0].ServerPort == nil {
+		t.Fatalf("Transport: %s", resp.Header.Get("Transport"))
+	}
+	serverPort := transports[0].ServerPort.Start
+	if resp, err := publisher.Record(ctx, streamURL); err != nil || resp.StatusCode != rtsp.OK {
+		t.Fatalf("RECORD: %v, %v", resp, err)
+	}
+
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 45554})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	viewer := rtsp.NewSession()
+	defer viewer.Close()
+	if _, err := viewer.Setup(ctx, streamURL+"/trackID=1", "RTP/AVP;unicast;client_port=45554-45555"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := viewer.Play(ctx, streamURL, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := net.DialUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 45552},
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: serverPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write(newTestRTPPacket(42, 8000, 0xBEEF)); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 1500)
+	n, _, err := receiver.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packet rtp.Packet
+	if err := packet.Unmarshal(buffer[:n]); err != nil || packet.PayloadType != 96 {
+		t.Errorf("reflected packet %x: %v", buffer[:n], err)
+	}
+}
+
+func TestInterleavedChannelRange(t *testing.T) {
+	server := New()
+	server.SetBindAddresses("127.0.0.1")
+	if err := server.Listen(45556); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Destroy()
+
+	sdpInfo, err := sdp.ParseSdp(testAnnounceSDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sms := newLiveServerMediaSession("mic", sdpInfo)
+	server.addServerMediaSession(sms)
+	defer server.removeServerMediaSession(sms)
+
+	// a frame header has one byte for the channel
+	for _, test := range []struct {
+		transport  string
+		statusCode int
+	}{
+		{"RTP/AVP/TCP;unicast;interleaved=254-255", rtsp.OK},
+		{"RTP/AVP/TCP;unicast;interleaved=256-257", rtsp.UnsupportedTransport},
+		{"RTP/AVP/TCP;unicast;interleaved=254-256", rtsp.UnsupportedTransport},
+		{"RTP/AVP/TCP;unicast;interleaved=255", rtsp.UnsupportedTransport},
+		{"RTP/AVP/TCP;unicast;interleaved=300-301,RTP/AVP/TCP;unicast;interleaved=2-3", rtsp.OK},
+	} {
+		session := rtsp.NewSession()
+		resp, err := session.Setup(context.Background(), "rtsp://127.0.0.1:45556/mic/trackID=1", test.transport)
+		session.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.statusCode {
+			t.Errorf("SETUP with %s: %d, want %d", test.transport, resp.StatusCode, test.statusCode)
+		}
+	}
+}
+
+func TestRecordSetupFailureReleasesStream(t *testing.T) {
+	server := New()
+	server.SetBindAddresses("127.0.0.1")
+	if err := server.SetRTPPortRange(45560, 45561); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Listen(45558); err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	defer server.Destroy()
+
+	// the only server port pair is taken
+	taken, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 45560})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	const streamURL = "rtsp://127.0.0.1:45558/mic"
+	ctx := context.Background()
+	failed := rtsp.NewSession()
+	defer failed.Close()
+	if resp, err := failed.Announce(ctx, streamURL, testAnnounceSDP); err != nil || resp.StatusCode != rtsp.OK {
+		t.Fatalf("ANNOUNCE: %v, %v", resp, err)
+	}
+	resp, err := failed.Setup(ctx, streamURL+"/trackID=1", "RTP/AVP;unicast;client_port=45562-45563;mode=record")
+	if err != nil || resp.StatusCode != rtsp.NotEnoughBandwidth {
+		t.Fatalf("SETUP without server ports: %v, %v", resp, err)
+	}
+
+	// the stream is free for another publisher
+	publisher := rtsp.NewSession()
+	defer publisher.Close()
+	if resp, err := publisher.Announce(ctx, streamURL, testAnnounceSDP); err != nil || resp.StatusCode != rtsp.OK {
+		t.Fatalf("ANNOUNCE after a failed SETUP: %v, %v", resp, err)
+	}
+	resp, err = publisher.Setup(ctx, streamURL+"/trackID=1", "RTP/AVP/TCP;unicast;interleaved=0-1;mode=record")
+	if err != nil || resp.StatusCode != rtsp.OK {
+		t.Errorf("SETUP after a failed SETUP: %v, %v", resp, err)
+	}
+}
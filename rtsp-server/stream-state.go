@@ -0,0 +1,231 @@
+package rtsp_server
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yangxianzhi/my-streaming-server/rtcp"
+)
+
+const udpReceiveBufferSize = 65536
+
+// StreamServerState is the per-track state of a RTSPClientSession, created by SETUP.
+type StreamServerState struct {
+	subsession     *ServerMediaSubsession
+	isRecord       bool
+	isTCP          bool
+	rtpChannelID   uint
+	rtcpChannelID  uint
+	clientRTPPort  int
+	clientRTCPPort int
+	destAddr       string
+	ssrc           uint32
+	clientRTPAddr  *net.UDPAddr
+	clientRTCPAddr *net.UDPAddr
+	rtpConn        *net.UDPConn
+	rtcpConn       *net.UDPConn
+	portAllocator  *RTPPortAllocator
+	connection     *RTSPClientConnection
+	output         *ReflectorOutput
+	isPaused       bool
+	multicast      *multicastGroup // set for a multicast viewer
+
+	isReceivingRTP  bool
+	isReceivingRTCP bool
+
+	// from the receiver reports of the client
+	receptionMutex sync.Mutex
+	lastReport     rtcp.ReceptionReport
+	lastReportTime time.Time
+	roundTripTime  time.Duration
+}
+
+// receptionStats is what a client reports about a track we send it.
+type receptionStats struct {
+	trackID       string
+	fractionLost  float64
+	totalLost     int32
+	jitter        uint32 // in RTP timestamp units
+	roundTripTime time.Duration
+	lastReport    time.Time
+}
+
+func (st *StreamServerState) setClientAddr(destAddr string, clientRTPPort, clientRTCPPort int) {
+	st.clientRTPAddr = udpAddr(destAddr, clientRTPPort)
+	st.clientRTCPAddr = udpAddr(destAddr, clientRTCPPort)
+}
+
+// udpAddr returns the address of port on host, an IPv4 or IPv6 address
+// that may carry the zone of a link-local IPv6 address, e.g. "fe80::1%eth0".
+func udpAddr(host string, port int) *net.UDPAddr {
+	host, zone, _ := strings.Cut(host, "%")
+	return &net.UDPAddr{IP: net.ParseIP(host), Port: port, Zone: zone}
+}
+
+func (st *StreamServerState) serverRTPPort() int {
+	if st.rtpConn == nil {
+		return 0
+	}
+	return st.rtpConn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (st *StreamServerState) serverRTCPPort() int {
+	if st.rtcpConn == nil {
+		return 0
+	}
+	return st.rtcpConn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// startReceiving begins reading the packets the client sends to the UDP
+// sockets of this stream state: the media of a publisher, or the RTCP of
+// either kind of client. A nil handler leaves its socket unread.
+func (st *StreamServerState) startReceiving(handleRTP, handleRTCP func(packet []byte)) {
+	if st.rtpConn != nil && handleRTP != nil && !st.isReceivingRTP {
+		st.isReceivingRTP = true
+		go receiveLoop(st.rtpConn, handleRTP)
+	}
+	if st.rtcpConn != nil && handleRTCP != nil && !st.isReceivingRTCP {
+		st.isReceivingRTCP = true
+		go receiveLoop(st.rtcpConn, handleRTCP)
+	}
+}
+
+// receiveLoop hands every packet read from conn to handler until conn is
+// closed.
+func receiveLoop(conn *net.UDPConn, handler func(packet []byte)) {
+	buffer := make([]byte, udpReceiveBufferSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
+		handler(packet)
+	}
+}
+
+// startPlaying attaches this stream state to the reflector of its track,
+// or resumes it after pausePlaying. A multicast viewer shares the output of
+// the group of the track instead.
+func (st *StreamServerState) startPlaying() *ReflectorOutput {
+	switch {
+	case st.multicast != nil && (st.output == nil || st.isPaused):
+		st.output = st.multicast.addViewer(st.subsession.reflector)
+	case st.output == nil:
+		st.output = st.subsession.reflector.addOutput(st, st.ssrc)
+	case st.isPaused:
+		st.subsession.reflector.resumeOutput(st.output)
+	}
+	st.isPaused = false
+	return st.output
+}
+
+// pausePlaying stops sending the track until startPlaying resumes it.
+func (st *StreamServerState) pausePlaying() {
+	if st.output == nil || st.isPaused {
+		return
+	}
+	if st.multicast != nil {
+		st.multicast.removeViewer(st.subsession.reflector)
+	} else {
+		st.subsession.reflector.pauseOutput(st.output)
+	}
+	st.isPaused = true
+}
+
+func (st *StreamServerState) stopPlaying() {
+	if st.output == nil {
+		return
+	}
+	if st.multicast != nil {
+		if !st.isPaused {
+			st.multicast.removeViewer(st.subsession.reflector)
+		}
+	} else {
+		st.output.sendGoodbye()
+		st.subsession.reflector.removeOutput(st.output)
+	}
+	st.output = nil
+	st.isPaused = false
+}
+
+func (st *StreamServerState) sendRTP(packet []byte) {
+	if st.isTCP {
+		st.connection.sendInterleavedFrame(st.rtpChannelID, packet)
+	} else if st.rtpConn != nil && st.clientRTPAddr != nil {
+		st.rtpConn.WriteToUDP(packet, st.clientRTPAddr)
+	}
+}
+
+func (st *StreamServerState) sendRTCP(packet []byte) {
+	if st.isTCP {
+		st.connection.sendInterleavedFrame(st.rtcpChannelID, packet)
+	} else if st.rtcpConn != nil && st.clientRTCPAddr != nil {
+		st.rtcpConn.WriteToUDP(packet, st.clientRTCPAddr)
+	}
+}
+
+// allocatePorts binds the server side RTP/RTCP sockets of this stream state.
+func (st *StreamServerState) allocatePorts(portAllocator *RTPPortAllocator, host string) (err error) {
+	if st.rtpConn != nil {
+		return nil
+	}
+	st.rtpConn, st.rtcpConn, err = portAllocator.allocate(host)
+	if err == nil {
+		st.portAllocator = portAllocator
+	}
+	return err
+}
+
+// close releases the sockets of this stream state and gives their ports
+// back to the allocator. Output goroutines that are still finishing a send
+// just get an error from the closed socket.
+func (st *StreamServerState) close() {
+	if st.rtpConn != nil {
+		st.rtpConn.Close()
+	}
+	if st.rtcpConn != nil {
+		st.rtcpConn.Close()
+	}
+	if st.portAllocator != nil {
+		st.portAllocator.release(st.serverRTPPort())
+		st.portAllocator = nil
+	}
+}
+
+// noteReceptionReports keeps the report block about our stream, if any.
+func (st *StreamServerState) noteReceptionReports(reports []rtcp.ReceptionReport, now time.Time) {
+	for _, report := range reports {
+		if report.SSRC != st.ssrc {
+			continue
+		}
+
+		st.receptionMutex.Lock()
+		st.lastReport = report
+		st.lastReportTime = now
+		if report.LastSenderReport != 0 {
+			// RFC 3550 section 6.4.1: A - LSR - DLSR, in 1/65536 seconds
+			rtt := rtcp.MiddleNTP(rtcp.NTPTime(now)) - report.LastSenderReport - report.Delay
+			if rtt < 1<<31 {
+				st.roundTripTime = time.Duration(rtt) * time.Second / 65536
+			}
+		}
+		st.receptionMutex.Unlock()
+	}
+}
+
+func (st *StreamServerState) receptionStats() receptionStats {
+	st.receptionMutex.Lock()
+	defer st.receptionMutex.Unlock()
+	return receptionStats{
+		trackID:       st.subsession.trackID,
+		fractionLost:  float64(st.lastReport.FractionLost) / 256,
+		totalLost:     st.lastReport.TotalLost,
+		jitter:        st.lastReport.Jitter,
+		roundTripTime: st.roundTripTime,
+		lastReport:    st.lastReportTime,
+	}
+}
@@ -0,0 +1,202 @@
+package rtsp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer answers each request it reads with whatever handle writes.
+type fakeServer struct {
+	listener net.Listener
+	requests chan *Request
+}
+
+func newFakeServer(t *testing.T, handle func(conn net.Conn, req *Request)) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeServer{listener: listener, requests: make(chan *Request, 64)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := NewReader(conn)
+				for {
+					req, err := r.ReadRequest()
+					if err != nil {
+						return
+					}
+					server.requests <- req
+					handle(conn, req)
+				}
+			}()
+		}
+	}()
+	return server
+}
+
+func (s *fakeServer) url(path string) string {
+	return "rtsp://" + s.listener.Addr().String() + path
+}
+
+func (s *fakeServer) close() {
+	s.listener.Close()
+}
+
+func reply(conn net.Conn, req *Request, status string, headers ...string) {
+	response := fmt.Sprintf("RTSP/1.0 %s\r\nCSeq: %s\r\n", status, req.Header.Get("CSeq"))
+	for _, header := range headers {
+		response += header + "\r\n"
+	}
+	conn.Write([]byte(response + "\r\n"))
+}
+
+const testSDP = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=test\r\n" +
+	"t=0 0\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 H264/90000\r\n" +
+	"a=control:trackID=1\r\n"
+
+func TestClientDescribe(t *testing.T) {
+	var server *fakeServer
+	server = newFakeServer(t, func(conn net.Conn, req *Request) {
+		switch req.URL.Path {
+		case "/old":
+			reply(conn, req, "302 Moved Temporarily", "Location: "+server.url("/new"))
+		case "/new":
+			// things a server may send before its response
+			conn.Write([]byte("$\x00\x00\x02hi"))
+			conn.Write([]byte("REDIRECT " + server.url("/new") + " RTSP/1.0\r\nCSeq: 1\r\nLocation: rtsp://elsewhere/new\r\n\r\n"))
+			reply(conn, req, "200 OK", "Content-Base: "+server.url("/new"),
+				"Content-Type: application/sdp", fmt.Sprintf("Content-Length: %d", len(testSDP)))
+			conn.Write([]byte(testSDP))
+		}
+	})
+	defer server.close()
+
+	session := NewSession()
+	defer session.Close()
+	frames := make(chan *InterleavedFrame, 1)
+	session.OnInterleavedFrame = func(frame *InterleavedFrame) { frames <- frame }
+	redirects := make(chan string, 1)
+	session.OnRedirect = func(location string) { redirects <- location }
+
+	info, res, err := session.Describe(context.Background(), server.url("/old"))
+	if err != nil || res.StatusCode != OK {
+		t.Fatalf("Describe() = %v, %v", res, err)
+	}
+	if len(info.StreamInfoArray) != 1 || info.StreamInfoArray[0].Media != "video" {
+		t.Errorf("streams = %+v", info.StreamInfoArray)
+	}
+	if got, want := session.ControlURL("trackID=1"), server.url("/new/trackID=1"); got != want {
+		t.Errorf("ControlURL() = %q, want %q", got, want)
+	}
+	if got, want := session.ControlURL("rtsp://other/track"), "rtsp://other/track"; got != want {
+		t.Errorf("ControlURL() = %q, want %q", got, want)
+	}
+
+	if frame := <-frames; frame.Channel != 0 || string(frame.Payload) != "hi" {
+		t.Errorf("frame = %+v", frame)
+	}
+	if location := <-redirects; location != "rtsp://elsewhere/new" {
+		t.Errorf("redirected to %q", location)
+	}
+}
+
+func TestClientKeepalive(t *testing.T) {
+	server := newFakeServer(t, func(conn net.Conn, req *Request) {
+		switch req.Method {
+		case SETUP:
+			reply(conn, req, "200 OK", "Session: 12345678;timeout=1", "Transport: "+req.Header.Get("Transport"))
+		default:
+			reply(conn, req, "200 OK", "Session: 12345678")
+		}
+	})
+	defer server.close()
+
+	session := NewSession()
+	defer session.Close()
+	ctx := context.Background()
+	if _, err := session.Setup(ctx, server.url("/live/trackID=1"), "RTP/AVP/TCP;unicast;interleaved=0-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Play(ctx, server.url("/live"), "npt=0-"); err != nil {
+		t.Fatal(err)
+	}
+
+	var methods []string
+	timeout := time.After(2 * time.Second)
+	for len(methods) < 3 {
+		select {
+		case req := <-server.requests:
+			methods = append(methods, req.Method)
+			if req.Method != SETUP && req.Header.Get("Session") != "12345678" {
+				t.Errorf("%s without the session: %v", req.Method, req.Header)
+			}
+		case <-timeout:
+			t.Fatalf("requests = %v, want a keepalive after SETUP and PLAY", methods)
+		}
+	}
+	if methods[2] != GET_PARAMETER {
+		t.Errorf("requests = %v, want a GET_PARAMETER keepalive", methods)
+	}
+
+	if _, err := session.Teardown(ctx, server.url("/live")); err != nil {
+		t.Fatal(err)
+	}
+	if session.SessionID() != "" {
+		t.Errorf("session %q still set after TEARDOWN", session.SessionID())
+	}
+	if _, err := session.Play(ctx, server.url("/live"), ""); err != ErrNoSession {
+		t.Errorf("Play() after TEARDOWN: %v, want %v", err, ErrNoSession)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	server := newFakeServer(t, func(conn net.Conn, req *Request) {
+		// never answer
+	})
+	defer server.close()
+
+	session := NewSession()
+	defer session.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := session.Options(ctx, server.url("/")); err != context.DeadlineExceeded {
+		t.Errorf("Options() on a silent server: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if _, _, err := session.Describe(context.Background(), "rtsp://[::1/bad"); err == nil ||
+		!strings.Contains(err.Error(), "parse") {
+		t.Errorf("Describe() with a bad URL: %v", err)
+	}
+}
+
+func TestResolveControl(t *testing.T) {
+	var tests = []struct {
+		base, control, want string
+	}{
+		{"rtsp://host/live/", "trackID=1", "rtsp://host/live/trackID=1"},
+		{"rtsp://host/live", "trackID=1", "rtsp://host/live/trackID=1"},
+		{"rtsp://host/live", "*", "rtsp://host/live"},
+		{"rtsp://host/live/", "rtsp://host:8554/other/track1", "rtsp://host:8554/other/track1"},
+		{"rtsp://host/live?token=1", "track1", "rtsp://host/live/track1"},
+	}
+	for _, test := range tests {
+		base, _ := NewRequest(OPTIONS, test.base, "", "")
+		if got := resolveControl(base.URL, test.control); got != test.want {
+			t.Errorf("resolveControl(%q, %q) = %q, want %q", test.base, test.control, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Range is a "Range:" header value, RFC 2326 section 12.29, in one of the
+// time units of sections 3.5 to 3.7: normal play time, SMPTE timecodes or
+// absolute UTC times.
+type Range struct {
+	// Unit is "npt", "clock", or "smpte", "smpte-30-drop" or "smpte-25".
+	Unit string
+	// Start and End are the npt or SMPTE times of the range, as offsets
+	// from the beginning of the presentation. Now is set for "npt=now-".
+	Start    time.Duration
+	End      time.Duration
+	HasStart bool
+	HasEnd   bool
+	Now      bool
+	// StartTime and EndTime are the clock times of the range, zero if absent.
+	StartTime time.Time
+	EndTime   time.Time
+	// Time is the ";time=" parameter, when the range is to take effect.
+	Time time.Time
+}
+
+var ErrInvalidRange = errors.New("invalid range")
+
+const clockLayout = "20060102T150405Z"
+
+// ParseRange parses a "Range:" header value such as "npt=10-20",
+// "smpte=0:10:20-" or "clock=19961108T143720.25Z-;time=19970123T143720Z".
+func ParseRange(header string) (*Range, error) {
+	params := strings.Split(strings.TrimSpace(header), ";")
+	unit, value, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+	if !ok {
+		return nil, fmt.Errorf("%v: %q", ErrInvalidRange, header)
+	}
+	r := &Range{Unit: strings.ToLower(strings.TrimSpace(unit))}
+	startStr, endStr, ok := strings.Cut(strings.TrimSpace(value), "-")
+	if !ok || startStr == "" && endStr == "" {
+		return nil, fmt.Errorf("%v: %q", ErrInvalidRange, header)
+	}
+
+	var err error
+	switch r.Unit {
+	case "npt":
+		if startStr == "now" {
+			r.Now = true
+		} else if startStr != "" {
+			r.Start, err = parseNPT(startStr)
+			r.HasStart = true
+		}
+		if err == nil && endStr != "" {
+			r.End, err = parseNPT(endStr)
+			r.HasEnd = true
+		}
+	case "smpte", "smpte-30-drop", "smpte-25":
+		if startStr != "" {
+			r.Start, err = parseSMPTE(r.Unit, startStr)
+			r.HasStart = true
+		}
+		if err == nil && endStr != "" {
+			r.End, err = parseSMPTE(r.Unit, endStr)
+			r.HasEnd = true
+		}
+	case "clock":
+		if startStr == "" {
+			err = ErrInvalidRange
+			break
+		}
+		r.StartTime, err = time.Parse(clockLayout, startStr)
+		r.HasStart = true
+		if err == nil && endStr != "" {
+			r.EndTime, err = time.Parse(clockLayout, endStr)
+			r.HasEnd = true
+		}
+	default:
+		err = ErrInvalidRange
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %q", ErrInvalidRange, header)
+	}
+
+	for _, param := range params[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(name, "time") {
+			if r.Time, err = time.Parse(clockLayout, value); err != nil {
+				return nil, fmt.Errorf("%v: bad time in %q", ErrInvalidRange, header)
+			}
+		}
+	}
+	return r, nil
+}
+
+// parseNPT parses a npt time other than "now": seconds, e.g. "12.5", or
+// hours, minutes and seconds, e.g. "0:00:12.5".
+func parseNPT(s string) (time.Duration, error) {
+	var hours, minutes int
+	fields := strings.Split(s, ":")
+	switch len(fields) {
+	case 1:
+	case 3:
+		var err1, err2 error
+		hours, err1 = strconv.Atoi(fields[0])
+		minutes, err2 = strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 {
+			return 0, ErrInvalidRange
+		}
+	default:
+		return 0, ErrInvalidRange
+	}
+	seconds, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+	if err != nil || seconds < 0 || len(fields) == 3 && seconds >= 60 {
+		return 0, ErrInvalidRange
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+		time.Duration(seconds*float64(time.Second)), nil
+}
+
+// parseSMPTE parses a SMPTE timecode "hours:minutes:seconds[:frames[.subframes]]".
+func parseSMPTE(unit, s string) (time.Duration, error) {
+	s, subframesStr, hasSubframes := strings.Cut(s, ".")
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 && len(fields) != 4 {
+		return 0, ErrInvalidRange
+	}
+	var values [4]int
+	for i, field := range fields {
+		v, err := strconv.Atoi(field)
+		if err != nil || v < 0 {
+			return 0, ErrInvalidRange
+		}
+		values[i] = v
+	}
+	subframes := 0
+	if hasSubframes {
+		var err error
+		if subframes, err = strconv.Atoi(subframesStr); err != nil || subframes < 0 || subframes > 99 {
+			return 0, ErrInvalidRange
+		}
+	}
+	hours, minutes, seconds, frames := values[0], values[1], values[2], values[3]
+	if minutes > 59 || seconds > 59 || frames >= smpteFrameRate(unit) {
+		return 0, ErrInvalidRange
+	}
+
+	if unit == "smpte-30-drop" {
+		// frame numbers 0 and 1 are skipped at the start of every minute
+		// that is not a multiple of ten
+		totalMinutes := 60*hours + minutes
+		frameNumber := 108000*hours + 1800*minutes + 30*seconds + frames - 2*(totalMinutes-totalMinutes/10)
+		return time.Duration((float64(frameNumber) + float64(subframes)/100) * 1001 / 30000 * float64(time.Second)), nil
+	}
+	rate := smpteFrameRate(unit)
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second +
+		time.Duration((float64(frames)+float64(subframes)/100)/float64(rate)*float64(time.Second)), nil
+}
+
+func smpteFrameRate(unit string) int {
+	if unit == "smpte-25" {
+		return 25
+	}
+	return 30
+}
+
+// formatSMPTE is the inverse of parseSMPTE.
+func formatSMPTE(unit string, d time.Duration) string {
+	var hours, minutes, seconds, frames, subframes int
+	if unit == "smpte-30-drop" {
+		hundredths := int(math.Round(d.Seconds() * 30000 / 1001 * 100))
+		frameNumber := hundredths / 100
+		subframes = hundredths % 100
+		// add back the skipped frame numbers
+		tenMinutes, rest := frameNumber/17982, frameNumber%17982
+		frameNumber += 18 * tenMinutes
+		if rest >= 2 {
+			frameNumber += 2 * ((rest - 2) / 1798)
+		}
+		hours, frameNumber = frameNumber/108000, frameNumber%108000
+		minutes, frameNumber = frameNumber/1800, frameNumber%1800
+		seconds, frames = frameNumber/30, frameNumber%30
+	} else {
+		rate := smpteFrameRate(unit)
+		hundredths := int(math.Round(d.Seconds() * float64(rate) * 100))
+		total := hundredths / (100 * rate)
+		frames, subframes = hundredths/100%rate, hundredths%100
+		hours, minutes, seconds = total/3600, total/60%60, total%60
+	}
+	s := fmt.Sprintf("%d:%02d:%02d:%02d", hours, minutes, seconds, frames)
+	if subframes > 0 {
+		s += fmt.Sprintf(".%02d", subframes)
+	}
+	return s
+}
+
+func formatNPT(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+func formatClock(t time.Time) string {
+	t = t.UTC()
+	s := t.Format("20060102T150405")
+	if centiseconds := t.Nanosecond() / 1e7; centiseconds > 0 {
+		s += fmt.Sprintf(".%02d", centiseconds)
+	}
+	return s + "Z"
+}
+
+// String formats the range as a "Range:" header value.
+func (r *Range) String() string {
+	var start, end string
+	switch r.Unit {
+	case "npt":
+		if r.Now {
+			start = "now"
+		} else if r.HasStart {
+			start = formatNPT(r.Start)
+		}
+		if r.HasEnd {
+			end = formatNPT(r.End)
+		}
+	case "clock":
+		if r.HasStart {
+			start = formatClock(r.StartTime)
+		}
+		if r.HasEnd {
+			end = formatClock(r.EndTime)
+		}
+	default:
+		if r.HasStart {
+			start = formatSMPTE(r.Unit, r.Start)
+		}
+		if r.HasEnd {
+			end = formatSMPTE(r.Unit, r.End)
+		}
+	}
+	s := r.Unit + "=" + start + "-" + end
+	if !r.Time.IsZero() {
+		s += ";time=" + formatClock(r.Time)
+	}
+	return s
+}
+
+// RTPInfo is one stream of a "RTP-Info:" header, RFC 2326 section 12.33:
+// the sequence number and RTP timestamp the stream continues with after a
+// PLAY.
+type RTPInfo struct {
+	URL        string
+	Seq        uint16
+	RTPTime    uint32
+	HasSeq     bool
+	HasRTPTime bool
+}
+
+func (info *RTPInfo) String() string {
+	s := "url=" + info.URL
+	if info.HasSeq {
+		s += ";seq=" + strconv.Itoa(int(info.Seq))
+	}
+	if info.HasRTPTime {
+		s += ";rtptime=" + strconv.FormatUint(uint64(info.RTPTime), 10)
+	}
+	return s
+}
+
+// ParseRTPInfo parses a "RTP-Info:" header value, which describes each
+// stream of the PLAY request, separated by commas.
+func ParseRTPInfo(header string) ([]*RTPInfo, error) {
+	var infos []*RTPInfo
+	for _, stream := range strings.Split(header, ",") {
+		if strings.TrimSpace(stream) == "" {
+			continue
+		}
+		info := new(RTPInfo)
+		for _, param := range strings.Split(stream, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch strings.ToLower(name) {
+			case "url":
+				info.URL = value
+			case "seq":
+				seq, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("bad seq in RTP-Info %q", header)
+				}
+				info.Seq, info.HasSeq = uint16(seq), true
+			case "rtptime":
+				rtpTime, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("bad rtptime in RTP-Info %q", header)
+				}
+				info.RTPTime, info.HasRTPTime = uint32(rtpTime), true
+			}
+		}
+		if info.URL == "" {
+			return nil, fmt.Errorf("no url in RTP-Info %q", header)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// FormatRTPInfo serializes the streams of a PLAY response into one
+// "RTP-Info:" header value.
+func FormatRTPInfo(infos []*RTPInfo) string {
+	streams := make([]string, len(infos))
+	for i, info := range infos {
+		streams[i] = info.String()
+	}
+	return strings.Join(streams, ",")
+}
@@ -0,0 +1,77 @@
+package rtsp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	var tests = []struct {
+		input  string
+		want   Range
+		output string
+	}{
+		{"npt=0-", Range{Unit: "npt", HasStart: true}, "npt=0.000-"},
+		{"npt=now-", Range{Unit: "npt", Now: true}, "npt=now-"},
+		{"npt=12.5-1:02:03.25", Range{Unit: "npt", Start: 12500 * time.Millisecond, HasStart: true,
+			End: time.Hour + 2*time.Minute + 3250*time.Millisecond, HasEnd: true}, "npt=12.500-3723.250"},
+		{"npt=-20", Range{Unit: "npt", End: 20 * time.Second, HasEnd: true}, "npt=-20.000"},
+		{"smpte=0:10:20-", Range{Unit: "smpte", Start: 10*time.Minute + 20*time.Second, HasStart: true}, "smpte=0:10:20:00-"},
+		{"smpte-25=10:07:33:05.01-10:07:34", Range{Unit: "smpte-25",
+			Start: 10*time.Hour + 7*time.Minute + 33*time.Second + 200400*time.Microsecond, HasStart: true,
+			End: 10*time.Hour + 7*time.Minute + 34*time.Second, HasEnd: true}, "smpte-25=10:07:33:05.01-10:07:34:00"},
+		// the first frame after a minute that drops frame numbers 0 and 1
+		{"smpte-30-drop=0:01:00:02-", Range{Unit: "smpte-30-drop", Start: 1800 * 1001 * time.Second / 30000, HasStart: true},
+			"smpte-30-drop=0:01:00:02-"},
+		{"clock=19961108T142300Z-19961108T143520.25Z;time=19970123T143720Z", Range{Unit: "clock",
+			StartTime: time.Date(1996, 11, 8, 14, 23, 0, 0, time.UTC), HasStart: true,
+			EndTime: time.Date(1996, 11, 8, 14, 35, 20, 250e6, time.UTC), HasEnd: true,
+			Time: time.Date(1997, 1, 23, 14, 37, 20, 0, time.UTC)},
+			"clock=19961108T142300Z-19961108T143520.25Z;time=19970123T143720Z"},
+	}
+	for _, test := range tests {
+		got, err := ParseRange(test.input)
+		if err != nil {
+			t.Errorf("ParseRange(%q): %v", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("ParseRange(%q) = %+v, want %+v", test.input, *got, test.want)
+		}
+		if s := got.String(); s != test.output {
+			t.Errorf("String() = %q, want %q", s, test.output)
+		}
+	}
+
+	for _, input := range []string{"", "npt", "npt=-", "npt=x-", "npt=1:2-", "npt=0:61:00-",
+		"smpte=0:00:00:30-", "smpte-25=1:00-", "clock=-19961108T142300Z", "clock=yesterday-", "frames=1-"} {
+		if _, err := ParseRange(input); err == nil {
+			t.Errorf("ParseRange(%q) succeeded", input)
+		}
+	}
+}
+
+func TestParseRTPInfo(t *testing.T) {
+	header := "url=rtsp://example.com/live/trackID=1;seq=45102;rtptime=12345678,url=rtsp://example.com/live/trackID=2;seq=30211"
+	infos, err := ParseRTPInfo(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*RTPInfo{
+		{URL: "rtsp://example.com/live/trackID=1", Seq: 45102, RTPTime: 12345678, HasSeq: true, HasRTPTime: true},
+		{URL: "rtsp://example.com/live/trackID=2", Seq: 30211, HasSeq: true},
+	}
+	if !reflect.DeepEqual(infos, want) {
+		t.Errorf("ParseRTPInfo() = %+v, want %+v", infos, want)
+	}
+	if got := FormatRTPInfo(infos); got != header {
+		t.Errorf("FormatRTPInfo() = %q", got)
+	}
+
+	for _, input := range []string{"seq=1", "url=x;seq=65536", "url=x;rtptime=-1"} {
+		if _, err := ParseRTPInfo(input); err == nil {
+			t.Errorf("ParseRTPInfo(%q) succeeded", input)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultMaxHeaderBytes limits the request line and headers of a message.
+	DefaultMaxHeaderBytes = 16 * 1024
+	// DefaultMaxBodyBytes limits the body of a message, e.g. an ANNOUNCEd SDP.
+	DefaultMaxBodyBytes = 1024 * 1024
+
+	readerBufferSize = 64 * 1024
+)
+
+// ProtocolError is returned by Reader for messages that can't be parsed.
+// StatusCode is the response a server should send before closing the connection.
+type ProtocolError struct {
+	StatusCode  int
+	ErrorString string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.ErrorString
+}
+
+// Status formats the error as the status of a response, e.g. "400 Bad Request".
+func (e *ProtocolError) Status() string {
+	return fmt.Sprintf("%d %s", e.StatusCode, StatusText(e.StatusCode))
+}
+
+var (
+	ErrMalformedRequestLine = &ProtocolError{BadRequest, "malformed RTSP request line"}
+	ErrMalformedStatusLine  = &ProtocolError{BadRequest, "malformed RTSP status line"}
+	ErrMalformedHeader      = &ProtocolError{BadRequest, "malformed RTSP header line"}
+	ErrBadContentLength     = &ProtocolError{BadRequest, "bad Content-Length"}
+	ErrUnsupportedVersion   = &ProtocolError{RTSPVersionNotSupported, "unsupported RTSP version"}
+	ErrHeaderTooLarge       = &ProtocolError{RequestEntityTooLarge, "RTSP header too large"}
+	ErrBodyTooLarge         = &ProtocolError{RequestEntityTooLarge, "RTSP body too large"}
+	ErrNotInterleavedFrame  = &ProtocolError{BadRequest, "not an interleaved frame"}
+)
+
+// InterleavedFrame is a RTP or RTCP packet sent on the RTSP connection, RFC 2326 section 10.12.
+type InterleavedFrame struct {
+	Channel uint8
+	Payload []byte
+}
+
+// Reader reads RTSP messages and interleaved frames from a byte stream. It
+// buffers its input, so messages may arrive split across many reads or
+// several in one read.
+type Reader struct {
+	MaxHeaderBytes int
+	MaxBodyBytes   int
+	r              *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		MaxHeaderBytes: DefaultMaxHeaderBytes,
+		MaxBodyBytes:   DefaultMaxBodyBytes,
+		r:              bufio.NewReaderSize(r, readerBufferSize),
+	}
+}
+
+// IsInterleavedFrame reports whether the next item in the stream is an
+// interleaved frame rather than a RTSP message. It blocks until at least
+// one byte is available.
+func (r *Reader) IsInterleavedFrame() (bool, error) {
+	b, err := r.r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return b[0] == '$', nil
+}
+
+func (r *Reader) ReadInterleavedFrame() (*InterleavedFrame, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != '$' {
+		return nil, ErrNotInterleavedFrame
+	}
+	frame := &InterleavedFrame{
+		Channel: header[1],
+		Payload: make([]byte, binary.BigEndian.Uint16(header[2:4])),
+	}
+	if _, err := io.ReadFull(r.r, frame.Payload); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// ReadRequest reads the next request, including its body. On an
+// ErrBodyTooLarge the request is returned as well, so that the response can
+// carry its CSeq.
+func (r *Reader) ReadRequest() (*Request, error) {
+	lines, err := r.readHeaderLines()
+	if err != nil {
+		return nil, err
+	}
+	return r.parseRequest(lines)
+}
+
+// ReadResponse reads the next response, including its body.
+func (r *Reader) ReadResponse() (*Response, error) {
+	lines, err := r.readHeaderLines()
+	if err != nil {
+		return nil, err
+	}
+	return r.parseResponse(lines)
+}
+
+// ReadMessage reads the next message, which may be either a request or a
+// response: a client has to expect requests such as REDIRECT from the
+// server. Exactly one of the returned messages is non-nil on success.
+func (r *Reader) ReadMessage() (*Request, *Response, error) {
+	lines, err := r.readHeaderLines()
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.HasPrefix(lines[0], "RTSP/") {
+		res, err := r.parseResponse(lines)
+		return nil, res, err
+	}
+	req, err := r.parseRequest(lines)
+	return req, nil, err
+}
+
+func (r *Reader) parseRequest(lines []string) (req *Request, err error) {
+	req = new(Request)
+	parts := strings.SplitN(lines[0], " ", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, ErrMalformedRequestLine
+	}
+	req.Method = parts[0]
+	if req.URL, err = url.Parse(parts[1]); err != nil {
+		return nil, ErrMalformedRequestLine
+	}
+	if req.Proto, req.ProtoMajor, req.ProtoMinor, err = ParseRTSPVersion(parts[2]); err != nil {
+		return nil, ErrMalformedRequestLine
+	}
+	if req.Proto != "RTSP" || req.ProtoMajor != 1 {
+		return nil, ErrUnsupportedVersion
+	}
+
+	if req.Header, err = parseHeaderLines(lines[1:]); err != nil {
+		return nil, err
+	}
+	if req.ContentLength, err = r.contentLength(req.Header); err != nil {
+		return req, err
+	}
+	if req.ContentLength > 0 {
+		body := make([]byte, req.ContentLength)
+		if _, err = io.ReadFull(r.r, body); err != nil {
+			return nil, err
+		}
+		req.Body = string(body)
+	}
+	return req, nil
+}
+
+func (r *Reader) parseResponse(lines []string) (res *Response, err error) {
+	res = new(Response)
+	parts := strings.SplitN(lines[0], " ", 3)
+	if len(parts) < 2 {
+		return nil, ErrMalformedStatusLine
+	}
+	if res.Proto, res.ProtoMajor, res.ProtoMinor, err = ParseRTSPVersion(parts[0]); err != nil {
+		return nil, ErrMalformedStatusLine
+	}
+	if res.Proto != "RTSP" || res.ProtoMajor != 1 {
+		return nil, ErrUnsupportedVersion
+	}
+	if res.StatusCode, err = strconv.Atoi(parts[1]); err != nil || len(parts[1]) != 3 {
+		return nil, ErrMalformedStatusLine
+	}
+	if len(parts) == 3 {
+		res.Status = strings.TrimSpace(parts[2])
+	}
+
+	if res.Header, err = parseHeaderLines(lines[1:]); err != nil {
+		return nil, err
+	}
+	contentLength, err := r.contentLength(res.Header)
+	if err != nil {
+		return res, err
+	}
+	res.ContentLength = int64(contentLength)
+	if contentLength > 0 {
+		res.Body = make([]byte, contentLength)
+		if _, err = io.ReadFull(r.r, res.Body); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// readHeaderLines reads the start line and headers of a message up to the
+// empty line ending them. Lines may end in CRLF or a bare LF, and empty
+// lines before the start line are skipped.
+func (r *Reader) readHeaderLines() ([]string, error) {
+	var lines []string
+	size := 0
+	for {
+		line, err := r.r.ReadSlice('\n')
+		size += len(line)
+		if size > r.MaxHeaderBytes {
+			return nil, ErrHeaderTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			return nil, ErrHeaderTooLarge
+		}
+		if err != nil {
+			if err == io.EOF && size > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			if len(lines) == 0 {
+				continue
+			}
+			return lines, nil
+		}
+		lines = append(lines, string(line))
+	}
+}
+
+func parseHeaderLines(lines []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, line := range lines {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, ErrMalformedHeader
+		}
+		header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return header, nil
+}
+
+func (r *Reader) contentLength(header http.Header) (int, error) {
+	value := header.Get(Headers[MySSContentLengthHeader])
+	if value == "" {
+		return 0, nil
+	}
+	contentLength, err := strconv.Atoi(value)
+	if err != nil || contentLength < 0 {
+		return 0, ErrBadContentLength
+	}
+	if contentLength > r.MaxBodyBytes {
+		return 0, ErrBodyTooLarge
+	}
+	return contentLength, nil
+}
@@ -0,0 +1,100 @@
+package rtsp
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+const (
+	optionsRequest  = "OPTIONS rtsp://example.com/live RTSP/1.0\r\nCSeq: 1\r\n\r\n"
+	announceRequest = "ANNOUNCE rtsp://example.com/live RTSP/1.0\r\n" +
+		"CSeq: 2\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"Content-Length: 24\r\n" +
+		"\r\n" +
+		"v=0\r\ns=live\r\nt=0 0\r\nm=\r\n"
+)
+
+func TestReaderPipelinedAndSplit(t *testing.T) {
+	stream := optionsRequest + announceRequest + "$\x01\x00\x03abc" + "\n" +
+		"SETUP rtsp://example.com/live/trackID=1 RTSP/1.0\nCSeq: 3\nTransport: RTP/AVP/TCP;interleaved=0-1\n\n"
+
+	for name, r := range map[string]io.Reader{
+		"pipelined":     strings.NewReader(stream),
+		"one byte each": iotest.OneByteReader(strings.NewReader(stream)),
+	} {
+		reader := NewReader(r)
+
+		req, err := reader.ReadRequest()
+		if err != nil || req.Method != OPTIONS || req.Header.Get("CSeq") != "1" {
+			t.Fatalf("%s: first request = %v, %v", name, req, err)
+		}
+
+		req, err = reader.ReadRequest()
+		if err != nil || req.Method != ANNOUNCE || req.Body != "v=0\r\ns=live\r\nt=0 0\r\nm=\r\n" {
+			t.Fatalf("%s: second request = %v, %v", name, req, err)
+		}
+
+		if isFrame, err := reader.IsInterleavedFrame(); !isFrame || err != nil {
+			t.Fatalf("%s: IsInterleavedFrame() = %v, %v", name, isFrame, err)
+		}
+		frame, err := reader.ReadInterleavedFrame()
+		if err != nil || frame.Channel != 1 || string(frame.Payload) != "abc" {
+			t.Fatalf("%s: frame = %+v, %v", name, frame, err)
+		}
+
+		// a stray line break and bare LF line endings
+		if isFrame, err := reader.IsInterleavedFrame(); isFrame || err != nil {
+			t.Fatalf("%s: IsInterleavedFrame() = %v, %v", name, isFrame, err)
+		}
+		req, err = reader.ReadRequest()
+		if err != nil || req.Method != SETUP || req.URL.Path != "/live/trackID=1" ||
+			req.Header.Get("Transport") != "RTP/AVP/TCP;interleaved=0-1" {
+			t.Fatalf("%s: third request = %v, %v", name, req, err)
+		}
+
+		if _, err = reader.ReadRequest(); err != io.EOF {
+			t.Errorf("%s: reading past the end: %v, want EOF", name, err)
+		}
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	var tests = []struct {
+		input      string
+		err        error
+		statusCode int
+	}{
+		{"OPTIONS\r\n\r\n", ErrMalformedRequestLine, BadRequest},
+		{"OPTIONS * HTTP/1.1\r\n\r\n", ErrUnsupportedVersion, RTSPVersionNotSupported},
+		{"OPTIONS * RTSP/1.0\r\nno colon here\r\n\r\n", ErrMalformedHeader, BadRequest},
+		{"ANNOUNCE * RTSP/1.0\r\nContent-Length: x\r\n\r\n", ErrBadContentLength, BadRequest},
+		{"ANNOUNCE * RTSP/1.0\r\nContent-Length: 2000000\r\n\r\n", ErrBodyTooLarge, RequestEntityTooLarge},
+		{"OPTIONS * RTSP/1.0\r\nX-Big: " + strings.Repeat("a", DefaultMaxHeaderBytes) + "\r\n\r\n", ErrHeaderTooLarge, RequestEntityTooLarge},
+		{"OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n", io.ErrUnexpectedEOF, 0},
+	}
+	for _, test := range tests {
+		_, err := NewReader(strings.NewReader(test.input)).ReadRequest()
+		if err != test.err {
+			t.Errorf("ReadRequest(%.40q) error = %v, want %v", test.input, err, test.err)
+			continue
+		}
+		if protocolErr, ok := err.(*ProtocolError); ok && protocolErr.StatusCode != test.statusCode {
+			t.Errorf("ReadRequest(%.40q) status = %d, want %d", test.input, protocolErr.StatusCode, test.statusCode)
+		}
+	}
+}
+
+func TestReaderBodyTooLargeKeepsCSeq(t *testing.T) {
+	reader := NewReader(strings.NewReader(announceRequest))
+	reader.MaxBodyBytes = 10
+	req, err := reader.ReadRequest()
+	if err != ErrBodyTooLarge {
+		t.Fatalf("error = %v, want %v", err, ErrBodyTooLarge)
+	}
+	if req == nil || req.Header.Get("CSeq") != "2" {
+		t.Errorf("request = %v, want the headers of the rejected request", req)
+	}
+}
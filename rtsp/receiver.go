@@ -0,0 +1,393 @@
+package rtsp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+const (
+	// DefaultJitterWindow is how many packets a track holds back to put
+	// them in sequence order.
+	DefaultJitterWindow = 64
+	// DefaultJitterDelay is how long a track waits for a missing packet
+	// before giving it up as lost.
+	DefaultJitterDelay = 200 * time.Millisecond
+
+	trackQueueSize      = 512
+	udpReadBufferSize   = 65536
+	udpPortPairAttempts = 16
+)
+
+// RTPPacket is a RTP packet received on a track, in sequence order.
+type RTPPacket struct {
+	rtp.Packet
+	Arrival time.Time
+}
+
+// Track is a stream set up with SetupTrack. Its packets are delivered on
+// Packets, which is closed when the session is torn down or closed.
+type Track struct {
+	Index     int
+	URL       string
+	Transport *Transport
+
+	packets    chan *RTPPacket
+	mutex      sync.Mutex
+	jitter     *jitterBuffer
+	flushTimer *time.Timer
+	closed     bool
+	rtpConn    *net.UDPConn
+	rtcpConn   *net.UDPConn
+}
+
+// Packets returns the channel the packets of the track are delivered on.
+// Packets are dropped if it isn't drained in time.
+func (t *Track) Packets() <-chan *RTPPacket {
+	return t.packets
+}
+
+// SetupTrack sets up the stream at urlStr, as returned by ControlURL, and
+// starts receiving it. Its RTP arrives on a pair of UDP ports we open, or
+// interleaved on the RTSP connection if tcp is set.
+func (s *Session) SetupTrack(ctx context.Context, urlStr string, tcp bool) (*Track, *Response, error) {
+	// the index picks the interleaved channels, so it is reserved along
+	// with the track's place in s.tracks
+	s.tracksMutex.Lock()
+	track := &Track{
+		Index:   s.nextTrack,
+		URL:     urlStr,
+		packets: make(chan *RTPPacket, trackQueueSize),
+		jitter:  newJitterBuffer(s.jitterWindow(), s.jitterDelay()),
+	}
+	s.nextTrack++
+	s.tracks = append(s.tracks, track)
+	s.tracksMutex.Unlock()
+
+	var transport *Transport
+	if tcp {
+		channel := 2 * track.Index
+		transport = &Transport{Protocol: "RTP", Profile: "AVP", LowerTransport: "TCP", Unicast: true,
+			Interleaved: &PortRange{channel, channel + 1}}
+	} else {
+		var err error
+		if track.rtpConn, track.rtcpConn, err = listenUDPPair(); err != nil {
+			s.removeTrack(track)
+			return nil, nil, err
+		}
+		rtpPort := track.rtpConn.LocalAddr().(*net.UDPAddr).Port
+		transport = &Transport{Protocol: "RTP", Profile: "AVP", Unicast: true, ClientPort: &PortRange{rtpPort, rtpPort + 1}}
+	}
+
+	res, err := s.Setup(ctx, urlStr, transport.String())
+	var negotiated *Transport
+	if err == nil && res.StatusCode == OK {
+		negotiated, err = negotiatedTransport(res, transport)
+	}
+	if err != nil || res.StatusCode != OK {
+		s.removeTrack(track)
+		return nil, res, err
+	}
+
+	// handleTrackFrame reads it under the lock
+	s.tracksMutex.Lock()
+	track.Transport = negotiated
+	s.tracksMutex.Unlock()
+
+	if track.rtpConn != nil {
+		go track.receiveUDP(track.rtpConn, false)
+		go track.receiveUDP(track.rtcpConn, true)
+	}
+	return track, res, nil
+}
+
+// negotiatedTransport is the Transport of a SETUP response, with what the
+// server left out filled in from our request.
+func negotiatedTransport(res *Response, requested *Transport) (*Transport, error) {
+	transports, err := ParseTransport(res.Header.Get(Headers[MySSTransportHeader]))
+	if err != nil {
+		return nil, err
+	}
+	transport := transports[0]
+	if transport.IsTCP() != requested.IsTCP() {
+		return nil, fmt.Errorf("rtsp: server answered transport %q to %q", transport, requested)
+	}
+	if transport.IsTCP() && transport.Interleaved == nil {
+		transport.Interleaved = requested.Interleaved
+	}
+	if !transport.IsTCP() && transport.ClientPort == nil {
+		transport.ClientPort = requested.ClientPort
+	}
+	return transport, nil
+}
+
+// listenUDPPair opens a RTP port and the RTCP port above it, the RTP port
+// being even as RFC 3550 recommends.
+func listenUDPPair() (rtpConn, rtcpConn *net.UDPConn, err error) {
+	for i := 0; i < udpPortPairAttempts; i++ {
+		if rtpConn, err = net.ListenUDP("udp", &net.UDPAddr{}); err != nil {
+			return nil, nil, err
+		}
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			if rtcpConn, err = net.ListenUDP("udp", &net.UDPAddr{Port: port + 1}); err == nil {
+				rtpConn.SetReadBuffer(udpReadBufferSize * 16)
+				return rtpConn, rtcpConn, nil
+			}
+		}
+		rtpConn.Close()
+	}
+	return nil, nil, errors.New("rtsp: no free UDP port pair")
+}
+
+func (t *Track) receiveUDP(conn *net.UDPConn, isRTCP bool) {
+	buffer := make([]byte, udpReadBufferSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if !isRTCP {
+			t.handleRTP(buffer[:n])
+		}
+	}
+}
+
+// handleRTP parses a RTP packet and passes it through the jitter buffer.
+// data is copied, as its buffer will be reused.
+func (t *Track) handleRTP(data []byte) {
+	packet := &RTPPacket{Arrival: time.Now()}
+	if packet.Unmarshal(append([]byte(nil), data...)) != nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return
+	}
+	t.deliver(t.jitter.push(packet))
+	t.scheduleFlush()
+}
+
+// flushOverdue delivers the packets held behind a gap once it is overdue,
+// for when no packet comes after them to do it, e.g. the sender paused or
+// ended the stream.
+func (t *Track) flushOverdue() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return
+	}
+	t.deliver(t.jitter.flush(time.Now()))
+	t.scheduleFlush()
+}
+
+// scheduleFlush arms the flush timer for when the oldest packet held back
+// becomes overdue. The caller holds t.mutex.
+func (t *Track) scheduleFlush() {
+	deadline, ok := t.jitter.deadline()
+	if !ok {
+		return
+	}
+	wait := time.Until(deadline)
+	if t.flushTimer == nil {
+		t.flushTimer = time.AfterFunc(wait, t.flushOverdue)
+	} else {
+		t.flushTimer.Reset(wait)
+	}
+}
+
+// deliver hands packets to the caller. The caller holds t.mutex.
+func (t *Track) deliver(packets []*RTPPacket) {
+	for _, p := range packets {
+		select {
+		case t.packets <- p:
+		default:
+			// the caller can't keep up
+		}
+	}
+}
+
+func (t *Track) close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	if t.flushTimer != nil {
+		t.flushTimer.Stop()
+	}
+	if t.rtpConn != nil {
+		t.rtpConn.Close()
+		t.rtcpConn.Close()
+	}
+	close(t.packets)
+}
+
+// handleTrackFrame routes an interleaved frame to the track set up on its
+// channel, reporting whether there was one.
+func (s *Session) handleTrackFrame(frame *InterleavedFrame) bool {
+	s.tracksMutex.RLock()
+	defer s.tracksMutex.RUnlock()
+	for _, track := range s.tracks {
+		if track.Transport == nil || track.Transport.Interleaved == nil {
+			continue
+		}
+		switch int(frame.Channel) {
+		case track.Transport.Interleaved.Start:
+			track.handleRTP(frame.Payload)
+			return true
+		case track.Transport.Interleaved.End:
+			return true
+		}
+	}
+	return false
+}
+
+// removeTrack drops a track whose SETUP failed.
+func (s *Session) removeTrack(track *Track) {
+	s.tracksMutex.Lock()
+	for i, t := range s.tracks {
+		if t == track {
+			s.tracks = append(s.tracks[:i], s.tracks[i+1:]...)
+			break
+		}
+	}
+	s.tracksMutex.Unlock()
+	track.close()
+}
+
+func (s *Session) closeTracks() {
+	s.tracksMutex.Lock()
+	tracks := s.tracks
+	s.tracks = nil
+	s.nextTrack = 0
+	s.tracksMutex.Unlock()
+	for _, track := range tracks {
+		track.close()
+	}
+}
+
+func (s *Session) jitterWindow() int {
+	if s.JitterWindow > 0 {
+		return s.JitterWindow
+	}
+	return DefaultJitterWindow
+}
+
+func (s *Session) jitterDelay() time.Duration {
+	if s.JitterDelay > 0 {
+		return s.JitterDelay
+	}
+	return DefaultJitterDelay
+}
+
+// jitterBuffer puts packets back in sequence order. A missing packet is
+// waited for until window packets have piled up behind it or it is delay
+// overdue; packets arriving after their turn are dropped.
+type jitterBuffer struct {
+	window  int
+	delay   time.Duration
+	started bool
+	next    uint16
+	pending map[uint16]*RTPPacket
+}
+
+func newJitterBuffer(window int, delay time.Duration) *jitterBuffer {
+	return &jitterBuffer{
+		window:  window,
+		delay:   delay,
+		pending: make(map[uint16]*RTPPacket),
+	}
+}
+
+// push adds a packet and returns those now ready, in order.
+func (j *jitterBuffer) push(packet *RTPPacket) []*RTPPacket {
+	if !j.started {
+		j.started = true
+		j.next = packet.SequenceNumber
+	}
+	if int16(packet.SequenceNumber-j.next) < 0 {
+		// too late, or a duplicate
+		return nil
+	}
+	if int(packet.SequenceNumber-j.next) >= 1<<14 {
+		// the sender jumped, e.g. it restarted: start over
+		j.pending = make(map[uint16]*RTPPacket)
+		j.next = packet.SequenceNumber
+	}
+	j.pending[packet.SequenceNumber] = packet
+	return j.flush(packet.Arrival)
+}
+
+// flush returns the packets ready at now, in order, skipping the gaps that
+// are overdue.
+func (j *jitterBuffer) flush(now time.Time) []*RTPPacket {
+	var ready []*RTPPacket
+	for {
+		ready = j.popInOrder(ready)
+		if len(j.pending) == 0 || !j.overdue(now) {
+			return ready
+		}
+		j.skipGap()
+	}
+}
+
+// deadline is when the oldest packet held back becomes overdue, if any is.
+func (j *jitterBuffer) deadline() (time.Time, bool) {
+	var oldest time.Time
+	for _, p := range j.pending {
+		if oldest.IsZero() || p.Arrival.Before(oldest) {
+			oldest = p.Arrival
+		}
+	}
+	if oldest.IsZero() {
+		return oldest, false
+	}
+	return oldest.Add(j.delay), true
+}
+
+func (j *jitterBuffer) popInOrder(ready []*RTPPacket) []*RTPPacket {
+	for {
+		p, ok := j.pending[j.next]
+		if !ok {
+			return ready
+		}
+		delete(j.pending, j.next)
+		ready = append(ready, p)
+		j.next++
+	}
+}
+
+// overdue reports whether we have waited long enough for j.next.
+func (j *jitterBuffer) overdue(now time.Time) bool {
+	if len(j.pending) >= j.window {
+		return true
+	}
+	for _, p := range j.pending {
+		if now.Sub(p.Arrival) >= j.delay {
+			return true
+		}
+	}
+	return false
+}
+
+// skipGap gives up on the missing packets up to the first one we have.
+func (j *jitterBuffer) skipGap() {
+	first := true
+	var lowest uint16
+	for seq := range j.pending {
+		if first || int16(seq-lowest) < 0 {
+			lowest = seq
+			first = false
+		}
+	}
+	j.next = lowest
+}
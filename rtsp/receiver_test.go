@@ -0,0 +1,170 @@
+package rtsp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yangxianzhi/my-streaming-server/rtp"
+)
+
+func rtpPacket(seq uint16, payload string) []byte {
+	packet := rtp.Packet{
+		Header: rtp.Header{
+			PayloadType:    96,
+			SequenceNumber: seq,
+			Timestamp:      uint32(seq) * 3000,
+			SSRC:           0xCAFE,
+		},
+		Payload: []byte(payload),
+	}
+	data, _ := packet.Marshal()
+	return data
+}
+
+func TestJitterBuffer(t *testing.T) {
+	now := time.Now()
+	j := newJitterBuffer(4, time.Second)
+	var got []uint16
+	push := func(seq uint16, arrival time.Time) {
+		packet := &RTPPacket{Arrival: arrival}
+		packet.SequenceNumber = seq
+		for _, p := range j.push(packet) {
+			got = append(got, p.SequenceNumber)
+		}
+	}
+
+	push(65534, now)
+	push(0, now) // 65535 is late
+	push(65535, now)
+	push(1, now)
+	push(1, now)     // duplicate
+	push(65533, now) // older than what we delivered
+	// 2 is lost: wait for a full window
+	push(4, now)
+	push(5, now)
+	push(3, now)
+	push(6, now)
+	// 7 is lost: wait for the delay
+	push(8, now)
+	push(9, now.Add(2*time.Second))
+
+	want := []uint16{65534, 65535, 0, 1, 3, 4, 5, 6, 8, 9}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+}
+
+func TestTrackFlushesAfterGap(t *testing.T) {
+	track := &Track{
+		packets: make(chan *RTPPacket, trackQueueSize),
+		jitter:  newJitterBuffer(DefaultJitterWindow, 50*time.Millisecond),
+	}
+	defer track.close()
+
+	// 2 is lost and nothing comes after 3
+	track.handleRTP(rtpPacket(1, "1"))
+	track.handleRTP(rtpPacket(3, "3"))
+	for _, want := range []string{"1", "3"} {
+		select {
+		case packet := <-track.Packets():
+			if string(packet.Payload) != want {
+				t.Errorf("got packet %q, want %q", packet.Payload, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no packet %q", want)
+		}
+	}
+}
+
+func TestSetupTrackReceives(t *testing.T) {
+	for _, tcp := range []bool{true, false} {
+		server := newFakeServer(t, func(conn net.Conn, req *Request) {
+			transports, _ := ParseTransport(req.Header.Get("Transport"))
+			switch req.Method {
+			case SETUP:
+				reply(conn, req, "200 OK", "Session: 1;timeout=60", "Transport: "+transports[0].String())
+				if !transports[0].IsTCP() {
+					// send the packets now, out of order
+					addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: transports[0].ClientPort.Start}
+					udp, _ := net.DialUDP("udp", nil, addr)
+					for _, seq := range []uint16{10, 12, 11} {
+						udp.Write(rtpPacket(seq, fmt.Sprint(seq)))
+					}
+					udp.Close()
+				}
+			case PLAY:
+				reply(conn, req, "200 OK", "Session: 1")
+				for _, seq := range []uint16{10, 12, 11} {
+					packet := rtpPacket(seq, fmt.Sprint(seq))
+					frame := append([]byte{'$', 0, 0, byte(len(packet))}, packet...)
+					conn.Write(frame)
+				}
+				conn.Write([]byte("$\x01\x00\x04rtcp"))
+			}
+		})
+
+		session := NewSession()
+		ctx := context.Background()
+		track, res, err := session.SetupTrack(ctx, server.url("/live/trackID=1"), tcp)
+		if err != nil || res.StatusCode != OK {
+			t.Fatalf("tcp=%v: SetupTrack() = %v, %v", tcp, res, err)
+		}
+		if _, err := session.Play(ctx, server.url("/live"), ""); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, want := range []string{"10", "11", "12"} {
+			select {
+			case packet := <-track.Packets():
+				if string(packet.Payload) != want {
+					t.Errorf("tcp=%v: got packet %q, want %q", tcp, packet.Payload, want)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("tcp=%v: no packet %q", tcp, want)
+			}
+		}
+
+		session.Close()
+		if _, ok := <-track.Packets(); ok {
+			t.Errorf("tcp=%v: track still open after Close", tcp)
+		}
+		server.close()
+	}
+}
+
+func TestSetupTrackConcurrentChannels(t *testing.T) {
+	server := newFakeServer(t, func(conn net.Conn, req *Request) {
+		if req.Method == SETUP {
+			reply(conn, req, "200 OK", "Session: 1;timeout=60", "Transport: "+req.Header.Get("Transport"))
+		}
+	})
+	defer server.close()
+
+	session := NewSession()
+	defer session.Close()
+	tracks := make(chan *Track, 4)
+	for i := 0; i < cap(tracks); i++ {
+		go func(i int) {
+			track, _, err := session.SetupTrack(context.Background(), server.url(fmt.Sprintf("/live/trackID=%d", i)), true)
+			if err != nil {
+				t.Error(err)
+			}
+			tracks <- track
+		}(i)
+	}
+	channels := make(map[int]bool)
+	for i := 0; i < cap(tracks); i++ {
+		track := <-tracks
+		if track == nil {
+			continue
+		}
+		if channels[track.Transport.Interleaved.Start] {
+			t.Errorf("channel %d set up twice", track.Transport.Interleaved.Start)
+		}
+		channels[track.Transport.Interleaved.Start] = true
+	}
+}
@@ -2,10 +2,9 @@ package rtsp
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
-	"github.com/yangxianzhi/CommonUtilities"
 	"io"
-	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -131,6 +130,61 @@ const (
 	OptionNotsupport = 551
 )
 
+var statusText = map[int]string{
+	Continue: "Continue",
+
+	OK:                "OK",
+	Created:           "Created",
+	LowOnStorageSpace: "Low on Storage Space",
+
+	MultipleChoices:  "Multiple Choices",
+	MovedPermanently: "Moved Permanently",
+	MovedTemporarily: "Moved Temporarily",
+	SeeOther:         "See Other",
+	UseProxy:         "Use Proxy",
+
+	BadRequest:                    "Bad Request",
+	Unauthorized:                  "Unauthorized",
+	PaymentRequired:               "Payment Required",
+	Forbidden:                     "Forbidden",
+	NotFound:                      "Not Found",
+	MethodNotAllowed:              "Method Not Allowed",
+	NotAcceptable:                 "Not Acceptable",
+	ProxyAuthenticationRequired:   "Proxy Authentication Required",
+	RequestTimeout:                "Request Timeout",
+	Gone:                          "Gone",
+	LengthRequired:                "Length Required",
+	PreconditionFailed:            "Precondition Failed",
+	RequestEntityTooLarge:         "Request Entity Too Large",
+	RequestURITooLong:             "Request-URI Too Long",
+	UnsupportedMediaType:          "Unsupported Media Type",
+	Invalidparameter:              "Invalid parameter",
+	IllegalConferenceIdentifier:   "Illegal Conference Identifier",
+	NotEnoughBandwidth:            "Not Enough Bandwidth",
+	SessionNotFound:               "Session Not Found",
+	MethodNotValidInThisState:     "Method Not Valid In This State",
+	HeaderFieldNotValid:           "Header Field Not Valid",
+	InvalidRange:                  "Invalid Range",
+	ParameterIsReadOnly:           "Parameter Is Read-Only",
+	AggregateOperationNotAllowed:  "Aggregate Operation Not Allowed",
+	OnlyAggregateOperationAllowed: "Only Aggregate Operation Allowed",
+	UnsupportedTransport:          "Unsupported Transport",
+	DestinationUnreachable:        "Destination Unreachable",
+
+	InternalServerError:     "Internal Server Error",
+	NotImplemented:          "Not Implemented",
+	BadGateway:              "Bad Gateway",
+	ServiceUnavailable:      "Service Unavailable",
+	GatewayTimeout:          "Gateway Timeout",
+	RTSPVersionNotSupported: "RTSP Version Not Supported",
+	OptionNotsupport:        "Option not supported",
+}
+
+// StatusText returns the reason phrase of a RTSP status code, or "" if the code is unknown.
+func StatusText(code int) string {
+	return statusText[code]
+}
+
 const maxCommandNum = 11
 
 // Handler routines for specific RTSP commands:
@@ -332,109 +386,6 @@ func NewRequest(method, urlStr, cSeq string, body string) (*Request, error) {
 	return req, nil
 }
 
-type Session struct {
-	cSeq    int
-	conn    net.Conn
-	session string
-}
-
-func NewSession() *Session {
-	return &Session{}
-}
-
-func (s *Session) nextCSeq() string {
-	s.cSeq++
-	return strconv.Itoa(s.cSeq)
-}
-
-func (s *Session) Describe(urlStr string) (*Response, error) {
-	req, err := NewRequest(DESCRIBE, urlStr, s.nextCSeq(), "")
-	if err != nil {
-		panic(err)
-	}
-
-	req.Header.Add(Headers[MySSAcceptHeader], "application/sdp")
-
-	if s.conn == nil {
-		s.conn, err = net.Dial("tcp", req.URL.Host)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	_, err = io.WriteString(s.conn, req.String())
-	if err != nil {
-		return nil, err
-	}
-	return ReadResponse(s.conn)
-}
-
-func (s *Session) Options(urlStr string) (*Response, error) {
-	req, err := NewRequest(OPTIONS, urlStr, s.nextCSeq(), "")
-	if err != nil {
-		panic(err)
-	}
-
-	if s.conn == nil {
-		s.conn, err = net.Dial("tcp", req.URL.Host)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	_, err = io.WriteString(s.conn, req.String())
-	if err != nil {
-		return nil, err
-	}
-	return ReadResponse(s.conn)
-}
-
-func (s *Session) Setup(urlStr, transport string) (*Response, error) {
-	req, err := NewRequest(SETUP, urlStr, s.nextCSeq(), "")
-	if err != nil {
-		panic(err)
-	}
-
-	req.Header.Add(Headers[MySSTransportHeader], transport)
-
-	if s.conn == nil {
-		s.conn, err = net.Dial("tcp", req.URL.Host)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	_, err = io.WriteString(s.conn, req.String())
-	if err != nil {
-		return nil, err
-	}
-	resp, err := ReadResponse(s.conn)
-	s.session = resp.Header.Get(Headers[MySSSessionHeader])
-	return resp, err
-}
-
-func (s *Session) Play(urlStr, sessionId string) (*Response, error) {
-	req, err := NewRequest(PLAY, urlStr, s.nextCSeq(), "")
-	if err != nil {
-		panic(err)
-	}
-
-	req.Header.Add(Headers[MySSSessionHeader], sessionId)
-
-	if s.conn == nil {
-		s.conn, err = net.Dial("tcp", req.URL.Host)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	_, err = io.WriteString(s.conn, req.String())
-	if err != nil {
-		return nil, err
-	}
-	return ReadResponse(s.conn)
-}
-
 type closer struct {
 	*bufio.Reader
 	r io.Reader
@@ -457,54 +408,28 @@ func (c closer) Close() error {
 func ParseRTSPVersion(s string) (proto string, major int, minor int, err error) {
 	parts := strings.SplitN(s, "/", 2)
 	proto = parts[0]
+	if len(parts) != 2 {
+		err = fmt.Errorf("malformed RTSP version %q", s)
+		return
+	}
 	parts = strings.SplitN(parts[1], ".", 2)
+	if len(parts) != 2 {
+		err = fmt.Errorf("malformed RTSP version %q", s)
+		return
+	}
 	if major, err = strconv.Atoi(parts[0]); err != nil {
 		return
 	}
-	if minor, err = strconv.Atoi(parts[0]); err != nil {
+	if minor, err = strconv.Atoi(parts[1]); err != nil {
 		return
 	}
 	return
 }
 
-// super simple RTSP parser; would be nice if net/http would allow more general parsing
+// ReadRequest parses the single request held in buffer[:length]. Use a
+// Reader to read requests from a connection.
 func ReadRequest(buffer []byte, length int) (req *Request, err error) {
-	req = new(Request)
-	req.Header = make(map[string][]string)
-
-	reqParser := commonutilities.New(string(buffer[:length]))
-	var s string
-	var ok bool
-	if s, ok = reqParser.GetThruEOL(); !ok {
-		return
-	}
-	parts := strings.SplitN(s, " ", 3)
-	req.Method = parts[0]
-	if req.URL, err = url.Parse(parts[1]); err != nil {
-		return
-	}
-
-	req.Proto, req.ProtoMajor, req.ProtoMinor, err = ParseRTSPVersion(parts[2])
-	if err != nil {
-		return
-	}
-
-	// read headers
-	for {
-		if s, ok = reqParser.GetThruEOL(); !ok || s == "" {
-			break
-		}
-
-		parts := strings.SplitN(s, ":", 2)
-		req.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
-	}
-
-	req.ContentLength, _ = strconv.Atoi(req.Header.Get(Headers[MySSContentLengthHeader]))
-	if req.ContentLength > 0 {
-		fmt.Println(Headers[MySSContentLengthHeader], req.ContentLength)
-		req.Body = reqParser.ConsumeLength(req.ContentLength)
-	}
-	return
+	return NewReader(bytes.NewReader(buffer[:length])).ReadRequest()
 }
 
 type Response struct {
@@ -518,58 +443,23 @@ type Response struct {
 	ContentLength int64
 
 	Header http.Header
-	Body   *bufio.Reader
+	Body   []byte
 }
 
 func (res Response) String() string {
-	s := fmt.Sprintf("%s/%d.%d %d %s\n", res.Proto, res.ProtoMajor, res.ProtoMinor, res.StatusCode, res.Status)
+	s := fmt.Sprintf("%s/%d.%d %d %s\r\n", res.Proto, res.ProtoMajor, res.ProtoMinor, res.StatusCode, res.Status)
 	for k, v := range res.Header {
 		for _, v := range v {
-			s += fmt.Sprintf("%s: %s\n", k, v)
+			s += fmt.Sprintf("%s: %s\r\n", k, v)
 		}
 	}
+	s += "\r\n" + string(res.Body)
 	return s
 }
 
+// ReadResponse parses a single response from r. Use a Reader to read
+// several responses from a connection, as this one buffers past the end of
+// the response.
 func ReadResponse(r io.Reader) (res *Response, err error) {
-	res = new(Response)
-	res.Header = make(map[string][]string)
-
-	b := bufio.NewReader(r)
-	var s string
-
-	// TODO: allow CR, LF, or CRLF
-	if s, err = b.ReadString('\n'); err != nil {
-		return
-	}
-
-	parts := strings.SplitN(s, " ", 3)
-	res.Proto, res.ProtoMajor, res.ProtoMinor, err = ParseRTSPVersion(parts[0])
-	if err != nil {
-		return
-	}
-
-	if res.StatusCode, err = strconv.Atoi(parts[1]); err != nil {
-		return
-	}
-
-	res.Status = strings.TrimSpace(parts[2])
-
-	// read headers
-	for {
-		if s, err = b.ReadString('\n'); err != nil {
-			return
-		} else if s = strings.TrimRight(s, "\r\n"); s == "" {
-			break
-		}
-
-		parts := strings.SplitN(s, ":", 2)
-		res.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
-	}
-
-	res.ContentLength, _ = strconv.ParseInt(res.Header.Get(Headers[MySSContentLengthHeader]), 10, 64)
-	if res.ContentLength > 0 {
-		res.Body = b
-	}
-	return
+	return NewReader(r).ReadResponse()
 }
@@ -0,0 +1,350 @@
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is a "<start>-<end>" pair as used by the port, client_port,
+// server_port and interleaved parameters. End equals Start for a single value.
+type PortRange struct {
+	Start int
+	End   int
+}
+
+func (p PortRange) String() string {
+	if p.End == p.Start {
+		return strconv.Itoa(p.Start)
+	}
+	return fmt.Sprintf("%d-%d", p.Start, p.End)
+}
+
+// Transport is one transport specification of a "Transport:" header,
+// RFC 2326 section 12.39 and RFC 7826 section 18.54. Optional parameters
+// that are absent are nil, zero or empty.
+type Transport struct {
+	Protocol       string // e.g. "RTP"
+	Profile        string // e.g. "AVP"
+	LowerTransport string // "UDP", "TCP", or empty meaning UDP
+	Unicast        bool   // the "unicast" parameter is present
+	Multicast      bool   // the "multicast" parameter is present; unicast if not
+	Destination    string
+	Source         string
+	Port           *PortRange // multicast RTP/RTCP ports
+	ClientPort     *PortRange
+	ServerPort     *PortRange
+	Interleaved    *PortRange // channels when LowerTransport is "TCP"
+	TTL            int
+	Layers         int
+	SSRC           []uint32
+	Mode           string // e.g. "PLAY" or "RECORD", without quotes
+	Append         bool
+	DestAddr       []string // RFC 7826 dest_addr, without quotes
+	SrcAddr        []string // RFC 7826 src_addr, without quotes
+	Setup          string   // RFC 7826 "active", "passive" or "actpass"
+	Connection     string   // RFC 7826 "new" or "existing"
+	RTCPMux        bool
+	Extra          []string // parameters not known here, kept verbatim
+}
+
+var ErrInvalidTransport = errors.New("invalid transport specification")
+
+// ParseTransport parses a "Transport:" header value, which may list several
+// comma separated transports in the client's order of preference.
+func ParseTransport(header string) ([]*Transport, error) {
+	if !balancedQuotes(header) {
+		return nil, fmt.Errorf("%v: unbalanced quotes in %q", ErrInvalidTransport, header)
+	}
+	var transports []*Transport
+	for _, spec := range splitQuoted(header, ',') {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		t, err := ParseTransportSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		transports = append(transports, t)
+	}
+	if len(transports) == 0 {
+		return nil, ErrInvalidTransport
+	}
+	return transports, nil
+}
+
+// ParseTransportSpec parses a single transport specification such as
+// "RTP/AVP;unicast;client_port=4588-4589".
+func ParseTransportSpec(spec string) (*Transport, error) {
+	if !balancedQuotes(spec) {
+		return nil, fmt.Errorf("%v: unbalanced quotes in %q", ErrInvalidTransport, spec)
+	}
+	params := splitQuoted(spec, ';')
+	t := new(Transport)
+
+	protocol := strings.Split(strings.TrimSpace(params[0]), "/")
+	if len(protocol) < 2 || len(protocol) > 3 {
+		return nil, fmt.Errorf("%v: %q", ErrInvalidTransport, spec)
+	}
+	for _, token := range protocol {
+		if token == "" || strings.ContainsAny(token, " \t\"") {
+			return nil, fmt.Errorf("%v: %q", ErrInvalidTransport, spec)
+		}
+	}
+	t.Protocol = strings.ToUpper(protocol[0])
+	t.Profile = strings.ToUpper(protocol[1])
+	if len(protocol) == 3 {
+		t.LowerTransport = strings.ToUpper(protocol[2])
+	}
+
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+		if param == "" {
+			continue
+		}
+		name, value := param, ""
+		if i := strings.Index(param, "="); i >= 0 {
+			name, value = strings.TrimSpace(param[:i]), strings.TrimSpace(param[i+1:])
+		}
+
+		var err error
+		switch strings.ToLower(name) {
+		case "unicast":
+			t.Unicast, t.Multicast = true, false
+		case "multicast":
+			t.Unicast, t.Multicast = false, true
+		case "destination":
+			t.Destination = unbracketHost(value)
+		case "source":
+			t.Source = unbracketHost(value)
+		case "port":
+			t.Port, err = parsePortRange(value)
+		case "client_port":
+			t.ClientPort, err = parsePortRange(value)
+		case "server_port":
+			t.ServerPort, err = parsePortRange(value)
+		case "interleaved":
+			t.Interleaved, err = parsePortRange(value)
+		case "ttl":
+			t.TTL, err = parseCount(value)
+		case "layers":
+			t.Layers, err = parseCount(value)
+		case "ssrc":
+			for _, ssrc := range strings.Split(value, "/") {
+				var v uint64
+				if v, err = strconv.ParseUint(ssrc, 16, 32); err != nil {
+					break
+				}
+				t.SSRC = append(t.SSRC, uint32(v))
+			}
+		case "mode":
+			t.Mode, err = unquote(value)
+		case "append":
+			t.Append = true
+		case "dest_addr":
+			t.DestAddr, err = splitAddressList(value)
+		case "src_addr":
+			t.SrcAddr, err = splitAddressList(value)
+		case "setup":
+			t.Setup = value
+		case "connection":
+			t.Connection = value
+		case "rtcp-mux":
+			t.RTCPMux = true
+		default:
+			t.Extra = append(t.Extra, param)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: bad %s in %q", ErrInvalidTransport, name, spec)
+		}
+	}
+	return t, nil
+}
+
+func parsePortRange(value string) (*PortRange, error) {
+	parts := strings.SplitN(value, "-", 2)
+	start, err := strconv.Atoi(parts[0])
+	if err != nil || start < 0 || start > 65535 {
+		return nil, ErrInvalidTransport
+	}
+	end := start
+	if len(parts) == 2 {
+		if end, err = strconv.Atoi(parts[1]); err != nil || end < start || end > 65535 {
+			return nil, ErrInvalidTransport
+		}
+	}
+	return &PortRange{Start: start, End: end}, nil
+}
+
+// parseCount parses the value of ttl or layers, which can't be negative.
+func parseCount(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err == nil && n < 0 {
+		return 0, ErrInvalidTransport
+	}
+	return n, err
+}
+
+func splitAddressList(value string) ([]string, error) {
+	var addrs []string
+	for _, addr := range splitQuoted(value, '/') {
+		addr, err := unquote(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// unquote strips the double quotes around a parameter value, if any. A
+// quoted string can't hold a quote itself.
+func unquote(value string) (string, error) {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	if strings.Contains(value, "\"") {
+		return "", ErrInvalidTransport
+	}
+	return value, nil
+}
+
+// balancedQuotes reports whether every double quote of s is closed.
+func balancedQuotes(s string) bool {
+	return strings.Count(s, "\"")%2 == 0
+}
+
+// splitQuoted splits s at sep, except where sep is inside double quotes.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case sep:
+			if !inQuotes {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// IsTCP reports whether the transport is interleaved on the RTSP connection.
+func (t *Transport) IsTCP() bool {
+	return t.LowerTransport == "TCP"
+}
+
+// IsRTP reports whether the transport carries RTP, rather than e.g. raw MPEG-TS.
+func (t *Transport) IsRTP() bool {
+	return t.Protocol == "RTP"
+}
+
+// IsRecord reports whether the client asked to send media to the server.
+func (t *Transport) IsRecord() bool {
+	return strings.EqualFold(t.Mode, RECORD)
+}
+
+// String serializes the transport in the form used by the "Transport:" header.
+func (t *Transport) String() string {
+	var b strings.Builder
+	b.WriteString(t.Protocol + "/" + t.Profile)
+	if t.LowerTransport != "" {
+		b.WriteString("/" + t.LowerTransport)
+	}
+	if t.Multicast {
+		b.WriteString(";multicast")
+	} else if t.Unicast {
+		b.WriteString(";unicast")
+	}
+	if t.Destination != "" {
+		b.WriteString(";destination=" + t.Destination)
+	}
+	if t.Source != "" {
+		b.WriteString(";source=" + t.Source)
+	}
+	if t.Interleaved != nil {
+		b.WriteString(";interleaved=" + t.Interleaved.String())
+	}
+	if t.Append {
+		b.WriteString(";append")
+	}
+	if t.TTL > 0 {
+		fmt.Fprintf(&b, ";ttl=%d", t.TTL)
+	}
+	if t.Layers > 0 {
+		fmt.Fprintf(&b, ";layers=%d", t.Layers)
+	}
+	if t.Port != nil {
+		b.WriteString(";port=" + t.Port.String())
+	}
+	if t.ClientPort != nil {
+		b.WriteString(";client_port=" + t.ClientPort.String())
+	}
+	if t.ServerPort != nil {
+		b.WriteString(";server_port=" + t.ServerPort.String())
+	}
+	if len(t.SSRC) > 0 {
+		ssrcs := make([]string, len(t.SSRC))
+		for i, ssrc := range t.SSRC {
+			ssrcs[i] = fmt.Sprintf("%08X", ssrc)
+		}
+		b.WriteString(";ssrc=" + strings.Join(ssrcs, "/"))
+	}
+	if t.Mode != "" {
+		if strings.ContainsAny(t.Mode, ",; ") {
+			b.WriteString(";mode=\"" + t.Mode + "\"")
+		} else {
+			b.WriteString(";mode=" + t.Mode)
+		}
+	}
+	if len(t.DestAddr) > 0 {
+		b.WriteString(";dest_addr=" + joinAddressList(t.DestAddr))
+	}
+	if len(t.SrcAddr) > 0 {
+		b.WriteString(";src_addr=" + joinAddressList(t.SrcAddr))
+	}
+	if t.Setup != "" {
+		b.WriteString(";setup=" + t.Setup)
+	}
+	if t.Connection != "" {
+		b.WriteString(";connection=" + t.Connection)
+	}
+	if t.RTCPMux {
+		b.WriteString(";RTCP-mux")
+	}
+	for _, param := range t.Extra {
+		b.WriteString(";" + param)
+	}
+	return b.String()
+}
+
+func joinAddressList(addrs []string) string {
+	quoted := make([]string, len(addrs))
+	for i, addr := range addrs {
+		quoted[i] = "\"" + addr + "\""
+	}
+	return strings.Join(quoted, "/")
+}
+
+// FormatTransports serializes several transports into one "Transport:" header value.
+func FormatTransports(transports []*Transport) string {
+	specs := make([]string, len(transports))
+	for i, t := range transports {
+		specs[i] = t.String()
+	}
+	return strings.Join(specs, ",")
+}
+
+// unbracketHost strips the brackets some clients put around an IPv6
+// address in "destination" and "source", which need none there.
+func unbracketHost(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
@@ -0,0 +1,125 @@
+package rtsp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTransport(t *testing.T) {
+	var tests = []struct {
+		input string
+		want  []*Transport
+	}{
+		{
+			"RTP/AVP;unicast;client_port=4588-4589",
+			[]*Transport{{Protocol: "RTP", Profile: "AVP", Unicast: true, ClientPort: &PortRange{4588, 4589}}},
+		},
+		{
+			"RTP/AVP/TCP;unicast;interleaved=0-1;mode=record",
+			[]*Transport{{Protocol: "RTP", Profile: "AVP", LowerTransport: "TCP", Unicast: true, Interleaved: &PortRange{0, 1}, Mode: "record"}},
+		},
+		{
+			"RTP/AVP;multicast;destination=224.2.0.1;port=3456-3457;ttl=16;layers=2",
+			[]*Transport{{Protocol: "RTP", Profile: "AVP", Multicast: true, Destination: "224.2.0.1",
+				Port: &PortRange{3456, 3457}, TTL: 16, Layers: 2}},
+		},
+		{
+			"RTP/AVP;unicast;source=10.0.0.1;server_port=6970-6971;ssrc=1A2B3C4D;mode=\"PLAY\";x-custom=1",
+			[]*Transport{{Protocol: "RTP", Profile: "AVP", Unicast: true, Source: "10.0.0.1", ServerPort: &PortRange{6970, 6971},
+				SSRC: []uint32{0x1A2B3C4D}, Mode: "PLAY", Extra: []string{"x-custom=1"}}},
+		},
+		{
+			"RTP/AVP/TCP;unicast;interleaved=0-1, RTP/AVP;unicast;client_port=5000-5001",
+			[]*Transport{
+				{Protocol: "RTP", Profile: "AVP", LowerTransport: "TCP", Unicast: true, Interleaved: &PortRange{0, 1}},
+				{Protocol: "RTP", Profile: "AVP", Unicast: true, ClientPort: &PortRange{5000, 5001}},
+			},
+		},
+		{
+			"RTP/AVP/UDP;unicast;dest_addr=\":5000\"/\":5001\";setup=passive;connection=new;RTCP-mux",
+			[]*Transport{{Protocol: "RTP", Profile: "AVP", LowerTransport: "UDP", Unicast: true, DestAddr: []string{":5000", ":5001"},
+				Setup: "passive", Connection: "new", RTCPMux: true}},
+		},
+		{
+			"RTP/AVP;multicast;destination=[ff15::101];source=2001:db8::1;port=5000-5001",
+			[]*Transport{{Protocol: "RTP", Profile: "AVP", Multicast: true, Destination: "ff15::101", Source: "2001:db8::1",
+				Port: &PortRange{5000, 5001}}},
+		},
+		{
+			"RAW/RAW/UDP;unicast;client_port=1234",
+			[]*Transport{{Protocol: "RAW", Profile: "RAW", LowerTransport: "UDP", Unicast: true, ClientPort: &PortRange{1234, 1234}}},
+		},
+	}
+	for _, test := range tests {
+		got, err := ParseTransport(test.input)
+		if err != nil {
+			t.Errorf("ParseTransport(%q): %v", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseTransport(%q) = %+v, want %+v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseTransportErrors(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"RTP",
+		"RTP/AVP;client_port=abc",
+		"RTP/AVP;client_port=5001-5000",
+		"RTP/AVP;interleaved=0-70000",
+		"RTP/AVP;ssrc=nothex",
+		"RTP/AVP/",
+		"RTP/AVP;ttl=-1",
+		"RTP/AVP;mode=\"PLAY",
+		"RTP/AVP;unicast;dest_addr=\":5000\"/\":5001",
+		"RTP/AVP;unicast, RTP/AVP;mode=\"PLAY",
+		"RTP/AVP;mode=\"\"PLAY\"\"",
+	} {
+		if _, err := ParseTransport(input); err == nil {
+			t.Errorf("ParseTransport(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+func TestTransportRoundTrip(t *testing.T) {
+	for _, input := range []string{
+		"RTP/AVP;unicast;destination=10.0.0.2;source=10.0.0.1;client_port=5000-5001;server_port=6970-6971;ssrc=0000ABCD;mode=record",
+		"RTP/AVP/TCP;unicast;interleaved=2-3",
+		"RTP/AVP;multicast;destination=232.1.1.1;ttl=127;port=5004-5005",
+		"RTP/AVP;unicast;mode=\"PLAY, RECORD\";x-dynamic-rate=1",
+		"RTP/AVP;client_port=5000-5001",
+		"RTP/AVP/UDP;unicast;mode=\"x;y\";dest_addr=\"a/b\"/\":5001\";x-quoted=\"a;b,c\"",
+	} {
+		transports, err := ParseTransport(input)
+		if err != nil {
+			t.Fatalf("ParseTransport(%q): %v", input, err)
+		}
+		if got := FormatTransports(transports); got != input {
+			t.Errorf("FormatTransports(ParseTransport(%q)) = %q", input, got)
+		}
+	}
+}
+
+func FuzzTransportRoundTrip(f *testing.F) {
+	f.Add("RTP/AVP;unicast;client_port=4588-4589")
+	f.Add("RTP/AVP;multicast;destination=224.2.0.1;port=3456-3457;ttl=16;layers=2")
+	f.Add("RTP/AVP;unicast;mode=\"PLAY, RECORD\";ssrc=1A2B3C4D;x-custom=\"a;b\"")
+	f.Add("RTP/AVP/UDP;dest_addr=\":5000\"/\":5001\";setup=passive;RTCP-mux, RTP/AVP/TCP;interleaved=0-1")
+
+	f.Fuzz(func(t *testing.T, header string) {
+		transports, err := ParseTransport(header)
+		if err != nil {
+			return
+		}
+		first := FormatTransports(transports)
+		again, err := ParseTransport(first)
+		if err != nil {
+			t.Fatalf("ParseTransport(%q), from %q: %v", first, header, err)
+		}
+		if second := FormatTransports(again); second != first {
+			t.Fatalf("round trip of %q: %q, then %q", header, first, second)
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package sdp
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/yangxianzhi/my-streaming-server/aac"
+	"github.com/yangxianzhi/my-streaming-server/h264"
+	"github.com/yangxianzhi/my-streaming-server/h265"
+)
+
+// Format is one payload type of a "m=" line, as its "a=rtpmap:" and
+// "a=fmtp:" attributes describe it.
+type Format struct {
+	PayloadType uint8
+	// EncodingName is the encoding as written in "a=rtpmap:", e.g. "H264"
+	// or "mpeg4-generic".
+	EncodingName string
+	ClockRate    uint32
+	// Channels is the number of audio channels, 0 for video.
+	Channels int
+	// Fmtp is the value of "a=fmtp:" after the payload type, and Params
+	// its parameters, by name in lower case.
+	Fmtp   string
+	Params map[string]string
+}
+
+// staticFormats are the static payload types of RFC 3551 section 6, used
+// for a payload type without "a=rtpmap:".
+var staticFormats = map[uint8]Format{
+	0:  {EncodingName: "PCMU", ClockRate: 8000, Channels: 1},
+	3:  {EncodingName: "GSM", ClockRate: 8000, Channels: 1},
+	4:  {EncodingName: "G723", ClockRate: 8000, Channels: 1},
+	5:  {EncodingName: "DVI4", ClockRate: 8000, Channels: 1},
+	6:  {EncodingName: "DVI4", ClockRate: 16000, Channels: 1},
+	7:  {EncodingName: "LPC", ClockRate: 8000, Channels: 1},
+	8:  {EncodingName: "PCMA", ClockRate: 8000, Channels: 1},
+	9:  {EncodingName: "G722", ClockRate: 8000, Channels: 1},
+	10: {EncodingName: "L16", ClockRate: 44100, Channels: 2},
+	11: {EncodingName: "L16", ClockRate: 44100, Channels: 1},
+	12: {EncodingName: "QCELP", ClockRate: 8000, Channels: 1},
+	13: {EncodingName: "CN", ClockRate: 8000, Channels: 1},
+	14: {EncodingName: "MPA", ClockRate: 90000},
+	15: {EncodingName: "G728", ClockRate: 8000, Channels: 1},
+	16: {EncodingName: "DVI4", ClockRate: 11025, Channels: 1},
+	17: {EncodingName: "DVI4", ClockRate: 22050, Channels: 1},
+	18: {EncodingName: "G729", ClockRate: 8000, Channels: 1},
+	25: {EncodingName: "CelB", ClockRate: 90000},
+	26: {EncodingName: "JPEG", ClockRate: 90000},
+	28: {EncodingName: "nv", ClockRate: 90000},
+	31: {EncodingName: "H261", ClockRate: 90000},
+	32: {EncodingName: "MPV", ClockRate: 90000},
+	33: {EncodingName: "MP2T", ClockRate: 90000},
+	34: {EncodingName: "H263", ClockRate: 90000},
+}
+
+// newFormat returns the format of a payload type of a "m=" line, filled in
+// from the static table if there is an entry for it.
+func newFormat(payloadType uint8) *Format {
+	format := &Format{PayloadType: payloadType}
+	if static, ok := staticFormats[payloadType]; ok {
+		format.EncodingName = static.EncodingName
+		format.ClockRate = static.ClockRate
+		format.Channels = static.Channels
+	}
+	return format
+}
+
+// parseRTPMap reads the value of "a=rtpmap:" after the payload type, e.g.
+// "mpeg4-generic/48000/2". Audio defaults to one channel.
+func (f *Format) parseRTPMap(value string, isAudio bool) {
+	parts := strings.Split(strings.TrimSpace(value), "/")
+	f.EncodingName = parts[0]
+	f.ClockRate = 0
+	f.Channels = 0
+	if len(parts) > 1 {
+		if rate, err := strconv.ParseUint(parts[1], 10, 32); err == nil {
+			f.ClockRate = uint32(rate)
+		}
+	}
+	if len(parts) > 2 {
+		f.Channels, _ = strconv.Atoi(parts[2])
+	}
+	if isAudio && f.Channels == 0 {
+		f.Channels = 1
+	}
+}
+
+// parseFmtp reads the value of "a=fmtp:" after the payload type, e.g.
+// "packetization-mode=1; profile-level-id=42001F". A parameter without "="
+// is kept with an empty value.
+func (f *Format) parseFmtp(value string) {
+	f.Fmtp = strings.TrimSpace(value)
+	f.Params = make(map[string]string)
+	for _, param := range strings.Split(f.Fmtp, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if name == "" {
+			continue
+		}
+		f.Params[strings.ToLower(name)] = strings.TrimSpace(value)
+	}
+}
+
+// Param returns the value of a fmtp parameter, or "" if it isn't there.
+func (f *Format) Param(name string) string {
+	return f.Params[strings.ToLower(name)]
+}
+
+// H264Params decodes the fmtp parameters of a H.264 format.
+func (f *Format) H264Params() (*h264.Params, error) {
+	return h264.ParseFmtp(f.Fmtp)
+}
+
+// H265Params decodes the fmtp parameters of a H.265 format.
+func (f *Format) H265Params() (*h265.Params, error) {
+	return h265.ParseFmtp(f.Fmtp)
+}
+
+// AACParams decodes the fmtp parameters of a mpeg4-generic format.
+func (f *Format) AACParams() (*aac.Params, error) {
+	return aac.ParseFmtp(f.Fmtp)
+}
+
+// LATMParams decodes the fmtp parameters of a MP4A-LATM format.
+func (f *Format) LATMParams() (*aac.LATMParams, error) {
+	return aac.ParseLATMFmtp(f.Fmtp)
+}
+
+// parseMediaFormats returns the formats of the payload types listed on a
+// "m=" line. Formats of other protocols than RTP aren't payload types and
+// are left out.
+func parseMediaFormats(protocol string, fmts []string) []*Format {
+	if !strings.HasPrefix(protocol, "RTP/") {
+		return nil
+	}
+	var formats []*Format
+	for _, field := range fmts {
+		if payloadType, err := strconv.ParseUint(field, 10, 7); err == nil {
+			formats = append(formats, newFormat(uint8(payloadType)))
+		}
+	}
+	return formats
+}
+
+// splitPayloadType splits the value of a "a=rtpmap:" or "a=fmtp:" attribute,
+// e.g. "96 H264/90000", into its payload type and the rest.
+func splitPayloadType(value string) (uint8, string, bool) {
+	field, rest, _ := strings.Cut(strings.TrimSpace(value), " ")
+	payloadType, err := strconv.ParseUint(field, 10, 7)
+	if err != nil {
+		return 0, "", false
+	}
+	return uint8(payloadType), rest, true
+}
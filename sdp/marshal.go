@@ -0,0 +1,107 @@
+package sdp
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Marshal encodes the description as an RFC 4566 document with CRLF line
+// endings. The mandatory "o=", "s=" and "t=" lines are filled in when the
+// description has none.
+func (info *Info) Marshal() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "v=%d\r\n", info.Version)
+	origin := info.Origin
+	if origin.Username == "" {
+		origin = Origin{Username: "-", NetworkType: "IN", AddressType: "IP4", Address: "127.0.0.1"}
+	}
+	fmt.Fprintf(&b, "o=%s\r\n", origin)
+	sessionName := info.SessionName
+	if sessionName == "" {
+		sessionName = "-"
+	}
+	fmt.Fprintf(&b, "s=%s\r\n", sessionName)
+	writeLine(&b, "i", info.SessionInformation)
+	writeLine(&b, "u", info.URI)
+	writeLine(&b, "e", info.Email)
+	writeLine(&b, "p", info.Phone)
+	if info.Connection != nil {
+		fmt.Fprintf(&b, "c=%s\r\n", info.Connection)
+	}
+	for _, bandwidth := range info.Bandwidths {
+		fmt.Fprintf(&b, "b=%s\r\n", bandwidth)
+	}
+
+	if len(info.Times) == 0 {
+		b.WriteString("t=0 0\r\n")
+	}
+	for _, t := range info.Times {
+		fmt.Fprintf(&b, "t=%d %d\r\n", t.Start, t.Stop)
+		for _, repeat := range t.Repeats {
+			fmt.Fprintf(&b, "r=%s\r\n", repeat)
+		}
+	}
+	if len(info.TimeZones) > 0 {
+		var fields []string
+		for _, zone := range info.TimeZones {
+			fields = append(fields, strconv.FormatUint(zone.AdjustmentTime, 10), formatTypedTime(zone.Offset))
+		}
+		fmt.Fprintf(&b, "z=%s\r\n", strings.Join(fields, " "))
+	}
+	writeLine(&b, "k", info.EncryptionKey)
+	for _, attribute := range info.Attributes {
+		fmt.Fprintf(&b, "a=%s\r\n", attribute)
+	}
+
+	for _, streamInfo := range info.StreamInfoArray {
+		streamInfo.marshal(&b)
+	}
+	return b.Bytes()
+}
+
+// marshal writes the media description of the stream.
+func (s *StreamInfo) marshal(b *bytes.Buffer) {
+	fmt.Fprintf(b, "m=%s\r\n", s.MediaLine())
+	writeLine(b, "i", s.Information)
+	for i := range s.Connections {
+		fmt.Fprintf(b, "c=%s\r\n", &s.Connections[i])
+	}
+	for _, bandwidth := range s.Bandwidths {
+		fmt.Fprintf(b, "b=%s\r\n", bandwidth)
+	}
+	writeLine(b, "k", s.EncryptionKey)
+	for _, attribute := range s.Attributes {
+		fmt.Fprintf(b, "a=%s\r\n", attribute)
+	}
+}
+
+// writeLine writes an optional line, leaving it out if value is empty.
+func writeLine(b *bytes.Buffer, key, value string) {
+	if value != "" {
+		fmt.Fprintf(b, "%s=%s\r\n", key, value)
+	}
+}
+
+// Clone returns a copy of the stream that can be changed without affecting
+// the original, e.g. to describe it to players.
+func (s *StreamInfo) Clone() *StreamInfo {
+	clone := *s
+	clone.Formats = append([]string(nil), s.Formats...)
+	clone.Connections = append([]Connection(nil), s.Connections...)
+	clone.Bandwidths = append([]Bandwidth(nil), s.Bandwidths...)
+	clone.Attributes = append([]Attribute(nil), s.Attributes...)
+	clone.PayloadFormats = make([]*Format, len(s.PayloadFormats))
+	for i, format := range s.PayloadFormats {
+		f := *format
+		if format.Params != nil {
+			f.Params = make(map[string]string, len(format.Params))
+			for name, value := range format.Params {
+				f.Params[name] = value
+			}
+		}
+		clone.PayloadFormats[i] = &f
+	}
+	return &clone
+}
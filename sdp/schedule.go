@@ -0,0 +1,89 @@
+package sdp
+
+import "time"
+
+// ntpUnixOffset is the number of seconds from the NTP epoch, 1900, to the
+// Unix epoch, 1970.
+const ntpUnixOffset = 2208988800
+
+// StartTimeUnixSecs returns the start of the "t=" line as Unix seconds, or
+// 0 if the session is permanent.
+func (t Time) StartTimeUnixSecs() int64 {
+	if t.Start == 0 {
+		return 0
+	}
+	return int64(t.Start) - ntpUnixOffset
+}
+
+// EndTimeUnixSecs returns the stop of the "t=" line as Unix seconds, or 0
+// if the session is unbounded.
+func (t Time) EndTimeUnixSecs() int64 {
+	if t.Stop == 0 {
+		return 0
+	}
+	return int64(t.Stop) - ntpUnixOffset
+}
+
+// isActive reports whether now falls in the time, or with repeats in one
+// of its repetitions.
+func (t Time) isActive(now time.Time) bool {
+	unix := now.Unix()
+	if start := t.StartTimeUnixSecs(); start != 0 && unix < start {
+		return false
+	}
+	if end := t.EndTimeUnixSecs(); end != 0 && unix >= end {
+		return false
+	}
+	if len(t.Repeats) == 0 || t.Start == 0 {
+		return true
+	}
+
+	elapsed := now.Sub(time.Unix(t.StartTimeUnixSecs(), 0))
+	for _, repeat := range t.Repeats {
+		if repeat.Interval <= 0 {
+			continue
+		}
+		offsets := repeat.Offsets
+		if len(offsets) == 0 {
+			offsets = []time.Duration{0}
+		}
+		for _, offset := range offsets {
+			since := elapsed - offset
+			if since < 0 {
+				continue
+			}
+			if since%repeat.Interval < repeat.Duration {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsActive reports whether the session takes place at now, according to
+// its "t=" and "r=" lines. A description without times is always active.
+func (info *Info) IsActive(now time.Time) bool {
+	if len(info.Times) == 0 {
+		return true
+	}
+	for _, t := range info.Times {
+		if t.isActive(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasEnded reports whether the session is over at now: all of its "t="
+// lines have a stop time, and it has passed.
+func (info *Info) HasEnded(now time.Time) bool {
+	if len(info.Times) == 0 {
+		return false
+	}
+	for _, t := range info.Times {
+		if end := t.EndTimeUnixSecs(); end == 0 || now.Unix() < end {
+			return false
+		}
+	}
+	return true
+}
@@ -1,11 +1,20 @@
+// Package sdp reads and writes the session descriptions of RFC 4566 (now
+// RFC 8866) that RTSP servers and clients exchange with DESCRIBE and
+// ANNOUNCE.
+//
+// ParseSdp keeps every line of a description in the exported fields of Info
+// and StreamInfo, so that Marshal gives back an equivalent document. A few
+// fields are only derived from those lines for convenience, and are noted
+// as such; Marshal ignores them.
 package sdp
 
 import (
 	"errors"
-	"github.com/yangxianzhi/CommonUtilities"
+	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type RTPPayloadType uint32
@@ -21,277 +30,658 @@ const (
 	RTSPSessionControl
 )
 
+// defaultBufferDelay is the "a=x-bufferdelay:" of a stream without one, in
+// seconds.
+const defaultBufferDelay = 3
+
+// SyntaxError is the error ParseSdp returns for a line it cannot read.
+type SyntaxError struct {
+	Line int // 1-based
+	Text string
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("sdp: line %d: %s: %q", e.Line, e.Msg, e.Text)
+}
+
+// Origin is the "o=" line of a session description.
+type Origin struct {
+	Username       string
+	SessionID      uint64
+	SessionVersion uint64
+	NetworkType    string
+	AddressType    string
+	Address        string
+}
+
+func (o Origin) String() string {
+	return fmt.Sprintf("%s %d %d %s %s %s", o.Username, o.SessionID, o.SessionVersion, o.NetworkType, o.AddressType, o.Address)
+}
+
+// Connection is a "c=" line. TTL only applies to IPv4 multicast addresses,
+// and AddressCount to a range of multicast addresses; both are 0 when the
+// line doesn't give them.
+type Connection struct {
+	NetworkType  string
+	AddressType  string
+	Address      string
+	TTL          int
+	AddressCount int
+}
+
+// IsMulticast reports whether Address is a multicast group.
+func (c *Connection) IsMulticast() bool {
+	ip := net.ParseIP(c.Address)
+	return ip != nil && ip.IsMulticast()
+}
+
+// AddressType returns the <addrtype> of "o=" and "c=" lines for an IP
+// address: "IP6" for IPv6, "IP4" otherwise. IPv4-mapped IPv6 addresses
+// count as IPv4.
+func AddressType(addr string) string {
+	host, _, _ := strings.Cut(addr, "%")
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "IP6"
+	}
+	return "IP4"
+}
+
+// UnspecifiedAddress returns "0.0.0.0" or "::", whichever has the address
+// type of addr.
+func UnspecifiedAddress(addr string) string {
+	if AddressType(addr) == "IP6" {
+		return "::"
+	}
+	return "0.0.0.0"
+}
+
+func (c *Connection) String() string {
+	s := c.NetworkType + " " + c.AddressType + " " + c.Address
+	if c.TTL > 0 {
+		s += "/" + strconv.Itoa(c.TTL)
+	}
+	if c.AddressCount > 0 {
+		s += "/" + strconv.Itoa(c.AddressCount)
+	}
+	return s
+}
+
+// Bandwidth is a "b=" line, e.g. "AS:64", in kilobits per second for the
+// "CT" and "AS" types.
+type Bandwidth struct {
+	Type  string
+	Value uint64
+}
+
+func (b Bandwidth) String() string {
+	return b.Type + ":" + strconv.FormatUint(b.Value, 10)
+}
+
+// Time is a "t=" line with the "r=" lines that follow it. Start and Stop
+// are NTP seconds; 0 leaves them open.
+type Time struct {
+	Start   uint64
+	Stop    uint64
+	Repeats []Repeat
+}
+
+// Repeat is a "r=" line, times when a session is active again.
+type Repeat struct {
+	Interval time.Duration
+	Duration time.Duration
+	Offsets  []time.Duration
+}
+
+func (r Repeat) String() string {
+	fields := []string{formatTypedTime(r.Interval), formatTypedTime(r.Duration)}
+	for _, offset := range r.Offsets {
+		fields = append(fields, formatTypedTime(offset))
+	}
+	return strings.Join(fields, " ")
+}
+
+// TimeZone is an adjustment of a "z=" line: from AdjustmentTime, in NTP
+// seconds, the times of repeated sessions are shifted by Offset.
+type TimeZone struct {
+	AdjustmentTime uint64
+	Offset         time.Duration
+}
+
+// Attribute is an "a=" line, e.g. "rtpmap:96 H264/90000". Flags like
+// "recvonly" have an empty Value.
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+func (a Attribute) String() string {
+	if a.Value == "" {
+		return a.Key
+	}
+	return a.Key + ":" + a.Value
+}
+
+// parseAttribute splits the value of an "a=" line.
+func parseAttribute(value string) Attribute {
+	key, value, _ := strings.Cut(value, ":")
+	return Attribute{Key: key, Value: value}
+}
+
+// StreamInfo is a media description: a "m=" line and the lines up to the
+// next one.
 type StreamInfo struct {
-	fSrcIPAddr      string         // Src IP address of content (this may be 0 if not known for sure)
-	fDestIPAddr     string         // Dest IP address of content (destination IP addr for source broadcast!)
-	fPort           uint16         // Dest (RTP) port of source content
-	fTimeToLive     uint16         // Ttl for this stream
-	fPayloadType    RTPPayloadType // Payload type of this stream
-	fPayloadName    string         // Payload name of this stream
-	fTrackID        uint32         // ID of this stream
-	fTrackName      string         //Track Name of this stream
-	fBufferDelay    float32        // buffer delay (default is 3 seconds)
-	fIsTCP          bool           // Is this a TCP broadcast? If this is the case, the port and ttl are not valid
-	fSetupToReceive bool           // If true then a push to the server is setup on this stream.
-	fTimeScale      uint32
-}
-type OutputInfo struct {
-	fDestAddr     string   // Destination address to forward the input onto
-	fLocalAddr    string   // Address of local interface to send out on (may be 0)
-	fTimeToLive   uint16   // Time to live for resulting output (if multicast)
-	fPortArray    []uint16 // 1 destination RTP port for each Stream.
-	fNumPorts     uint32   // Size of the fPortArray (usually equal to fNumStreams)
-	fBasePort     uint16   // The base destination RTP port - for i=1 to fNumStreams fPortArray[i] = fPortArray[i-1] + 2
-	fAlreadySetup bool     // A flag used in QTSSReflectorModule.cpp
-}
-
-func (o *OutputInfo) Equal(info OutputInfo) bool {
-	if o.fDestAddr == info.fDestAddr && o.fLocalAddr == info.fLocalAddr && o.fTimeToLive == info.fTimeToLive {
-		if o.fBasePort != 0 && o.fBasePort == info.fBasePort {
-			return true
-		} else if o.fNumPorts == 0 || (o.fNumPorts == info.fNumPorts && o.fPortArray[0] == info.fPortArray[0]) {
-			return true
+	// Media, Port, PortCount, Protocol and Formats are the fields of the
+	// "m=" line, e.g. "video 0 RTP/AVP 96". PortCount is 0 unless the line
+	// gives one.
+	Media     string
+	Port      uint16
+	PortCount int
+	Protocol  string
+	Formats   []string
+
+	Information   string
+	Connections   []Connection
+	Bandwidths    []Bandwidth
+	EncryptionKey string
+	// Attributes are all "a=" lines of the stream, in order.
+	Attributes []Attribute
+
+	// The fields below are derived from the ones above.
+
+	// PayloadType tells an audio from a video stream.
+	PayloadType RTPPayloadType
+	// PayloadFormats describe the payload types of Formats, as their
+	// "a=rtpmap:" and "a=fmtp:" attributes give them.
+	PayloadFormats []*Format
+	// TrackName is the "a=control:" value, and TrackID the number in it or
+	// else the position of the stream, counting from 1.
+	TrackName string
+	TrackID   uint32
+	// IsTCP is set for the "RTP/AVP/TCP" protocol of broadcasters that push
+	// over the RTSP connection.
+	IsTCP bool
+	// BufferDelay is the "a=x-bufferdelay:" of the stream or else of the
+	// session, in seconds; 3 by default.
+	BufferDelay float32
+}
+
+// MediaLine returns the value of the "m=" line of this stream.
+func (s *StreamInfo) MediaLine() string {
+	port := strconv.Itoa(int(s.Port))
+	if s.PortCount > 0 {
+		port += "/" + strconv.Itoa(s.PortCount)
+	}
+	return strings.Join(append([]string{s.Media, port, s.Protocol}, s.Formats...), " ")
+}
+
+// Attribute returns the value of the first "a=" line of the stream with
+// the given key.
+func (s *StreamInfo) Attribute(key string) (string, bool) {
+	return findAttribute(s.Attributes, key)
+}
+
+// SetAttribute replaces the value of the first "a=" line with the given
+// key, or adds one at the end.
+func (s *StreamInfo) SetAttribute(key, value string) {
+	s.Attributes = setAttribute(s.Attributes, key, value)
+}
+
+// Format returns the format of a payload type of this stream, or nil.
+func (s *StreamInfo) Format(payloadType uint8) *Format {
+	for _, format := range s.PayloadFormats {
+		if format.PayloadType == payloadType {
+			return format
 		}
 	}
-	return false
+	return nil
 }
 
+// PreferredFormat returns the first payload type of the "m=" line, or nil if
+// there is none.
+func (s *StreamInfo) PreferredFormat() *Format {
+	if len(s.PayloadFormats) == 0 {
+		return nil
+	}
+	return s.PayloadFormats[0]
+}
+
+// formatFor returns the format of a payload type, adding one for a payload
+// type the "m=" line doesn't list.
+func (s *StreamInfo) formatFor(payloadType uint8) *Format {
+	if format := s.Format(payloadType); format != nil {
+		return format
+	}
+	format := newFormat(payloadType)
+	s.PayloadFormats = append(s.PayloadFormats, format)
+	return format
+}
+
+// Info is a session description.
 type Info struct {
-	Version               int
-	Originator            string
-	SessionName           string
-	SessionInformation    string
-	URI                   string
-	Email                 string
-	Phone                 string
-	ConnectionInformation string
-	BandwidthInformation  string
-	StreamInfoArray       []*StreamInfo
-	OutputInfoArray       []*OutputInfo
-	SessionControlType    uint32
-	StartTimeUnixSecs     uint32
-	EndTimeUnixSecs       uint32
-	HasValidTime          bool
+	Version            int
+	Origin             Origin
+	SessionName        string
+	SessionInformation string
+	URI                string
+	Email              string
+	Phone              string
+	// Connection is the "c=" line of the session, or nil if every stream
+	// has its own.
+	Connection    *Connection
+	Bandwidths    []Bandwidth
+	Times         []Time
+	TimeZones     []TimeZone
+	EncryptionKey string
+	// Attributes are the session level "a=" lines, in order.
+	Attributes      []Attribute
+	StreamInfoArray []*StreamInfo
+
+	// SessionControlType is derived from "a=x-broadcastcontrol:".
+	SessionControlType uint32
+}
+
+// Attribute returns the value of the first session level "a=" line with
+// the given key.
+func (info *Info) Attribute(key string) (string, bool) {
+	return findAttribute(info.Attributes, key)
+}
+
+// SetAttribute replaces the value of the first session level "a=" line
+// with the given key, or adds one at the end.
+func (info *Info) SetAttribute(key, value string) {
+	info.Attributes = setAttribute(info.Attributes, key, value)
 }
 
+// StreamConnection returns the "c=" line that applies to a stream: its own,
+// or else that of the session. It is nil if there is neither.
+func (info *Info) StreamConnection(s *StreamInfo) *Connection {
+	if len(s.Connections) > 0 {
+		return &s.Connections[0]
+	}
+	return info.Connection
+}
+
+func findAttribute(attributes []Attribute, key string) (string, bool) {
+	for _, attribute := range attributes {
+		if attribute.Key == key {
+			return attribute.Value, true
+		}
+	}
+	return "", false
+}
+
+func setAttribute(attributes []Attribute, key, value string) []Attribute {
+	for i := range attributes {
+		if attributes[i].Key == key {
+			attributes[i].Value = value
+			return attributes
+		}
+	}
+	return append(attributes, Attribute{Key: key, Value: value})
+}
+
+// ParseSdp reads a session description with CRLF or LF line endings.
+// Lines of a type it doesn't know are skipped.
 func ParseSdp(sdpStr string) (packet Info, err error) {
-	hasGlobalStreamInfo := false
-	var globalStreamInfo StreamInfo
-	var theStreamIndex, currentTrack uint32 = 0, 1
-	var b = strings.Split(sdpStr, "\r\n")
-	for i := 0; i < len(b); i++ {
-		// TODO: allow CR, LF, or CRLF
-		parts := strings.SplitN(b[i], "=", 2)
-		if len(parts) == 2 {
-			if len(parts[0]) != 1 {
-				return packet, errors.New("SDP only allows 1-character variables")
+	var stream *StreamInfo
+	var sessionBufferDelay float32 = defaultBufferDelay
+	var streamBufferDelays []float32
+
+	lines := strings.Split(sdpStr, "\n")
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		syntaxError := func(msg string) error {
+			return &SyntaxError{Line: i + 1, Text: line, Msg: msg}
+		}
+		if len(line) < 2 || line[1] != '=' {
+			return packet, syntaxError("not a <type>=<value> line")
+		}
+		key, value := line[0], line[2:]
+		if i == 0 && key != 'v' {
+			return packet, syntaxError("description doesn't start with \"v=\"")
+		}
+
+		switch key {
+		case 'v':
+			if packet.Version, err = strconv.Atoi(value); err != nil {
+				return packet, syntaxError("bad version")
 			}
-			key := parts[0]
-			value := parts[1]
-			switch key {
-			// version
-			case "v":
-				var ver int
-				ver, err = strconv.Atoi(value)
-				if err != nil {
-					return packet, err
-				}
-				packet.Version = ver
-			// owner/creator and session identifier
-			case "o":
-				// o=<username> <session id> <version> <network type> <address type> <address>
-				// TODO: parse this
-				packet.Originator = value
-			// session name
-			case "s":
-				packet.SessionName = value
-			// session information
-			case "i":
+		case 'o':
+			if packet.Origin, err = parseOrigin(value); err != nil {
+				return packet, syntaxError(err.Error())
+			}
+		case 's':
+			packet.SessionName = value
+		case 'i':
+			if stream != nil {
+				stream.Information = value
+			} else {
 				packet.SessionInformation = value
-			// URI of description
-			case "u":
-				packet.URI = value
-			// email address
-			case "e":
-				packet.Email = value
-			// phone number
-			case "p":
-				packet.Phone = value
-			case "t":
-				tParser := commonutilities.New(value)
-				tParser.ConsumeUntil(commonutilities.DigitMask)
-				_, ntpStart := tParser.ConsumeInteger()
-				tParser.ConsumeUntil(commonutilities.DigitMask)
-				_, ntpEnd := tParser.ConsumeInteger()
-				if ntpStart > 0 && ntpEnd > 0 && ntpStart > ntpEnd {
-					continue
-				}
-				var startTimeUnixSecs, endTimeUnixSecs uint32
-				if ntpStart != 0 && isValidNTPSecs(ntpStart) { // allow anything less than 1970
-					startTimeUnixSecs = ntpSecs_to_UnixSecs(ntpStart) // convert to 1970 time
-				}
-				if ntpEnd != 0 && !isValidNTPSecs(ntpEnd) {
-					continue
-				}
-				if ntpEnd != 0 { // convert to 1970 time
-					endTimeUnixSecs = ntpSecs_to_UnixSecs(ntpEnd)
-				}
-				packet.StartTimeUnixSecs = startTimeUnixSecs
-				packet.EndTimeUnixSecs = endTimeUnixSecs
-				packet.HasValidTime = true
-			// connection information - not required if included in all media
-			case "c":
-				// TODO: parse this
-				packet.ConnectionInformation = value
-				values := strings.SplitN(value[7:], "/", 3)
-				var tempIPAddr string
-				if len(values) > 0 {
-					tempIPAddr = values[0]
+			}
+		case 'u':
+			packet.URI = value
+		case 'e':
+			packet.Email = value
+		case 'p':
+			packet.Phone = value
+		case 'c':
+			connection, err := parseConnection(value)
+			if err != nil {
+				return packet, syntaxError(err.Error())
+			}
+			if stream != nil {
+				stream.Connections = append(stream.Connections, connection)
+			} else {
+				packet.Connection = &connection
+			}
+		case 'b':
+			bandwidth, err := parseBandwidth(value)
+			if err != nil {
+				return packet, syntaxError(err.Error())
+			}
+			if stream != nil {
+				stream.Bandwidths = append(stream.Bandwidths, bandwidth)
+			} else {
+				packet.Bandwidths = append(packet.Bandwidths, bandwidth)
+			}
+		case 't':
+			t, err := parseTime(value)
+			if err != nil {
+				return packet, syntaxError(err.Error())
+			}
+			packet.Times = append(packet.Times, t)
+		case 'r':
+			if len(packet.Times) == 0 || stream != nil {
+				return packet, syntaxError("\"r=\" without \"t=\"")
+			}
+			repeat, err := parseRepeat(value)
+			if err != nil {
+				return packet, syntaxError(err.Error())
+			}
+			t := &packet.Times[len(packet.Times)-1]
+			t.Repeats = append(t.Repeats, repeat)
+		case 'z':
+			if packet.TimeZones, err = parseTimeZones(value); err != nil {
+				return packet, syntaxError(err.Error())
+			}
+		case 'k':
+			if stream != nil {
+				stream.EncryptionKey = value
+			} else {
+				packet.EncryptionKey = value
+			}
+		case 'm':
+			if stream, err = parseMedia(value); err != nil {
+				return packet, syntaxError(err.Error())
+			}
+			packet.StreamInfoArray = append(packet.StreamInfoArray, stream)
+			streamBufferDelays = append(streamBufferDelays, 0)
+			stream.TrackID = uint32(len(packet.StreamInfoArray))
+		case 'a':
+			attribute := parseAttribute(value)
+			if stream == nil {
+				packet.Attributes = append(packet.Attributes, attribute)
+			} else {
+				stream.Attributes = append(stream.Attributes, attribute)
+			}
+
+			switch attribute.Key {
+			case "x-broadcastcontrol":
+				// found a control line for the broadcast (delete at time or delete at end of broadcast/server startup)
+				switch attribute.Value {
+				case "RTSP":
+					packet.SessionControlType = RTSPSessionControl
+				case "TIME":
+					packet.SessionControlType = SDPTimeControl
 				}
-				tempTtl := 15
-				if len(values) > 1 {
-					tempTtl, err = strconv.Atoi(values[0])
-					if tempTtl >= 65535 || tempTtl < 0 {
-						panic("Ttl invalid")
-					}
+			case "x-bufferdelay":
+				delay, err := strconv.ParseFloat(strings.TrimSpace(attribute.Value), 32)
+				if err != nil || delay < 0 {
+					return packet, syntaxError("bad buffer delay")
 				}
-				if theStreamIndex > 0 {
-					if len(packet.StreamInfoArray) < int(theStreamIndex) {
-						packet.StreamInfoArray = append(packet.StreamInfoArray, new(StreamInfo))
-					}
-					packet.StreamInfoArray[theStreamIndex-1].fDestIPAddr = tempIPAddr
-					packet.StreamInfoArray[theStreamIndex-1].fTimeToLive = uint16(tempTtl)
+				if stream == nil {
+					sessionBufferDelay = float32(delay)
 				} else {
-					globalStreamInfo.fDestIPAddr = tempIPAddr
-					globalStreamInfo.fTimeToLive = uint16(tempTtl)
-					hasGlobalStreamInfo = true
-				}
-			// bandwidth information
-			case "b":
-				// TODO: parse this
-				packet.BandwidthInformation = value
-			// media info
-			case "m":
-				if len(packet.StreamInfoArray) < int(theStreamIndex)+1 {
-					packet.StreamInfoArray = append(packet.StreamInfoArray, new(StreamInfo))
-				}
-				if hasGlobalStreamInfo {
-					packet.StreamInfoArray[theStreamIndex].fDestIPAddr = globalStreamInfo.fDestIPAddr
-					packet.StreamInfoArray[theStreamIndex].fTimeToLive = globalStreamInfo.fTimeToLive
-				}
-				packet.StreamInfoArray[theStreamIndex].fTrackID = currentTrack
-				currentTrack++
-
-				mParser := commonutilities.New(value)
-				theStreamType := mParser.ConsumeWord()
-				if theStreamType == "audio" {
-					packet.StreamInfoArray[theStreamIndex].fPayloadType = AudioPayloadType
-				} else if theStreamType == "video" {
-					packet.StreamInfoArray[theStreamIndex].fPayloadType = VideoPayloadType
-				}
-				mParser.ConsumeUntil(commonutilities.DigitMask)
-				_, tempPort := mParser.ConsumeInteger()
-				if tempPort > 0 && tempPort < 65536 {
-					packet.StreamInfoArray[theStreamIndex].fPort = uint16(tempPort)
-				}
-				// find out whether this is TCP or UDP
-				mParser.ConsumeWhitespace()
-				transportID := mParser.ConsumeUntilStop(' ')
-				if transportID == "RTP/AVP/TCP" {
-					packet.StreamInfoArray[theStreamIndex].fIsTCP = true
-				}
-				theStreamIndex++
-			case "a":
-				aParser := commonutilities.New(value)
-				aLineType := aParser.ConsumeWord()
-				if aLineType == "x-broadcastcontrol" {
-					// found a control line for the broadcast (delete at time or delete at end of broadcast/server startup)
-					// qtss_printf("found =%s\n",sBroadcastControlStr);
-					aParser.ConsumeUntil(commonutilities.WordMask)
-					sessionControlType := aParser.ConsumeWord()
-					if sessionControlType == "RTSP" {
-						packet.SessionControlType = RTSPSessionControl
-					} else if sessionControlType == "TIME" {
-						packet.SessionControlType = SDPTimeControl
-					}
-				}
-
-				//if we haven't even hit an 'm' line yet, just ignore all 'a' lines
-				if theStreamIndex == 0 {
-					continue
+					streamBufferDelays[len(streamBufferDelays)-1] = float32(delay)
 				}
+			}
+			if stream == nil {
+				continue
+			}
 
-				if aLineType == "rtpmap" {
-					//mark the codec type if this line has a codec name on it. If we already
-					//have a codec type for this track, just ignore this line
-					if _, ok := aParser.GetThru(' '); len(packet.StreamInfoArray[theStreamIndex-1].fPayloadName) == 0 && ok {
-						if payloadName := aParser.ConsumeLength(aParser.GetDataRemaining()); payloadName != "" {
-							packet.StreamInfoArray[theStreamIndex-1].fPayloadName = payloadName
-						}
+			switch attribute.Key {
+			case "control":
+				stream.TrackName = attribute.Value
+				if _, number, ok := strings.Cut(attribute.Value, "="); ok {
+					if id, err := strconv.ParseUint(leadingDigits(number), 10, 32); err == nil {
+						stream.TrackID = uint32(id)
 					}
-				} else if aLineType == "control" {
-					if _, ok := aParser.GetThru(':'); ok {
-						if trackName := aParser.ConsumeLength(aParser.GetDataRemaining()); trackName != "" {
-							packet.StreamInfoArray[theStreamIndex-1].fTrackName = trackName
-							trackParser := commonutilities.New(trackName)
-							trackParser.ConsumeUntilStop('=')
-							trackParser.ConsumeUntil(commonutilities.DigitMask)
-							_, packet.StreamInfoArray[theStreamIndex-1].fTrackID = trackParser.ConsumeInteger()
-						}
+				}
+			case "rtpmap", "fmtp":
+				if payloadType, rest, ok := splitPayloadType(attribute.Value); ok {
+					if attribute.Key == "rtpmap" {
+						stream.formatFor(payloadType).parseRTPMap(rest, stream.PayloadType == AudioPayloadType)
+					} else {
+						stream.formatFor(payloadType).parseFmtp(rest)
 					}
-				} else if aLineType == "x-bufferdelay" {
-					aParser.ConsumeUntil(commonutilities.DigitMask)
-					globalStreamInfo.fBufferDelay = aParser.ConsumeFloat()
 				}
 			}
 		}
 	}
-	return
-}
 
-// Convert uint to net.IP http://www.sharejs.com
-func inet_ntoa(ipnr int64) net.IP {
-	var bytes [4]byte
-	bytes[0] = byte(ipnr & 0xFF)
-	bytes[1] = byte((ipnr >> 8) & 0xFF)
-	bytes[2] = byte((ipnr >> 16) & 0xFF)
-	bytes[3] = byte((ipnr >> 24) & 0xFF)
+	for i, stream := range packet.StreamInfoArray {
+		stream.BufferDelay = sessionBufferDelay
+		if streamBufferDelays[i] > 0 {
+			stream.BufferDelay = streamBufferDelays[i]
+		}
+	}
+	return packet, nil
+}
 
-	return net.IPv4(bytes[3], bytes[2], bytes[1], bytes[0])
+// leadingDigits returns the decimal digits s starts with.
+func leadingDigits(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return s[:i]
+		}
+	}
+	return s
 }
 
-// Convert net.IP to int64 ,  http://www.sharejs.com
-func inet_aton(ipnr net.IP) int64 {
-	bits := strings.Split(ipnr.String(), ".")
+// o=<username> <sess-id> <sess-version> <nettype> <addrtype> <unicast-address>
+func parseOrigin(value string) (Origin, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 6 {
+		return Origin{}, fmt.Errorf("origin needs 6 fields, has %d", len(fields))
+	}
+	sessionID, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return Origin{}, errors.New("bad session id")
+	}
+	sessionVersion, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return Origin{}, errors.New("bad session version")
+	}
+	return Origin{
+		Username:       fields[0],
+		SessionID:      sessionID,
+		SessionVersion: sessionVersion,
+		NetworkType:    fields[3],
+		AddressType:    fields[4],
+		Address:        fields[5],
+	}, nil
+}
 
-	b0, _ := strconv.Atoi(bits[0])
-	b1, _ := strconv.Atoi(bits[1])
-	b2, _ := strconv.Atoi(bits[2])
-	b3, _ := strconv.Atoi(bits[3])
+// c=<nettype> <addrtype> <connection-address>, where the address of IPv4
+// multicast is <address>/<ttl>[/<number of addresses>] and that of IPv6
+// multicast <address>[/<number of addresses>].
+func parseConnection(value string) (Connection, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return Connection{}, fmt.Errorf("connection needs 3 fields, has %d", len(fields))
+	}
+	parts := strings.Split(fields[2], "/")
+	connection := Connection{NetworkType: fields[0], AddressType: fields[1], Address: parts[0]}
+	numbers := parts[1:]
+	if connection.AddressType == "IP4" && len(numbers) > 0 {
+		ttl, err := strconv.Atoi(numbers[0])
+		if err != nil || ttl < 0 || ttl > 255 {
+			return Connection{}, errors.New("bad TTL")
+		}
+		connection.TTL = ttl
+		numbers = numbers[1:]
+	}
+	if len(numbers) > 1 {
+		return Connection{}, errors.New("bad connection address")
+	}
+	if len(numbers) == 1 {
+		count, err := strconv.Atoi(numbers[0])
+		if err != nil || count < 1 {
+			return Connection{}, errors.New("bad number of addresses")
+		}
+		connection.AddressCount = count
+	}
+	return connection, nil
+}
 
-	var sum int64
+// b=<bwtype>:<bandwidth>
+func parseBandwidth(value string) (Bandwidth, error) {
+	bwtype, bandwidth, ok := strings.Cut(value, ":")
+	if !ok || bwtype == "" {
+		return Bandwidth{}, errors.New("bandwidth without type")
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(bandwidth), 10, 64)
+	if err != nil {
+		return Bandwidth{}, errors.New("bad bandwidth")
+	}
+	return Bandwidth{Type: bwtype, Value: n}, nil
+}
 
-	sum += int64(b0) << 24
-	sum += int64(b1) << 16
-	sum += int64(b2) << 8
-	sum += int64(b3)
+// t=<start-time> <stop-time>
+func parseTime(value string) (Time, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return Time{}, fmt.Errorf("timing needs 2 fields, has %d", len(fields))
+	}
+	start, err1 := strconv.ParseUint(fields[0], 10, 64)
+	stop, err2 := strconv.ParseUint(fields[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return Time{}, errors.New("bad time")
+	}
+	if start != 0 && stop != 0 && start > stop {
+		return Time{}, errors.New("session stops before it starts")
+	}
+	return Time{Start: start, Stop: stop}, nil
+}
 
-	return sum
+// r=<repeat interval> <active duration> <offsets from start-time>
+func parseRepeat(value string) (Repeat, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 3 {
+		return Repeat{}, fmt.Errorf("repeat needs at least 3 fields, has %d", len(fields))
+	}
+	var durations []time.Duration
+	for _, field := range fields {
+		d, err := parseTypedTime(field)
+		if err != nil {
+			return Repeat{}, err
+		}
+		durations = append(durations, d)
+	}
+	return Repeat{Interval: durations[0], Duration: durations[1], Offsets: durations[2:]}, nil
 }
 
-const kNTP_Offset_From_1970 = 2208988800
+// z=<adjustment time> <offset> <adjustment time> <offset> ...
+func parseTimeZones(value string) ([]TimeZone, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return nil, errors.New("time zones need pairs of fields")
+	}
+	var zones []TimeZone
+	for i := 0; i < len(fields); i += 2 {
+		adjustment, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return nil, errors.New("bad adjustment time")
+		}
+		offset, err := parseTypedTime(fields[i+1])
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, TimeZone{AdjustmentTime: adjustment, Offset: offset})
+	}
+	return zones, nil
+}
 
-func isValidNTPSecs(time uint32) bool {
-	if time >= kNTP_Offset_From_1970 {
-		return true
-	} else {
-		return false
+// parseTypedTime reads a time in seconds, or in the days, hours or minutes
+// of a "d", "h" or "m" suffix, possibly negative.
+func parseTypedTime(field string) (time.Duration, error) {
+	unit := time.Second
+	switch {
+	case strings.HasSuffix(field, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(field, "h"):
+		unit = time.Hour
+	case strings.HasSuffix(field, "m"):
+		unit = time.Minute
+	case strings.HasSuffix(field, "s"):
+	default:
+		n, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad time %q", field)
+		}
+		return time.Duration(n) * unit, nil
 	}
+	n, err := strconv.ParseInt(field[:len(field)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q", field)
+	}
+	return time.Duration(n) * unit, nil
 }
 
-func ntpSecs_to_UnixSecs(time uint32) uint32 {
-	return (uint32)(time - kNTP_Offset_From_1970)
+// formatTypedTime writes a time in the largest unit that keeps it whole.
+func formatTypedTime(d time.Duration) string {
+	seconds := int64(d / time.Second)
+	switch {
+	case seconds != 0 && seconds%86400 == 0:
+		return strconv.FormatInt(seconds/86400, 10) + "d"
+	case seconds != 0 && seconds%3600 == 0:
+		return strconv.FormatInt(seconds/3600, 10) + "h"
+	case seconds != 0 && seconds%60 == 0:
+		return strconv.FormatInt(seconds/60, 10) + "m"
+	}
+	return strconv.FormatInt(seconds, 10)
 }
-func unixSecs_to_NTPSecs(time uint32) uint32 {
-	return (uint32)(time + kNTP_Offset_From_1970)
+
+// m=<media> <port>[/<number of ports>] <proto> <fmt> ...
+func parseMedia(value string) (*StreamInfo, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("media needs at least 3 fields, has %d", len(fields))
+	}
+	stream := &StreamInfo{Media: fields[0], Protocol: fields[2], Formats: fields[3:]}
+	port, count, hasCount := strings.Cut(fields[1], "/")
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.New("bad port")
+	}
+	stream.Port = uint16(n)
+	if hasCount {
+		if stream.PortCount, err = strconv.Atoi(count); err != nil || stream.PortCount < 1 {
+			return nil, errors.New("bad number of ports")
+		}
+	}
+
+	switch stream.Media {
+	case "audio":
+		stream.PayloadType = AudioPayloadType
+	case "video":
+		stream.PayloadType = VideoPayloadType
+	}
+	stream.IsTCP = stream.Protocol == "RTP/AVP/TCP"
+	stream.PayloadFormats = parseMediaFormats(stream.Protocol, stream.Formats)
+	return stream, nil
 }
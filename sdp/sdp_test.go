@@ -1,7 +1,9 @@
 package sdp
 
 import (
+	"reflect"
 	"testing"
+	"time"
 )
 
 const (
@@ -56,3 +58,236 @@ func TestParseSdp(t *testing.T) {
 		}
 	}
 }
+
+func TestFormats(t *testing.T) {
+	info, err := ParseSdp(sdp1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := info.StreamInfoArray[0].PreferredFormat()
+	if video == nil || video.PayloadType != 96 || video.EncodingName != "H264" || video.ClockRate != 90000 || video.Channels != 0 {
+		t.Fatalf("video format = %+v", video)
+	}
+	if video.Param("packetization-mode") != "1" || video.Param("Profile-Level-ID") != "4D401E" {
+		t.Errorf("video params = %v", video.Params)
+	}
+	if params, err := video.H264Params(); err != nil || params.PacketizationMode != 1 || len(params.SPS) != 1 || len(params.PPS) != 1 {
+		t.Errorf("H264Params() = %+v, %v", params, err)
+	}
+	audio := info.StreamInfoArray[1].PreferredFormat()
+	if audio == nil || audio.PayloadType != 97 || audio.EncodingName != "mpeg4-generic" || audio.ClockRate != 48000 || audio.Channels != 2 {
+		t.Fatalf("audio format = %+v", audio)
+	}
+	if params, err := audio.AACParams(); err != nil || params.SizeLength != 13 || params.Config == nil || params.Config.SampleRate != 48000 {
+		t.Errorf("AACParams() = %+v, %v", params, err)
+	}
+
+	// a static payload type without "a=rtpmap:"
+	info, _ = ParseSdp(sdp2)
+	if pcma := info.StreamInfoArray[1].PreferredFormat(); pcma == nil || pcma.EncodingName != "PCMA" || pcma.ClockRate != 8000 || pcma.Channels != 1 {
+		t.Errorf("PCMA format = %+v", pcma)
+	}
+	if params := info.StreamInfoArray[0].PreferredFormat().Params; params["sprop-parameter-sets"] != "Z0IAH52oFAFum4CAgIE=,aM48gA==" || params["profile-level-id"] != "42001F" {
+		t.Errorf("params = %v", params)
+	}
+
+	// several payload types on one "m=" line
+	info, _ = ParseSdp("v=0\r\n" +
+		"m=audio 0 RTP/AVP 111 0 101\r\n" +
+		"a=rtpmap:111 opus/48000/2\r\n" +
+		"a=fmtp:111 minptime=10;useinbandfec=1\r\n" +
+		"a=rtpmap:101 telephone-event/8000\r\n" +
+		"a=fmtp:101 0-15\r\n")
+	formats := info.StreamInfoArray[0].PayloadFormats
+	if len(formats) != 3 || formats[0].PayloadType != 111 || formats[1].EncodingName != "PCMU" || formats[2].EncodingName != "telephone-event" {
+		t.Fatalf("formats = %+v", formats)
+	}
+	if formats[0].Channels != 2 || formats[0].Param("useinbandfec") != "1" || formats[2].Channels != 1 || formats[2].Fmtp != "0-15" {
+		t.Errorf("formats = %+v %+v", formats[0], formats[2])
+	}
+	if info.StreamInfoArray[0].Format(101) != formats[2] || info.StreamInfoArray[0].Format(96) != nil {
+		t.Errorf("Format() lookup")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	// the fixtures come out as they went in
+	for _, input := range []string{sdp1, sdp2} {
+		info, err := ParseSdp(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := string(info.Marshal())
+		if output != input {
+			t.Errorf("Marshal() = %q, want %q", output, input)
+		}
+		again, err := ParseSdp(output)
+		if err != nil {
+			t.Fatalf("ParseSdp(Marshal()): %v", err)
+		}
+		if !reflect.DeepEqual(info, again) {
+			t.Errorf("round trip of\n%s\ngave\n%s", input, output)
+		}
+	}
+
+	// mandatory lines are filled in
+	info := Info{StreamInfoArray: []*StreamInfo{{
+		Media:      "audio",
+		Protocol:   "RTP/AVP",
+		Formats:    []string{"0"},
+		Attributes: []Attribute{{Key: "control", Value: "trackID=1"}, {Key: "recvonly"}},
+	}}}
+	want := "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\nm=audio 0 RTP/AVP 0\r\na=control:trackID=1\r\na=recvonly\r\n"
+	if output := string(info.Marshal()); output != want {
+		t.Errorf("Marshal() = %q, want %q", output, want)
+	}
+}
+
+func TestStreamInfoClone(t *testing.T) {
+	info, _ := ParseSdp(sdp1)
+	original := info.StreamInfoArray[0]
+	clone := original.Clone()
+	clone.Port = 5004
+	clone.SetAttribute("control", "rtsp://example.com/live/trackID=1")
+	clone.PayloadFormats[0].Params["packetization-mode"] = "0"
+	if control, _ := clone.Attribute("control"); clone.MediaLine() != "video 5004 RTP/AVP 96" || control != "rtsp://example.com/live/trackID=1" {
+		t.Errorf("clone = %q %q", clone.MediaLine(), control)
+	}
+	if control, _ := original.Attribute("control"); original.MediaLine() != "video 0 RTP/AVP 96" || control != "trackID=1" ||
+		original.PayloadFormats[0].Param("packetization-mode") != "1" {
+		t.Errorf("original changed: %q %q", original.MediaLine(), control)
+	}
+}
+
+func TestParseSdpFields(t *testing.T) {
+	// LF line endings, IPv4 multicast, repeats and time zones
+	info, err := ParseSdp("v=0\n" +
+		"o=jdoe 2890844526 2890842807 IN IP4 10.47.16.5\n" +
+		"s=SDP Seminar\n" +
+		"c=IN IP4 224.2.17.12/127\n" +
+		"b=CT:1000\n" +
+		"t=2873397496 2873404696\n" +
+		"r=7d 1h 0 25h\n" +
+		"z=2882844526 -1h 2898848070 0\n" +
+		"a=recvonly\n" +
+		"a=x-bufferdelay:4.5\n" +
+		"m=audio 49170 RTP/AVP 0\n" +
+		"m=video 51372/2 RTP/AVP 99\n" +
+		"i=the video\n" +
+		"c=IN IP6 FF15::101/3\n" +
+		"a=rtpmap:99 h263-1998/90000\n" +
+		"a=control:streamid=7\n" +
+		"a=x-bufferdelay:1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Origin{Username: "jdoe", SessionID: 2890844526, SessionVersion: 2890842807, NetworkType: "IN", AddressType: "IP4", Address: "10.47.16.5"}
+	if info.Origin != want {
+		t.Errorf("Origin = %+v", info.Origin)
+	}
+	if c := info.Connection; c == nil || c.Address != "224.2.17.12" || c.TTL != 127 || c.AddressCount != 0 || !c.IsMulticast() {
+		t.Errorf("Connection = %+v", c)
+	}
+	if len(info.Bandwidths) != 1 || info.Bandwidths[0] != (Bandwidth{Type: "CT", Value: 1000}) {
+		t.Errorf("Bandwidths = %+v", info.Bandwidths)
+	}
+	wantTimes := []Time{{Start: 2873397496, Stop: 2873404696, Repeats: []Repeat{
+		{Interval: 7 * 24 * time.Hour, Duration: time.Hour, Offsets: []time.Duration{0, 25 * time.Hour}},
+	}}}
+	if !reflect.DeepEqual(info.Times, wantTimes) {
+		t.Errorf("Times = %+v", info.Times)
+	}
+	wantZones := []TimeZone{{AdjustmentTime: 2882844526, Offset: -time.Hour}, {AdjustmentTime: 2898848070}}
+	if !reflect.DeepEqual(info.TimeZones, wantZones) {
+		t.Errorf("TimeZones = %+v", info.TimeZones)
+	}
+
+	audio, video := info.StreamInfoArray[0], info.StreamInfoArray[1]
+	if audio.Port != 49170 || audio.TrackID != 1 || audio.BufferDelay != 4.5 || info.StreamConnection(audio) != info.Connection {
+		t.Errorf("audio = %+v", audio)
+	}
+	if video.Port != 51372 || video.PortCount != 2 || video.TrackName != "streamid=7" || video.TrackID != 7 || video.BufferDelay != 1 {
+		t.Errorf("video = %+v", video)
+	}
+	if c := info.StreamConnection(video); c.AddressType != "IP6" || c.Address != "FF15::101" || c.TTL != 0 || c.AddressCount != 3 || !c.IsMulticast() {
+		t.Errorf("video connection = %+v", c)
+	}
+	if video.Information != "the video" || video.PreferredFormat().EncodingName != "h263-1998" {
+		t.Errorf("video = %+v", video)
+	}
+
+	again, err := ParseSdp(string(info.Marshal()))
+	if err != nil || !reflect.DeepEqual(info, again) {
+		t.Errorf("round trip: %v\n%s", err, info.Marshal())
+	}
+}
+
+func TestParseSdpErrors(t *testing.T) {
+	var tests = []struct {
+		input string
+		line  int
+	}{
+		{"s=no version\r\n", 1},
+		{"v=0\r\nbogus\r\n", 2},
+		{"v=0\r\no=- 0 IN IP4 127.0.0.1\r\n", 2},
+		{"v=0\r\nc=IN IP4 224.2.1.1/300\r\n", 2},
+		{"v=0\r\nc=IN IP4\r\n", 2},
+		{"v=0\ns=x\nt=0 0\nb=AS\n", 4},
+		{"v=0\r\nt=2 1\r\n", 2},
+		{"v=0\r\nr=7d 1h 0\r\n", 2},
+		{"v=0\r\nt=0 0\r\nz=2882844526\r\n", 3},
+		{"v=0\r\nm=video x RTP/AVP 96\r\n", 2},
+		{"v=0\r\nm=video 0 RTP/AVP 96\r\na=x-bufferdelay:soon\r\n", 3},
+	}
+	for _, test := range tests {
+		_, err := ParseSdp(test.input)
+		syntaxError, ok := err.(*SyntaxError)
+		if !ok || syntaxError.Line != test.line {
+			t.Errorf("ParseSdp(%q) = %v, want an error on line %d", test.input, err, test.line)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	// two weeks, an hour every week and another one a day later
+	info, err := ParseSdp("v=0\r\n" +
+		"t=3900000000 3901209600\r\n" +
+		"r=7d 1h 0 25h\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(info.Times[0].StartTimeUnixSecs(), 0)
+	if start.Unix() != 3900000000-2208988800 || info.Times[0].EndTimeUnixSecs() != start.Unix()+14*24*3600 {
+		t.Errorf("times = %d-%d", info.Times[0].StartTimeUnixSecs(), info.Times[0].EndTimeUnixSecs())
+	}
+	var tests = []struct {
+		at     time.Duration
+		active bool
+		ended  bool
+	}{
+		{-time.Minute, false, false},
+		{30 * time.Minute, true, false},
+		{2 * time.Hour, false, false},
+		{25*time.Hour + 30*time.Minute, true, false},
+		{7*24*time.Hour + 10*time.Minute, true, false},
+		{8 * 24 * time.Hour, false, false},
+		{14 * 24 * time.Hour, false, true},
+	}
+	for _, test := range tests {
+		now := start.Add(test.at)
+		if active := info.IsActive(now); active != test.active {
+			t.Errorf("IsActive(start%+v) = %v", test.at, active)
+		}
+		if ended := info.HasEnded(now); ended != test.ended {
+			t.Errorf("HasEnded(start%+v) = %v", test.at, ended)
+		}
+	}
+
+	// permanent sessions
+	for _, input := range []string{"v=0\r\n", "v=0\r\nt=0 0\r\n"} {
+		info, _ := ParseSdp(input)
+		if now := time.Now(); !info.IsActive(now) || info.HasEnded(now) {
+			t.Errorf("%q is not active", input)
+		}
+	}
+}